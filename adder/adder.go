@@ -4,23 +4,74 @@ package adder
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ipfs/ipfs-cluster/adder/ipfsadd"
 	"github.com/ipfs/ipfs-cluster/api"
 
 	cid "github.com/ipfs/go-cid"
+	cidutil "github.com/ipfs/go-cidutil"
+	chunker "github.com/ipfs/go-ipfs-chunker"
 	files "github.com/ipfs/go-ipfs-files"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
 	merkledag "github.com/ipfs/go-merkledag"
 	multihash "github.com/multiformats/go-multihash"
+	"go.opencensus.io/trace"
 )
 
 var logger = logging.Logger("adder")
 
+// Logger is what Adders log to. The package logger is used by default, and
+// *logging.ZapEventLogger implements it.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// cleanupTimeout bounds the time spent cleaning up after a failed add.
+var cleanupTimeout = time.Minute
+
+// ErrAdderConsumed is returned when trying to add content with an Adder
+// which has been used already.
+var ErrAdderConsumed = errors.New("adder: already used, create a new Adder")
+
+// ErrMaxDuration is returned when adding takes longer than the MaxDuration
+// add parameter.
+var ErrMaxDuration = errors.New("adder: add took longer than the maximum duration")
+
+// ErrOutputInUse is returned when the output channel given to an Adder is in
+// use by another Adder which has not finished adding.
+var ErrOutputInUse = errors.New("adder: the output channel is in use by another Adder")
+
+// ErrIdentityTooLarge is returned when adding with the identity hash function
+// would make a CID larger than the InlineLimit add parameter.
+var ErrIdentityTooLarge = errors.New("adder: block too large to be hashed with identity")
+
+// outputsInUse has the output channels given to the Adders which are adding
+// at the moment.
+var outputsInUse sync.Map
+
+// ErrNotFinished is returned by RootLinks when the Adder has not successfully
+// finished adding content.
+var ErrNotFinished = errors.New("adder: the add has not finished successfully")
+
+// ErrNotBuilt is returned by Commit when called without a successful Build
+// first.
+var ErrNotBuilt = errors.New("adder: nothing to commit, Build must succeed first")
+
 // ClusterDAGService is an implementation of ipld.DAGService plus a Finalize
 // method. ClusterDAGServices can be used to provide Adders with a different
 // add implementation.
@@ -31,6 +82,42 @@ type ClusterDAGService interface {
 	Finalize(ctx context.Context, ipfsRoot cid.Cid) (cid.Cid, error)
 }
 
+// Cleaner can optionally be implemented by ClusterDAGServices which can undo
+// what they did when adding fails or is cancelled. Cleanup is called with the
+// CIDs of the blocks added so far, and should undo what was done for them
+// (i.e. remove them) as far as possible.
+type Cleaner interface {
+	Cleanup(ctx context.Context, cids []cid.Cid) error
+}
+
+// BlockChecker can optionally be implemented by ClusterDAGServices which can
+// tell whether they have a block already. Blocks which the ClusterDAGService
+// has already are not stored again and are counted as deduplicated in the
+// AddResult.
+type BlockChecker interface {
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+}
+
+// Preparer can optionally be implemented by ClusterDAGServices which can
+// finalize content in two phases, so that it can be checked before it is
+// committed. Prepare stages the content with the given IPFS root and
+// returns its cluster root without committing it (i.e. without pinning it).
+// Commit then commits the prepared cluster root. Finalize must be the same
+// as Prepare followed by Commit, and Cleanup (see Cleaner) must undo what
+// Prepare did, as it is called when prepared content is not committed.
+type Preparer interface {
+	Prepare(ctx context.Context, ipfsRoot cid.Cid) (cid.Cid, error)
+	Commit(ctx context.Context, clusterRoot cid.Cid) error
+}
+
+// ShardConfigurer can optionally be implemented by ClusterDAGServices which
+// shard content. Adders call ConfigureShards with the ShardSize and
+// ShardAllocation add parameters before adding anything, so that they are
+// honored when the shards are allocated and pinned.
+type ShardConfigurer interface {
+	ConfigureShards(size uint64, allocation string)
+}
+
 // Adder is used to add content to IPFS Cluster using an implementation of
 // ClusterDAGService.
 type Adder struct {
@@ -38,103 +125,681 @@ type Adder struct {
 	cancel context.CancelFunc
 
 	dgs ClusterDAGService
+	// tracker wraps dgs and is used to add blocks.
+	tracker *dagTracker
 
 	params *api.AddParams
+	// the params as applied, set when the ipfs adder is created.
+	effective *api.AddParams
 
 	// AddedOutput updates are placed on this channel
 	// whenever a block is processed. They contain information
 	// about the block, the CID, the Name etc. and are mostly
 	// meant to be streamed back to the user.
 	output chan *api.AddedOutput
+	// the output is closed once, when adding ends.
+	closeOnce sync.Once
+	// held for reading by the adding methods while they may send to
+	// the output.
+	sendMu sync.RWMutex
+
+	result *api.AddResult
+	// the IPFS root of the finished add.
+	ipfsRoot cid.Cid
+	// the ipfs adder in use, which counts the added files.
+	ipfsAdder *ipfsadd.Adder
+	// set by Build.
+	cp    *checkpoint
+	built cid.Cid
+	roots []cid.Cid
+	// set by Commit, or by Prepare and when the prepared content expires.
+	commitMu     sync.Mutex
+	committed    bool
+	prepared     cid.Cid
+	prepareTimer *time.Timer
+	expired      bool
+	// when adding started.
+	start time.Time
+	// applied to the readers of the added content, when set.
+	throttle *throttle
+	limit    *sizeLimit
+	metrics  AddMetrics
+	log      Logger
+	// set when adding with AddBlock.
+	addingBlocks bool
+	trustCID     bool
+	// set by FromFilesystem to leave out hidden files.
+	skipHidden bool
+	// set by FromFilesystem to the directory holding the added path.
+	diskRoot string
+	// set by AddFromChannel, whose files can only be read in order.
+	sequential bool
+	// set by NewQuiet: no output channel is used.
+	quiet bool
+	// set by CancelWithCommit (accessed atomically), and when the
+	// partial root was committed.
+	interrupted int32
+	partial     bool
+	// receives non-fatal issues, when set.
+	warnings chan<- *api.AddWarning
+	// applied to the content of every file, when set.
+	transform func(name string, r io.Reader) (io.Reader, error)
+	// called with the cluster root once finalized, when set.
+	onFinalize func(root cid.Cid) error
+	// the error which aborted the add, if any.
+	abortMu  sync.Mutex
+	abortErr error
+
+	// when set, progress is recorded here so that interrupted adds can
+	// be resumed.
+	checkpointPath string
 }
 
 // New returns a new Adder with the given ClusterDAGService, add options and a
-// channel to send updates during the adding process.
+// channel to send updates during the adding process. The Adder owns the
+// channel and closes it when adding ends: it must not be closed elsewhere,
+// nor given to another Adder, which fails with ErrOutputInUse while this one
+// is adding.
 //
-// An Adder may only be used once.
+// An Adder may only be used once. Further calls to any of the adding methods
+// return ErrAdderConsumed.
 func New(ds ClusterDAGService, p *api.AddParams, out chan *api.AddedOutput) *Adder {
-	// Discard all progress update output as the caller has not provided
-	// a channel for them to listen on.
-	if out == nil {
-		out = make(chan *api.AddedOutput, 100)
+	tracker := newDAGTracker(ds)
+	tracker.timeout = p.BlockTimeout
+	tracker.retries = p.PutRetries
+	tracker.backoff = p.PutBackoff
+	tracker.batchSize = p.BatchSize
+	tracker.flushInterval = p.FlushInterval
+	if p.MaxBufferBytes > 0 {
+		tracker.buffer = newByteSemaphore(p.MaxBufferBytes)
+	}
+	return &Adder{
+		dgs:     ds,
+		tracker: tracker,
+		params:  p,
+		output:  out,
+		metrics: DefaultAddMetrics,
+		log:     logger,
+	}
+}
+
+// NewQuiet returns a new Adder like New which does not use any output
+// channel: no updates are produced, so there is no channel to drain, and
+// only the AddResult and the AddMetrics report on the add. It suits callers
+// which only want the root and the counts.
+func NewQuiet(ds ClusterDAGService, p *api.AddParams) *Adder {
+	a := New(ds, p, nil)
+	a.quiet = true
+	return a
+}
+
+// openOutput makes sure there is an output channel to send updates to. When
+// the caller has not provided one, a channel with a buffer of ProgressBuffer
+// size is created and all updates on it are discarded until it is closed at
+// the end of the adding process, or until the context of the add is
+// cancelled and the adding methods have returned, as Adders which are left
+// unfinished (i.e. built but never committed) never close it. This is only
+// done once adding actually starts, so that nothing is leaked by Adders
+// which are never used. It returns ErrOutputInUse when the given channel is
+// in use by another Adder. Quiet Adders have no output.
+func (a *Adder) openOutput() error {
+	if a.quiet {
+		return nil
+	}
+	if a.output != nil {
+		if _, inUse := outputsInUse.LoadOrStore(a.output, a); inUse {
+			return ErrOutputInUse
+		}
+		return nil
+	}
+	size := a.params.ProgressBuffer
+	if size <= 0 {
+		size = api.DefaultProgressBuffer
+	}
+	out := make(chan *api.AddedOutput, size)
+	go a.discard(out)
+	a.output = out
+	return nil
+}
+
+// discard drains the given output until it is closed or the add is
+// cancelled. Once cancelled, it keeps draining until the adding methods have
+// returned, as they may still send updates. Nothing is sent afterwards.
+func (a *Adder) discard(out chan *api.AddedOutput) {
+	for {
+		select {
+		case _, ok := <-out:
+			if !ok {
+				return
+			}
+		case <-a.ctx.Done():
+			idle := make(chan struct{})
+			go func() {
+				a.sendMu.Lock()
+				close(idle)
+				a.sendMu.Unlock()
+			}()
+			for {
+				select {
+				case _, ok := <-out:
+					if !ok {
+						return
+					}
+				case <-idle:
+					return
+				}
+			}
+		}
+	}
+}
+
+// closeOutput closes the output channel, only the first time it is called.
+func (a *Adder) closeOutput() {
+	a.closeOnce.Do(func() {
+		if a.output == nil {
+			return
+		}
+		outputsInUse.Delete(a.output)
+		close(a.output)
+	})
+}
+
+// send sends the update to the output, if any.
+func (a *Adder) send(ao *api.AddedOutput) {
+	if a.output != nil {
+		a.output <- ao
+	}
+}
+
+// setContext sets the context for the adding process. It returns
+// ErrAdderConsumed if the Adder has been used already.
+func (a *Adder) setContext(ctx context.Context) error {
+	if a.ctx != nil { // only allows first context
+		return ErrAdderConsumed
+	}
+	ctxc, cancel := context.WithCancel(ctx)
+	a.ctx = ctxc
+	a.cancel = cancel
+	if d := a.params.MaxDuration; d > 0 {
 		go func() {
-			for range out {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				a.abort(fmt.Errorf("%w (%s)", ErrMaxDuration, d))
+			case <-ctxc.Done():
 			}
 		}()
 	}
+	a.tracker.ctx = ctxc
+	a.tracker.abort = a.abort
+	// Nothing is stored nor pinned when only hashing, whatever the
+	// content is added from. Blocks are not batched either, as
+	// nothing is finalized, which would flush them.
+	if a.params.OnlyHash {
+		a.tracker.ClusterDAGService = discardDAGService{}
+		a.tracker.checker = nil
+		a.tracker.batchSize = 0
+	}
+	a.start = time.Now()
+	if a.params.MaxRate > 0 {
+		a.throttle = newThrottle(a.params.MaxRate)
+	}
+	if a.params.MaxTotalSize > 0 {
+		a.limit = newSizeLimit(a.params.MaxTotalSize, a.abort)
+	}
+	if sc, ok := a.dgs.(ShardConfigurer); ok {
+		sc.ConfigureShards(a.params.ShardSize, a.params.ShardAllocation)
+	}
+	return nil
+}
 
-	return &Adder{
-		dgs:    ds,
-		params: p,
-		output: out,
+// SetLogger sets the Logger used for the add instead of the package logger,
+// which is used again when given nil. It must be called before adding.
+func (a *Adder) SetLogger(l Logger) {
+	if l == nil {
+		l = logger
+	}
+	a.log = l
+	a.tracker.log = l
+}
+
+// SetMetrics sets the AddMetrics notified of the add instead of
+// DefaultAddMetrics. It must be called before adding.
+func (a *Adder) SetMetrics(m AddMetrics) {
+	a.metrics = m
+}
+
+// started reports the start of the add to the metrics. finished must be
+// called once it ends.
+func (a *Adder) started() {
+	a.metrics.AddStarted(a.ctx)
+}
+
+// finished reports the end of the add to the metrics. Adding has finished,
+// so the tracker totals can be read.
+func (a *Adder) finished(err error) {
+	a.metrics.AddFinished(a.ctx, len(a.tracker.cids), a.tracker.bytes, err)
+}
+
+// wrapReader applies the size limit and the throttle, if any, to a reader of
+// the added content, and makes it fail once interrupted by CancelWithCommit.
+func (a *Adder) wrapReader(r io.Reader) io.Reader {
+	r = &interruptibleReader{r: r, a: a}
+	if a.limit != nil {
+		r = a.limit.reader(r)
+	}
+	if a.throttle != nil {
+		r = a.throttle.reader(a.ctx, r)
+	}
+	return r
+}
+
+// abort cancels the add because of err. The first such error is returned by
+// the adding methods instead of whatever the cancellation caused.
+func (a *Adder) abort(err error) {
+	a.abortMu.Lock()
+	if a.abortErr == nil {
+		a.abortErr = err
+	}
+	a.abortMu.Unlock()
+	a.cancel()
+}
+
+// abortedErr returns the error which aborted the add, if any, when adding
+// failed with err.
+func (a *Adder) abortedErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	a.abortMu.Lock()
+	defer a.abortMu.Unlock()
+	if a.abortErr != nil {
+		return a.abortErr
 	}
+	return err
 }
 
-func (a *Adder) setContext(ctx context.Context) {
-	if a.ctx == nil { // only allows first context
-		ctxc, cancel := context.WithCancel(ctx)
-		a.ctx = ctxc
-		a.cancel = cancel
+// SetOnBlock sets a function which is called with every block once stored,
+// before adding continues. The AddedOutput has the Cid and the Size of the
+// block. Inlined blocks, which are not stored, and blocks stored already in
+// the same add are not reported. When the function returns an error, the
+// add is aborted with it. It must be called before adding.
+func (a *Adder) SetOnBlock(f func(*api.AddedOutput) error) {
+	a.tracker.onBlock = f
+}
+
+// SetOnFinalize sets a function which is called once with the cluster root
+// after the ClusterDAGService has finalized it (and it has been verified,
+// with VerifyAfterAdd), before the adding method returns. When the function
+// returns an error, the add fails with it and is cleaned up. It must be
+// called before adding.
+func (a *Adder) SetOnFinalize(f func(root cid.Cid) error) {
+	a.onFinalize = f
+}
+
+// SetWarnings sets a channel where non-fatal issues found while adding (i.e.
+// skipped symlinks) are sent, separately from the progress output. Sends
+// never block: warnings are dropped and logged when the channel is full,
+// so it should be buffered. The channel is not closed by the adder. It must
+// be called before adding.
+func (a *Adder) SetWarnings(ch chan<- *api.AddWarning) {
+	a.warnings = ch
+}
+
+// SetTransform sets a function which transforms the content of every file
+// added from files (i.e. to strip metadata or normalize line endings) before
+// it is chunked. It is given the name of the file, as in the AddedOutput,
+// and the reader of its content, and returns the reader of the content to
+// add instead, which changes the CIDs. When it fails, adding the file fails,
+// and the add with it unless SkipFailedFiles is set. Files added with NoCopy
+// cannot be transformed. It must be called before adding.
+func (a *Adder) SetTransform(f func(name string, r io.Reader) (io.Reader, error)) {
+	a.transform = f
+}
+
+// SetCheckpoint makes the adder record every block it stores in a checkpoint
+// file at the given path. If the file exists already, blocks recorded on it
+// are not added again, which allows resuming an interrupted add by calling
+// FromFiles with the same content and parameters on a new Adder. An error
+// is returned if the parameters affecting chunking and hashing differ from
+// those used to create the checkpoint, and ErrCheckpointShard when sharding.
+// The checkpoint file is removed when the add finishes successfully.
+func (a *Adder) SetCheckpoint(path string) {
+	a.checkpointPath = path
+}
+
+// EffectiveParams returns the parameters as they are applied when adding
+// files: with the CID version actually used (i.e. CIDv1 with raw leaves),
+// the chunker sizes in bytes, the default chunker, layout and hash function
+// spelled out, and the Concurrency and Deterministic settings in effect.
+// It returns nil until adding files has started.
+func (a *Adder) EffectiveParams() *api.AddParams {
+	return a.effective
+}
+
+// Result returns a summary of the adding process or nil if the adder has not
+// successfully finished adding content yet.
+func (a *Adder) Result() *api.AddResult {
+	return a.result
+}
+
+// RootLinks returns the links of the IPFS root of the added content, as read
+// from the ClusterDAGService, i.e. the entries of the wrapping directory.
+// It returns ErrNotFinished until adding has successfully finished, and
+// fails when the ClusterDAGService cannot return the root block (as with
+// inlined roots, which are not stored).
+func (a *Adder) RootLinks() ([]*ipld.Link, error) {
+	if a.result == nil {
+		return nil, ErrNotFinished
+	}
+	nd, err := a.dgs.Get(context.Background(), a.ipfsRoot)
+	if err != nil {
+		return nil, fmt.Errorf("reading the root %s: %w", a.ipfsRoot, err)
+	}
+	return nd.Links(), nil
+}
+
+func (a *Adder) setResult(root cid.Cid) {
+	a.result = &api.AddResult{
+		Root:          root,
+		Cids:          a.tracker.cids,
+		Blocks:        len(a.tracker.cids),
+		Bytes:         a.tracker.bytes,
+		DedupedBytes:  a.tracker.dedupedBytes,
+		DedupedBlocks: a.tracker.existing.Len(),
+		Duration:      time.Since(a.start),
+	}
+	if len(a.roots) > 0 {
+		a.result.Roots = a.roots
+	}
+	a.result.Partial = a.partial
+	if a.params.AlternateCid && root.Defined() {
+		alt, err := api.AlternateCid(root)
+		if err != nil {
+			a.log.Warnf("no alternate CID for %s: %s", root, err)
+		} else {
+			a.result.AlternateRoot = alt
+		}
+	}
+	if a.ipfsAdder != nil {
+		a.result.Files = a.ipfsAdder.AddedFiles()
+		a.result.SkippedFiles = a.ipfsAdder.FailedFiles()
+		if manifest := a.ipfsAdder.Manifest(); len(manifest) > 0 {
+			a.result.Manifest = manifest
+		}
+		if a.params.Wrap && a.params.UnwrapSingle && a.result.Files == 1 {
+			a.result.UnwrappedRoot = singleFile(a.result.Manifest, a.params.WrapName)
+		}
+		count, dups := a.ipfsAdder.DuplicateFiles()
+		a.result.DuplicateFiles = count
+		for c, names := range dups {
+			if a.result.Duplicates == nil {
+				a.result.Duplicates = make(map[string][]string, len(dups))
+			}
+			a.result.Duplicates[a.params.FormatCid(c)] = names
+		}
 	}
 }
 
+// singleFile returns the CID of the only entry of the manifest other than
+// the wrapping directory with the given name, when it is a file, or
+// cid.Undef otherwise.
+func singleFile(manifest map[string]cid.Cid, wrapName string) cid.Cid {
+	file := cid.Undef
+	for name, c := range manifest {
+		switch {
+		case wrapName != "" && name == wrapName+"/":
+		case file.Defined() || strings.HasSuffix(name, "/"):
+			return cid.Undef
+		default:
+			file = c
+		}
+	}
+	return file
+}
+
 // FromMultipart adds content from a multipart.Reader. The adder will
 // no longer be usable after calling this method.
+//
+// Per-part metadata headers (i.e. X-File-Mtime) are not read: the parts
+// are parsed by go-ipfs-files, which does not expose their headers, and
+// the UnixFS implementation in use cannot store modification times.
 func (a *Adder) FromMultipart(ctx context.Context, r *multipart.Reader) (cid.Cid, error) {
-	logger.Debugf("adding from multipart with params: %+v", a.params)
+	a.log.Debugf("adding from multipart with params: %+v", a.params)
+
+	// Symlink targets would be read from the local disk rather than
+	// from the request.
+	if a.params.Symlinks == "follow" {
+		return cid.Undef, errors.New("symlinks cannot be followed when adding from multipart")
+	}
 
 	f, err := files.NewFileFromPartReader(r, "multipart/form-data")
 	if err != nil {
 		return cid.Undef, err
 	}
 	defer f.Close()
+	return a.fromFiles(ctx, f, true)
+}
+
+// FromReader adds the content read from r as a single file with the given
+// name. When the name is empty, the AddedOutput names are set to the CID of
+// the content. The adder will no longer be usable after calling this method.
+func (a *Adder) FromReader(ctx context.Context, r io.Reader, name string) (cid.Cid, error) {
+	a.log.Debugf("adding from reader with params: %+v", a.params)
+
+	f := files.NewSliceDirectory(
+		[]files.DirEntry{files.FileEntry(name, files.NewReaderFile(r))},
+	)
+	defer f.Close()
 	return a.FromFiles(ctx, f)
 }
 
-// FromFiles adds content from a files.Directory. The adder will no longer
-// be usable after calling this method.
+// FromFiles adds content from a files.Directory. When the Concurrency
+// parameter is set, the entries of each top-level directory are added in
+// parallel. It is the same as calling Build and Commit. The adder will no
+// longer be usable after calling this method.
 func (a *Adder) FromFiles(ctx context.Context, f files.Directory) (cid.Cid, error) {
-	logger.Debug("adding from files")
-	a.setContext(ctx)
+	return a.fromFiles(ctx, f, false)
+}
 
-	if a.ctx.Err() != nil { // don't allow running twice
-		return cid.Undef, a.ctx.Err()
+// Build adds content from a files.Directory like FromFiles, but does not
+// finalize it. It returns the root of the IPFS content, which can be
+// inspected before calling Commit. Until then, the content is not
+// pinned and the output channel remains open. Commit must be called to end
+// the adding process once Build has succeeded. The adder will no longer be
+// usable for adding after calling this method.
+func (a *Adder) Build(ctx context.Context, f files.Directory) (cid.Cid, error) {
+	return a.build(ctx, f, false)
+}
+
+// Commit finalizes the content added with Build using the
+// ClusterDAGService (i.e. pins it) and returns the resulting root. When the
+// content was prepared with Prepare, it commits the prepared root instead.
+// It returns ErrNotBuilt unless Build was successful, and ErrPrepareExpired
+// when the prepared content expired. Once Commit returns, the adding
+// process is over: the output channel is closed and, on error, what was
+// added is cleaned up.
+func (a *Adder) Commit(ctx context.Context) (root cid.Cid, err error) {
+	if !a.built.Defined() {
+		return cid.Undef, ErrNotBuilt
+	}
+	a.commitMu.Lock()
+	if a.expired {
+		a.commitMu.Unlock()
+		return cid.Undef, ErrPrepareExpired
+	}
+	if a.committed {
+		a.commitMu.Unlock()
+		return cid.Undef, ErrAdderConsumed
+	}
+	a.committed = true
+	if a.prepareTimer != nil {
+		a.prepareTimer.Stop()
 	}
+	a.commitMu.Unlock()
+	defer func() { a.end(err) }()
 
-	defer a.cancel()
-	defer close(a.output)
+	return a.finish(ctx, a.built, a.cp)
+}
+
+func (a *Adder) fromFiles(ctx context.Context, f files.Directory, multipart bool) (cid.Cid, error) {
+	ctx, span := trace.StartSpan(ctx, "adder/FromFiles")
+	defer span.End()
 
-	ipfsAdder, err := ipfsadd.NewAdder(a.ctx, a.dgs)
+	if _, err := a.build(ctx, f, multipart); err != nil {
+		return cid.Undef, err
+	}
+	root, err := a.Commit(a.ctx)
+	if err == nil && span.IsRecordingEvents() {
+		res := a.Result()
+		span.AddAttributes(
+			trace.StringAttribute("cid", root.String()),
+			trace.Int64Attribute("bytes", int64(res.Bytes)),
+			trace.Int64Attribute("blocks", int64(res.Blocks)),
+			trace.Int64Attribute("files", int64(res.Files)),
+		)
+	}
+	return root, err
+}
+
+// end ends the adding process once built and committed, or on error.
+func (a *Adder) end(err error) {
+	if a.cp != nil {
+		a.cp.Close()
+	}
+	a.cleanup(err)
+	a.finished(err)
+	a.closeOutput()
+	a.cancel()
+}
+
+// begin starts the adding process: it sets the context, opens the output
+// and validates the parameters. When it fails, the adding process is over.
+// It returns ErrAdderConsumed if the Adder has been used already.
+func (a *Adder) begin(ctx context.Context) error {
+	if err := a.setContext(ctx); err != nil { // don't allow running twice
+		return err
+	}
+	if err := a.ctx.Err(); err != nil {
+		a.cancel()
+		return err
+	}
+	if err := a.openOutput(); err != nil {
+		a.cancel()
+		return err
+	}
+	a.started()
+	err := a.params.Validate()
+	// Blocks skipped when resuming would be left out of the shards.
+	if err == nil && a.checkpointPath != "" && a.params.Shard {
+		err = ErrCheckpointShard
+	}
 	if err != nil {
-		logger.Error(err)
+		a.end(err)
+		return err
+	}
+	return nil
+}
+
+// run runs the whole adding process for the methods which add and finalize
+// content in one call. The process begins before calling add, and ends once
+// it returns, cleaning up what was added on error.
+func (a *Adder) run(ctx context.Context, add func() (cid.Cid, error)) (root cid.Cid, err error) {
+	a.sendMu.RLock()
+	defer a.sendMu.RUnlock()
+	if err := a.begin(ctx); err != nil {
 		return cid.Undef, err
 	}
+	defer func() {
+		err = a.abortedErr(err)
+		a.end(err)
+	}()
+	return add()
+}
 
-	ipfsAdder.Trickle = a.params.Layout == "trickle"
-	ipfsAdder.RawLeaves = a.params.RawLeaves
-	ipfsAdder.Chunker = a.params.Chunker
-	ipfsAdder.Out = a.output
-	ipfsAdder.Progress = a.params.Progress
-	ipfsAdder.NoCopy = a.params.NoCopy
+func (a *Adder) build(ctx context.Context, f files.Directory, multipart bool) (root cid.Cid, err error) {
+	ctx, span := trace.StartSpan(ctx, "adder/build")
+	defer span.End()
 
-	// Set up prefix
-	prefix, err := merkledag.PrefixForCidVersion(a.params.CidVersion)
+	a.log.Debug("adding from files")
+	a.sendMu.RLock()
+	defer a.sendMu.RUnlock()
+	if err := a.begin(ctx); err != nil {
+		return cid.Undef, err
+	}
+	// Commit ends the add otherwise.
+	defer func() {
+		if err != nil {
+			err = a.abortedErr(err)
+			a.end(err)
+		}
+	}()
+
+	// Parts can only be read in order, so they are added sequentially,
+	// as are files received on a channel. Ignore rules are also read in
+	// order. Deterministic adds output events in order.
+	sequential := multipart || a.sequential
+	concurrency := a.params.Concurrency
+	if sequential || len(a.params.IgnoreRulesFiles) > 0 || a.params.Deterministic {
+		concurrency = 1
+	}
+
+	ipfsAdder, err := a.newIPFSAdder()
 	if err != nil {
-		return cid.Undef, fmt.Errorf("bad CID Version: %s", err)
+		return cid.Undef, err
 	}
+	defer a.coalesceProgress(ipfsAdder)()
+	ipfsAdder.Concurrency = concurrency
+	// Parts cannot be reordered, but they come in the order they
+	// were sent anyway.
+	ipfsAdder.Deterministic = a.params.Deterministic && !sequential
+	a.effective.Concurrency = concurrency
+	a.effective.Deterministic = ipfsAdder.Deterministic
 
-	hashFunCode, ok := multihash.Names[strings.ToLower(a.params.HashFun)]
-	if !ok {
-		return cid.Undef, fmt.Errorf("unrecognized hash function: %s", a.params.HashFun)
+	a.cp, err = a.startCheckpoint()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	// The size of decompressed files is not known.
+	if a.params.Decompress == "gzip" {
+		f = decompressedDirectory{f}
+	}
+
+	// Figure out the total size for progress percentages when it is
+	// possible without consuming the files (i.e. not multipart).
+	if a.params.Progress {
+		if size, err := f.Size(); err == nil {
+			ipfsAdder.TotalSize = size
+			// Give clients a denominator before anything is read.
+			a.send(&api.AddedOutput{
+				Type:           api.AddedPlan,
+				Bytes:          uint64(size),
+				ExpectedBlocks: a.params.EstimateBlocks(size),
+			})
+		}
+	}
+
+	// place the files under the TargetPath, innermost directory first.
+	// It was validated already. The timestamp is the same for all the
+	// entries.
+	targetPath, _ := a.params.TargetPathComponents()
+	if a.params.WrapTimestamp {
+		stamp := a.start.UTC().Format(time.RFC3339)
+		targetPath = append([]string{stamp}, targetPath...)
+	}
+	for i := len(targetPath) - 1; i >= 0; i-- {
+		f = files.NewSliceDirectory(
+			[]files.DirEntry{files.FileEntry(targetPath[i], f)},
+		)
 	}
-	prefix.MhType = hashFunCode
-	prefix.MhLength = -1
-	ipfsAdder.CidBuilder = &prefix
 
-	// setup wrapping
-	if a.params.Wrap {
+	// setup wrapping. The wrapping directory is output with the
+	// WrapName, if any. It is needed to link the TargetPath.
+	if a.params.Wrap || len(targetPath) > 0 {
 		f = files.NewSliceDirectory(
-			[]files.DirEntry{files.FileEntry("", f)},
+			[]files.DirEntry{files.FileEntry(a.params.WrapName, f)},
 		)
 	}
 
@@ -161,24 +826,402 @@ func (a *Adder) FromFiles(ctx context.Context, f files.Directory) (cid.Cid, erro
 		case <-a.ctx.Done():
 			return cid.Undef, a.ctx.Err()
 		default:
-			logger.Debugf("ipfsAdder AddFile(%s)", it.Name())
+			a.log.Debugf("ipfsAdder AddFile(%s)", it.Name())
 
 			adderRoot, err = ipfsAdder.AddAllAndPin(it.Node())
+			if err != nil && a.isInterrupted() {
+				adderRoot, err = a.partialRoot(ipfsAdder, it.Node())
+			}
+			if err == nil {
+				err = a.tracker.checkInline(adderRoot)
+			}
 			if err != nil {
-				logger.Error("error adding to cluster: ", err)
+				a.log.Error("error adding to cluster: ", err)
 				return cid.Undef, err
 			}
+			a.roots = append(a.roots, adderRoot.Cid())
+		}
+		// The rest of the entries are left out.
+		if a.partial {
+			break
 		}
 	}
 	if it.Err() != nil {
 		return cid.Undef, it.Err()
 	}
 
-	clusterRoot, err := a.dgs.Finalize(a.ctx, adderRoot.Cid())
+	a.built = adderRoot.Cid()
+	if span.IsRecordingEvents() {
+		span.AddAttributes(
+			trace.StringAttribute("cid", a.built.String()),
+			trace.Int64Attribute("bytes", int64(a.tracker.bytes)),
+			trace.Int64Attribute("blocks", int64(len(a.tracker.cids))),
+		)
+	}
+	return a.built, nil
+}
+
+// newIPFSAdder returns an ipfsadd.Adder configured with the chunking and
+// hashing parameters, which adds to the tracker. Parameters must have been
+// validated already.
+func (a *Adder) newIPFSAdder() (*ipfsadd.Adder, error) {
+	ipfsAdder, err := ipfsadd.NewAdder(a.ctx, a.tracker)
+	if err != nil {
+		a.log.Error(err)
+		return nil, err
+	}
+
+	ipfsAdder.Trickle = a.params.Layout == "trickle"
+	ipfsAdder.RawLeaves = a.params.RawLeaves
+	ipfsAdder.RawLeavesAuto = a.params.RawLeavesAuto
+	ipfsAdder.DetectMIME = a.params.DetectMIME
+	ipfsAdder.StrictSize = a.params.StrictSize
+	ipfsAdder.Chunker = a.params.EffectiveChunker()
+	ipfsAdder.Out = a.output
+	// nothing reads progress updates without an output.
+	ipfsAdder.Progress = a.params.Progress && a.output != nil
+	ipfsAdder.NoCopy = a.params.NoCopy
+	ipfsAdder.ShardingThreshold = a.params.ShardingThreshold
+	ipfsAdder.Symlinks = a.params.Symlinks
+	ipfsAdder.SkipHidden = a.skipHidden
+	ipfsAdder.DiskRoot = a.diskRoot
+	ipfsAdder.Warnings = a.warnings
+	ipfsAdder.IgnoreRulesFiles = a.params.IgnoreRulesFiles
+	ipfsAdder.SkipFailedFiles = a.params.SkipFailedFiles
+	ipfsAdder.FormatCid = a.params.FormatCid
+	ipfsAdder.WrapReader = a.wrapReader
+	ipfsAdder.MaxFileSize = a.params.MaxFileSize
+	ipfsAdder.MaxLinks = a.params.MaxLinks
+	ipfsAdder.AutoLayout = a.params.Layout == "auto"
+	ipfsAdder.TrickleThreshold = a.params.TrickleThreshold
+	ipfsAdder.NormalizeNames = a.params.NormalizeNames
+	ipfsAdder.Transform = a.transform
+
+	filter, err := newPathFilter(a.params.Include, a.params.Exclude)
 	if err != nil {
-		logger.Error("error finalizing adder:", err)
+		return nil, err
+	}
+	if filter != nil {
+		ipfsAdder.Skip = filter.skip
+	}
+
+	// Set up prefix
+	hashFun, err := a.params.EffectiveHashFunction()
+	if err != nil {
+		return nil, err
+	}
+
+	// CIDv0 only supports sha2-256 dag-pb blocks. We upgrade to
+	// CIDv1 when using other hash functions, like ipfs, and when
+	// using raw leaves.
+	cidVersion, err := a.params.EffectiveCidVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := merkledag.PrefixForCidVersion(cidVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix.MhType = hashFun.Code
+	prefix.MhLength = hashFun.Length
+	ipfsAdder.CidBuilder = &prefix
+	// Identity CIDs carry all of the block, so they are kept small.
+	if hashFun.Code == multihash.IDENTITY {
+		a.tracker.identityLimit = a.params.InlineLimit
+	}
+
+	effective := *a.params
+	effective.CidVersion = cidVersion
+	effective.Chunker = ipfsAdder.Chunker
+	if effective.Chunker == "" || effective.Chunker == "default" {
+		effective.Chunker = fmt.Sprintf("size-%d", chunker.DefaultBlockSize)
+	}
+	if effective.Layout == "" {
+		effective.Layout = "balanced"
+	}
+	effective.HashFun = strings.ToLower(effective.HashFun)
+	a.effective = &effective
+
+	// Inline CIDs are always CIDv1, so Validate does not allow
+	// mixing them with CIDv0.
+	if a.params.Inline {
+		ipfsAdder.CidBuilder = cidutil.InlineBuilder{
+			Builder: &prefix,
+			Limit:   a.params.InlineLimit,
+		}
+	}
+
+	a.ipfsAdder = ipfsAdder
+	return ipfsAdder, nil
+}
+
+// startCheckpoint opens the checkpoint when one has been set and makes the
+// tracker add through it. It returns nil otherwise.
+func (a *Adder) startCheckpoint() (*checkpoint, error) {
+	if a.checkpointPath == "" {
+		return nil, nil
+	}
+	cp, err := openCheckpoint(a.checkpointPath, a.tracker.ClusterDAGService, a.params, a.log)
+	if err != nil {
+		return nil, err
+	}
+	a.tracker.ClusterDAGService = cp
+	return cp, nil
+}
+
+// finish finalizes the DAG with the given root and sets the result. The
+// checkpoint, if any, is removed on success.
+func (a *Adder) finish(ctx context.Context, root cid.Cid, cp *checkpoint) (cid.Cid, error) {
+	ctx, span := trace.StartSpan(ctx, "adder/Finalize")
+	defer span.End()
+
+	// Verified before committing, so that nothing is pinned when it
+	// fails.
+	if err := a.verifyRoot(ctx, root); err != nil {
 		return cid.Undef, err
 	}
-	logger.Infof("%s successfully added to cluster", clusterRoot)
+
+	var clusterRoot cid.Cid
+	var err error
+	switch {
+	case a.params.OnlyHash:
+		// nothing was stored, so nothing is finalized.
+		clusterRoot = root
+	case a.prepared.Defined():
+		clusterRoot = a.prepared
+		err = a.tracker.Commit(ctx, clusterRoot)
+	default:
+		clusterRoot, err = a.tracker.Finalize(ctx, root)
+	}
+	if err != nil {
+		a.log.Error("error finalizing adder:", err)
+		return cid.Undef, err
+	}
+	if a.onFinalize != nil {
+		if err := a.onFinalize(clusterRoot); err != nil {
+			a.log.Error("error after finalizing adder:", err)
+			return cid.Undef, err
+		}
+	}
+	span.AddAttributes(trace.StringAttribute("cid", clusterRoot.String()))
+	a.log.Infof("%s successfully added to cluster", clusterRoot)
+	if cp != nil {
+		if err := cp.Delete(); err != nil {
+			a.log.Warnf("error removing checkpoint: %s", err)
+		}
+	}
+	a.ipfsRoot = root
+	a.setResult(clusterRoot)
 	return clusterRoot, nil
 }
+
+// cleanup lets the ClusterDAGService undo what was added when adding failed
+// or was cancelled. It is best-effort: errors are only logged. Nothing is
+// cleaned up when checkpointing, as the blocks are needed to resume.
+func (a *Adder) cleanup(err error) {
+	if err == nil || a.checkpointPath != "" {
+		return
+	}
+	// blocks which were there before adding are left alone.
+	added := a.tracker.added()
+	if len(added) == 0 {
+		return
+	}
+
+	// a.ctx is likely cancelled already.
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	a.log.Infof("cleaning up %d blocks after failed add: %s", len(added), err)
+	if cerr := a.tracker.Cleanup(ctx, added); cerr != nil {
+		a.log.Warnf("error cleaning up after failed add: %s", cerr)
+	}
+}
+
+// FromCAR adds the blocks contained in a CARv1 archive as they are and
+// finalizes the DAG using the root declared in the archive header. Blocks
+// are already addressed, so the Chunker, CidVersion and HashFun parameters
+// have no effect. The adder will no longer be usable after calling this
+// method.
+func (a *Adder) FromCAR(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	roots, err := a.fromCAR(ctx, r, nil, false)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return roots[0], nil
+}
+
+// FromCARRoots adds the blocks contained in a CARv1 archive like FromCAR,
+// but finalizes the given roots, which must be blocks in the archive,
+// instead of the root declared in the header. When no roots are given, all
+// the roots in the header are finalized. Every block is stored, even those
+// which are not reachable from the roots, unless drop is set: those are
+// then removed from the ClusterDAGService once the roots are finalized, and
+// are still counted in the Result.
+//
+// The roots are finalized one after another, which sharding
+// ClusterDAGServices do not support, so sharded adds can only finalize one,
+// and cannot drop blocks, which are in shards already.
+// It returns what Finalize returned for each of them. The Result has the
+// last one as its Root and, when there are several, all the given ones in
+// Roots.
+func (a *Adder) FromCARRoots(ctx context.Context, r io.Reader, roots []cid.Cid, drop bool) ([]cid.Cid, error) {
+	if roots == nil {
+		roots = []cid.Cid{}
+	}
+	return a.fromCAR(ctx, r, roots, drop)
+}
+
+// fromCAR adds the blocks in the archive and finalizes the given roots:
+// all the header roots when empty, and the only header root when nil.
+func (a *Adder) fromCAR(ctx context.Context, r io.Reader, roots []cid.Cid, drop bool) ([]cid.Cid, error) {
+	a.log.Debug("adding from CAR")
+	var clusterRoots []cid.Cid
+	_, err := a.run(ctx, func() (cid.Cid, error) {
+		var err error
+		clusterRoots, err = a.addCAR(r, roots, drop)
+		return cid.Undef, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clusterRoots, nil
+}
+
+// addCAR adds the blocks in the archive and finalizes the roots as
+// described in fromCAR.
+func (a *Adder) addCAR(r io.Reader, roots []cid.Cid, drop bool) (clusterRoots []cid.Cid, err error) {
+	r = a.wrapReader(r)
+	car, err := newCARReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case roots == nil:
+		if len(car.header.Roots) != 1 {
+			return nil, fmt.Errorf("car: expected a single root, got %d", len(car.header.Roots))
+		}
+		roots = car.header.Roots
+	case len(roots) == 0:
+		if len(car.header.Roots) == 0 {
+			return nil, errors.New("car: no roots in the header")
+		}
+		roots = car.header.Roots
+	}
+	if len(roots) > 1 && a.params.Shard {
+		return nil, errors.New("car: only one root can be finalized when sharding")
+	}
+	// Blocks in shards cannot be removed (and Cleanup unpins all the
+	// shards).
+	if drop && a.params.Shard {
+		return nil, errors.New("car: unreachable blocks cannot be dropped when sharding")
+	}
+
+	seen := cid.NewSet()
+	// the links of every block, to find those which are unreachable.
+	var links map[cid.Cid][]cid.Cid
+	if drop {
+		links = make(map[cid.Cid][]cid.Cid)
+	}
+	for {
+		select {
+		case <-a.ctx.Done():
+			return nil, a.ctx.Err()
+		default:
+		}
+
+		nd, err := car.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen.Visit(nd.Cid()) {
+			continue
+		}
+
+		err = a.tracker.Add(a.ctx, nd)
+		if err != nil {
+			a.log.Error("error adding to cluster: ", err)
+			return nil, err
+		}
+		if drop {
+			for _, l := range nd.Links() {
+				links[nd.Cid()] = append(links[nd.Cid()], l.Cid)
+			}
+		}
+
+		a.send(&api.AddedOutput{
+			Cid:  nd.Cid(),
+			Name: a.params.FormatCid(nd.Cid()),
+			Size: uint64(len(nd.RawData())),
+		})
+	}
+
+	for _, root := range roots {
+		if !seen.Has(root) {
+			return nil, fmt.Errorf("car: root %s not found in archive", root)
+		}
+	}
+
+	if len(roots) > 1 {
+		a.roots = roots
+	}
+	for _, root := range roots[:len(roots)-1] {
+		if a.params.OnlyHash {
+			clusterRoots = append(clusterRoots, root)
+			continue
+		}
+		if err := a.verifyRoot(a.ctx, root); err != nil {
+			return nil, err
+		}
+		clusterRoot, err := a.tracker.Finalize(a.ctx, root)
+		if err != nil {
+			a.log.Error("error finalizing adder:", err)
+			return nil, err
+		}
+		clusterRoots = append(clusterRoots, clusterRoot)
+	}
+	clusterRoot, err := a.finish(a.ctx, roots[len(roots)-1], nil)
+	if err != nil {
+		return nil, err
+	}
+	clusterRoots = append(clusterRoots, clusterRoot)
+
+	if drop {
+		a.dropUnreachable(seen, links, roots)
+	}
+	return clusterRoots, nil
+}
+
+// dropUnreachable removes the blocks in seen which cannot be reached from
+// the roots following the given links.
+func (a *Adder) dropUnreachable(seen *cid.Set, links map[cid.Cid][]cid.Cid, roots []cid.Cid) {
+	reachable := cid.NewSet()
+	pending := append([]cid.Cid(nil), roots...)
+	for len(pending) > 0 {
+		c := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable.Visit(c) {
+			pending = append(pending, links[c]...)
+		}
+	}
+
+	var unreachable []cid.Cid
+	for _, c := range seen.Keys() {
+		if !reachable.Has(c) {
+			unreachable = append(unreachable, c)
+		}
+	}
+	if len(unreachable) == 0 {
+		return
+	}
+	a.log.Infof("car: dropping %d blocks not reachable from the roots", len(unreachable))
+	if err := a.tracker.RemoveMany(a.ctx, unreachable); err != nil {
+		a.log.Warnf("error dropping unreachable blocks: %s", err)
+	}
+}
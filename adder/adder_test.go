@@ -1,8 +1,19 @@
 package adder
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"mime/multipart"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -13,15 +24,25 @@ import (
 	cid "github.com/ipfs/go-cid"
 	files "github.com/ipfs/go-ipfs-files"
 	ipld "github.com/ipfs/go-ipld-format"
+	unixfs "github.com/ipfs/go-unixfs"
+	unixfs_pb "github.com/ipfs/go-unixfs/pb"
+	multibase "github.com/multiformats/go-multibase"
+	multihash "github.com/multiformats/go-multihash"
+	"go.opencensus.io/trace"
 )
 
 type mockCDAGServ struct {
 	BaseDAGService
 	resultCids map[string]struct{}
+	// nodes are only kept when initialized.
+	nodes map[string]ipld.Node
 }
 
 func (dag *mockCDAGServ) Add(ctx context.Context, node ipld.Node) error {
 	dag.resultCids[node.Cid().String()] = struct{}{}
+	if dag.nodes != nil {
+		dag.nodes[node.Cid().String()] = node
+	}
 	return nil
 }
 
@@ -142,3 +163,3277 @@ func TestAdder_ContextCancelled(t *testing.T) {
 	cancel()
 	wg.Wait()
 }
+
+func TestAdder_FromReader(t *testing.T) {
+	// ipfs add of "hello world\n" with default params.
+	expected := "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"
+
+	testcase := func(name, expectedName string) func(t *testing.T) {
+		return func(t *testing.T) {
+			dags := &mockCDAGServ{
+				resultCids: make(map[string]struct{}),
+			}
+			out := make(chan *api.AddedOutput, 10)
+			adder := New(dags, api.DefaultAddParams(), out)
+			root, err := adder.FromReader(context.Background(), strings.NewReader("hello world\n"), name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root.String() != expected {
+				t.Error("unexpected root:", root)
+			}
+
+			var last *api.AddedOutput
+			for ao := range out {
+				last = ao
+			}
+			if last == nil || last.Name != expectedName {
+				t.Errorf("expected output name %s, got %+v", expectedName, last)
+			}
+		}
+	}
+
+	t.Run("named", testcase("hello.txt", "hello.txt"))
+	t.Run("unnamed", testcase("", expected))
+}
+
+func TestAdder_Result(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	testcase := func(wrap bool, expectedRoot string, expectedBlocks int) func(t *testing.T) {
+		return func(t *testing.T) {
+			mr, closer := sth.GetTreeMultiReader(t)
+			defer closer.Close()
+			r := multipart.NewReader(mr, mr.Boundary())
+
+			dags := &mockCDAGServ{
+				resultCids: make(map[string]struct{}),
+			}
+			p := api.DefaultAddParams()
+			p.Wrap = wrap
+			adder := New(dags, p, nil)
+			if adder.Result() != nil {
+				t.Fatal("expected no result before adding")
+			}
+
+			root, err := adder.FromMultipart(context.Background(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := adder.Result()
+			if res.Root.String() != expectedRoot || !res.Root.Equals(root) {
+				t.Error("unexpected result root:", res.Root)
+			}
+			if len(res.Cids) != expectedBlocks {
+				t.Fatalf("expected %d cids, got %d", expectedBlocks, len(res.Cids))
+			}
+			found := false
+			for _, c := range res.Cids {
+				if _, ok := dags.resultCids[c.String()]; !ok {
+					t.Error("unexpected cid in result:", c)
+				}
+				if c.Equals(root) {
+					found = true
+				}
+			}
+			if !found {
+				t.Error("the root should be part of the result")
+			}
+		}
+	}
+
+	t.Run("no wrap", testcase(false, test.ShardingDirBalancedRootCID, len(test.ShardingDirCids)))
+	t.Run("wrap", testcase(true, test.ShardingDirBalancedRootCIDWrapped, len(test.ShardingDirCids)+1))
+}
+
+func TestAdder_ProgressPercent(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	progressUpdates := func(out chan *api.AddedOutput) []*api.AddedOutput {
+		var updates []*api.AddedOutput
+		for ao := range out {
+			if !ao.Cid.Defined() {
+				updates = append(updates, ao)
+			}
+		}
+		return updates
+	}
+
+	t.Run("known size", func(t *testing.T) {
+		f := sth.GetTreeSerialFile(t)
+		defer f.Close()
+		dir := files.NewSliceDirectory(
+			[]files.DirEntry{files.FileEntry("testTree", f)},
+		)
+		total, err := dir.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := api.DefaultAddParams()
+		p.Progress = true
+		out := make(chan *api.AddedOutput, 100)
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		}
+		adder := New(dags, p, out)
+		var updates []*api.AddedOutput
+		done := make(chan struct{})
+		go func() {
+			updates = progressUpdates(out)
+			close(done)
+		}()
+		_, err = adder.FromFiles(context.Background(), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if len(updates) == 0 {
+			t.Fatal("expected progress updates")
+		}
+
+		var last uint64
+		for _, u := range updates {
+			if u.AddedBytes < last {
+				t.Error("added bytes should be cumulative")
+			}
+			last = u.AddedBytes
+			if u.Percent < 0 || u.Percent > 100 {
+				t.Error("unexpected percent:", u.Percent)
+			}
+		}
+		if last != uint64(total) || updates[len(updates)-1].Percent != 100 {
+			t.Errorf("expected to finish at 100%% of %d bytes: %+v", total, updates[len(updates)-1])
+		}
+	})
+
+	t.Run("unknown size", func(t *testing.T) {
+		mr, closer := sth.GetTreeMultiReader(t)
+		defer closer.Close()
+		r := multipart.NewReader(mr, mr.Boundary())
+
+		p := api.DefaultAddParams()
+		p.Progress = true
+		out := make(chan *api.AddedOutput, 100)
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		}
+		adder := New(dags, p, out)
+		var updates []*api.AddedOutput
+		done := make(chan struct{})
+		go func() {
+			updates = progressUpdates(out)
+			close(done)
+		}()
+		_, err := adder.FromMultipart(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if len(updates) == 0 {
+			t.Fatal("expected progress updates")
+		}
+
+		for _, u := range updates {
+			if u.Percent != -1 {
+				t.Fatal("expected percent to be -1 when the size is unknown")
+			}
+		}
+	})
+}
+
+func TestAdder_ShardingThreshold(t *testing.T) {
+	makeDir := func(reverse bool) files.Directory {
+		var entries []files.DirEntry
+		for i := 0; i < 20; i++ {
+			n := i
+			if reverse {
+				n = 19 - i
+			}
+			name := fmt.Sprintf("file-%d", n)
+			entries = append(entries, files.FileEntry(name, files.NewBytesFile([]byte(name))))
+		}
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("big", files.NewSliceDirectory(entries)),
+		})
+	}
+
+	add := func(t *testing.T, threshold int, reverse bool) (ipld.Node, *mockCDAGServ) {
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+			nodes:      make(map[string]ipld.Node),
+		}
+		p := api.DefaultAddParams()
+		p.Wrap = true
+		p.ShardingThreshold = threshold
+		adder := New(dags, p, nil)
+		root, err := adder.FromFiles(context.Background(), makeDir(reverse))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dags.nodes[root.String()], dags
+	}
+
+	dirType := func(t *testing.T, nd ipld.Node) unixfs_pb.Data_DataType {
+		fsn, err := unixfs.ExtractFSNode(nd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsn.Type()
+	}
+
+	t.Run("sharded", func(t *testing.T) {
+		root, dags := add(t, 10, false)
+		// The wrapping directory has a single entry.
+		if dirType(t, root) != unixfs.TDirectory {
+			t.Fatal("wrapping directory should not be sharded")
+		}
+		big := dags.nodes[root.Links()[0].Cid.String()]
+		if dirType(t, big) != unixfs.THAMTShard {
+			t.Fatal("directory should have been sharded")
+		}
+
+		root2, _ := add(t, 10, true)
+		if !root.Cid().Equals(root2.Cid()) {
+			t.Error("sharded directories should have a stable CID")
+		}
+	})
+
+	t.Run("not sharded", func(t *testing.T) {
+		root, dags := add(t, 0, false)
+		big := dags.nodes[root.Links()[0].Cid.String()]
+		if dirType(t, big) != unixfs.TDirectory {
+			t.Fatal("directory should not have been sharded")
+		}
+
+		root2, _ := add(t, 20, false)
+		if !root.Cid().Equals(root2.Cid()) {
+			t.Error("directories under the threshold should not be sharded")
+		}
+	})
+}
+
+func TestAdder_NoCopy(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	p := api.DefaultAddParams()
+	p.NoCopy = true
+
+	t.Run("multipart", func(t *testing.T) {
+		// Parts have no abspath header.
+		mr := files.NewMultiFileReader(files.NewMapDirectory(map[string]files.Node{
+			"a": files.NewBytesFile([]byte("not on disk")),
+		}), true)
+		r := multipart.NewReader(mr, mr.Boundary())
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		}
+		adder := New(dags, p, nil)
+		_, err := adder.FromMultipart(context.Background(), r)
+		if err == nil {
+			t.Fatal("expected an error when using nocopy with multipart")
+		}
+	})
+
+	t.Run("files", func(t *testing.T) {
+		f := sth.GetTreeSerialFile(t)
+		defer f.Close()
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		}
+		out := make(chan *api.AddedOutput, 100)
+		adder := New(dags, p, out)
+		done := make(chan struct{})
+		var refs, dirs int
+		go func() {
+			defer close(done)
+			for ao := range out {
+				if ao.ByReference {
+					refs++
+				} else {
+					dirs++
+				}
+			}
+		}()
+		_, err := adder.FromFiles(context.Background(), files.NewSliceDirectory(
+			[]files.DirEntry{files.FileEntry("testTree", f)},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		// 6 files and 8 directories
+		if refs != 6 || dirs != 8 {
+			t.Errorf("expected 6 files added by reference, got %d (%d others)", refs, dirs)
+		}
+	})
+}
+
+func TestAdder_OnlyHash(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	mr, closer := sth.GetTreeMultiReader(t)
+	defer closer.Close()
+	r := multipart.NewReader(mr, mr.Boundary())
+
+	p := api.DefaultAddParams()
+	p.OnlyHash = true
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	adder := New(dags, p, nil)
+	root, err := adder.FromMultipart(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root.String() != test.ShardingDirBalancedRootCID {
+		t.Error("expected the right content root")
+	}
+
+	if len(dags.resultCids) != 0 {
+		t.Error("no blocks should be stored with only-hash")
+	}
+
+	if len(adder.Result().Cids) != len(test.ShardingDirCids) {
+		t.Error("expected all CIDs to be reported")
+	}
+}
+
+func TestAdder_NoOutputLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	p := api.DefaultAddParams()
+	p.Chunker = "bad"
+	for i := 0; i < 100; i++ {
+		// Never used.
+		New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+
+		// Failing add.
+		adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+		})
+		_, err := adder.FromFiles(context.Background(), f)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	// Give the discarding goroutines some time to exit.
+	for i := 0; i < 50; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("goroutines leaked: %d before, %d after", before, runtime.NumGoroutine())
+}
+
+func TestAdder_AbandonedNoLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// Built but never committed.
+		adder := New(NewMemoryDAGService(), api.DefaultAddParams(), nil)
+		_, err := adder.Build(ctx, files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Blocks added, but never committed.
+		adder = New(NewMemoryDAGService(), api.DefaultAddParams(), nil)
+		if _, err := adder.AddBlock(ctx, []byte("hello"), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// Cancelled before starting.
+		adder = New(NewMemoryDAGService(), api.DefaultAddParams(), nil)
+		cancel()
+		if _, err := adder.FromReader(ctx, strings.NewReader("hello"), ""); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	// Give the discarding goroutines some time to exit.
+	for i := 0; i < 50; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("goroutines leaked: %d before, %d after", before, runtime.NumGoroutine())
+}
+
+func TestAdder_Quiet(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	p := api.DefaultAddParams()
+	p.Progress = true
+	dags := NewMemoryDAGService()
+	adder := NewQuiet(dags, p)
+	root, err := adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.String() != test.ShardingDirBalancedRootCID {
+		t.Error("expected the right content root")
+	}
+	if adder.output != nil {
+		t.Error("no output channel should be used")
+	}
+
+	res := adder.Result()
+	if res.Blocks != len(test.ShardingDirCids) || res.Blocks != dags.Len() {
+		t.Errorf("expected %d blocks, got %d", len(test.ShardingDirCids), res.Blocks)
+	}
+	if res.Bytes-res.DedupedBytes != dags.Size() {
+		t.Errorf("expected %d stored bytes, got %d", dags.Size(), res.Bytes-res.DedupedBytes)
+	}
+
+	// Nothing is left running by quiet Adders, even by those which are
+	// never committed.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		adder := NewQuiet(NewMemoryDAGService(), api.DefaultAddParams())
+		_, err := adder.Build(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("goroutines leaked: %d before, %d after", before, runtime.NumGoroutine())
+}
+
+func TestAdder_Consumed(t *testing.T) {
+	newDir := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+		})
+	}
+
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	adder := New(dags, api.DefaultAddParams(), nil)
+	_, err := adder.FromFiles(context.Background(), newDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = adder.FromFiles(context.Background(), newDir())
+	if err != ErrAdderConsumed {
+		t.Error("expected ErrAdderConsumed, got:", err)
+	}
+
+	_, err = adder.FromCAR(context.Background(), strings.NewReader(""))
+	if err != ErrAdderConsumed {
+		t.Error("expected ErrAdderConsumed, got:", err)
+	}
+}
+
+func TestAdder_Concurrency(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	testConcurrency := func(t *testing.T, wrap bool, expected string) {
+		f := sth.GetTreeSerialFile(t)
+		defer f.Close()
+		dir := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("testTree", f),
+		})
+
+		p := api.DefaultAddParams()
+		p.Wrap = wrap
+		p.Concurrency = 4
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		}
+		out := make(chan *api.AddedOutput, 100)
+		adder := New(dags, p, out)
+
+		done := make(chan struct{})
+		names := make(map[string]struct{})
+		go func() {
+			defer close(done)
+			for ao := range out {
+				names[ao.Name] = struct{}{}
+			}
+		}()
+
+		root, err := adder.FromFiles(context.Background(), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+
+		if root.String() != expected {
+			t.Error("expected the same root as when adding sequentially")
+		}
+		if _, ok := names["testTree"]; !ok {
+			t.Error("expected an output event for the top directory")
+		}
+	}
+
+	t.Run("no wrap", func(t *testing.T) {
+		testConcurrency(t, false, test.ShardingDirBalancedRootCID)
+	})
+
+	t.Run("wrap", func(t *testing.T) {
+		testConcurrency(t, true, test.ShardingDirBalancedRootCIDWrapped)
+	})
+}
+
+func TestAdder_Symlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adder-symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "a")
+	err = ioutil.WriteFile(target, []byte("symlinked content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(target, filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addDir := func(t *testing.T, mode string) map[string]*api.AddedOutput {
+		stat, err := os.Lstat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf, err := files.NewSerialFile(dir, false, stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sf.Close()
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", sf),
+		})
+
+		p := api.DefaultAddParams()
+		p.Symlinks = mode
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		}
+		out := make(chan *api.AddedOutput, 100)
+		adder := New(dags, p, out)
+
+		done := make(chan struct{})
+		outputs := make(map[string]*api.AddedOutput)
+		go func() {
+			defer close(done)
+			for ao := range out {
+				outputs[ao.Name] = ao
+			}
+		}()
+
+		_, err = adder.FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		return outputs
+	}
+
+	t.Run("preserve", func(t *testing.T) {
+		outputs := addDir(t, "preserve")
+		link, ok := outputs["dir/link"]
+		if !ok {
+			t.Fatal("expected the symlink to be added")
+		}
+		if link.Type != api.AddedSymlink {
+			t.Error("expected a symlink entry, got:", link.Type)
+		}
+		if link.Cid.Equals(outputs["dir/a"].Cid) {
+			t.Error("the symlink should not store the target content")
+		}
+		if outputs["dir"].Type != api.AddedDirectory {
+			t.Error("expected a directory entry")
+		}
+	})
+
+	t.Run("follow", func(t *testing.T) {
+		outputs := addDir(t, "follow")
+		link, ok := outputs["dir/link"]
+		if !ok {
+			t.Fatal("expected the symlink target to be added")
+		}
+		if link.Type != api.AddedFile {
+			t.Error("expected a file entry, got:", link.Type)
+		}
+		if !link.Cid.Equals(outputs["dir/a"].Cid) {
+			t.Error("expected the target content to be added")
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		outputs := addDir(t, "skip")
+		if _, ok := outputs["dir/link"]; ok {
+			t.Error("symlink should have been skipped")
+		}
+		if _, ok := outputs["dir/a"]; !ok {
+			t.Error("expected the regular file to be added")
+		}
+	})
+
+	t.Run("follow multipart", func(t *testing.T) {
+		mr := files.NewMultiFileReader(files.NewMapDirectory(map[string]files.Node{
+			"link": files.NewLinkFile(target, nil),
+		}), true)
+		r := multipart.NewReader(mr, mr.Boundary())
+		p := api.DefaultAddParams()
+		p.Symlinks = "follow"
+		adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+		_, err := adder.FromMultipart(context.Background(), r)
+		if err == nil {
+			t.Error("expected an error following symlinks from multipart")
+		}
+	})
+
+	t.Run("follow relative", func(t *testing.T) {
+		rdir := filepath.Join(dir, "rel")
+		if err := os.MkdirAll(filepath.Join(rdir, "sub"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, "sibling"), []byte("symlinked content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("./sibling", filepath.Join(rdir, "link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../sibling", filepath.Join(rdir, "sub", "link")); err != nil {
+			t.Fatal(err)
+		}
+
+		add := func() (map[string]*api.AddedOutput, error) {
+			p := api.DefaultAddParams()
+			p.Symlinks = "follow"
+			p.Recursive = true
+			out := make(chan *api.AddedOutput, 100)
+			adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, out)
+			outputs := make(map[string]*api.AddedOutput)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for ao := range out {
+					outputs[ao.Name] = ao
+				}
+			}()
+			_, err := adder.FromFilesystem(context.Background(), rdir)
+			<-done
+			return outputs, err
+		}
+
+		outputs, err := add()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"rel/link", "rel/sub/link"} {
+			link, ok := outputs[name]
+			if !ok {
+				t.Fatalf("expected the target of %s to be added", name)
+			}
+			if link.Type != api.AddedFile || !link.Cid.Equals(outputs["rel/sibling"].Cid) {
+				t.Errorf("expected %s to be added as the sibling file", name)
+			}
+		}
+
+		// links cannot point outside of the added directory.
+		if err := os.Symlink("../a", filepath.Join(rdir, "escape")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := add(); err == nil {
+			t.Error("expected an error following a symlink outside of the added directory")
+		}
+	})
+}
+
+func TestAdder_NoPinShard(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.NoPin = true
+	p.Shard = true
+	adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+	})
+	_, err := adder.FromFiles(context.Background(), f)
+	if err != api.ErrNoPinShard {
+		t.Error("expected an error when using no-pin with sharding, got:", err)
+	}
+}
+
+func TestAdder_Filters(t *testing.T) {
+	tree := func(full bool) files.Directory {
+		entries := map[string]files.Node{
+			"main.go": files.NewBytesFile([]byte("package main")),
+			"sub": files.NewMapDirectory(map[string]files.Node{
+				"util.go": files.NewBytesFile([]byte("package sub")),
+			}),
+		}
+		if full {
+			entries["debug.log"] = files.NewBytesFile([]byte("log"))
+			entries["node_modules"] = files.NewMapDirectory(map[string]files.Node{
+				"index.go": files.NewBytesFile([]byte("module")),
+			})
+			entries["sub"] = files.NewMapDirectory(map[string]files.Node{
+				"util.go":   files.NewBytesFile([]byte("package sub")),
+				"notes.txt": files.NewBytesFile([]byte("notes")),
+			})
+		}
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("proj", files.NewMapDirectory(entries)),
+		})
+	}
+
+	adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, api.DefaultAddParams(), nil)
+	expected, err := adder.FromFiles(context.Background(), tree(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := api.DefaultAddParams()
+	p.Progress = true
+	p.Include = []string{"**/*.go"}
+	p.Exclude = []string{"proj/node_modules", "**/*.log"}
+	out := make(chan *api.AddedOutput, 100)
+	adder = New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, out)
+
+	done := make(chan struct{})
+	skipped := make(map[string]struct{})
+	go func() {
+		defer close(done)
+		for ao := range out {
+			if ao.Skipped {
+				if ao.SkipReason != api.SkipFiltered {
+					t.Errorf("%s: unexpected skip reason: %s", ao.Name, ao.SkipReason)
+				}
+				skipped[ao.Name] = struct{}{}
+			}
+		}
+	}()
+
+	root, err := adder.FromFiles(context.Background(), tree(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if !root.Equals(expected) {
+		t.Error("expected the filtered entries to be left out of the DAG")
+	}
+
+	for _, name := range []string{"proj/debug.log", "proj/node_modules", "proj/sub/notes.txt"} {
+		if _, ok := skipped[name]; !ok {
+			t.Error("expected a skipped update for", name)
+		}
+	}
+}
+
+func TestAdder_IgnoreRulesFiles(t *testing.T) {
+	rootRules := []byte("*.log\nbuild/\n")
+	subRules := []byte("!keep.log\n")
+	tree := func(full bool) files.Directory {
+		sub := map[string]files.Node{
+			".ipfsignore": files.NewBytesFile(subRules),
+			"keep.log":    files.NewBytesFile([]byte("kept")),
+		}
+		entries := map[string]files.Node{
+			".ipfsignore": files.NewBytesFile(rootRules),
+			"a.txt":       files.NewBytesFile([]byte("a")),
+		}
+		if full {
+			sub["drop.log"] = files.NewBytesFile([]byte("dropped"))
+			entries["x.log"] = files.NewBytesFile([]byte("x"))
+			entries["build"] = files.NewMapDirectory(map[string]files.Node{
+				"out": files.NewBytesFile([]byte("out")),
+			})
+		}
+		entries["sub"] = files.NewMapDirectory(sub)
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("proj", files.NewMapDirectory(entries)),
+		})
+	}
+
+	adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, api.DefaultAddParams(), nil)
+	expected, err := adder.FromFiles(context.Background(), tree(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := api.DefaultAddParams()
+	p.Progress = true
+	p.IgnoreRulesFiles = []string{".ipfsignore"}
+	out := make(chan *api.AddedOutput, 100)
+	adder = New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, out)
+
+	done := make(chan struct{})
+	skipped := make(map[string]struct{})
+	go func() {
+		defer close(done)
+		for ao := range out {
+			if ao.Skipped {
+				if ao.SkipReason != api.SkipIgnored {
+					t.Errorf("%s: unexpected skip reason: %s", ao.Name, ao.SkipReason)
+				}
+				skipped[ao.Name] = struct{}{}
+			}
+		}
+	}()
+
+	root, err := adder.FromFiles(context.Background(), tree(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if !root.Equals(expected) {
+		t.Error("expected the ignored entries to be left out of the DAG")
+	}
+
+	if len(skipped) != 3 {
+		t.Error("expected 3 skipped entries, got:", skipped)
+	}
+	for _, name := range []string{"proj/x.log", "proj/build", "proj/sub/drop.log"} {
+		if _, ok := skipped[name]; !ok {
+			t.Error("expected a skipped update for", name)
+		}
+	}
+}
+
+func TestAdder_DirectoryOutput(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	mr, closer := sth.GetTreeMultiReader(t)
+	defer closer.Close()
+	r := multipart.NewReader(mr, mr.Boundary())
+
+	p := api.DefaultAddParams()
+	p.Wrap = true
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	out := make(chan *api.AddedOutput, 100)
+	adder := New(dags, p, out)
+
+	done := make(chan struct{})
+	var outputs []*api.AddedOutput
+	go func() {
+		defer close(done)
+		for ao := range out {
+			outputs = append(outputs, ao)
+		}
+	}()
+
+	root, err := adder.FromMultipart(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	firstDir := -1
+	filesAfterDir := 0
+	for i, ao := range outputs {
+		switch ao.Type {
+		case api.AddedDirectory:
+			if firstDir < 0 {
+				firstDir = i
+			}
+			// everything inside comes before
+			for _, later := range outputs[i+1:] {
+				if strings.HasPrefix(later.Name, ao.Name+"/") {
+					t.Errorf("%s output after its directory", later.Name)
+				}
+			}
+		case api.AddedFile:
+			if firstDir >= 0 {
+				filesAfterDir++
+			}
+		default:
+			t.Errorf("%s: unexpected type %q", ao.Name, ao.Type)
+		}
+	}
+
+	if filesAfterDir == 0 {
+		t.Error("expected directories to be output before the add finishes")
+	}
+
+	last := outputs[len(outputs)-1]
+	if !last.Cid.Equals(root) || last.Type != api.AddedDirectory {
+		t.Error("expected the wrapping directory to be output last")
+	}
+}
+
+func BenchmarkAdder_ProgressBuffer(b *testing.B) {
+	// many small files, with progress, produce many output events.
+	smallFiles := func() files.Directory {
+		entries := make([]files.DirEntry, 200)
+		for i := range entries {
+			name := fmt.Sprintf("file-%d", i)
+			entries[i] = files.FileEntry(name, files.NewBytesFile([]byte(name)))
+		}
+		return files.NewSliceDirectory(entries)
+	}
+
+	for _, size := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprintf("buffer-%d", size), func(b *testing.B) {
+			p := api.DefaultAddParams()
+			p.Progress = true
+			p.ProgressBuffer = size
+			for i := 0; i < b.N; i++ {
+				dags := &mockCDAGServ{
+					resultCids: make(map[string]struct{}),
+				}
+				adder := New(dags, p, nil)
+				_, err := adder.FromFiles(context.Background(), smallFiles())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// failingReader fails after returning some data, calling onFail first.
+type failingReader struct {
+	data   bool
+	onFail func()
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if !r.data {
+		r.data = true
+		return copy(p, "some data"), nil
+	}
+	if r.onFail != nil {
+		r.onFail()
+	}
+	return 0, errors.New("read failed")
+}
+
+func TestAdder_SkipFailedFiles(t *testing.T) {
+	makeDir := func(onFail func()) files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("d", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("bad", files.NewReaderFile(&failingReader{onFail: onFail})),
+				files.FileEntry("ok", files.NewBytesFile([]byte("ok"))),
+			})),
+		})
+	}
+	expectedDir := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("d", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("ok", files.NewBytesFile([]byte("ok"))),
+		})),
+	})
+
+	p := api.DefaultAddParams()
+	expected, err := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil).FromFiles(context.Background(), expectedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+		_, err := adder.FromFiles(context.Background(), makeDir(nil))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		p := api.DefaultAddParams()
+		p.SkipFailedFiles = true
+		out := make(chan *api.AddedOutput, 100)
+		adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, out)
+		root, err := adder.FromFiles(context.Background(), makeDir(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !root.Equals(expected) {
+			t.Error("expected the root without the failed file")
+		}
+		if n := adder.Result().SkippedFiles; n != 1 {
+			t.Errorf("expected 1 skipped file, got %d", n)
+		}
+
+		var failed []string
+		for ao := range out {
+			if ao.Error != "" {
+				failed = append(failed, ao.Name)
+			}
+		}
+		if len(failed) != 1 || failed[0] != "d/bad" {
+			t.Error("expected an error event for d/bad, got", failed)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		p := api.DefaultAddParams()
+		p.SkipFailedFiles = true
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+		_, err := adder.FromFiles(ctx, makeDir(cancel))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestAdder_Deterministic(t *testing.T) {
+	// makeTree lists the directory entries in the given order, as a
+	// filesystem might.
+	makeTree := func(reverse bool) files.Directory {
+		entries := func(names ...string) []files.DirEntry {
+			var dirEntries []files.DirEntry
+			for _, name := range names {
+				var node files.Node = files.NewBytesFile([]byte(name))
+				if name == "sub" {
+					node = files.NewSliceDirectory([]files.DirEntry{
+						files.FileEntry("x", files.NewBytesFile([]byte("x"))),
+						files.FileEntry("y", files.NewBytesFile([]byte("y"))),
+					})
+				}
+				dirEntries = append(dirEntries, files.FileEntry(name, node))
+			}
+			if reverse {
+				for i, j := 0, len(dirEntries)-1; i < j; i, j = i+1, j-1 {
+					dirEntries[i], dirEntries[j] = dirEntries[j], dirEntries[i]
+				}
+			}
+			return dirEntries
+		}
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("d", files.NewSliceDirectory(entries("a", "b", "c", "sub"))),
+		})
+	}
+
+	add := func(deterministic, reverse bool) (cid.Cid, []string) {
+		p := api.DefaultAddParams()
+		p.Deterministic = deterministic
+		out := make(chan *api.AddedOutput, 100)
+		adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, out)
+		root, err := adder.FromFiles(context.Background(), makeTree(reverse))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for ao := range out {
+			names = append(names, ao.Name)
+		}
+		return root, names
+	}
+
+	for _, deterministic := range []bool{false, true} {
+		root1, names1 := add(deterministic, false)
+		root2, names2 := add(deterministic, true)
+		if !root1.Equals(root2) {
+			t.Errorf("deterministic=%t: roots should not depend on the order", deterministic)
+		}
+		sameOutput := strings.Join(names1, ",") == strings.Join(names2, ",")
+		if sameOutput != deterministic {
+			t.Errorf("deterministic=%t: unexpected output order: %s and %s", deterministic, names1, names2)
+		}
+	}
+}
+
+// checkerCDAGServ reports having every block.
+type checkerCDAGServ struct {
+	*mockCDAGServ
+}
+
+func (dag checkerCDAGServ) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return true, nil
+}
+
+func TestAdder_ResultStats(t *testing.T) {
+	makeDir := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("same"))),
+			files.FileEntry("b", files.NewBytesFile([]byte("same"))),
+			files.FileEntry("c", files.NewBytesFile([]byte("other"))),
+		})
+	}
+
+	p := api.DefaultAddParams()
+	p.Wrap = true
+	adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+	_, err := adder.FromFiles(context.Background(), makeDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := adder.Result()
+	if res.Files != 3 {
+		t.Errorf("expected 3 files, got %d", res.Files)
+	}
+	if res.Blocks != len(res.Cids) {
+		t.Errorf("expected %d blocks, got %d", len(res.Cids), res.Blocks)
+	}
+	// "same" is added twice.
+	if res.DedupedBytes == 0 || res.DedupedBytes >= res.Bytes {
+		t.Errorf("unexpected deduplicated bytes: %d of %d", res.DedupedBytes, res.Bytes)
+	}
+	if res.Duration <= 0 {
+		t.Error("expected a duration")
+	}
+
+	adder = New(checkerCDAGServ{&mockCDAGServ{resultCids: make(map[string]struct{})}}, p, nil)
+	_, err = adder.FromFiles(context.Background(), makeDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2 := adder.Result()
+	if res2.Bytes != res.Bytes || res2.DedupedBytes != res2.Bytes {
+		t.Errorf("all blocks should be deduplicated: %d of %d", res2.DedupedBytes, res2.Bytes)
+	}
+}
+
+// countingDAGServ records the blocks stored in a MemoryDAGService.
+type countingDAGServ struct {
+	*MemoryDAGService
+	stored *cid.Set
+}
+
+func (dag *countingDAGServ) Add(ctx context.Context, node ipld.Node) error {
+	dag.stored.Add(node.Cid())
+	return dag.MemoryDAGService.Add(ctx, node)
+}
+
+func (dag *countingDAGServ) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	for _, node := range nodes {
+		dag.stored.Add(node.Cid())
+	}
+	return dag.MemoryDAGService.AddMany(ctx, nodes)
+}
+
+func TestAdder_SkipExistingBlocks(t *testing.T) {
+	random := func(seed int64) []byte {
+		data := make([]byte, 10000)
+		rand.New(rand.NewSource(seed)).Read(data)
+		return data
+	}
+	a, b := random(1), random(2)
+	p := api.DefaultAddParams()
+	p.Chunker = "size-1000"
+
+	dags := &countingDAGServ{MemoryDAGService: NewMemoryDAGService(), stored: cid.NewSet()}
+	// pre-populate with the blocks of a, about half of them.
+	adder := New(dags, p, nil)
+	_, err := adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("a", files.NewBytesFile(a)),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := dags.stored
+	dags.stored = cid.NewSet()
+
+	adder = New(dags, p, nil)
+	root, err := adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile(a)),
+			files.FileEntry("b", files.NewBytesFile(b)),
+		})),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := adder.Result()
+	deduped := 0
+	for _, c := range res.Cids {
+		if !existing.Has(c) {
+			continue
+		}
+		deduped++
+		if dags.stored.Has(c) {
+			t.Errorf("block %s should not have been stored again", c)
+		}
+	}
+	if deduped < 10 || res.DedupedBlocks != deduped {
+		t.Errorf("expected %d deduplicated blocks, got %d", deduped, res.DedupedBlocks)
+	}
+	if dags.stored.Len() != res.Blocks-deduped {
+		t.Errorf("expected %d blocks to be stored, got %d", res.Blocks-deduped, dags.stored.Len())
+	}
+	if _, err := dags.Get(context.Background(), root); err != nil {
+		t.Error("the root should be stored:", err)
+	}
+}
+
+// finalizeCDAGServ records whether Finalize was called.
+type finalizeCDAGServ struct {
+	*mockCDAGServ
+	finalized bool
+}
+
+func (dag *finalizeCDAGServ) Finalize(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	dag.finalized = true
+	return root, nil
+}
+
+func TestAdder_BuildCommit(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	dags := &finalizeCDAGServ{
+		mockCDAGServ: &mockCDAGServ{resultCids: make(map[string]struct{})},
+	}
+	out := make(chan *api.AddedOutput, 100)
+	adder := New(dags, api.DefaultAddParams(), out)
+
+	_, err := adder.Commit(context.Background())
+	if err != ErrNotBuilt {
+		t.Fatal("expected ErrNotBuilt, got", err)
+	}
+
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+	})
+	root, err := adder.Build(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.String() != test.ShardingDirBalancedRootCID {
+		t.Error("expected the right content root")
+	}
+	if dags.finalized {
+		t.Error("Build should not finalize")
+	}
+
+	clusterRoot, err := adder.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dags.finalized || !clusterRoot.Equals(root) {
+		t.Error("Commit should finalize the built root")
+	}
+	if adder.Result() == nil {
+		t.Error("expected a result")
+	}
+	for range out { // closed by Commit
+	}
+
+	_, err = adder.Commit(context.Background())
+	if err != ErrAdderConsumed {
+		t.Error("expected ErrAdderConsumed, got", err)
+	}
+}
+
+func TestAdder_WrapName(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Wrap = true
+	p.WrapName = "mydir"
+
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+		nodes:      make(map[string]ipld.Node),
+	}
+	out := make(chan *api.AddedOutput, 100)
+	adder := New(dags, p, out)
+	root, err := adder.FromReader(context.Background(), strings.NewReader("hello"), "myfile.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]cid.Cid)
+	for ao := range out {
+		names[ao.Name] = ao.Cid
+	}
+	if c, ok := names["mydir"]; !ok || !c.Equals(root) {
+		t.Error("the root should be output with the wrap name")
+	}
+	fileCid, ok := names["mydir/myfile.txt"]
+	if !ok {
+		t.Fatal("the file should be output under the wrap name")
+	}
+
+	// <root>/myfile.txt resolves to the file.
+	rootNode, ok := dags.nodes[root.String()]
+	if !ok {
+		t.Fatal("the root should have been added")
+	}
+	lnk, _, err := rootNode.ResolveLink([]string{"myfile.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lnk.Cid.Equals(fileCid) {
+		t.Error("myfile.txt should resolve to the added file")
+	}
+
+	p.WrapName = "a/b"
+	_, err = New(dags, p, nil).FromReader(context.Background(), strings.NewReader("hello"), "myfile.txt")
+	if err == nil {
+		t.Error("expected an error for a wrap name with '/'")
+	}
+}
+
+func TestAdder_RawLeavesCidV0(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.RawLeaves = true
+	p.Chunker = "size-4"
+
+	dags := NewMemoryDAGService()
+	root, err := New(dags, p, nil).FromReader(context.Background(), strings.NewReader("hello world\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Version() != 1 {
+		t.Error("CIDv0 should have been upgraded with raw leaves, got", root)
+	}
+
+	nd, err := dags.Get(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range nd.Links() {
+		if l.Cid.Version() != 1 || l.Cid.Type() != cid.Raw {
+			t.Error("expected CIDv1 raw leaves, got", l.Cid)
+		}
+	}
+}
+
+func TestAdder_Inline(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Inline = true
+	p.CidVersion = 1
+	p.RawLeaves = true
+
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	out := make(chan *api.AddedOutput, 100)
+	adder := New(dags, p, out)
+	root, err := adder.FromReader(context.Background(), strings.NewReader("tiny"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data can be read back from the CID.
+	dmh, err := multihash.Decode(root.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dmh.Code != multihash.IDENTITY || string(dmh.Digest) != "tiny" {
+		t.Fatalf("expected the data inlined in the CID: %s", root)
+	}
+	if _, ok := dags.resultCids[root.String()]; ok {
+		t.Error("inlined blocks should not be stored")
+	}
+	inline := false
+	for ao := range out {
+		inline = inline || (ao.Cid.Equals(root) && ao.Inline)
+	}
+	if !inline {
+		t.Error("the output should tell that the root is inlined")
+	}
+
+	// larger blocks are not inlined.
+	adder = New(dags, p, nil)
+	root, err = adder.FromReader(context.Background(), strings.NewReader(strings.Repeat("a", 100)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Prefix().MhType == multihash.IDENTITY {
+		t.Error("larger blocks should not be inlined")
+	}
+
+	// CIDv0 would be upgraded with raw leaves.
+	p.CidVersion = 0
+	p.RawLeaves = false
+	_, err = New(dags, p, nil).FromReader(context.Background(), strings.NewReader("tiny"), "")
+	if err == nil {
+		t.Error("expected an error using inline with CIDv0")
+	}
+}
+
+// slowCDAGServ stalls when adding blocks containing "stall" until the
+// context is done.
+type slowCDAGServ struct {
+	*mockCDAGServ
+}
+
+func (dag slowCDAGServ) Add(ctx context.Context, node ipld.Node) error {
+	if strings.Contains(string(node.RawData()), "stall") {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return dag.mockCDAGServ.Add(ctx, node)
+}
+
+func TestAdder_BlockTimeout(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.BlockTimeout = 50 * time.Millisecond
+
+	dags := slowCDAGServ{&mockCDAGServ{resultCids: make(map[string]struct{})}}
+	_, err := New(dags, p, nil).FromReader(context.Background(), strings.NewReader("stall"), "")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatal("expected a timeout error, got", err)
+	}
+
+	p.SkipFailedFiles = true
+	dir := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("d", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("bad", files.NewBytesFile([]byte("stall"))),
+			files.FileEntry("ok", files.NewBytesFile([]byte("ok"))),
+		})),
+	})
+	adder := New(dags, p, nil)
+	_, err = adder.FromFiles(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adder.Result().SkippedFiles != 1 {
+		t.Error("the stalled file should have been skipped")
+	}
+}
+
+// stallingDAGServ is a MemoryDAGService which stalls when adding blocks
+// containing "stall" until the context is done.
+type stallingDAGServ struct {
+	*MemoryDAGService
+}
+
+func (dag stallingDAGServ) Add(ctx context.Context, node ipld.Node) error {
+	if strings.Contains(string(node.RawData()), "stall") {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return dag.MemoryDAGService.Add(ctx, node)
+}
+
+func TestAdder_MaxDuration(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.MaxDuration = 100 * time.Millisecond
+	p.Deterministic = true
+
+	dags := stallingDAGServ{NewMemoryDAGService()}
+	start := time.Now()
+	_, err := New(dags, p, nil).FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("d", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("ok"))),
+			files.FileEntry("b", files.NewBytesFile([]byte("stall"))),
+		})),
+	}))
+	if !errors.Is(err, ErrMaxDuration) {
+		t.Fatal("expected ErrMaxDuration, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the add should have been aborted, it took %s", elapsed)
+	}
+	if dags.Len() != 0 {
+		t.Errorf("the %d blocks added should have been cleaned up", dags.Len())
+	}
+
+	// fast adds are not affected.
+	_, err = New(stallingDAGServ{NewMemoryDAGService()}, p, nil).FromReader(context.Background(), strings.NewReader("ok"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// flakyCDAGServ fails the first attempts to add every block.
+type flakyCDAGServ struct {
+	*mockCDAGServ
+	failures int
+	attempts map[string]int
+}
+
+func (dag *flakyCDAGServ) Add(ctx context.Context, node ipld.Node) error {
+	dag.attempts[node.Cid().String()]++
+	if dag.attempts[node.Cid().String()] <= dag.failures {
+		return errors.New("transient error")
+	}
+	return dag.mockCDAGServ.Add(ctx, node)
+}
+
+func TestAdder_PutRetries(t *testing.T) {
+	newFlaky := func() *flakyCDAGServ {
+		return &flakyCDAGServ{
+			mockCDAGServ: &mockCDAGServ{resultCids: make(map[string]struct{})},
+			failures:     2,
+			attempts:     make(map[string]int),
+		}
+	}
+	makeDir := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("d", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+				files.FileEntry("b", files.NewBytesFile([]byte("b"))),
+			})),
+		})
+	}
+
+	p := api.DefaultAddParams()
+	p.PutBackoff = time.Millisecond
+
+	p.PutRetries = 1
+	_, err := New(newFlaky(), p, nil).FromFiles(context.Background(), makeDir())
+	if err == nil {
+		t.Error("expected an error with too few retries")
+	}
+
+	p.PutRetries = 2
+	dags := newFlaky()
+	adder := New(dags, p, nil)
+	_, err = adder.FromFiles(context.Background(), makeDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dags.resultCids) != len(adder.Result().Cids) {
+		t.Error("all blocks should have been added")
+	}
+
+	// cancelling does not wait for the backoff.
+	p.PutBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = New(newFlaky(), p, nil).FromFiles(ctx, makeDir())
+	if err == nil {
+		t.Error("expected an error when cancelled")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("cancelling should abort the retries")
+	}
+}
+
+func TestAdder_CidBase(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.CidVersion = 1
+	p.CidBase = "base58btc"
+
+	out := make(chan *api.AddedOutput, 100)
+	adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, out)
+	root, err := adder.FromReader(context.Background(), strings.NewReader("hello"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for ao := range out {
+		names = append(names, ao.Name)
+	}
+	if len(names) == 0 || names[len(names)-1] != root.Encode(multibase.MustNewEncoder(multibase.Base58BTC)) {
+		t.Error("the root should be named with its base58btc CID, got", names)
+	}
+	b58 := root.Encode(multibase.MustNewEncoder(multibase.Base58BTC))
+	if _, ok := adder.Result().Manifest[b58]; !ok {
+		t.Error("the manifest should name the root with its base58btc CID, got", adder.Result().Manifest)
+	}
+
+	adder = New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+	_, err = adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+		files.FileEntry("b", files.NewBytesFile([]byte("hello"))),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := adder.Result().Duplicates[b58]; !ok {
+		t.Error("the duplicates should be keyed by base58btc CIDs, got", adder.Result().Duplicates)
+	}
+
+	p.CidBase = "nope"
+	_, err = New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil).FromReader(context.Background(), strings.NewReader("hello"), "")
+	if err == nil {
+		t.Error("expected an error for an unknown base")
+	}
+}
+
+func TestAdder_MaxRate(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.MaxRate = 200 * 1024
+	data := strings.Repeat("a", 100*1024)
+
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	start := time.Now()
+	_, err := New(dags, p, nil).FromReader(context.Background(), strings.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a tenth of a second worth of bytes can be read right away.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("adding should have been throttled, took", elapsed)
+	}
+
+	// throttled adds abort promptly.
+	p.MaxRate = 1024
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = New(dags, p, nil).FromReader(ctx, strings.NewReader(data), "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Error("cancelling should abort the throttled add, took", elapsed)
+	}
+}
+
+// endlessReader returns data forever and counts the bytes read.
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r.read + i)
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestAdder_MaxTotalSize(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.MaxTotalSize = 1024 * 1024
+
+	dags := NewMemoryDAGService()
+	src := &endlessReader{}
+	_, err := New(dags, p, nil).FromReader(context.Background(), src, "")
+	if err != ErrAddTooLarge {
+		t.Fatal("expected ErrAddTooLarge, got:", err)
+	}
+	if src.read > 2*1024*1024 {
+		t.Error("adding should have been aborted early, read", src.read)
+	}
+	if dags.Len() != 0 {
+		t.Errorf("the blocks added should have been cleaned up, %d left", dags.Len())
+	}
+
+	// skipping failed files does not skip the limit.
+	p.SkipFailedFiles = true
+	tree := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile(make([]byte, 768*1024))),
+				files.FileEntry("b", files.NewBytesFile(make([]byte, 768*1024))),
+			})),
+		})
+	}
+	_, err = New(dags, p, nil).FromFiles(context.Background(), tree())
+	if err != ErrAddTooLarge {
+		t.Fatal("expected ErrAddTooLarge, got:", err)
+	}
+
+	p.MaxTotalSize = 2 * 768 * 1024
+	_, err = New(dags, p, nil).FromFiles(context.Background(), tree())
+	if err != nil {
+		t.Fatal("content within the limit should be added:", err)
+	}
+}
+
+func TestAdder_MaxFileSize(t *testing.T) {
+	tree := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile(make([]byte, 1000))),
+				files.FileEntry("big", files.NewReaderFile(&endlessReader{})),
+				files.FileEntry("c", files.NewBytesFile(make([]byte, 1000))),
+				files.FileEntry("d", files.NewBytesFile(make([]byte, 1000))),
+			})),
+		})
+	}
+
+	p := api.DefaultAddParams()
+	p.MaxFileSize = 1000
+	p.Chunker = "size-100"
+
+	_, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), tree())
+	if err == nil || !strings.Contains(err.Error(), "dir/big") {
+		t.Fatal("expected an error naming the large file, got:", err)
+	}
+
+	// files of known size fail right away.
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("large", files.NewBytesFile(make([]byte, 1001))),
+	})
+	_, err = New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), f)
+	if err == nil || !strings.Contains(err.Error(), "large") {
+		t.Fatal("expected an error naming the large file, got:", err)
+	}
+
+	p.SkipFailedFiles = true
+	adder := New(NewMemoryDAGService(), p, nil)
+	_, err = adder.FromFiles(context.Background(), tree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the limit applies to every file.
+	if res := adder.Result(); res.SkippedFiles != 1 || res.Files != 3 {
+		t.Errorf("expected 3 files and 1 skipped, got %d and %d", res.Files, res.SkippedFiles)
+	}
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (sr *spanRecorder) ExportSpan(sd *trace.SpanData) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.spans = append(sr.spans, sd)
+}
+
+func TestAdder_Tracing(t *testing.T) {
+	sr := &spanRecorder{}
+	trace.RegisterExporter(sr)
+	defer trace.UnregisterExporter(sr)
+
+	ctx, span := trace.StartSpan(context.Background(), "request", trace.WithSampler(trace.AlwaysSample()))
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+			files.FileEntry("b", files.NewBytesFile([]byte("world"))),
+		})),
+	})
+	root, err := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, api.DefaultAddParams(), nil).FromFiles(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	counts := make(map[string]int)
+	for _, sd := range sr.spans {
+		if sd.TraceID != span.SpanContext().TraceID {
+			t.Errorf("%s should be part of the request trace", sd.Name)
+		}
+		counts[sd.Name]++
+		switch sd.Name {
+		case "adder/FromFiles":
+			if sd.ParentSpanID != span.SpanContext().SpanID {
+				t.Error("adder/FromFiles should nest under the request span")
+			}
+			if sd.Attributes["cid"] != root.String() || sd.Attributes["files"] != int64(2) {
+				t.Error("bad attributes:", sd.Attributes)
+			}
+		case "adder/addFile":
+			if name := sd.Attributes["name"]; name != "dir/a" && name != "dir/b" {
+				t.Error("bad file name:", name)
+			}
+		}
+	}
+	for name, n := range map[string]int{"adder/FromFiles": 1, "adder/build": 1, "adder/Finalize": 1, "adder/addFile": 2} {
+		if counts[name] != n {
+			t.Errorf("expected %d %s spans, got %d", n, name, counts[name])
+		}
+	}
+}
+
+type fakeAddMetrics struct {
+	mu       sync.Mutex
+	started  int
+	finished int
+	failed   int
+	blocks   int
+	bytes    uint64
+}
+
+func (m *fakeAddMetrics) AddStarted(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started++
+}
+
+func (m *fakeAddMetrics) AddFinished(ctx context.Context, blocks int, bytes uint64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished++
+	if err != nil {
+		m.failed++
+	}
+	m.blocks += blocks
+	m.bytes += bytes
+}
+
+func TestAdder_Metrics(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	m := &fakeAddMetrics{}
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+	})
+	adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, api.DefaultAddParams(), nil)
+	adder.SetMetrics(m)
+	_, err := adder.FromFiles(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.started != 1 || m.finished != 1 || m.failed != 0 {
+		t.Errorf("unexpected calls: %+v", m)
+	}
+	if m.blocks != len(test.ShardingDirCids) || m.bytes != adder.Result().Bytes {
+		t.Errorf("unexpected totals: %d blocks, %d bytes", m.blocks, m.bytes)
+	}
+
+	adder = New(brokenCDAGServ{&mockCDAGServ{resultCids: make(map[string]struct{})}}, api.DefaultAddParams(), nil)
+	adder.SetMetrics(m)
+	_, err = adder.FromReader(context.Background(), strings.NewReader("hello"), "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if m.started != 2 || m.finished != 2 || m.failed != 1 {
+		t.Errorf("unexpected calls: %+v", m)
+	}
+
+	// consumed adders do not start adding again.
+	_, err = adder.FromReader(context.Background(), strings.NewReader("hello"), "")
+	if err != ErrAdderConsumed || m.started != 2 {
+		t.Error("consumed adders should not record adds")
+	}
+}
+
+func TestAdder_OnBlock(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+	tree := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+		})
+	}
+
+	seen := make(map[string]struct{})
+	adder := New(NewMemoryDAGService(), api.DefaultAddParams(), nil)
+	adder.SetOnBlock(func(out *api.AddedOutput) error {
+		if out.Size == 0 {
+			t.Error("expected the block size")
+		}
+		seen[out.Cid.String()] = struct{}{}
+		return nil
+	})
+	_, err := adder.FromFiles(context.Background(), tree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(test.ShardingDirCids) {
+		t.Errorf("expected %d blocks, saw %d", len(test.ShardingDirCids), len(seen))
+	}
+	for _, c := range test.ShardingDirCids {
+		if _, ok := seen[c]; !ok {
+			t.Error("block not seen:", c)
+		}
+	}
+
+	// errors abort the add, even when skipping failed files.
+	errIndex := errors.New("index unavailable")
+	p := api.DefaultAddParams()
+	p.SkipFailedFiles = true
+	dags := NewMemoryDAGService()
+	adder = New(dags, p, nil)
+	n := 0
+	adder.SetOnBlock(func(out *api.AddedOutput) error {
+		n++
+		if n == 5 {
+			return errIndex
+		}
+		return nil
+	})
+	_, err = adder.FromFiles(context.Background(), tree())
+	if !errors.Is(err, errIndex) {
+		t.Fatal("expected the callback error, got:", err)
+	}
+	if n != 5 {
+		t.Errorf("adding should have stopped after the error, %d blocks seen", n)
+	}
+	if dags.Len() != 0 {
+		t.Errorf("the blocks added should have been cleaned up, %d left", dags.Len())
+	}
+}
+
+func TestAdder_MaxLinks(t *testing.T) {
+	add := func(maxLinks int) cid.Cid {
+		p := api.DefaultAddParams()
+		p.Chunker = "size-256"
+		p.MaxLinks = maxLinks
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("file", files.NewBytesFile([]byte(strings.Repeat("0123456789", 1000)))),
+		})
+		root, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+
+	tcs := []struct {
+		maxLinks int
+		root     string
+	}{
+		// the default fanout does not change the CIDs.
+		{0, "QmNYSJTHY7c6HWPM9PzgpGJQDNo6ivFBgqyGMfofwBhosM"},
+		{174, "QmNYSJTHY7c6HWPM9PzgpGJQDNo6ivFBgqyGMfofwBhosM"},
+		{4, "QmckwtRV7aUFEkzrquL6jqcm3391DUF4KcMzpp55EaLs2x"},
+	}
+	for _, tc := range tcs {
+		for i := 0; i < 2; i++ {
+			if root := add(tc.maxLinks); root.String() != tc.root {
+				t.Errorf("max links %d: expected %s, got %s", tc.maxLinks, tc.root, root)
+			}
+		}
+	}
+}
+
+func TestAdder_AutoLayout(t *testing.T) {
+	small := []byte(strings.Repeat("0123456789", 100))
+	large := []byte(strings.Repeat("0123456789", 2000))
+	params := func(layout string) *api.AddParams {
+		p := api.DefaultAddParams()
+		p.Chunker = "size-256"
+		p.MaxLinks = 4
+		p.Layout = layout
+		p.TrickleThreshold = 10000
+		return p
+	}
+	addFile := func(layout string, data []byte) cid.Cid {
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("file", files.NewBytesFile(data)),
+		})
+		root, err := New(NewMemoryDAGService(), params(layout), nil).FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+
+	if addFile("balanced", large).Equals(addFile("trickle", large)) {
+		t.Fatal("the layouts should result in different CIDs")
+	}
+
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("large", files.NewBytesFile(large)),
+			files.FileEntry("small", files.NewBytesFile(small)),
+			// the size of streams is unknown.
+			files.FileEntry("stream", files.NewReaderFile(bytes.NewReader(large))),
+		})),
+	})
+	out := make(chan *api.AddedOutput, 10)
+	_, err := New(NewMemoryDAGService(), params("auto"), out).FromFiles(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]cid.Cid)
+	for ao := range out {
+		got[ao.Name] = ao.Cid
+	}
+
+	expected := map[string]cid.Cid{
+		"dir/large":  addFile("trickle", large),
+		"dir/small":  addFile("balanced", small),
+		"dir/stream": addFile("balanced", large),
+	}
+	for name, c := range expected {
+		if !got[name].Equals(c) {
+			t.Errorf("%s: expected %s, got %s", name, c, got[name])
+		}
+	}
+}
+
+// resizedFile reports a size other than its actual size.
+type resizedFile struct {
+	files.File
+	size int64
+}
+
+func (f resizedFile) Size() (int64, error) {
+	return f.size, nil
+}
+
+func TestAdder_Warnings(t *testing.T) {
+	add := func(p *api.AddParams, entries ...files.DirEntry) []*api.AddWarning {
+		warnings := make(chan *api.AddWarning, 10)
+		adder := New(NewMemoryDAGService(), p, nil)
+		adder.SetWarnings(warnings)
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory(entries)),
+		})
+		if _, err := adder.FromFiles(context.Background(), f); err != nil {
+			t.Fatal(err)
+		}
+		close(warnings)
+		var ws []*api.AddWarning
+		for w := range warnings {
+			ws = append(ws, w)
+		}
+		return ws
+	}
+
+	p := api.DefaultAddParams()
+	p.Symlinks = "skip"
+	ws := add(p,
+		files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+		files.FileEntry("link", files.NewLinkFile("a", nil)),
+	)
+	if len(ws) != 1 {
+		t.Fatalf("expected 1 warning, got %d", len(ws))
+	}
+	if ws[0].Name != "dir/link" || ws[0].Code != api.WarnSymlinkSkipped {
+		t.Errorf("unexpected warning: %+v", ws[0])
+	}
+
+	p = api.DefaultAddParams()
+	ws = add(p,
+		files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+		files.FileEntry("growing", resizedFile{files.NewBytesFile([]byte("more bytes")), 5}),
+	)
+	if len(ws) != 1 || ws[0].Name != "dir/growing" || ws[0].Code != api.WarnSizeChanged {
+		t.Errorf("expected a size warning, got %+v", ws)
+	}
+
+	// no warnings when nothing is wrong, and nothing blocks without a
+	// channel.
+	ws = add(p, files.FileEntry("a", files.NewBytesFile([]byte("a"))))
+	if len(ws) != 0 {
+		t.Errorf("expected no warnings, got %+v", ws)
+	}
+	p.Symlinks = "skip"
+	_, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("link", files.NewLinkFile("a", nil)),
+		})),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdder_RelativeNames(t *testing.T) {
+	add := func(p *api.AddParams) map[string]struct{} {
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a.txt", files.NewBytesFile([]byte("a"))),
+				files.FileEntry("sub", files.NewSliceDirectory([]files.DirEntry{
+					files.FileEntry("deep", files.NewSliceDirectory([]files.DirEntry{
+						files.FileEntry("file.txt", files.NewBytesFile(make([]byte, 1024*1024))),
+					})),
+				})),
+			})),
+		})
+		out := make(chan *api.AddedOutput, 1024)
+		_, err := New(NewMemoryDAGService(), p, out).FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]struct{})
+		for ao := range out {
+			if ao.Type == api.AddedPlan {
+				continue
+			}
+			names[ao.Name] = struct{}{}
+		}
+		return names
+	}
+
+	check := func(names map[string]struct{}, expected ...string) {
+		t.Helper()
+		if len(names) != len(expected) {
+			t.Errorf("expected %d names, got %v", len(expected), names)
+		}
+		for _, name := range expected {
+			if _, ok := names[name]; !ok {
+				t.Errorf("%s was not output: %v", name, names)
+			}
+		}
+	}
+
+	// progress updates carry the same names as the added entries.
+	p := api.DefaultAddParams()
+	p.Progress = true
+	check(add(p),
+		"dir", "dir/a.txt", "dir/sub", "dir/sub/deep", "dir/sub/deep/file.txt",
+	)
+
+	p.Wrap = true
+	p.WrapName = "wrap"
+	check(add(p),
+		"wrap", "wrap/dir", "wrap/dir/a.txt", "wrap/dir/sub", "wrap/dir/sub/deep", "wrap/dir/sub/deep/file.txt",
+	)
+}
+
+func TestAdder_Plan(t *testing.T) {
+	// add returns the output and the number of leaves which were added.
+	add := func(p *api.AddParams, f files.Directory) ([]*api.AddedOutput, int64) {
+		out := make(chan *api.AddedOutput, 1024)
+		dags := NewMemoryDAGService()
+		_, err := New(dags, p, out).FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []*api.AddedOutput
+		for ao := range out {
+			events = append(events, ao)
+		}
+		var leaves int64
+		for _, nd := range dags.blocks {
+			if len(nd.Links()) == 0 {
+				leaves++
+			}
+		}
+		return events, leaves
+	}
+
+	data := make([]byte, 10*1024*1024+1)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, chunker := range []string{"", "size-65536", "rabin-16384-65536-131072", "buzhash", "buzhash-14"} {
+		p := api.DefaultAddParams()
+		p.Progress = true
+		p.Chunker = chunker
+		events, leaves := add(p, files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("file", files.NewBytesFile(data)),
+		}))
+
+		plan := events[0]
+		if plan.Type != api.AddedPlan || plan.Bytes != uint64(len(data)) {
+			t.Fatalf("%s: expected a plan first, got %+v", chunker, plan)
+		}
+		for _, ao := range events[1:] {
+			if ao.Type == api.AddedPlan {
+				t.Errorf("%s: only one plan should be sent", chunker)
+			}
+		}
+
+		// within 10% of the number of leaves.
+		diff := plan.ExpectedBlocks - leaves
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff*10 > leaves {
+			t.Errorf("%s: estimated %d blocks, added %d leaves", chunker, plan.ExpectedBlocks, leaves)
+		}
+		if strings.HasPrefix(chunker, "size") && plan.ExpectedBlocks != leaves {
+			t.Errorf("%s: the estimate should be exact, got %d for %d leaves", chunker, plan.ExpectedBlocks, leaves)
+		}
+	}
+
+	// no plan when the size is unknown or without progress.
+	p := api.DefaultAddParams()
+	p.Progress = true
+	events, _ := add(p, files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("stream", files.NewReaderFile(bytes.NewReader(data))),
+	}))
+	events2, _ := add(api.DefaultAddParams(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("file", files.NewBytesFile(data)),
+	}))
+	for _, ao := range append(events, events2...) {
+		if ao.Type == api.AddedPlan {
+			t.Error("unexpected plan:", ao)
+		}
+	}
+}
+
+// slowFile is read at a steady rate of 20MB/s.
+type slowFile struct {
+	files.File
+}
+
+func (f slowFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	time.Sleep(time.Duration(n) * 50 * time.Nanosecond)
+	return n, err
+}
+
+func TestAdder_ProgressETA(t *testing.T) {
+	progress := func(f files.Node) []*api.AddedOutput {
+		p := api.DefaultAddParams()
+		p.Progress = true
+		out := make(chan *api.AddedOutput, 1024)
+		_, err := New(NewMemoryDAGService(), p, out).FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("file", f),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var updates []*api.AddedOutput
+		for ao := range out {
+			if ao.Type == "" && ao.Bytes > 0 {
+				updates = append(updates, ao)
+			}
+		}
+		return updates
+	}
+
+	// 16 progress updates over 200ms.
+	data := make([]byte, 4*1024*1024)
+	updates := progress(slowFile{files.NewBytesFile(data)})
+	if len(updates) < 8 {
+		t.Fatalf("expected progress updates, got %d", len(updates))
+	}
+	for _, ao := range updates {
+		if ao.ETA < 0 {
+			t.Fatalf("expected an ETA with a known size, got %s", ao.ETA)
+		}
+	}
+	first, second := updates[len(updates)/4].ETA, updates[3*len(updates)/4].ETA
+	if second >= first {
+		t.Errorf("the ETA should go down: %s and then %s", first, second)
+	}
+	if first > time.Second {
+		t.Errorf("the ETA is way off: %s", first)
+	}
+	if last := updates[len(updates)-1]; last.ETA != 0 {
+		t.Errorf("expected no time left at the end, got %s", last.ETA)
+	}
+
+	for _, ao := range progress(files.NewReaderFile(bytes.NewReader(data))) {
+		if ao.ETA != -1 {
+			t.Fatalf("expected no ETA with an unknown size, got %s", ao.ETA)
+		}
+	}
+}
+
+func TestAdder_RawLeavesAuto(t *testing.T) {
+	binary := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(binary)
+	text := bytes.Repeat([]byte("some text to add\n"), 20000)
+
+	p := api.DefaultAddParams()
+	p.RawLeavesAuto = true
+	dags := NewMemoryDAGService()
+	out := make(chan *api.AddedOutput, 100)
+	_, err := New(dags, p, out).FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("binary", files.NewBytesFile(binary)),
+			files.FileEntry("text", files.NewBytesFile(text)),
+			files.FileEntry("small", files.NewBytesFile(binary[:100])),
+		})),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leafCodec returns the codec of the first leaf of a file.
+	leafCodec := func(c cid.Cid) uint64 {
+		for {
+			nd, err := dags.Get(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nd.Links()) == 0 {
+				return c.Type()
+			}
+			c = nd.Links()[0].Cid
+		}
+	}
+
+	names := make(map[string]cid.Cid)
+	for ao := range out {
+		names[ao.Name] = ao.Cid
+	}
+	if codec := leafCodec(names["dir/binary"]); codec != cid.Raw {
+		t.Errorf("binary content should use raw leaves, got %s", cid.CodecToStr[codec])
+	}
+	if codec := leafCodec(names["dir/small"]); codec != cid.Raw {
+		t.Errorf("small binary files should be raw blocks, got %s", cid.CodecToStr[codec])
+	}
+	if codec := leafCodec(names["dir/text"]); codec != cid.DagProtobuf {
+		t.Errorf("text content should use UnixFS leaves, got %s", cid.CodecToStr[codec])
+	}
+	if names["dir/text"].Version() != 1 {
+		t.Error("expected CIDv1")
+	}
+}
+
+func TestAdder_DetectMIME(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 1000)...)
+	text := bytes.Repeat([]byte("some text to add\n"), 100)
+	newDir := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("image.png", files.NewBytesFile(png)),
+				files.FileEntry("text", files.NewBytesFile(text)),
+			})),
+		})
+	}
+
+	p := api.DefaultAddParams()
+	p.DetectMIME = true
+	out := make(chan *api.AddedOutput, 100)
+	root, err := New(NewMemoryDAGService(), p, out).FromFiles(context.Background(), newDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]string)
+	for ao := range out {
+		types[ao.Name] = ao.ContentType
+	}
+	if types["dir/image.png"] != "image/png" {
+		t.Errorf("expected image/png, got %q", types["dir/image.png"])
+	}
+	if types["dir/text"] != "text/plain; charset=utf-8" {
+		t.Errorf("expected plain text, got %q", types["dir/text"])
+	}
+	if types["dir"] != "" {
+		t.Error("directories have no content type")
+	}
+
+	// The sniffed bytes are still added.
+	otherRoot, err := New(NewMemoryDAGService(), api.DefaultAddParams(), nil).FromFiles(context.Background(), newDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(otherRoot) {
+		t.Error("detecting MIME types should not change the CIDs")
+	}
+}
+
+func TestAdder_EmptyFiles(t *testing.T) {
+	for _, rawLeaves := range []bool{false, true} {
+		p := api.DefaultAddParams()
+		p.Progress = true
+		p.RawLeaves = rawLeaves
+		emptyCid := "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"
+		if rawLeaves {
+			emptyCid = "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+		}
+
+		dags := NewMemoryDAGService()
+		out := make(chan *api.AddedOutput, 1024)
+		_, err := New(dags, p, out).FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("empty", files.NewBytesFile(nil)),
+				files.FileEntry("full", files.NewBytesFile([]byte("hello"))),
+			})),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		added := make(map[string]*api.AddedOutput)
+		progress := make(map[string]bool)
+		for ao := range out {
+			switch ao.Type {
+			case "":
+				progress[ao.Name] = true
+			case api.AddedFile, api.AddedDirectory:
+				added[ao.Name] = ao
+			}
+		}
+		if !progress["dir/empty"] || !progress["dir/full"] {
+			t.Errorf("raw-leaves=%t: expected progress for both files, got %v", rawLeaves, progress)
+		}
+
+		empty, full := added["dir/empty"], added["dir/full"]
+		if empty == nil || full == nil || added["dir"] == nil {
+			t.Fatalf("raw-leaves=%t: expected output for all entries, got %v", rawLeaves, added)
+		}
+		if empty.Cid.String() != emptyCid {
+			t.Errorf("raw-leaves=%t: expected %s for the empty file, got %s", rawLeaves, emptyCid, empty.Cid)
+		}
+
+		// fileSize returns the size of the content of a single-block file.
+		fileSize := func(c cid.Cid) uint64 {
+			nd, err := dags.Get(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Type() == cid.Raw {
+				return uint64(len(nd.RawData()))
+			}
+			fsn, err := unixfs.ExtractFSNode(nd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fsn.FileSize()
+		}
+		if size := fileSize(empty.Cid); size != 0 {
+			t.Errorf("raw-leaves=%t: the empty file has size %d", rawLeaves, size)
+		}
+		if size := fileSize(full.Cid); size != 5 {
+			t.Errorf("raw-leaves=%t: expected size 5, got %d", rawLeaves, size)
+		}
+
+		dir, err := dags.Get(context.Background(), added["dir"].Cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		links := make(map[string]cid.Cid)
+		for _, l := range dir.Links() {
+			links[l.Name] = l.Cid
+		}
+		if !links["empty"].Equals(empty.Cid) || !links["full"].Equals(full.Cid) {
+			t.Errorf("raw-leaves=%t: the directory should link both files, got %v", rawLeaves, links)
+		}
+	}
+}
+
+func TestAdder_DuplicateFiles(t *testing.T) {
+	for _, concurrency := range []int{0, 4} {
+		p := api.DefaultAddParams()
+		p.Concurrency = concurrency
+		adder := New(NewMemoryDAGService(), p, nil)
+		_, err := adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile([]byte("same"))),
+				files.FileEntry("b", files.NewBytesFile([]byte("same"))),
+				files.FileEntry("c", files.NewBytesFile([]byte("other"))),
+				files.FileEntry("sub", files.NewSliceDirectory([]files.DirEntry{
+					files.FileEntry("d", files.NewBytesFile([]byte("same"))),
+					files.FileEntry("e", files.NewBytesFile([]byte("another"))),
+				})),
+			})),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := adder.Result()
+		if res.Files != 5 {
+			t.Errorf("concurrency=%d: expected 5 files, got %d", concurrency, res.Files)
+		}
+		if res.DuplicateFiles != 2 {
+			t.Errorf("concurrency=%d: expected 2 duplicate files, got %d", concurrency, res.DuplicateFiles)
+		}
+		if len(res.Duplicates) != 1 {
+			t.Fatalf("concurrency=%d: expected one duplicated CID, got %v", concurrency, res.Duplicates)
+		}
+		for _, names := range res.Duplicates {
+			sort.Strings(names)
+			if strings.Join(names, ",") != "dir/a,dir/b,dir/sub/d" {
+				t.Errorf("concurrency=%d: unexpected duplicates: %v", concurrency, names)
+			}
+		}
+	}
+}
+
+func TestAdder_ChunkerUnits(t *testing.T) {
+	add := func(chunker string) cid.Cid {
+		p := api.DefaultAddParams()
+		p.Chunker = chunker
+		root, err := New(NewMemoryDAGService(), p, nil).FromReader(context.Background(), bytes.NewReader(make([]byte, 5000)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+	if add("size-1KiB") != add("size-1024") {
+		t.Error("size-1KiB should chunk like size-1024")
+	}
+	if add("size-1KiB") == add("size-1KB") {
+		t.Error("size-1KiB and size-1KB should chunk differently")
+	}
+}
+
+func TestAdder_SharedOutput(t *testing.T) {
+	newDir := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+		})
+	}
+
+	out := make(chan *api.AddedOutput, 100)
+	adder1 := New(NewMemoryDAGService(), api.DefaultAddParams(), out)
+	if _, err := adder1.Build(context.Background(), newDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a misuse: the channel is still in use by the first Adder.
+	adder2 := New(NewMemoryDAGService(), api.DefaultAddParams(), out)
+	if _, err := adder2.FromFiles(context.Background(), newDir()); err != ErrOutputInUse {
+		t.Fatal("expected ErrOutputInUse, got", err)
+	}
+
+	if _, err := adder1.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for range out {
+	}
+
+	// closing again does nothing.
+	adder1.closeOutput()
+}
+
+func TestAdder_EffectiveParams(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.RawLeaves = true
+	p.CidVersion = 0
+	p.Chunker = "size-1KiB"
+	p.Layout = ""
+	p.HashFun = "SHA2-256"
+	p.Concurrency = 4
+	p.Deterministic = true
+
+	adder := New(NewMemoryDAGService(), p, nil)
+	if adder.EffectiveParams() != nil {
+		t.Error("there should be no effective params before adding")
+	}
+	if _, err := adder.FromReader(context.Background(), strings.NewReader("hello"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	eff := adder.EffectiveParams()
+	if eff == nil {
+		t.Fatal("expected the effective params")
+	}
+	if eff.CidVersion != 1 {
+		t.Error("raw leaves should have upgraded to CIDv1")
+	}
+	if eff.Chunker != "size-1024" {
+		t.Error("expected the chunker size in bytes, got", eff.Chunker)
+	}
+	if eff.Layout != "balanced" {
+		t.Error("expected the balanced layout, got", eff.Layout)
+	}
+	if eff.HashFun != "sha2-256" {
+		t.Error("expected the resolved hash function, got", eff.HashFun)
+	}
+	if eff.Concurrency != 1 {
+		t.Error("deterministic adds are sequential, got concurrency", eff.Concurrency)
+	}
+	if p.CidVersion != 0 || p.Chunker != "size-1KiB" || p.Concurrency != 4 {
+		t.Error("the given params should be left untouched")
+	}
+	if err := eff.Validate(); err != nil {
+		t.Error("the effective params should be valid:", err)
+	}
+}
+
+func TestAdder_Roots(t *testing.T) {
+	out := make(chan *api.AddedOutput, 100)
+	adder := New(NewMemoryDAGService(), api.DefaultAddParams(), out)
+	root, err := adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+		files.FileEntry("b", files.NewBytesFile([]byte("b"))),
+		files.FileEntry("c", files.NewBytesFile([]byte("c"))),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := make(map[string]cid.Cid)
+	for ao := range out {
+		if ao.Type == api.AddedFile {
+			added[ao.Name] = ao.Cid
+		}
+	}
+
+	roots := adder.Result().Roots
+	if len(roots) != 3 {
+		t.Fatalf("expected 3 roots, got %d", len(roots))
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		if !roots[i].Equals(added[name]) {
+			t.Errorf("root %d should be %s, got %s", i, added[name], roots[i])
+		}
+	}
+	if !root.Equals(roots[2]) {
+		t.Error("the last root should be the primary one")
+	}
+}
+
+func TestAdder_NormalizeNames(t *testing.T) {
+	composed, decomposed := "caf\u00e9", "cafe\u0301"
+	add := func(normalize bool, names ...string) (cid.Cid, error) {
+		p := api.DefaultAddParams()
+		p.NormalizeNames = normalize
+		var entries []files.DirEntry
+		for _, name := range names {
+			entries = append(entries, files.FileEntry(name, files.NewBytesFile([]byte("content"))))
+		}
+		return New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("sub", files.NewSliceDirectory(entries)),
+			})),
+		}))
+	}
+	mustAdd := func(normalize bool, names ...string) cid.Cid {
+		root, err := add(normalize, names...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+
+	if mustAdd(false, composed) == mustAdd(false, decomposed) {
+		t.Error("names should be left as they are by default")
+	}
+	if mustAdd(true, composed) != mustAdd(true, decomposed) {
+		t.Error("composed and decomposed names should get the same root")
+	}
+	if mustAdd(true, composed) != mustAdd(false, composed) {
+		t.Error("NFC names should not change")
+	}
+	if mustAdd(true, composed+" \t") != mustAdd(true, composed) {
+		t.Error("trailing whitespace should be removed")
+	}
+
+	if _, err := add(true, composed, decomposed); err == nil {
+		t.Error("expected an error for names which are the same once normalized")
+	}
+	if _, err := add(true, "   "); err == nil {
+		t.Error("expected an error for a name which is empty once normalized")
+	}
+}
+
+// corruptNode has other data than that of its CID.
+type corruptNode struct {
+	ipld.Node
+}
+
+func (nd corruptNode) RawData() []byte {
+	return []byte("corrupted")
+}
+
+// corruptingDAGServ is a MemoryDAGService which returns a corrupted copy of
+// the blocks containing "corrupt".
+type corruptingDAGServ struct {
+	*MemoryDAGService
+}
+
+func (dag corruptingDAGServ) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	nd, err := dag.MemoryDAGService.Get(ctx, c)
+	if err == nil && bytes.Contains(nd.RawData(), []byte("corrupt")) {
+		return corruptNode{nd}, nil
+	}
+	return nd, err
+}
+
+// finalizingCorruptingDAGServ records whether the content was finalized.
+type finalizingCorruptingDAGServ struct {
+	corruptingDAGServ
+	finalized bool
+}
+
+func (dag *finalizingCorruptingDAGServ) Finalize(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	dag.finalized = true
+	return root, nil
+}
+
+func TestAdder_VerifyAfterAdd(t *testing.T) {
+	newDir := func(content string) files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile([]byte("fine"))),
+				files.FileEntry("b", files.NewBytesFile([]byte(content))),
+			})),
+		})
+	}
+	p := api.DefaultAddParams()
+	p.VerifyAfterAdd = true
+
+	_, err := New(corruptingDAGServ{NewMemoryDAGService()}, p, nil).FromFiles(context.Background(), newDir("also fine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is finalized when the verification fails, and batched
+	// blocks are verified too.
+	p.BatchSize = 10
+	fdags := &finalizingCorruptingDAGServ{corruptingDAGServ: corruptingDAGServ{NewMemoryDAGService()}}
+	_, err = New(fdags, p, nil).FromFiles(context.Background(), newDir("corrupt me"))
+	if !errors.Is(err, ErrVerifyMismatch) {
+		t.Fatal("expected ErrVerifyMismatch, got", err)
+	}
+	if fdags.finalized {
+		t.Error("content which fails the verification should not be finalized")
+	}
+	if fdags.Len() != 0 {
+		t.Error("content which fails the verification should be cleaned up")
+	}
+	p.BatchSize = 0
+
+	// not verified by default.
+	p.VerifyAfterAdd = false
+	_, err = New(corruptingDAGServ{NewMemoryDAGService()}, p, nil).FromFiles(context.Background(), newDir("corrupt me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blocks which cannot be read back fail the verification.
+	p.VerifyAfterAdd = true
+	dags := &mockCDAGServ{resultCids: make(map[string]struct{})}
+	_, err = New(dags, p, nil).FromFiles(context.Background(), newDir("fine"))
+	if err == nil {
+		t.Fatal("expected an error when blocks cannot be read back")
+	}
+}
+
+func TestAdder_ProgressInterval(t *testing.T) {
+	add := func(interval time.Duration) (updates int, added []string, last *api.AddedOutput) {
+		entries := []files.DirEntry{
+			files.FileEntry("big", files.NewBytesFile(bytes.Repeat([]byte("a"), 4<<20))),
+		}
+		for i := 0; i < 5; i++ {
+			entries = append(entries, files.FileEntry(fmt.Sprintf("small%d", i), files.NewBytesFile([]byte{byte(i)})))
+		}
+		dir := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory(entries)),
+		})
+
+		p := api.DefaultAddParams()
+		p.Progress = true
+		p.ProgressInterval = interval
+		out := make(chan *api.AddedOutput, 100)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for ao := range out {
+				switch {
+				case ao.Type == api.AddedFile:
+					added = append(added, ao.Name)
+				case isProgressUpdate(ao):
+					updates++
+				}
+				last = ao
+			}
+		}()
+		_, err := New(NewMemoryDAGService(), p, out).FromFiles(context.Background(), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		return updates, added, last
+	}
+
+	all, _, _ := add(0)
+	if all < 16 {
+		t.Fatal("expected a burst of progress updates, got", all)
+	}
+
+	updates, added, last := add(time.Hour)
+	if updates != 1 {
+		t.Errorf("expected the progress updates to be coalesced into 1, got %d", updates)
+	}
+	sort.Strings(added)
+	expected := []string{"dir/big", "dir/small0", "dir/small1", "dir/small2", "dir/small3", "dir/small4"}
+	if strings.Join(added, ",") != strings.Join(expected, ",") {
+		t.Error("all files should be reported:", added)
+	}
+	if last.Type != api.AddedDirectory || last.Name != "dir" {
+		t.Errorf("the root should come last: %+v", last)
+	}
+}
+
+func TestAdder_AlternateCid(t *testing.T) {
+	add := func(p *api.AddParams, content []byte) *api.AddResult {
+		adder := New(NewMemoryDAGService(), p, nil)
+		_, err := adder.FromReader(context.Background(), bytes.NewReader(content), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return adder.Result()
+	}
+
+	p := api.DefaultAddParams()
+	p.AlternateCid = true
+	res := add(p, bytes.Repeat([]byte("a"), 1<<20))
+	if res.AlternateRoot.Version() != 1 || string(res.AlternateRoot.Hash()) != string(res.Root.Hash()) {
+		t.Fatal("expected the CIDv1 of the root, got", res.AlternateRoot)
+	}
+	back, err := api.AlternateCid(res.AlternateRoot)
+	if err != nil || !back.Equals(res.Root) {
+		t.Error("the alternate root should convert back to the root:", back, err)
+	}
+
+	// single blocks get the same CID when added with the other version.
+	res = add(p, []byte("hello"))
+	p1 := api.DefaultAddParams()
+	p1.CidVersion = 1
+	p1.RawLeaves = false
+	p1.AlternateCid = true
+	res1 := add(p1, []byte("hello"))
+	if !res.AlternateRoot.Equals(res1.Root) || !res1.AlternateRoot.Equals(res.Root) {
+		t.Errorf("expected %s and %s to be each other's alternate", res.Root, res1.Root)
+	}
+
+	// raw roots have no CIDv0.
+	p1.RawLeaves = true
+	if res := add(p1, []byte("hello")); res.AlternateRoot.Defined() {
+		t.Error("expected no alternate root for a raw block")
+	}
+}
+
+func TestAdder_Transform(t *testing.T) {
+	upper := func(name string, r io.Reader) (io.Reader, error) {
+		if name == "dir/bad" {
+			return nil, errors.New("cannot transform")
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(bytes.ToUpper(data)), nil
+	}
+
+	p := api.DefaultAddParams()
+	p.RawLeaves = true
+	dags := NewMemoryDAGService()
+	adder := New(dags, p, nil)
+	adder.SetTransform(upper)
+	root, err := adder.FromReader(context.Background(), strings.NewReader("hello world"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := dags.Get(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(nd.RawData()) != "HELLO WORLD" {
+		t.Errorf("expected the transformed content, got %q", nd.RawData())
+	}
+
+	// failures fail the file.
+	newDir := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("bad", files.NewBytesFile([]byte("bad"))),
+				files.FileEntry("good", files.NewBytesFile([]byte("good"))),
+			})),
+		})
+	}
+	adder = New(NewMemoryDAGService(), p, nil)
+	adder.SetTransform(upper)
+	if _, err := adder.FromFiles(context.Background(), newDir()); err == nil {
+		t.Error("expected the add to fail")
+	}
+
+	p.SkipFailedFiles = true
+	adder = New(NewMemoryDAGService(), p, nil)
+	adder.SetTransform(upper)
+	if _, err := adder.FromFiles(context.Background(), newDir()); err != nil {
+		t.Fatal(err)
+	}
+	if res := adder.Result(); res.Files != 1 || res.SkippedFiles != 1 {
+		t.Errorf("expected the file which failed to be skipped: %+v", res)
+	}
+}
+
+func TestAdder_TargetPath(t *testing.T) {
+	newDir := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a.txt", files.NewBytesFile([]byte("hello"))),
+		})
+	}
+
+	p := api.DefaultAddParams()
+	p.TargetPath = "./docs/"
+	dags := NewMemoryDAGService()
+	root, err := New(dags, p, nil).FromFiles(context.Background(), newDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileRoot, err := New(NewMemoryDAGService(), api.DefaultAddParams(), nil).FromFiles(context.Background(), newDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := root
+	for _, name := range []string{"docs", "a.txt"} {
+		nd, err := dags.Get(context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, _, err := nd.ResolveLink([]string{name})
+		if err != nil {
+			t.Fatalf("resolving %s: %s", name, err)
+		}
+		c = l.Cid
+	}
+	if !c.Equals(fileRoot) {
+		t.Errorf("expected docs/a.txt to be %s, got %s", fileRoot, c)
+	}
+
+	p.TargetPath = "docs/../.."
+	_, err = New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), newDir())
+	if err == nil {
+		t.Error("expected an error escaping the root")
+	}
+}
+
+func TestAdder_WrapTimestamp(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.WrapTimestamp = true
+
+	// add returns the root and the name of its only link, which must be
+	// a timestamp.
+	add := func() (cid.Cid, string) {
+		dags := NewMemoryDAGService()
+		root, err := New(dags, p, nil).FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a.txt", files.NewBytesFile([]byte("hello"))),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := dags.Get(context.Background(), root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nd.Links()) != 1 {
+			t.Fatalf("expected a single link in the root, got %d", len(nd.Links()))
+		}
+		name := nd.Links()[0].Name
+		if _, err := time.Parse(time.RFC3339, name); err != nil {
+			t.Errorf("expected a timestamp: %s", err)
+		}
+		return root, name
+	}
+
+	root1, name1 := add()
+	for time.Now().UTC().Format(time.RFC3339) == name1 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	root2, name2 := add()
+	if name1 == name2 {
+		t.Error("expected different wrap names")
+	}
+	if root1.Equals(root2) {
+		t.Error("expected different roots")
+	}
+}
+
+func TestAdder_RootLinks(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Wrap = true
+	adder := New(NewMemoryDAGService(), p, nil)
+	if _, err := adder.RootLinks(); err != ErrNotFinished {
+		t.Errorf("expected ErrNotFinished, got %v", err)
+	}
+
+	out := make(chan *api.AddedOutput, 100)
+	adder = New(NewMemoryDAGService(), p, out)
+	_, err := adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+		files.FileEntry("b", files.NewBytesFile([]byte("world"))),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids := make(map[string]cid.Cid)
+	for ao := range out {
+		cids[ao.Name] = ao.Cid
+	}
+
+	links, err := adder.RootLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 {
+		t.Fatalf("expected 2 links, got %d", len(links))
+	}
+	for _, l := range links {
+		if c, ok := cids[l.Name]; !ok || !c.Equals(l.Cid) {
+			t.Errorf("unexpected link %s: %s", l.Name, l.Cid)
+		}
+	}
+}
+
+func TestAdder_Manifest(t *testing.T) {
+	for _, concurrency := range []int{0, 4} {
+		p := api.DefaultAddParams()
+		p.Concurrency = concurrency
+		out := make(chan *api.AddedOutput, 100)
+		adder := New(NewMemoryDAGService(), p, out)
+		_, err := adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+				files.FileEntry("sub", files.NewSliceDirectory([]files.DirEntry{
+					files.FileEntry("b", files.NewBytesFile([]byte("b"))),
+					files.FileEntry("c", files.NewBytesFile([]byte("a"))),
+				})),
+				files.FileEntry("empty", files.NewSliceDirectory(nil)),
+			})),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := make(map[string]cid.Cid)
+		for ao := range out {
+			switch ao.Type {
+			case api.AddedFile:
+				expected[ao.Name] = ao.Cid
+			case api.AddedDirectory:
+				expected[ao.Name+"/"] = ao.Cid
+			}
+		}
+		if len(expected) != 6 {
+			t.Fatalf("expected 6 entries, got %d", len(expected))
+		}
+
+		manifest := adder.Result().Manifest
+		if len(manifest) != len(expected) {
+			t.Errorf("expected %d entries in the manifest, got %d", len(expected), len(manifest))
+		}
+		for name, c := range expected {
+			if !manifest[name].Equals(c) {
+				t.Errorf("%s: expected %s, got %s", name, c, manifest[name])
+			}
+		}
+	}
+}
+
+func TestAdder_UnwrapSingle(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Wrap = true
+	p.UnwrapSingle = true
+	p.WrapName = "dir"
+	adder := New(NewMemoryDAGService(), p, nil)
+	root, err := adder.FromReader(context.Background(), strings.NewReader("hello"), "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileRoot, err := New(NewMemoryDAGService(), api.DefaultAddParams(), nil).FromReader(context.Background(), strings.NewReader("hello"), "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := adder.Result()
+	if !res.Root.Equals(root) || root.Equals(fileRoot) {
+		t.Error("expected the wrapping directory as the root")
+	}
+	if !res.UnwrappedRoot.Equals(fileRoot) {
+		t.Errorf("expected %s as the unwrapped root, got %s", fileRoot, res.UnwrappedRoot)
+	}
+
+	// Nothing is reported with several files.
+	adder = New(NewMemoryDAGService(), p, nil)
+	_, err = adder.FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+		files.FileEntry("b", files.NewBytesFile([]byte("b"))),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adder.Result().UnwrappedRoot.Defined() {
+		t.Error("expected no unwrapped root with several files")
+	}
+}
+
+// recordingLogger keeps the lines logged to it.
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(level, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+": "+msg)
+}
+
+func (l *recordingLogger) Debug(args ...interface{}) { l.record("debug", fmt.Sprint(args...)) }
+func (l *recordingLogger) Info(args ...interface{})  { l.record("info", fmt.Sprint(args...)) }
+func (l *recordingLogger) Warn(args ...interface{})  { l.record("warn", fmt.Sprint(args...)) }
+func (l *recordingLogger) Error(args ...interface{}) { l.record("error", fmt.Sprint(args...)) }
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("warn", fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) has(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAdder_SetLogger(t *testing.T) {
+	log := &recordingLogger{}
+	adder := New(NewMemoryDAGService(), api.DefaultAddParams(), nil)
+	adder.SetLogger(log)
+	root, err := adder.FromReader(context.Background(), strings.NewReader("hello"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !log.has("debug: adding from reader") {
+		t.Error("expected the debug lines of the add")
+	}
+	if !log.has(fmt.Sprintf("info: %s successfully added to cluster", root)) {
+		t.Error("expected the success line")
+	}
+
+	log = &recordingLogger{}
+	adder = New(&mockCDAGServ{resultCids: make(map[string]struct{})}, api.DefaultAddParams(), nil)
+	adder.SetLogger(log)
+	adder.SetOnBlock(func(ao *api.AddedOutput) error { return errors.New("no blocks") })
+	if _, err := adder.FromReader(context.Background(), strings.NewReader("hello"), ""); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !log.has("error: ") {
+		t.Error("expected the error to be logged")
+	}
+}
+
+func TestAdder_SetOnFinalize(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	add := func(dags ClusterDAGService, f func(cid.Cid) error) (cid.Cid, error) {
+		d := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+		})
+		adder := New(dags, api.DefaultAddParams(), nil)
+		adder.SetOnFinalize(f)
+		return adder.FromFiles(context.Background(), d)
+	}
+
+	var finalized []cid.Cid
+	root, err := add(NewMemoryDAGService(), func(c cid.Cid) error {
+		finalized = append(finalized, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finalized) != 1 || !finalized[0].Equals(root) {
+		t.Errorf("expected to be called once with %s, got: %s", root, finalized)
+	}
+
+	// the root given is the one returned by Finalize.
+	finalized = nil
+	root, err = add(otherRootCDAGServ{&mockCDAGServ{resultCids: make(map[string]struct{})}}, func(c cid.Cid) error {
+		finalized = append(finalized, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finalized) != 1 || !finalized[0].Equals(test.Cid1) || !root.Equals(test.Cid1) {
+		t.Error("expected the root returned by Finalize, got:", finalized)
+	}
+
+	dags := NewMemoryDAGService()
+	errNotified := errors.New("not notified")
+	_, err = add(dags, func(c cid.Cid) error { return errNotified })
+	if err != errNotified {
+		t.Fatal("expected the error of the callback, got:", err)
+	}
+	if dags.Len() != 0 {
+		t.Errorf("expected the blocks to be cleaned up, %d are left", dags.Len())
+	}
+}
+
+func TestAdder_StrictSize(t *testing.T) {
+	add := func(p *api.AddParams, f files.File) (cid.Cid, error) {
+		return New(NewMemoryDAGService(), p, nil).FromFiles(
+			context.Background(),
+			files.NewSliceDirectory([]files.DirEntry{files.FileEntry("a", f)}),
+		)
+	}
+	content := []byte("more bytes")
+
+	expected, err := add(api.DefaultAddParams(), files.NewBytesFile(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without StrictSize, what was read is added.
+	root, err := add(api.DefaultAddParams(), resizedFile{files.NewBytesFile(content), 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(expected) {
+		t.Error("expected the bytes read to be added")
+	}
+
+	p := api.DefaultAddParams()
+	p.StrictSize = true
+	for _, size := range []int64{5, 20} {
+		_, err := add(p, resizedFile{files.NewBytesFile(content), size})
+		if err == nil || !strings.Contains(err.Error(), "changed size") {
+			t.Errorf("expected a size error with size %d, got: %v", size, err)
+		}
+	}
+	root, err = add(p, files.NewBytesFile(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(expected) {
+		t.Error("expected files with the right size to be added")
+	}
+}
+
+func TestAdder_Buzhash(t *testing.T) {
+	add := func(chunker string, data []byte) (cid.Cid, *cid.Set) {
+		dags := NewMemoryDAGService()
+		p := api.DefaultAddParams()
+		p.Chunker = chunker
+		root, err := New(dags, p, nil).FromReader(context.Background(), bytes.NewReader(data), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves := cid.NewSet()
+		for c, nd := range dags.blocks {
+			if len(nd.Links()) == 0 {
+				leaves.Add(c)
+			}
+		}
+		return root, leaves
+	}
+	shared := func(a, b *cid.Set) float64 {
+		n := 0
+		for _, c := range b.Keys() {
+			if a.Has(c) {
+				n++
+			}
+		}
+		return float64(n) / float64(b.Len())
+	}
+
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// the default mask makes the same chunks as upstream.
+	root, _ := add("buzhash", data)
+	root17, _ := add("buzhash-17", data)
+	if !root.Equals(root17) {
+		t.Error("buzhash-17 should be the same as buzhash")
+	}
+
+	// a few bytes inserted in the middle only change the chunks around
+	// them, unlike with fixed-size chunks.
+	edited := append(append(append([]byte{}, data[:len(data)/2]...), "edit"...), data[len(data)/2:]...)
+	_, leaves := add("buzhash-12", data)
+	_, editedLeaves := add("buzhash-12", edited)
+	if leaves.Len() < 100 {
+		t.Fatalf("expected buzhash-12 to make small chunks, got %d", leaves.Len())
+	}
+	if s := shared(leaves, editedLeaves); s < 0.95 {
+		t.Errorf("expected most blocks to be shared with buzhash, got %.2f", s)
+	}
+	_, leaves = add("size-8192", data)
+	_, editedLeaves = add("size-8192", edited)
+	if s := shared(leaves, editedLeaves); s > 0.55 {
+		t.Errorf("expected fixed-size chunks to share about half the blocks, got %.2f", s)
+	}
+}
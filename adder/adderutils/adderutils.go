@@ -23,7 +23,11 @@ var logger = logging.Logger("adder")
 // AddMultipartHTTPHandler is a helper function to add content
 // uploaded using a multipart request. The outputTransform parameter
 // allows to customize the http response output format to something
-// else than api.AddedOutput objects.
+// else than api.AddedOutput objects. When it is nil, the objects are
+// written with their CIDs printed with the CidBase of the params and, when
+// the output is streamed, it is written with adder.StreamOutput, which
+// ends the stream with a summary of the add, or with the error of the add.
+// Errors are also sent in the X-Stream-Error trailer.
 func AddMultipartHTTPHandler(
 	ctx context.Context,
 	rpc *rpc.Client,
@@ -38,11 +42,12 @@ func AddMultipartHTTPHandler(
 	if params.Shard {
 		dags = sharding.New(rpc, params.PinOptions, output)
 	} else {
-		dags = single.New(rpc, params.PinOptions, params.Local)
+		dags = single.New(rpc, params.PinOptions, params.Local, params.NoPin)
 	}
 
+	stream := outputTransform == nil
 	if outputTransform == nil {
-		outputTransform = func(in *api.AddedOutput) interface{} { return in }
+		outputTransform = func(in *api.AddedOutput) interface{} { return params.FormatOutput(in) }
 	}
 
 	// This must be application/json otherwise go-ipfs client
@@ -96,6 +101,24 @@ func AddMultipartHTTPHandler(
 	// Used by go-ipfs to signal errors half-way through the stream.
 	w.Header().Set("Trailer", "X-Stream-Error")
 	w.WriteHeader(http.StatusOK)
+	if stream {
+		add := adder.New(dags, params, output)
+		var root cid.Cid
+		var addErr error
+		err := add.StreamOutput(w, func() error {
+			root, addErr = add.FromMultipart(ctx, reader)
+			return addErr
+		})
+		if err != nil {
+			logger.Error(err)
+		}
+		if addErr != nil {
+			logger.Error(addErr)
+			w.Header().Set("X-Stream-Error", addErr.Error())
+		}
+		return root, addErr
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
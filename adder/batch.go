@@ -0,0 +1,129 @@
+package adder
+
+import (
+	"context"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Blocks are batched when the batch size is larger than 1: they are kept in
+// a buffer and stored with a single AddMany call once the buffer is full,
+// once the flush interval since the first buffered block elapses, or when
+// finalizing. Blocks are stored in the order in which they were added, so
+// parents are still stored after their children. They are tracked once
+// stored.
+
+// batching returns whether blocks are batched.
+func (dt *dagTracker) batching() bool {
+	return dt.batchSize > 1
+}
+
+// enqueue buffers a node which holds the given bytes of the buffer
+// semaphore, flushing the buffer when it is full or when someone is waiting
+// for bytes to be released. It must be called with the lock held.
+func (dt *dagTracker) enqueue(ctx context.Context, node ipld.Node, weight uint64) error {
+	if dt.flushErr != nil {
+		dt.release(weight)
+		return dt.flushErr
+	}
+	if dt.batched == nil {
+		dt.batched = make(map[cid.Cid]ipld.Node)
+	}
+	dt.batch = append(dt.batch, node)
+	dt.batched[node.Cid()] = node
+	dt.batchBytes += weight
+	if len(dt.batch) >= dt.batchSize || (dt.buffer != nil && dt.buffer.waiting()) {
+		return dt.flush(ctx)
+	}
+	if len(dt.batch) == 1 && dt.flushInterval > 0 {
+		dt.timer = time.AfterFunc(dt.flushInterval, dt.flushLater)
+	}
+	return nil
+}
+
+// flush stores the buffered nodes. It must be called with the lock held.
+func (dt *dagTracker) flush(ctx context.Context) error {
+	dt.stopTimer()
+	if len(dt.batch) == 0 {
+		return dt.flushErr
+	}
+	nodes := dt.batch
+	dt.batch = nil
+	dt.batched = nil
+	err := dt.addMany(ctx, nodes)
+	dt.release(dt.batchBytes)
+	dt.batchBytes = 0
+	if err != nil && dt.flushErr == nil {
+		dt.flushErr = err
+	}
+	return err
+}
+
+// flushLater flushes the buffer when the flush interval elapses. As nobody
+// is waiting for the result, failures abort the add.
+func (dt *dagTracker) flushLater() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if len(dt.batch) == 0 {
+		return
+	}
+	ctx := dt.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := dt.flush(ctx); err != nil && dt.abort != nil {
+		dt.abort(err)
+	}
+}
+
+func (dt *dagTracker) stopTimer() {
+	if dt.timer != nil {
+		dt.timer.Stop()
+		dt.timer = nil
+	}
+}
+
+// Get returns buffered nodes which have not been stored yet, or gets them
+// from the wrapped DAGService otherwise.
+func (dt *dagTracker) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	dt.mu.Lock()
+	node, ok := dt.batched[c]
+	dt.mu.Unlock()
+	if ok {
+		return node, nil
+	}
+	return dt.ClusterDAGService.Get(ctx, c)
+}
+
+// Flush stores any buffered nodes.
+func (dt *dagTracker) Flush(ctx context.Context) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.flush(ctx)
+}
+
+// Finalize stores any buffered nodes before finalizing.
+func (dt *dagTracker) Finalize(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	dt.mu.Lock()
+	err := dt.flush(ctx)
+	dt.mu.Unlock()
+	if err != nil {
+		return cid.Undef, err
+	}
+	return dt.ClusterDAGService.Finalize(ctx, root)
+}
+
+// Cleanup drops any buffered nodes before cleaning up the wrapped
+// DAGService, if it is a Cleaner.
+func (dt *dagTracker) Cleanup(ctx context.Context, cids []cid.Cid) error {
+	dt.mu.Lock()
+	dt.stopTimer()
+	dt.batch = nil
+	dt.batched = nil
+	dt.release(dt.batchBytes)
+	dt.batchBytes = 0
+	dt.mu.Unlock()
+	return cleanupDAGService(ctx, dt.ClusterDAGService, cids)
+}
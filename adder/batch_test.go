@@ -0,0 +1,159 @@
+package adder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+// recordingDAGServ records the calls made to store blocks in a
+// MemoryDAGService. Every call waits for the given latency.
+type recordingDAGServ struct {
+	*MemoryDAGService
+	latency time.Duration
+
+	mu      sync.Mutex
+	adds    int
+	batches []int
+	order   []cid.Cid
+}
+
+func newRecordingDAGServ(latency time.Duration) *recordingDAGServ {
+	return &recordingDAGServ{
+		MemoryDAGService: NewMemoryDAGService(),
+		latency:          latency,
+	}
+}
+
+func (rdgs *recordingDAGServ) Add(ctx context.Context, node ipld.Node) error {
+	time.Sleep(rdgs.latency)
+	rdgs.mu.Lock()
+	rdgs.adds++
+	rdgs.order = append(rdgs.order, node.Cid())
+	rdgs.mu.Unlock()
+	return rdgs.MemoryDAGService.Add(ctx, node)
+}
+
+func (rdgs *recordingDAGServ) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	time.Sleep(rdgs.latency)
+	rdgs.mu.Lock()
+	rdgs.batches = append(rdgs.batches, len(nodes))
+	for _, node := range nodes {
+		rdgs.order = append(rdgs.order, node.Cid())
+	}
+	rdgs.mu.Unlock()
+	return rdgs.MemoryDAGService.AddMany(ctx, nodes)
+}
+
+func smallFiles(n int) files.Directory {
+	var entries []files.DirEntry
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%d", i)
+		entries = append(entries, files.FileEntry(name, files.NewBytesFile([]byte(name))))
+	}
+	return files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory(entries)),
+	})
+}
+
+func TestAdder_Batching(t *testing.T) {
+	p := api.DefaultAddParams()
+	expected, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), smallFiles(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dags := newRecordingDAGServ(0)
+	p.BatchSize = 16
+	adder := New(dags, p, nil)
+	root, err := adder.FromFiles(context.Background(), smallFiles(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(expected) {
+		t.Errorf("expected %s, got %s", expected, root)
+	}
+
+	if dags.adds != 0 {
+		t.Errorf("expected no single block puts, got %d", dags.adds)
+	}
+	if len(dags.batches) < 2 {
+		t.Fatalf("expected several batches, got %d", len(dags.batches))
+	}
+	stored := 0
+	for _, n := range dags.batches {
+		if n > p.BatchSize {
+			t.Errorf("batch of %d blocks is larger than %d", n, p.BatchSize)
+		}
+		stored += n
+	}
+	if res := adder.Result(); res.Blocks != dags.Len() || stored < res.Blocks {
+		t.Errorf("expected %d blocks to be stored, got %d", res.Blocks, dags.Len())
+	}
+
+	// children are stored before their parents.
+	seen := cid.NewSet()
+	for _, c := range dags.order {
+		nd, err := dags.Get(context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range nd.Links() {
+			if !seen.Has(l.Cid) {
+				t.Fatalf("%s was stored before its child %s", c, l.Cid)
+			}
+		}
+		seen.Add(c)
+	}
+}
+
+func TestDAGTracker_FlushInterval(t *testing.T) {
+	dags := NewMemoryDAGService()
+	dt := newDAGTracker(dags)
+	dt.ctx = context.Background()
+	dt.batchSize = 10
+	dt.flushInterval = 50 * time.Millisecond
+
+	nd := dag.NodeWithData([]byte("hello"))
+	if err := dt.Add(context.Background(), nd); err != nil {
+		t.Fatal(err)
+	}
+	if dags.Len() != 0 {
+		t.Fatal("the block should be buffered")
+	}
+	if _, err := dt.Get(context.Background(), nd.Cid()); err != nil {
+		t.Error("buffered blocks should be readable:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dags.Len() != 1 || len(dt.cids) != 1 {
+		t.Fatal("the block should have been stored after the flush interval")
+	}
+}
+
+func BenchmarkAdder_SmallFiles(b *testing.B) {
+	for _, batchSize := range []int{0, 100} {
+		b.Run(fmt.Sprintf("batch-%d", batchSize), func(b *testing.B) {
+			p := api.DefaultAddParams()
+			p.BatchSize = batchSize
+			for i := 0; i < b.N; i++ {
+				adder := New(newRecordingDAGServ(100*time.Microsecond), p, nil)
+				_, err := adder.FromFiles(context.Background(), smallFiles(500))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
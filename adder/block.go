@@ -0,0 +1,205 @@
+package adder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+// newBlockNode returns the node for the block with the given data and CID,
+// verifying first that they match when verify is set.
+func newBlockNode(data []byte, c cid.Cid, verify bool) (ipld.Node, error) {
+	if verify {
+		sum, err := c.Prefix().Sum(data)
+		if err != nil {
+			return nil, err
+		}
+		if !sum.Equals(c) {
+			return nil, fmt.Errorf("block data does not match CID %s", c)
+		}
+	}
+
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(blk)
+}
+
+// decodeBlock decodes a block with one of the supported codecs. The global
+// ipld decoder registry is left alone, as importers may register their own.
+func decodeBlock(blk blocks.Block) (ipld.Node, error) {
+	switch codec := blk.Cid().Type(); codec {
+	case cid.DagProtobuf:
+		return dag.DecodeProtobufBlock(blk)
+	case cid.Raw:
+		return dag.DecodeRawBlock(blk)
+	case cid.DagCBOR:
+		return cbor.DecodeBlock(blk)
+	default:
+		return nil, fmt.Errorf("unsupported codec for block %s: %s", blk.Cid(), cid.CodecToStr[codec])
+	}
+}
+
+// SetTrustCID makes AddBlockWithCid store blocks without checking that
+// their data matches the given CIDs, which saves hashing them. Only use it
+// with blocks from trusted sources: blocks whose data does not match their
+// CIDs are stored as they are and corrupt the DAGs they are part of.
+func (a *Adder) SetTrustCID(trust bool) {
+	a.trustCID = trust
+}
+
+// AddBlock stores a block with the given data, bypassing chunking, and
+// returns its CID, built with cidBuilder. When cidBuilder is nil, CIDv1s
+// with the Codec (raw by default) and HashFun parameters are used. The data
+// must be valid for the codec of the CID.
+//
+// AddBlock can be called several times, and after Build. The last block
+// added is the root of the content, which Commit finalizes. Commit must be
+// called to end the adding process, which uses the context of the first
+// call (or that of Build). When adding a block fails, the adding process
+// ends and the Adder can no longer be used. AddBlock is not safe for
+// concurrent use.
+func (a *Adder) AddBlock(ctx context.Context, data []byte, cidBuilder cid.Builder) (cid.Cid, error) {
+	if cidBuilder == nil {
+		b, err := a.blockCidBuilder()
+		if err != nil {
+			return cid.Undef, err
+		}
+		cidBuilder = b
+	}
+
+	c, err := cidBuilder.Sum(data)
+	if err != nil {
+		return cid.Undef, err
+	}
+	// the CID was just computed.
+	return c, a.addBlock(ctx, c, data, false)
+}
+
+// blockCidBuilder returns the CID builder used by AddBlock by default.
+func (a *Adder) blockCidBuilder() (cid.Builder, error) {
+	codec := uint64(cid.Raw)
+	if a.params.Codec != "" {
+		c, err := api.ResolveCodec(a.params.Codec)
+		if err != nil {
+			return nil, err
+		}
+		codec = c
+	}
+	hashFun, err := a.params.EffectiveHashFunction()
+	if err != nil {
+		return nil, err
+	}
+	return cid.V1Builder{
+		Codec:    codec,
+		MhType:   hashFun.Code,
+		MhLength: hashFun.Length,
+	}, nil
+}
+
+// AddBlockWithCid stores a block with the given CID and data like AddBlock.
+// The data is checked to match the CID unless SetTrustCID has been used.
+func (a *Adder) AddBlockWithCid(ctx context.Context, c cid.Cid, data []byte) error {
+	return a.addBlock(ctx, c, data, !a.trustCID)
+}
+
+// AddNode stores the given IPLD node (i.e. a dag-cbor node linking to
+// content added before) like AddBlock and returns its CID. The node must use
+// the Codec parameter, when set, or one of the supported codecs.
+func (a *Adder) AddNode(ctx context.Context, nd ipld.Node) (cid.Cid, error) {
+	if err := a.startBlocks(ctx); err != nil {
+		return cid.Undef, err
+	}
+	if err := a.checkCodec(nd.Cid()); err != nil {
+		return cid.Undef, a.abortBlocks(err)
+	}
+	return nd.Cid(), a.storeNode(ctx, nd)
+}
+
+// checkCodec checks that a node added with AddNode uses the right codec.
+func (a *Adder) checkCodec(c cid.Cid) error {
+	if a.params.Codec == "" {
+		switch c.Type() {
+		case cid.Raw, cid.DagProtobuf, cid.DagCBOR:
+			return nil
+		}
+		return fmt.Errorf("node %s: unsupported codec %s", c, cid.CodecToStr[c.Type()])
+	}
+
+	code, err := api.ResolveCodec(a.params.Codec)
+	if err != nil {
+		return err
+	}
+	if c.Type() != code {
+		return fmt.Errorf("node %s: expected codec %s, got %s", c, a.params.Codec, cid.CodecToStr[c.Type()])
+	}
+	return nil
+}
+
+func (a *Adder) addBlock(ctx context.Context, c cid.Cid, data []byte, verify bool) error {
+	if err := a.startBlocks(ctx); err != nil {
+		return err
+	}
+	nd, err := newBlockNode(data, c, verify)
+	if err != nil {
+		return a.abortBlocks(err)
+	}
+	return a.storeNode(ctx, nd)
+}
+
+// startBlocks starts the adding process on the first call, unless it was
+// started by Build. It fails when the Adder has been used otherwise, or when
+// the adding process has ended.
+func (a *Adder) startBlocks(ctx context.Context) error {
+	if a.committed || (a.ctx != nil && !a.addingBlocks && !a.built.Defined()) {
+		return ErrAdderConsumed
+	}
+
+	if a.ctx == nil {
+		if err := a.begin(ctx); err != nil {
+			return err
+		}
+	}
+	a.addingBlocks = true
+
+	if a.ctx.Err() != nil {
+		return a.abortBlocks(a.ctx.Err())
+	}
+	return nil
+}
+
+// abortBlocks ends the adding process after err.
+func (a *Adder) abortBlocks(err error) error {
+	err = a.abortedErr(err)
+	a.built = cid.Undef
+	a.committed = true
+	a.end(err)
+	return err
+}
+
+// storeNode stores a node added with AddBlock or AddNode, which becomes the
+// root of the content.
+func (a *Adder) storeNode(ctx context.Context, nd ipld.Node) error {
+	a.sendMu.RLock()
+	defer a.sendMu.RUnlock()
+	if err := a.tracker.Add(ctx, nd); err != nil {
+		a.log.Error("error adding to cluster: ", err)
+		return a.abortBlocks(err)
+	}
+
+	a.send(&api.AddedOutput{
+		Cid:  nd.Cid(),
+		Name: a.params.FormatCid(nd.Cid()),
+		Size: uint64(len(nd.RawData())),
+	})
+	a.built = nd.Cid()
+	return nil
+}
@@ -0,0 +1,243 @@
+package adder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+func TestAdder_AddBlock(t *testing.T) {
+	ctx := context.Background()
+	dags := NewMemoryDAGService()
+	adder := New(dags, api.DefaultAddParams(), nil)
+
+	leaf, err := adder.AddBlock(ctx, []byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Version() != 1 || leaf.Type() != cid.Raw {
+		t.Error("expected a CIDv1 raw block, got", leaf)
+	}
+
+	// a dag-pb root linking to the leaf.
+	nd := dag.NodeWithData(nil)
+	if err := nd.AddNodeLink("leaf", dag.NewRawNode([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Links()[0].Cid.Equals(leaf) {
+		t.Fatal("unexpected leaf CID")
+	}
+	root, err := adder.AddBlock(ctx, nd.RawData(), cid.V0Builder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(nd.Cid()) {
+		t.Error("expected the dag-pb CID, got", root)
+	}
+
+	clusterRoot, err := adder.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clusterRoot.Equals(root) {
+		t.Error("the last block should be the root")
+	}
+	if dags.Len() != 2 || adder.Result().Blocks != 2 {
+		t.Error("expected 2 blocks to be stored")
+	}
+
+	if _, err := adder.AddBlock(ctx, []byte("more"), nil); err != ErrAdderConsumed {
+		t.Error("expected ErrAdderConsumed after committing, got:", err)
+	}
+}
+
+func TestAdder_AddBlockWithCid(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("hello")
+	other, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256}.Sum([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verified
+	dags := NewMemoryDAGService()
+	adder := New(dags, api.DefaultAddParams(), nil)
+	c := dag.NewRawNode(data).Cid()
+	if err := adder.AddBlockWithCid(ctx, c, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := adder.AddBlockWithCid(ctx, other, data); err == nil {
+		t.Fatal("expected an error for a mismatching CID")
+	}
+	if dags.Len() != 0 {
+		t.Error("a failed add should be cleaned up")
+	}
+	if _, err := adder.Commit(ctx); err == nil {
+		t.Error("failed adds cannot be committed")
+	}
+
+	// trusted
+	dags = NewMemoryDAGService()
+	adder = New(dags, api.DefaultAddParams(), nil)
+	adder.SetTrustCID(true)
+	if err := adder.AddBlockWithCid(ctx, other, data); err != nil {
+		t.Fatal(err)
+	}
+	root, err := adder.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(other) {
+		t.Error("expected the given CID as root")
+	}
+	if ok, _ := dags.Has(ctx, other); !ok {
+		t.Error("the trusted block should be stored")
+	}
+}
+
+func TestAdder_AddNode(t *testing.T) {
+	ctx := context.Background()
+	dags := NewMemoryDAGService()
+	p := api.DefaultAddParams()
+	p.Codec = "dag-cbor"
+	adder := New(dags, p, nil)
+
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("file.txt", files.NewBytesFile([]byte("hello"))),
+	})
+	fileRoot, err := adder.Build(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// raw nodes do not use the codec.
+	if _, err := New(NewMemoryDAGService(), p, nil).AddNode(ctx, dag.NewRawNode([]byte("a"))); err == nil {
+		t.Error("expected an error for a node with another codec")
+	}
+
+	meta, err := cbor.WrapObject(map[string]interface{}{
+		"name": "file.txt",
+		"file": fileRoot,
+	}, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaCid, err := adder.AddNode(ctx, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := adder.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(metaCid) || root.Type() != cid.DagCBOR {
+		t.Error("expected the dag-cbor node as root, got", root)
+	}
+
+	nd, err := dags.Get(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnk, _, err := nd.ResolveLink([]string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lnk.Cid.Equals(fileRoot) {
+		t.Error("the metadata node should link to the file")
+	}
+	if _, err := dags.Get(ctx, fileRoot); err != nil {
+		t.Error("the file should be stored:", err)
+	}
+}
+
+func TestDecodeBlock(t *testing.T) {
+	cborNode, err := cbor.WrapObject(map[string]string{"hello": "world"}, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbNode := dag.NodeWithData([]byte("hello"))
+	for _, nd := range []ipld.Node{cborNode, pbNode, dag.NewRawNode([]byte("hello"))} {
+		blk, err := blocks.NewBlockWithCid(nd.RawData(), nd.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeBlock(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.Cid().Equals(nd.Cid()) {
+			t.Errorf("expected %s, got %s", nd.Cid(), decoded.Cid())
+		}
+	}
+
+	c := cid.NewCidV1(cid.GitRaw, cborNode.Cid().Hash())
+	blk, err := blocks.NewBlockWithCid(cborNode.RawData(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeBlock(blk); err == nil {
+		t.Error("expected an error for an unsupported codec")
+	}
+}
+
+func TestAdder_AddBlock_OnlyHash(t *testing.T) {
+	ctx := context.Background()
+	p := api.DefaultAddParams()
+	p.OnlyHash = true
+
+	t.Run("blocks", func(t *testing.T) {
+		dags := &finalizingDAGServ{MemoryDAGService: NewMemoryDAGService()}
+		adder := New(dags, p, nil)
+		if _, err := adder.AddBlock(ctx, []byte("hello"), nil); err != nil {
+			t.Fatal(err)
+		}
+		c := dag.NewRawNode([]byte("world")).Cid()
+		if err := adder.AddBlockWithCid(ctx, c, []byte("world")); err != nil {
+			t.Fatal(err)
+		}
+		root, err := adder.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !root.Equals(c) {
+			t.Error("the last block should be the root")
+		}
+		if dags.Len() != 0 || len(dags.finalized) != 0 {
+			t.Error("nothing should be stored nor finalized with only-hash")
+		}
+		if adder.Result().Blocks != 2 {
+			t.Error("expected 2 blocks to be counted")
+		}
+	})
+
+	t.Run("nodes", func(t *testing.T) {
+		dags := &finalizingDAGServ{MemoryDAGService: NewMemoryDAGService()}
+		adder := New(dags, p, nil)
+		nd, err := cbor.WrapObject(map[string]interface{}{"name": "a"}, multihash.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := adder.AddNode(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+		root, err := adder.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !root.Equals(nd.Cid()) {
+			t.Error("expected the node as root")
+		}
+		if dags.Len() != 0 || len(dags.finalized) != 0 {
+			t.Error("nothing should be stored nor finalized with only-hash")
+		}
+	})
+}
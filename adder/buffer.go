@@ -0,0 +1,114 @@
+package adder
+
+import (
+	"context"
+	"sync"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// byteSemaphore limits the bytes of block data held by the adder which have
+// not been stored yet. Requests larger than the limit are reduced to it, so
+// that any block can be stored on its own.
+type byteSemaphore struct {
+	max uint64
+
+	mu      sync.Mutex
+	used    uint64
+	waiters int
+	// released is closed and replaced every time bytes are released.
+	released chan struct{}
+}
+
+func newByteSemaphore(max uint64) *byteSemaphore {
+	return &byteSemaphore{
+		max:      max,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire takes n bytes, blocking until they are available or the context is
+// done. Before blocking, drain is called to let the bytes held by buffered
+// blocks be released. It returns the bytes taken, which must be released.
+func (s *byteSemaphore) acquire(ctx context.Context, n uint64, drain func()) (uint64, error) {
+	if n > s.max {
+		n = s.max
+	}
+	s.mu.Lock()
+	if s.used+n <= s.max {
+		s.used += n
+		s.mu.Unlock()
+		return n, nil
+	}
+	// Waiters are registered before draining so that blocks buffered
+	// afterwards are flushed right away (see waiting).
+	s.waiters++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.waiters--
+		s.mu.Unlock()
+	}()
+
+	drain()
+	for {
+		s.mu.Lock()
+		if s.used+n <= s.max {
+			s.used += n
+			s.mu.Unlock()
+			return n, nil
+		}
+		released := s.released
+		s.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (s *byteSemaphore) release(n uint64) {
+	if n == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// waiting returns whether someone is waiting for bytes to be released.
+func (s *byteSemaphore) waiting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters > 0
+}
+
+// acquire takes from the buffer semaphore, if any, the bytes of the given
+// node before it is stored. It returns the bytes taken, which are released
+// once the node is stored.
+func (dt *dagTracker) acquire(ctx context.Context, node ipld.Node) (uint64, error) {
+	if dt.buffer == nil {
+		return 0, nil
+	}
+	return dt.buffer.acquire(ctx, uint64(len(node.RawData())), func() { dt.drain(ctx) })
+}
+
+func (dt *dagTracker) release(n uint64) {
+	if dt.buffer != nil {
+		dt.buffer.release(n)
+	}
+}
+
+// drain flushes the buffered blocks so that the bytes they hold are
+// released. Failures are returned when buffering the next block.
+func (dt *dagTracker) drain(ctx context.Context) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if len(dt.batch) > 0 {
+		dt.flush(ctx)
+	}
+}
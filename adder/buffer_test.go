@@ -0,0 +1,107 @@
+package adder
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// batchBytesDAGServ records the largest number of bytes stored at once in
+// batches of several blocks.
+type batchBytesDAGServ struct {
+	*MemoryDAGService
+	max uint64
+}
+
+func (dags *batchBytesDAGServ) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	var size uint64
+	for _, node := range nodes {
+		size += uint64(len(node.RawData()))
+	}
+	if len(nodes) > 1 && size > dags.max {
+		dags.max = size
+	}
+	return dags.MemoryDAGService.AddMany(ctx, nodes)
+}
+
+func TestAdder_MaxBufferBytes(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	tree := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("large", files.NewBytesFile(data)),
+				files.FileEntry("small", smallFiles(100)),
+			})),
+		})
+	}
+
+	p := api.DefaultAddParams()
+	p.Chunker = "size-1024"
+	p.RawLeaves = true
+	expected, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), tree())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.BatchSize = 100
+	p.MaxBufferBytes = 8 * 1024
+	p.Concurrency = 4
+	dags := &batchBytesDAGServ{MemoryDAGService: NewMemoryDAGService()}
+	adder := New(dags, p, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	root, err := adder.FromFiles(ctx, tree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(expected) {
+		t.Errorf("expected %s, got %s", expected, root)
+	}
+	if dags.max > p.MaxBufferBytes {
+		t.Errorf("%d bytes were buffered, more than %d", dags.max, p.MaxBufferBytes)
+	}
+	if used := adder.tracker.buffer.used; used != 0 {
+		t.Errorf("%d bytes were not released", used)
+	}
+}
+
+func TestByteSemaphore(t *testing.T) {
+	s := newByteSemaphore(10)
+	ctx := context.Background()
+	drain := func() {}
+
+	if n, err := s.acquire(ctx, 100, drain); err != nil || n != 10 {
+		t.Fatal("large requests should take the whole semaphore:", n, err)
+	}
+
+	drained := make(chan struct{})
+	acquired := make(chan struct{})
+	go func() {
+		s.acquire(ctx, 5, func() { close(drained) })
+		close(acquired)
+	}()
+	<-drained
+	select {
+	case <-acquired:
+		t.Fatal("acquire should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !s.waiting() {
+		t.Error("there should be a waiter")
+	}
+	s.release(10)
+	<-acquired
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.acquire(ctx, 10, drain); err != context.Canceled {
+		t.Error("expected a cancelled acquire:", err)
+	}
+}
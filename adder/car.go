@@ -0,0 +1,174 @@
+package adder
+
+// car.go implements a minimal reader and writer for CARv1 archives
+// (https://github.com/ipld/specs/blob/master/block-layer/content-addressable-archives.md)
+// so that already-chunked DAGs can be imported without re-chunking and
+// added DAGs can be exported.
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+func init() {
+	cbor.RegisterCborType(carHeader{})
+}
+
+// maxCARSectionSize limits how large a single header or block section can
+// be so that a corrupted length prefix does not make us allocate
+// huge amounts of memory.
+const maxCARSectionSize = 32 << 20 // 32 MiB
+
+// ErrCARTruncated is returned when a CAR archive ends in the middle of a
+// section.
+var ErrCARTruncated = errors.New("car: truncated archive")
+
+type carHeader struct {
+	Roots   []cid.Cid
+	Version uint64
+}
+
+type carReader struct {
+	br     *bufio.Reader
+	header carHeader
+}
+
+func newCARReader(r io.Reader) (*carReader, error) {
+	cr := &carReader{
+		br: bufio.NewReader(r),
+	}
+
+	data, err := cr.readSection()
+	if err == io.EOF {
+		return nil, ErrCARTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cbor.DecodeInto(data, &cr.header); err != nil {
+		return nil, fmt.Errorf("car: invalid header: %s", err)
+	}
+
+	if cr.header.Version != 1 {
+		return nil, fmt.Errorf("car: unsupported version: %d", cr.header.Version)
+	}
+
+	if len(cr.header.Roots) == 0 {
+		return nil, errors.New("car: no roots in header")
+	}
+	return cr, nil
+}
+
+// readSection reads a varint-prefixed section. It returns
+// io.EOF only when the archive ends cleanly before a new section.
+func (cr *carReader) readSection() ([]byte, error) {
+	l, err := binary.ReadUvarint(cr.br)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, ErrCARTruncated
+	}
+
+	if l == 0 || l > maxCARSectionSize {
+		return nil, fmt.Errorf("car: invalid section length: %d", l)
+	}
+
+	data := make([]byte, l)
+	if _, err := io.ReadFull(cr.br, data); err != nil {
+		return nil, ErrCARTruncated
+	}
+	return data, nil
+}
+
+// next returns the next block in the archive, verifying that its
+// contents match its CID. It returns io.EOF when there are no more blocks.
+func (cr *carReader) next() (ipld.Node, error) {
+	data, err := cr.readSection()
+	if err != nil {
+		return nil, err
+	}
+
+	n, c, err := cid.CidFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("car: invalid block CID: %s", err)
+	}
+
+	nd, err := newBlockNode(data[n:], c, true)
+	if err != nil {
+		return nil, fmt.Errorf("car: %s", err)
+	}
+	return nd, nil
+}
+
+// writeCARSection writes a varint-prefixed section made of the given parts.
+func writeCARSection(w io.Writer, parts ...[]byte) error {
+	var l int
+	for _, p := range parts {
+		l += len(p)
+	}
+	lbuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lbuf, uint64(l))
+	if _, err := w.Write(lbuf[:n]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportCAR writes the DAG under root, as fetched from the given DAGService,
+// to w as a CARv1 archive with root as its only root. Blocks are written as
+// they are fetched, depth-first, so only the CIDs of the blocks seen so far
+// are kept in memory. Every block is written once and blocks whose data is
+// inlined in their CIDs are left out. Writing to w is not buffered.
+func ExportCAR(ctx context.Context, dgs ipld.DAGService, root cid.Cid, w io.Writer) error {
+	h, err := cbor.DumpObject(&carHeader{Roots: []cid.Cid{root}, Version: 1})
+	if err != nil {
+		return err
+	}
+	if err := writeCARSection(w, h); err != nil {
+		return err
+	}
+
+	seen := cid.NewSet()
+	seen.Add(root)
+	pending := []cid.Cid{root}
+	for len(pending) > 0 {
+		c := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		nd, err := dgs.Get(ctx, c)
+		if err != nil {
+			return fmt.Errorf("car: fetching block %s: %s", c, err)
+		}
+		if err := writeCARSection(w, c.Bytes(), nd.RawData()); err != nil {
+			return err
+		}
+
+		links := nd.Links()
+		// in reverse, so that blocks are written in link order.
+		for i := len(links) - 1; i >= 0; i-- {
+			lc := links[i].Cid
+			if lc.Prefix().MhType == multihash.IDENTITY {
+				continue
+			}
+			if seen.Visit(lc) {
+				pending = append(pending, lc)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package adder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+	"github.com/ipfs/ipfs-cluster/test"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+func makeTestCAR(t *testing.T, roots []cid.Cid, nodes []ipld.Node) []byte {
+	var buf bytes.Buffer
+	h, err := cbor.DumpObject(&carHeader{Roots: roots, Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCARSection(&buf, h)
+	for _, n := range nodes {
+		writeCARSection(&buf, append(n.Cid().Bytes(), n.RawData()...))
+	}
+	return buf.Bytes()
+}
+
+func makeTestDAG(t *testing.T) (ipld.Node, []ipld.Node) {
+	leaf1 := dag.NewRawNode([]byte("leaf one"))
+	leaf2 := dag.NewRawNode([]byte("leaf two"))
+	root := &dag.ProtoNode{}
+	if err := root.AddNodeLink("a", leaf1); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.AddNodeLink("b", leaf2); err != nil {
+		t.Fatal(err)
+	}
+	return root, []ipld.Node{leaf1, leaf2, root}
+}
+
+func TestAdder_FromCAR(t *testing.T) {
+	root, nodes := makeTestDAG(t)
+	car := makeTestCAR(t, []cid.Cid{root.Cid()}, nodes)
+
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	out := make(chan *api.AddedOutput, 10)
+	adder := New(dags, api.DefaultAddParams(), out)
+
+	c, err := adder.FromCAR(context.Background(), bytes.NewReader(car))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Equals(root.Cid()) {
+		t.Error("expected the CAR root to be finalized")
+	}
+
+	if len(dags.resultCids) != len(nodes) {
+		t.Fatal("unexpected number of blocks imported")
+	}
+
+	n := 0
+	for range out {
+		n++
+	}
+	if n != len(nodes) {
+		t.Errorf("expected %d output updates, got %d", len(nodes), n)
+	}
+}
+
+func TestAdder_FromCAR_Truncated(t *testing.T) {
+	root, nodes := makeTestDAG(t)
+	car := makeTestCAR(t, []cid.Cid{root.Cid()}, nodes)
+
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	adder := New(dags, api.DefaultAddParams(), nil)
+	_, err := adder.FromCAR(context.Background(), bytes.NewReader(car[:len(car)-5]))
+	if !errors.Is(err, ErrCARTruncated) {
+		t.Fatal("expected a truncated archive error, got:", err)
+	}
+}
+
+func TestAdder_FromCAR_MissingRoot(t *testing.T) {
+	root, nodes := makeTestDAG(t)
+	car := makeTestCAR(t, []cid.Cid{root.Cid()}, nodes[:2])
+
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	adder := New(dags, api.DefaultAddParams(), nil)
+	_, err := adder.FromCAR(context.Background(), bytes.NewReader(car))
+	if err == nil {
+		t.Fatal("expected an error when the root is not in the archive")
+	}
+}
+
+// finalizingDAGServ records the finalized roots.
+type finalizingDAGServ struct {
+	*MemoryDAGService
+	finalized []cid.Cid
+}
+
+func (dags *finalizingDAGServ) Finalize(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	dags.finalized = append(dags.finalized, root)
+	return root, nil
+}
+
+func TestAdder_FromCARRoots(t *testing.T) {
+	root1, nodes := makeTestDAG(t)
+	leaf := dag.NewRawNode([]byte("other leaf"))
+	root2 := &dag.ProtoNode{}
+	if err := root2.AddNodeLink("c", leaf); err != nil {
+		t.Fatal(err)
+	}
+	nodes = append(nodes, leaf, root2)
+	car := makeTestCAR(t, []cid.Cid{root1.Cid(), root2.Cid()}, nodes)
+
+	add := func(roots []cid.Cid, drop bool) (*finalizingDAGServ, *Adder, error) {
+		dags := &finalizingDAGServ{MemoryDAGService: NewMemoryDAGService()}
+		adder := New(dags, api.DefaultAddParams(), nil)
+		_, err := adder.FromCARRoots(context.Background(), bytes.NewReader(car), roots, drop)
+		return dags, adder, err
+	}
+
+	dags, _, err := add([]cid.Cid{root1.Cid()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dags.finalized) != 1 || !dags.finalized[0].Equals(root1.Cid()) {
+		t.Errorf("expected only %s to be finalized, got %v", root1.Cid(), dags.finalized)
+	}
+	if dags.Len() != len(nodes) {
+		t.Errorf("expected all %d blocks to be stored, got %d", len(nodes), dags.Len())
+	}
+
+	dags, _, err = add([]cid.Cid{root1.Cid()}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dags.Len() != 3 {
+		t.Errorf("expected the unreachable blocks to be dropped, %d are stored", dags.Len())
+	}
+	if ok, _ := dags.Has(context.Background(), leaf.Cid()); ok {
+		t.Error("the other leaf should have been dropped")
+	}
+
+	// All the header roots.
+	dags, adder, err := add(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dags.finalized) != 2 || len(adder.Result().Roots) != 2 {
+		t.Error("expected both roots to be finalized")
+	}
+	if !adder.Result().Root.Equals(root2.Cid()) {
+		t.Error("expected the last root as the result root")
+	}
+
+	if _, _, err := add([]cid.Cid{test.Cid1}, false); err == nil {
+		t.Error("expected an error for a root which is not in the archive")
+	}
+
+	// FromCAR still needs a single root.
+	adder = New(NewMemoryDAGService(), api.DefaultAddParams(), nil)
+	if _, err := adder.FromCAR(context.Background(), bytes.NewReader(car)); err == nil {
+		t.Error("expected an error with several roots")
+	}
+}
+
+func TestExportCAR(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	dags := NewMemoryDAGService()
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+	})
+	root, err := New(dags, api.DefaultAddParams(), nil).FromFiles(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportCAR(context.Background(), dags, root, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dags2 := NewMemoryDAGService()
+	root2, err := New(dags2, api.DefaultAddParams(), nil).FromCAR(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root2.Equals(root) {
+		t.Errorf("expected root %s, got %s", root, root2)
+	}
+	if dags2.Len() != len(test.ShardingDirCids) {
+		t.Errorf("expected %d blocks, got %d", len(test.ShardingDirCids), dags2.Len())
+	}
+
+	// fails on missing blocks.
+	nd, _ := dags.Get(context.Background(), root)
+	dags.Remove(context.Background(), nd.Links()[0].Cid)
+	err = ExportCAR(context.Background(), dags, root, &bytes.Buffer{})
+	if err == nil {
+		t.Error("expected an error for a missing block")
+	}
+}
+
+func TestAdder_FromCAR_OnlyHash(t *testing.T) {
+	root, nodes := makeTestDAG(t)
+	car := makeTestCAR(t, []cid.Cid{root.Cid()}, nodes)
+
+	dags := &finalizingDAGServ{MemoryDAGService: NewMemoryDAGService()}
+	p := api.DefaultAddParams()
+	p.OnlyHash = true
+	adder := New(dags, p, nil)
+	c, err := adder.FromCAR(context.Background(), bytes.NewReader(car))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(root.Cid()) {
+		t.Error("expected the CAR root")
+	}
+	if dags.Len() != 0 || len(dags.finalized) != 0 {
+		t.Error("nothing should be stored nor finalized with only-hash")
+	}
+	if adder.Result().Blocks != len(nodes) {
+		t.Error("expected all the blocks to be counted")
+	}
+}
+
+func TestAdder_FromCAR_CidBase(t *testing.T) {
+	root, nodes := makeTestDAG(t)
+	car := makeTestCAR(t, []cid.Cid{root.Cid()}, nodes)
+
+	p := api.DefaultAddParams()
+	p.CidBase = "base58btc"
+	out := make(chan *api.AddedOutput, 10)
+	adder := New(NewMemoryDAGService(), p, out)
+	if _, err := adder.FromCAR(context.Background(), bytes.NewReader(car)); err != nil {
+		t.Fatal(err)
+	}
+	for ao := range out {
+		if ao.Name != p.FormatCid(ao.Cid) {
+			t.Errorf("expected %s to be named with the chosen base, got %s", ao.Cid, ao.Name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// AddFromChannel adds the files received on the given channel, as they
+// arrive, to a directory which is finalized once the channel is closed.
+// Files are named after the order in which they were received ("0", "1",
+// ...), and are added one by one, so the Concurrency and Deterministic
+// parameters have no effect. The total size is not known in advance, so
+// progress has no percentages. When the context is cancelled, no more files
+// are consumed and what was added is cleaned up. The adder will no longer
+// be usable after calling this method.
+func (a *Adder) AddFromChannel(ctx context.Context, fs <-chan files.File) (cid.Cid, error) {
+	a.log.Debugf("adding from channel with params: %+v", a.params)
+
+	a.sequential = true
+	dir := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("", &channelDirectory{adder: a, files: fs}),
+	})
+	defer dir.Close()
+	return a.FromFiles(ctx, dir)
+}
+
+// channelDirectory is a files.Directory whose entries are received on a
+// channel. They can only be listed once, in order.
+type channelDirectory struct {
+	adder *Adder
+	files <-chan files.File
+}
+
+func (d *channelDirectory) Close() error {
+	return nil
+}
+
+func (d *channelDirectory) Size() (int64, error) {
+	return 0, errors.New("the size of files received on a channel is not known")
+}
+
+func (d *channelDirectory) Entries() files.DirIterator {
+	return &channelIterator{dir: d}
+}
+
+type channelIterator struct {
+	dir  *channelDirectory
+	n    int
+	name string
+	file files.File
+	err  error
+}
+
+func (it *channelIterator) Name() string {
+	return it.name
+}
+
+func (it *channelIterator) Node() files.Node {
+	return it.file
+}
+
+// Next waits for the next file, until the channel is closed or adding is
+// cancelled.
+func (it *channelIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	select {
+	case <-it.dir.adder.ctx.Done():
+		it.err = it.dir.adder.ctx.Err()
+		return false
+	case f, ok := <-it.dir.files:
+		if !ok {
+			return false
+		}
+		it.name = strconv.Itoa(it.n)
+		it.file = f
+		it.n++
+		return true
+	}
+}
+
+func (it *channelIterator) Err() error {
+	return it.err
+}
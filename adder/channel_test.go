@@ -0,0 +1,92 @@
+package adder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func TestAdder_AddFromChannel(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Progress = true
+
+	fs := make(chan files.File)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fs <- files.NewBytesFile([]byte(fmt.Sprintf("file %d", i)))
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(fs)
+	}()
+
+	dags := NewMemoryDAGService()
+	out := make(chan *api.AddedOutput, 100)
+	adder := New(dags, p, out)
+	root, err := adder.AddFromChannel(context.Background(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := dags.Get(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := dir.Links()
+	if len(links) != 3 {
+		t.Fatalf("expected 3 links, got %d", len(links))
+	}
+	for i, l := range links {
+		if l.Name != fmt.Sprint(i) {
+			t.Errorf("expected the files named after their order, got %s", l.Name)
+		}
+		if ok, _ := dags.Has(context.Background(), l.Cid); !ok {
+			t.Errorf("file %s was not stored", l.Name)
+		}
+	}
+	if adder.Result().Files != 3 {
+		t.Errorf("expected 3 files, got %d", adder.Result().Files)
+	}
+
+	progress := 0
+	for ao := range out {
+		if ao.Type == "" && ao.Bytes > 0 {
+			progress++
+		}
+	}
+	if progress < 3 {
+		t.Errorf("expected progress for every file, got %d updates", progress)
+	}
+}
+
+func TestAdder_AddFromChannelCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := make(chan files.File, 1)
+	fs <- files.NewBytesFile([]byte("first"))
+
+	dags := NewMemoryDAGService()
+	adder := New(dags, api.DefaultAddParams(), nil)
+	adder.SetOnBlock(func(*api.AddedOutput) error {
+		// the file sent was added, nothing else will come.
+		cancel()
+		return nil
+	})
+	_, err := adder.AddFromChannel(ctx, fs)
+	if err != context.Canceled {
+		t.Fatal("expected a cancellation, got", err)
+	}
+	if dags.Len() != 0 {
+		t.Errorf("the %d blocks added should have been cleaned up", dags.Len())
+	}
+}
@@ -0,0 +1,194 @@
+package adder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrCheckpointMismatch is returned when trying to resume an add from a
+// checkpoint which was created using different parameters.
+var ErrCheckpointMismatch = errors.New("checkpoint: stored params do not match the current add params")
+
+// ErrCheckpointShard is returned when adding with a checkpoint and the Shard
+// parameter. Resumed adds do not add the blocks recorded in the checkpoint
+// again, so they would not be part of any shard.
+var ErrCheckpointShard = errors.New("checkpoint: sharded adds cannot be checkpointed")
+
+// checkpointParams are the parameters which affect how content is chunked
+// and hashed. Resuming is only possible when they have not changed, as
+// otherwise the resulting blocks would be different.
+type checkpointParams struct {
+	Chunker     string `json:"chunker"`
+	Layout      string `json:"layout"`
+	RawLeaves   bool   `json:"raw_leaves"`
+	CidVersion  int    `json:"cid_version"`
+	HashFun     string `json:"hash"`
+	Inline      bool   `json:"inline,omitempty"`
+	InlineLimit int    `json:"inline_limit,omitempty"`
+	MaxLinks    int    `json:"max_links,omitempty"`
+	// RawLeaves is false when set.
+	RawLeavesAuto bool `json:"raw_leaves_auto,omitempty"`
+	// only set with the "auto" layout.
+	TrickleThreshold uint64 `json:"trickle_threshold,omitempty"`
+	NormalizeNames   bool   `json:"normalize_names,omitempty"`
+	// only set when truncating hashes.
+	HashLength int `json:"hash_length,omitempty"`
+}
+
+func newCheckpointParams(p *api.AddParams) checkpointParams {
+	params := checkpointParams{
+		Chunker:    p.Chunker,
+		Layout:     p.Layout,
+		RawLeaves:  p.RawLeaves,
+		CidVersion: p.CidVersion,
+		HashFun:    p.HashFun,
+		MaxLinks:   p.MaxLinks,
+		// names are part of the directory nodes.
+		NormalizeNames: p.NormalizeNames,
+	}
+	if p.RawLeavesAuto {
+		params.RawLeaves = false
+		params.RawLeavesAuto = true
+	}
+	if p.Layout == "auto" {
+		params.TrickleThreshold = p.TrickleThreshold
+	}
+	if p.Inline {
+		params.Inline = true
+		params.InlineLimit = p.InlineLimit
+	}
+	if p.HashLength > 0 {
+		params.HashLength = p.HashLength
+	}
+	return params
+}
+
+// checkpoint wraps a ClusterDAGService and records every stored block in a
+// file. The file contains the checkpointParams object in the first line,
+// followed by one CID per line. When a checkpoint is loaded, blocks already
+// recorded in it are not added again.
+type checkpoint struct {
+	ClusterDAGService
+	log Logger
+
+	f    *os.File
+	enc  *json.Encoder
+	done *cid.Set
+}
+
+// openCheckpoint opens or creates the checkpoint file at the given path.
+func openCheckpoint(path string, dgs ClusterDAGService, p *api.AddParams, log Logger) (*checkpoint, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &checkpoint{
+		ClusterDAGService: dgs,
+		log:               log,
+		f:                 f,
+		enc:               json.NewEncoder(f),
+		done:              cid.NewSet(),
+	}
+
+	err = cp.load(newCheckpointParams(p))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (cp *checkpoint) load(params checkpointParams) error {
+	dec := json.NewDecoder(cp.f)
+	var stored checkpointParams
+	err := dec.Decode(&stored)
+	if err == io.EOF { // new checkpoint
+		return cp.enc.Encode(params)
+	}
+	if err != nil {
+		return err
+	}
+	if stored != params {
+		return ErrCheckpointMismatch
+	}
+
+	good := dec.InputOffset()
+	for {
+		var c cid.Cid
+		err := dec.Decode(&c)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Likely a partially written entry from an interrupted
+			// add. It is discarded and overwritten.
+			cp.log.Warnf("checkpoint: discarding corrupted entry: %s", err)
+			break
+		}
+		cp.done.Add(c)
+		good = dec.InputOffset()
+	}
+	cp.log.Infof("checkpoint: resuming add with %d blocks already stored", cp.done.Len())
+
+	// Continue writing after the last valid entry.
+	err = cp.f.Truncate(good)
+	if err != nil {
+		return err
+	}
+	_, err = cp.f.Seek(good, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = cp.f.Write([]byte("\n"))
+	return err
+}
+
+// Add adds the node to the wrapped DAGService unless the checkpoint says it
+// was already stored.
+func (cp *checkpoint) Add(ctx context.Context, node ipld.Node) error {
+	if cp.done.Has(node.Cid()) {
+		return nil
+	}
+	err := cp.ClusterDAGService.Add(ctx, node)
+	if err != nil {
+		return err
+	}
+	cp.done.Add(node.Cid())
+	return cp.enc.Encode(node.Cid())
+}
+
+// AddMany calls Add for every given node.
+func (cp *checkpoint) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	for _, node := range nodes {
+		err := cp.Add(ctx, node)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the checkpoint file.
+func (cp *checkpoint) Close() error {
+	return cp.f.Close()
+}
+
+// Delete closes and removes the checkpoint file.
+func (cp *checkpoint) Delete() error {
+	cp.Close()
+	return os.Remove(cp.f.Name())
+}
+
+// Cleanup cleans up the wrapped DAGService, if it is a Cleaner.
+func (cp *checkpoint) Cleanup(ctx context.Context, cids []cid.Cid) error {
+	return cleanupDAGService(ctx, cp.ClusterDAGService, cids)
+}
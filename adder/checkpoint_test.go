@@ -0,0 +1,106 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+	"github.com/ipfs/ipfs-cluster/test"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// failingCDAGServ fails after a number of blocks have been added.
+type failingCDAGServ struct {
+	mockCDAGServ
+	failAfter int
+}
+
+func (dag *failingCDAGServ) Add(ctx context.Context, node ipld.Node) error {
+	if len(dag.resultCids) >= dag.failAfter {
+		return errors.New("failing on purpose")
+	}
+	return dag.mockCDAGServ.Add(ctx, node)
+}
+
+func TestAdder_Checkpoint(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	dir, err := ioutil.TempDir("", "adder-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cpPath := filepath.Join(dir, "checkpoint")
+
+	// First add fails half-way.
+	mr, closer := sth.GetTreeMultiReader(t)
+	defer closer.Close()
+	r := multipart.NewReader(mr, mr.Boundary())
+	failing := &failingCDAGServ{
+		mockCDAGServ: mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		},
+		failAfter: 10,
+	}
+	adder := New(failing, api.DefaultAddParams(), nil)
+	adder.SetCheckpoint(cpPath)
+	_, err = adder.FromMultipart(context.Background(), r)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if _, err := os.Stat(cpPath); err != nil {
+		t.Fatal("checkpoint should exist after a failed add")
+	}
+
+	// Resuming with other params fails.
+	mr2, closer2 := sth.GetTreeMultiReader(t)
+	defer closer2.Close()
+	r2 := multipart.NewReader(mr2, mr2.Boundary())
+	p := api.DefaultAddParams()
+	p.Chunker = "size-1000"
+	adder = New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+	adder.SetCheckpoint(cpPath)
+	_, err = adder.FromMultipart(context.Background(), r2)
+	if err != ErrCheckpointMismatch {
+		t.Fatal("expected a checkpoint mismatch error, got:", err)
+	}
+
+	// Resume skips the stored blocks.
+	mr3, closer3 := sth.GetTreeMultiReader(t)
+	defer closer3.Close()
+	r3 := multipart.NewReader(mr3, mr3.Boundary())
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	adder = New(dags, api.DefaultAddParams(), nil)
+	adder.SetCheckpoint(cpPath)
+	root, err := adder.FromMultipart(context.Background(), r3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root.String() != test.ShardingDirBalancedRootCID {
+		t.Error("expected the right content root")
+	}
+
+	if len(dags.resultCids)+len(failing.resultCids) != len(test.ShardingDirCids) {
+		t.Errorf("expected the resumed add to skip the %d stored blocks", len(failing.resultCids))
+	}
+	for c := range failing.resultCids {
+		if _, ok := dags.resultCids[c]; ok {
+			t.Error("block was added twice:", c)
+		}
+	}
+
+	if _, err := os.Stat(cpPath); !os.IsNotExist(err) {
+		t.Error("checkpoint should be removed after a successful add")
+	}
+}
@@ -0,0 +1,25 @@
+package adder
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+)
+
+func TestAdder_BadChunker(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Chunker = "size-abc"
+	dags := &mockCDAGServ{
+		resultCids: make(map[string]struct{}),
+	}
+	adder := New(dags, p, nil)
+	_, err := adder.FromReader(context.Background(), strings.NewReader("hello"), "")
+	if err == nil || !strings.Contains(err.Error(), "abc") {
+		t.Fatal("expected an error naming the bad token, got:", err)
+	}
+	if len(dags.resultCids) != 0 {
+		t.Error("nothing should have been added")
+	}
+}
@@ -0,0 +1,72 @@
+package adder
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// decompressedDirectory wraps a directory so that its files, at any depth,
+// are decompressed with gzip as they are read.
+type decompressedDirectory struct {
+	files.Directory
+}
+
+func (d decompressedDirectory) Size() (int64, error) {
+	return 0, errors.New("the size of decompressed files is not known")
+}
+
+func (d decompressedDirectory) Entries() files.DirIterator {
+	return decompressedIterator{d.Directory.Entries()}
+}
+
+type decompressedIterator struct {
+	files.DirIterator
+}
+
+func (it decompressedIterator) Node() files.Node {
+	return decompressed(it.DirIterator.Node())
+}
+
+// decompressed returns the given node with its files decompressed. Symlinks
+// are left as they are.
+func decompressed(nd files.Node) files.Node {
+	switch nd := nd.(type) {
+	case *files.Symlink:
+		return nd
+	case files.Directory:
+		return decompressedDirectory{nd}
+	case files.File:
+		return files.NewReaderFile(&gzipReader{f: nd})
+	default:
+		return nd
+	}
+}
+
+// gzipReader decompresses a file, starting on the first read so that
+// errors in the gzip header fail reading the file.
+type gzipReader struct {
+	f  files.File
+	zr *gzip.Reader
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	if r.zr == nil {
+		zr, err := gzip.NewReader(r.f)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, fmt.Errorf("decompressing: %w", err)
+		}
+		r.zr = zr
+	}
+	return r.zr.Read(p)
+}
+
+func (r *gzipReader) Close() error {
+	return r.f.Close()
+}
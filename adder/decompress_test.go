@@ -0,0 +1,91 @@
+package adder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"mime/multipart"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAdder_Decompress(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world\n"), 100000)
+	p := api.DefaultAddParams()
+	plain, err := New(NewMemoryDAGService(), p, nil).FromReader(context.Background(), bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Decompress = "gzip"
+	root, err := New(NewMemoryDAGService(), p, nil).FromReader(context.Background(), bytes.NewReader(gzipped(t, data)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(plain) {
+		t.Errorf("expected the CID of the original file %s, got %s", plain, root)
+	}
+
+	_, err = New(NewMemoryDAGService(), p, nil).FromReader(context.Background(), bytes.NewReader(data), "")
+	if err == nil {
+		t.Error("expected an error adding uncompressed content")
+	}
+}
+
+func TestAdder_DecompressMultipart(t *testing.T) {
+	newDir := func(a, b []byte) files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile(a)),
+				files.FileEntry("b", files.NewBytesFile(b)),
+			})),
+		})
+	}
+	a, b := []byte("some content"), bytes.Repeat([]byte("b"), 1<<20)
+
+	p := api.DefaultAddParams()
+	plain, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), newDir(a, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Decompress = "gzip"
+	mfr := files.NewMultiFileReader(newDir(gzipped(t, a), gzipped(t, b)), true)
+	root, err := New(NewMemoryDAGService(), p, nil).FromMultipart(context.Background(), multipart.NewReader(mfr, mfr.Boundary()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(plain) {
+		t.Errorf("expected the CID of the original files %s, got %s", plain, root)
+	}
+}
+
+func TestAdder_DecompressBomb(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Decompress = "gzip"
+	p.MaxTotalSize = 1 << 20
+	bomb := gzipped(t, make([]byte, 100<<20))
+	if len(bomb) > int(p.MaxTotalSize) {
+		t.Fatal("the compressed content should be under the limit")
+	}
+	_, err := New(NewMemoryDAGService(), p, nil).FromReader(context.Background(), bytes.NewReader(bomb), "")
+	if !errors.Is(err, ErrAddTooLarge) {
+		t.Error("expected ErrAddTooLarge, got", err)
+	}
+}
@@ -0,0 +1,51 @@
+package adder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// FromFilesystem adds the file or directory at the given path on the local
+// filesystem, named after its last element. Directories require the
+// Recursive parameter and are read as they are added. Hidden files are only
+// included when the Hidden parameter is set, and are reported as skipped on
+// progress otherwise. Symlinks are handled as the Symlinks parameter says:
+// relative targets are followed from the directory of the link, as long as
+// they stay within the added path. File modes and modification times are
+// not preserved, as the UnixFS implementation in use (go-unixfs v0.2.4)
+// cannot store UnixFS 1.5 metadata.
+// The adder will no longer be usable after calling this method.
+func (a *Adder) FromFilesystem(ctx context.Context, path string) (cid.Cid, error) {
+	a.log.Debugf("adding %s with params: %+v", path, a.params)
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return cid.Undef, err
+	}
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if stat.IsDir() && !a.params.Recursive {
+		return cid.Undef, fmt.Errorf("%s is a directory, but Recursive option is not set", path)
+	}
+
+	// hidden files are left out by the ipfs adder, which reports them.
+	a.skipHidden = !a.params.Hidden
+	// relative symlink targets are followed from where the links are.
+	a.diskRoot = filepath.Dir(path)
+	f, err := files.NewSerialFile(path, true, stat)
+	if err != nil {
+		return cid.Undef, err
+	}
+	dir := files.NewSliceDirectory(
+		[]files.DirEntry{files.FileEntry(filepath.Base(path), f)},
+	)
+	defer dir.Close()
+	return a.FromFiles(ctx, dir)
+}
@@ -0,0 +1,166 @@
+package adder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func TestAdder_FromFilesystem(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "adder-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	base := filepath.Join(tmp, "tree")
+	write := func(name, data string) {
+		p := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", "a")
+	write(".hidden", "hidden")
+	write("sub/b", "b")
+	if err := os.Symlink("sub/b", filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// expected returns the root of the same tree built in memory.
+	expected := func(p *api.AddParams, hidden, link bool) cid.Cid {
+		var entries []files.DirEntry
+		if hidden {
+			entries = append(entries, files.FileEntry(".hidden", files.NewBytesFile([]byte("hidden"))))
+		}
+		entries = append(entries, files.FileEntry("a", files.NewBytesFile([]byte("a"))))
+		if link {
+			entries = append(entries, files.FileEntry("link", files.NewLinkFile("sub/b", nil)))
+		}
+		entries = append(entries, files.FileEntry("sub", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("b", files.NewBytesFile([]byte("b"))),
+		})))
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("tree", files.NewSliceDirectory(entries)),
+		})
+		root, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+
+	tcs := []struct {
+		name   string
+		set    func(p *api.AddParams)
+		hidden bool
+		link   bool
+	}{
+		{"default", func(p *api.AddParams) {}, false, true},
+		{"hidden", func(p *api.AddParams) { p.Hidden = true }, true, true},
+		{"skip symlinks", func(p *api.AddParams) { p.Symlinks = "skip" }, false, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			p := api.DefaultAddParams()
+			p.Recursive = true
+			tc.set(p)
+			root, err := New(NewMemoryDAGService(), p, nil).FromFilesystem(context.Background(), base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exp := expected(p, tc.hidden, tc.link); !root.Equals(exp) {
+				t.Errorf("expected %s, got %s", exp, root)
+			}
+		})
+	}
+
+	t.Run("file", func(t *testing.T) {
+		p := api.DefaultAddParams()
+		root, err := New(NewMemoryDAGService(), p, nil).FromFilesystem(context.Background(), filepath.Join(base, "sub", "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("b", files.NewBytesFile([]byte("b"))),
+		})
+		exp, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !root.Equals(exp) {
+			t.Errorf("expected %s, got %s", exp, root)
+		}
+	})
+
+	t.Run("not recursive", func(t *testing.T) {
+		_, err := New(NewMemoryDAGService(), api.DefaultAddParams(), nil).FromFilesystem(context.Background(), base)
+		if err == nil {
+			t.Error("expected an error adding a directory without recursive")
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := New(NewMemoryDAGService(), api.DefaultAddParams(), nil).FromFilesystem(context.Background(), filepath.Join(tmp, "missing"))
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestAdder_FromFilesystemSkippedHidden(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "adder-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, name := range []string{"a", ".env", ".git/config"} {
+		p := filepath.Join(tmp, "tree", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	skipped := func(progress bool) []string {
+		p := api.DefaultAddParams()
+		p.Recursive = true
+		p.Progress = progress
+		out := make(chan *api.AddedOutput, 100)
+		_, err := New(NewMemoryDAGService(), p, out).FromFilesystem(context.Background(), filepath.Join(tmp, "tree"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for ao := range out {
+			if ao.Skipped {
+				if ao.SkipReason != api.SkipHidden {
+					t.Errorf("%s: unexpected reason: %s", ao.Name, ao.SkipReason)
+				}
+				names = append(names, ao.Name)
+			}
+		}
+		return names
+	}
+
+	// hidden directories are skipped with their contents.
+	if names := skipped(true); len(names) != 2 || names[0] != "tree/.env" || names[1] != "tree/.git" {
+		t.Errorf("unexpected skipped entries: %v", names)
+	}
+	if names := skipped(false); len(names) != 0 {
+		t.Errorf("skipped entries should only be reported on progress: %v", names)
+	}
+}
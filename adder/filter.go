@@ -0,0 +1,94 @@
+package adder
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathFilter decides which entries are added based on include and exclude
+// glob patterns. Patterns follow path.Match semantics and are matched
+// against the path of the entries relative to the content being added. A
+// "**" path segment matches any number of segments.
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+// newPathFilter returns a pathFilter for the given patterns or nil when there
+// are none.
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	for _, p := range append(append([]string{}, include...), exclude...) {
+		for _, seg := range strings.Split(p, "/") {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, fmt.Errorf("bad filter pattern %q: %s", p, err)
+			}
+		}
+	}
+	return &pathFilter{
+		include: include,
+		exclude: exclude,
+	}, nil
+}
+
+// skip returns true when the entry at the given path should not be added.
+// Excluded directories are skipped with all their contents. Include patterns
+// only apply to files, as directories must be traversed to find them.
+func (pf *pathFilter) skip(p string, dir bool) bool {
+	// Entries may come without their parent directories (i.e. from
+	// tar archives), so parents are checked too.
+	for parent := p; parent != "." && parent != "/"; parent = path.Dir(parent) {
+		if matchAny(pf.exclude, parent) {
+			return true
+		}
+	}
+	if dir || len(pf.include) == 0 {
+		return false
+	}
+	return !matchAny(pf.include, p)
+}
+
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		// patterns were validated already
+		if ok, _ := matchPattern(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern reports whether the path matches the pattern.
+func matchPattern(pattern, p string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(pattern, p []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try consuming any number of path segments
+			for i := 0; i <= len(p); i++ {
+				ok, err := matchSegments(pattern[1:], p[i:])
+				if ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(p) == 0 {
+			return false, nil
+		}
+
+		ok, err := path.Match(pattern[0], p[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, p = pattern[1:], p[1:]
+	}
+	return len(p) == 0, nil
+}
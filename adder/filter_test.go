@@ -0,0 +1,45 @@
+package adder
+
+import "testing"
+
+func TestPathFilter(t *testing.T) {
+	pf, err := newPathFilter(
+		[]string{"**/*.go", "dir/README"},
+		[]string{"**/node_modules", "**/*_test.go"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path string
+		dir  bool
+		skip bool
+	}{
+		{"dir/main.go", false, false},
+		{"dir/sub/deep/util.go", false, false},
+		{"dir/README", false, false},
+		{"dir/sub/README", false, true},
+		{"dir/main_test.go", false, true},
+		{"dir/sub", true, false},
+		{"dir/node_modules", true, true},
+		{"dir/node_modules/pkg/index.go", false, true},
+		{"dir/notes.txt", false, true},
+	}
+
+	for _, tc := range testCases {
+		if pf.skip(tc.path, tc.dir) != tc.skip {
+			t.Errorf("%s: expected skip to be %t", tc.path, tc.skip)
+		}
+	}
+
+	pf, err = newPathFilter(nil, nil)
+	if err != nil || pf != nil {
+		t.Error("expected no filter without patterns")
+	}
+
+	_, err = newPathFilter(nil, []string{"dir/[a"})
+	if err == nil {
+		t.Error("expected an error with a bad pattern")
+	}
+}
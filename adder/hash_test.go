@@ -0,0 +1,170 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+func TestAdder_HashFunctions(t *testing.T) {
+	hashes := []string{"sha2-256", "SHA3-512", "blake2b-256", "keccak-256", "blake3"}
+	seen := make(map[string]struct{})
+
+	for _, h := range hashes {
+		p := api.DefaultAddParams()
+		p.HashFun = h
+		p.RawLeaves = true
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		}
+		adder := New(dags, p, nil)
+		root, err := adder.FromReader(context.Background(), strings.NewReader("hello world\n"), "")
+		if err != nil {
+			t.Fatal(h, err)
+		}
+
+		if _, ok := seen[root.String()]; ok {
+			t.Error("different hash functions should produce different CIDs")
+		}
+		seen[root.String()] = struct{}{}
+
+		c, err := cid.Decode(root.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dmh, err := multihash.Decode(c.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hf, _ := api.ResolveHashFunction(h)
+		if dmh.Code != hf.Code || dmh.Length != hf.Length {
+			t.Errorf("%s: unexpected multihash %s (%d bytes)", h, dmh.Name, dmh.Length)
+		}
+
+		// CIDv0 only works with sha2-256.
+		if c.Version() == 0 && dmh.Code != multihash.SHA2_256 {
+			t.Errorf("%s: CIDv0 should have been upgraded", h)
+		}
+	}
+}
+
+func TestAdder_UnsupportedHashFunction(t *testing.T) {
+	for _, h := range []string{"blake2s-8", "keccak-384", "murmur3-128", "sha4-256", "x11"} {
+		p := api.DefaultAddParams()
+		p.HashFun = h
+		adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+		_, err := adder.FromReader(context.Background(), strings.NewReader("hello world\n"), "")
+		if err == nil || !strings.Contains(err.Error(), h) {
+			t.Errorf("%s: expected an error naming the hash function, got: %s", h, err)
+		}
+	}
+}
+
+func TestAdder_IdentityHash(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.HashFun = "identity"
+	p.RawLeaves = true
+	dags := NewMemoryDAGService()
+	adder := New(dags, p, nil)
+	root, err := adder.FromReader(context.Background(), strings.NewReader("hello world\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := cid.Decode(root.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dmh, err := multihash.Decode(c.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dmh.Code != multihash.IDENTITY || string(dmh.Digest) != "hello world\n" {
+		t.Errorf("expected the data inlined in the CID, got %s: %q", dmh.Name, dmh.Digest)
+	}
+	if dags.Len() != 0 {
+		t.Error("inlined blocks should not be stored")
+	}
+
+	// blocks over the limit fail.
+	p.InlineLimit = 8
+	adder = New(NewMemoryDAGService(), p, nil)
+	_, err = adder.FromReader(context.Background(), strings.NewReader("hello world\n"), "")
+	if !errors.Is(err, ErrIdentityTooLarge) {
+		t.Error("expected ErrIdentityTooLarge, got", err)
+	}
+
+	// as do roots over the limit, even when their leaves are not.
+	p.InlineLimit = 32
+	dir := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello world\n"))),
+			files.FileEntry("b", files.NewBytesFile([]byte("hello again\n"))),
+		})),
+	})
+	adder = New(NewMemoryDAGService(), p, nil)
+	_, err = adder.FromFiles(context.Background(), dir)
+	if !errors.Is(err, ErrIdentityTooLarge) {
+		t.Error("expected ErrIdentityTooLarge for the directory, got", err)
+	}
+}
+
+func TestAdder_HashLength(t *testing.T) {
+	for _, h := range []string{"sha2-256", "blake2b-256", "sha3-512"} {
+		p := api.DefaultAddParams()
+		p.HashFun = h
+		p.HashLength = 20
+		p.VerifyAfterAdd = true
+		content := strings.Repeat("hello world\n", 100000)
+		root, err := New(NewMemoryDAGService(), p, nil).FromReader(context.Background(), strings.NewReader(content), "")
+		if err != nil {
+			t.Fatal(h, err)
+		}
+
+		dmh, err := multihash.Decode(root.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hf, _ := api.ResolveHashFunction(h)
+		if dmh.Code != hf.Code || dmh.Length != 20 || len(dmh.Digest) != 20 {
+			t.Errorf("%s: expected a 20 bytes digest, got %s (%d bytes)", h, dmh.Name, dmh.Length)
+		}
+		if root.Version() != 1 {
+			t.Errorf("%s: truncated hashes need CIDv1", h)
+		}
+	}
+}
+
+func TestAdder_HashFunctionCodes(t *testing.T) {
+	tcs := []struct {
+		hashFun string
+		code    uint64
+	}{
+		{"sha2-256", multihash.SHA2_256},
+		{"blake3", multihash.BLAKE3},
+		{"sha3-512", multihash.SHA3_512},
+	}
+	for _, tc := range tcs {
+		p := api.DefaultAddParams()
+		p.HashFun = tc.hashFun
+		p.VerifyAfterAdd = true
+		root, err := New(NewMemoryDAGService(), p, nil).FromReader(context.Background(), strings.NewReader("hello world\n"), "")
+		if err != nil {
+			t.Fatal(tc.hashFun, err)
+		}
+		dmh, err := multihash.Decode(root.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dmh.Code != tc.code {
+			t.Errorf("%s: expected multihash code %#x, got %#x", tc.hashFun, tc.code, dmh.Code)
+		}
+	}
+}
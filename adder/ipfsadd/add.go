@@ -6,13 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	gopath "path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/ipfs/ipfs-cluster/api"
 
 	cid "github.com/ipfs/go-cid"
-	chunker "github.com/ipfs/go-ipfs-chunker"
 	files "github.com/ipfs/go-ipfs-files"
 	posinfo "github.com/ipfs/go-ipfs-posinfo"
 	ipld "github.com/ipfs/go-ipld-format"
@@ -23,6 +26,8 @@ import (
 	balanced "github.com/ipfs/go-unixfs/importer/balanced"
 	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
 	trickle "github.com/ipfs/go-unixfs/importer/trickle"
+	multihash "github.com/multiformats/go-multihash"
+	"go.opencensus.io/trace"
 )
 
 var log = logging.Logger("coreunix")
@@ -36,11 +41,15 @@ var liveCacheSize = uint64(256 << 10)
 func NewAdder(ctx context.Context, ds ipld.DAGService) (*Adder, error) {
 	// Cluster: we don't use pinner nor GCLocker.
 	return &Adder{
-		ctx:        ctx,
-		dagService: ds,
-		Progress:   false,
-		Trickle:    false,
-		Chunker:    "",
+		ctx:         ctx,
+		dagService:  ds,
+		Progress:    false,
+		Trickle:     false,
+		Chunker:     "",
+		TotalSize:   -1,
+		shardedDirs: make(map[string]ipld.Node),
+		dirsOutput:  make(map[string]struct{}),
+		throughput:  newThroughput(time.Now()),
 	}, nil
 }
 
@@ -65,6 +74,90 @@ type Adder struct {
 	// filename in the case of single files here and emit those events
 	// correctly from the beginning).
 	OutputPrefix string
+	// Cluster: total size of the content being added, used to report
+	// progress percentages. -1 when unknown.
+	TotalSize  int64
+	bytesRead  int64
+	throughput *throughput
+	// Cluster: number of files added, for the add result.
+	addedFiles int64
+	// Cluster: names of the files added by root CID, to report
+	// duplicates.
+	files fileCids
+	// Cluster: CIDs of the directories and symlinks added, for the
+	// manifest.
+	entries entryCids
+	// Cluster: directories with more entries than this are converted
+	// to HAMT shards. 0 disables sharding.
+	ShardingThreshold int
+	shardedDirs       map[string]ipld.Node
+	// Cluster: directories are output as soon as they are complete.
+	// These are the paths of the directories already output.
+	dirsOutput map[string]struct{}
+	// Cluster: number of top-level entries added in parallel, each by
+	// its own entry adder. 0 or 1 add them sequentially.
+	Concurrency int
+	// Cluster: how to add symlinks: "follow", "skip" or "preserve"
+	// (default).
+	Symlinks string
+	// Cluster: the directory on disk holding the added top-level
+	// entries, if known. Relative symlink targets are resolved against
+	// it when following symlinks.
+	DiskRoot string
+	// Cluster: entries for which Skip returns true are not added. It
+	// receives the output name of the entry.
+	Skip func(name string, dir bool) bool
+	// Cluster: non-fatal issues are sent to Warnings, when set, without
+	// blocking.
+	Warnings chan<- *api.AddWarning
+	// Cluster: entries whose names start with a dot are not added when
+	// set. Files read from disk are filtered here rather than when
+	// listing directories so that they can be reported.
+	SkipHidden bool
+	// Cluster: names of the .gitignore-style files whose rules apply
+	// to the rest of the directory they are in and its subdirectories.
+	IgnoreRulesFiles []string
+	ignoreStack      []ignoreLevel
+	// Cluster: set for entry adders. Progress is tracked by the parent.
+	parent *Adder
+	// Cluster: report and leave out files which fail to be added,
+	// rather than aborting.
+	SkipFailedFiles bool
+	failedFiles     int64
+	// Cluster: add the entries of every directory sorted by name. All
+	// the entries of a directory are listed before adding them.
+	Deterministic bool
+	// Cluster: formats CIDs used as names in the output, if set.
+	FormatCid func(cid.Cid) string
+	// Cluster: wraps the readers of the files being added, if set (i.e.
+	// to limit the rate at which they are read).
+	WrapReader func(io.Reader) io.Reader
+	// Cluster: files larger than this fail to be added. 0 means no
+	// limit.
+	MaxFileSize uint64
+	// Cluster: maximum number of links of the intermediate nodes of
+	// file DAGs. 0 means ihelper.DefaultLinksPerBlock.
+	MaxLinks int
+	// Cluster: when set, files larger than TrickleThreshold use the
+	// trickle layout and the rest use the balanced one, regardless of
+	// Trickle. Files of unknown size use the balanced layout.
+	AutoLayout       bool
+	TrickleThreshold uint64
+	// Cluster: decide whether to use raw leaves for every file from its
+	// content type.
+	RawLeavesAuto bool
+	// Cluster: normalize the names of directory entries before
+	// linking them.
+	NormalizeNames bool
+	// Cluster: detect the content type of every file and set it in its
+	// output.
+	DetectMIME bool
+	// Cluster: fail adding files whose size changed while reading them,
+	// instead of warning about it.
+	StrictSize bool
+	// Cluster: transform the content of every file, given its output
+	// name, before chunking it. Failures fail adding the file.
+	Transform func(name string, r io.Reader) (io.Reader, error)
 }
 
 func (adder *Adder) mfsRoot() (*mfs.Root, error) {
@@ -87,18 +180,23 @@ func (adder *Adder) SetMfsRoot(r *mfs.Root) {
 }
 
 // Constructs a node from reader's data, and adds it. Doesn't pin.
-func (adder *Adder) add(reader io.Reader) (ipld.Node, error) {
-	chnk, err := chunker.FromString(reader, adder.Chunker)
+func (adder *Adder) add(reader io.Reader, useTrickle, rawLeaves bool) (ipld.Node, error) {
+	chnk, err := newSplitter(reader, adder.Chunker)
 	if err != nil {
 		return nil, err
 	}
 
 	// Cluster: we don't do batching/use BufferedDS.
 
+	maxLinks := ihelper.DefaultLinksPerBlock
+	if adder.MaxLinks > 0 {
+		maxLinks = adder.MaxLinks
+	}
+
 	params := ihelper.DagBuilderParams{
 		Dagserv:    adder.dagService,
-		RawLeaves:  adder.RawLeaves,
-		Maxlinks:   ihelper.DefaultLinksPerBlock,
+		RawLeaves:  rawLeaves,
+		Maxlinks:   maxLinks,
 		NoCopy:     adder.NoCopy,
 		CidBuilder: adder.CidBuilder,
 	}
@@ -109,7 +207,7 @@ func (adder *Adder) add(reader io.Reader) (ipld.Node, error) {
 	}
 
 	var nd ipld.Node
-	if adder.Trickle {
+	if useTrickle {
 		nd, err = trickle.Layout(db)
 	} else {
 		nd, err = balanced.Layout(db)
@@ -169,44 +267,109 @@ func (adder *Adder) outputDirs(path string, fsn mfs.FSNode) error {
 	case *mfs.File:
 		return nil
 	case *mfs.Directory:
-		names, err := fsn.ListNames(adder.ctx)
+		// Cluster: the subtree was output already.
+		if _, ok := adder.dirsOutput[path]; ok {
+			return nil
+		}
+
+		err := adder.outputDirChildren(path, fsn)
 		if err != nil {
 			return err
 		}
 
-		for _, name := range names {
-			child, err := fsn.Child(name)
-			if err != nil {
-				// This fails when Child is of type *mfs.File
-				// because it tries to get them from the DAG
-				// service (does not implement this and returns
-				// a "not found" error)
-				// *mfs.Files are ignored in the recursive call
-				// anyway.
-				// For Cluster, we just ignore errors here.
-				continue
-			}
-
-			childpath := gopath.Join(path, name)
-			err = adder.outputDirs(childpath, child)
+		nd, ok := adder.shardedDirs[path]
+		if !ok {
+			nd, err = fsn.GetNode()
 			if err != nil {
 				return err
 			}
+		}
+
+		return adder.outputDir(path, nd)
+	default:
+		return fmt.Errorf("unrecognized fsn type: %#v", fsn)
+	}
+}
+
+func (adder *Adder) outputDirChildren(path string, dir *mfs.Directory) error {
+	names, err := dir.ListNames(adder.ctx)
+	if err != nil {
+		return err
+	}
 
-			fsn.Uncache(name)
+	for _, name := range names {
+		childpath := gopath.Join(path, name)
+		child, err := dir.Child(name)
+		if err != nil {
+			// This fails when Child is of type *mfs.File
+			// because it tries to get them from the DAG
+			// service (does not implement this and returns
+			// a "not found" error)
+			// *mfs.Files are ignored in the recursive call
+			// anyway.
+			// For Cluster, we just ignore errors here.
+			// Cluster: this also fails for directories replaced
+			// by HAMT shards, whose subtree events were already
+			// sent.
+			if nd, ok := adder.shardedDirs[childpath]; ok {
+				err = adder.outputDir(childpath, nd)
+				if err != nil {
+					return err
+				}
+			}
+			continue
 		}
-		nd, err := fsn.GetNode()
+
+		err = adder.outputDirs(childpath, child)
 		if err != nil {
 			return err
 		}
 
-		return adder.outputDagnode(adder.Out, path, nd)
-	default:
-		return fmt.Errorf("unrecognized fsn type: %#v", fsn)
+		dir.Uncache(name)
 	}
+	return nil
+}
+
+// Cluster: outputDir outputs the directory node unless it was output
+// already.
+func (adder *Adder) outputDir(path string, nd ipld.Node) error {
+	if _, ok := adder.dirsOutput[path]; ok {
+		return nil
+	}
+	adder.dirsOutput[path] = struct{}{}
+	if name := adder.outputName(path); name != "" {
+		adder.addEntryCid(name+"/", nd.Cid())
+	}
+	return adder.outputDagnode(adder.Out, path, nd)
+}
+
+// Cluster: outputCompleteDir outputs the directory at path once all its
+// entries have been added. The root directory is output when finishing.
+func (adder *Adder) outputCompleteDir(path string) error {
+	if nd, ok := adder.shardedDirs[path]; ok {
+		return adder.outputDir(path, nd)
+	}
+
+	mr, err := adder.mfsRoot()
+	if err != nil {
+		return err
+	}
+	fsn, err := mfs.Lookup(mr, path)
+	if err != nil {
+		return err
+	}
+	dir, ok := fsn.(*mfs.Directory)
+	if !ok {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		return err
+	}
+	return adder.outputDir(path, nd)
 }
 
-func (adder *Adder) addNode(node ipld.Node, path string) error {
+func (adder *Adder) addNode(node ipld.Node, path, entryType string, byReference bool, contentType string) error {
 	// patch it into the root
 	outputName := path
 	if path == "" {
@@ -247,8 +410,28 @@ func (adder *Adder) addNode(node ipld.Node, path string) error {
 	}
 	adder.lastFile = lastFile
 
-	if !adder.Silent {
-		return adder.outputDagnode(adder.Out, outputName, node)
+	// Cluster: count added files.
+	if entryType == api.AddedFile {
+		adder.addAddedFile()
+		name := adder.outputName(outputName)
+		if name == "" {
+			name = adder.formatCid(node.Cid())
+		}
+		adder.addFileCid(node.Cid(), name)
+	}
+	if entryType == api.AddedSymlink {
+		adder.addEntryCid(adder.outputName(outputName), node.Cid())
+	}
+
+	if !adder.Silent && adder.Out != nil {
+		ao, err := adder.newAddedOutput(outputName, node)
+		if err != nil {
+			return err
+		}
+		ao.Type = entryType
+		ao.ByReference = byReference
+		ao.ContentType = contentType
+		adder.Out <- ao
 	}
 	return nil
 }
@@ -260,6 +443,30 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 		return nil, err
 	}
 
+	// if adding a file without wrapping, swap the root to it (when adding a
+	// directory, mfs root is the directory)
+	_, dir := file.(files.Directory)
+	if dir {
+		return adder.finish(false, "")
+	}
+	// Cluster: top-level files are put in the mfs root named after their
+	// CIDs, next to the top-level files added before them. Swap the root
+	// to the one just added rather than to the first one by name.
+	var name string
+	if adder.lastFile != nil {
+		nd, err := adder.lastFile.GetNode()
+		if err != nil {
+			return nil, err
+		}
+		name = nd.Cid().String()
+	}
+	return adder.finish(true, name)
+}
+
+// Cluster: finish flushes the mfs root, outputs the directory events and
+// returns the root node. When swap is set, the root is replaced by its child
+// with the given name, or by its first child when the name is empty.
+func (adder *Adder) finish(swap bool, name string) (ipld.Node, error) {
 	// get root
 	mr, err := adder.mfsRoot()
 	if err != nil {
@@ -274,11 +481,7 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 		return nil, err
 	}
 
-	// if adding a file without wrapping, swap the root to it (when adding a
-	// directory, mfs root is the directory)
-	_, dir := file.(files.Directory)
-	var name string
-	if !dir {
+	if swap {
 		children, err := rootdir.ListNames(adder.ctx)
 		if err != nil {
 			return nil, err
@@ -289,7 +492,9 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 		}
 
 		// Replace root with the first child
-		name = children[0]
+		if name == "" {
+			name = children[0]
+		}
 		root, err = rootdir.Child(name)
 		if err != nil {
 			// Cluster: use the last file we added
@@ -311,6 +516,18 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 		return nil, err
 	}
 
+	// Cluster: shard the root directory if needed.
+	if _, dir := root.(*mfs.Directory); dir {
+		shardNd, err := adder.shardNode(nd)
+		if err != nil {
+			return nil, err
+		}
+		if shardNd != nil {
+			nd = shardNd
+			adder.shardedDirs[name] = nd
+		}
+	}
+
 	// output directory events
 	err = adder.outputDirs(name, root)
 	if err != nil {
@@ -327,6 +544,11 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 func (adder *Adder) addFileNode(path string, file files.Node, toplevel bool) error {
 	defer file.Close()
 
+	// Cluster: leave out filtered entries.
+	if !toplevel && adder.skip(path, file) {
+		return nil
+	}
+
 	if adder.liveNodes >= liveCacheSize {
 		// TODO: A smarter cache that uses some sort of lru cache with an eviction handler
 		mr, err := adder.mfsRoot()
@@ -345,9 +567,19 @@ func (adder *Adder) addFileNode(path string, file files.Node, toplevel bool) err
 	case files.Directory:
 		return adder.addDir(path, f, toplevel)
 	case *files.Symlink:
-		return adder.addSymlink(path, f)
+		// Cluster: symlinks can be followed or skipped.
+		switch adder.Symlinks {
+		case "follow":
+			return adder.skipFailed(path, adder.followSymlink(path, f), toplevel)
+		case "skip":
+			adder.warn(path, api.WarnSymlinkSkipped, "symlink to %s skipped", f.Target)
+			return nil
+		default:
+			return adder.addSymlink(path, f)
+		}
 	case files.File:
-		return adder.addFile(path, f)
+		// Cluster: failed files may be skipped.
+		return adder.skipFailed(path, adder.addFile(path, f), toplevel)
 	default:
 		return errors.New("unknown file type")
 	}
@@ -366,15 +598,100 @@ func (adder *Adder) addSymlink(path string, l *files.Symlink) error {
 		return err
 	}
 
-	return adder.addNode(dagnode, path)
+	return adder.addNode(dagnode, path, api.AddedSymlink, false, "")
+}
+
+// followSymlink adds the file that the symlink points to in its place.
+// Cluster: relative targets are resolved against the directory of the
+// symlink on disk, which is only known when DiskRoot is set, and cannot
+// point outside the top-level entry being added. Symlinks to directories
+// are not followed to avoid loops.
+func (adder *Adder) followSymlink(path string, l *files.Symlink) error {
+	target := l.Target
+	if !filepath.IsAbs(target) {
+		if adder.DiskRoot == "" {
+			return fmt.Errorf("cannot follow symlink %s: target %s is not an absolute path", adder.outputName(path), l.Target)
+		}
+		link := filepath.Join(adder.DiskRoot, filepath.FromSlash(adder.outputName(path)))
+		top := filepath.Join(adder.DiskRoot, filepath.FromSlash(adder.OutputPrefix))
+		target = filepath.Join(filepath.Dir(link), target)
+		if !strings.HasPrefix(target, top+string(filepath.Separator)) {
+			return fmt.Errorf("cannot follow symlink %s: target %s is outside of the added directory", adder.outputName(path), l.Target)
+		}
+	}
+
+	stat, err := os.Stat(target)
+	if err != nil {
+		return fmt.Errorf("cannot follow symlink %s: %s", adder.outputName(path), err)
+	}
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("cannot follow symlink %s: target %s is not a regular file", adder.outputName(path), target)
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	rf, err := files.NewReaderPathFile(target, f, stat)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer rf.Close()
+	return adder.addFile(path, rf)
 }
 
 func (adder *Adder) addFile(path string, file files.File) error {
+	// Cluster: trace adding every file.
+	_, span := trace.StartSpan(adder.ctx, "adder/addFile")
+	defer span.End()
+	if span.IsRecordingEvents() {
+		span.AddAttributes(trace.StringAttribute("name", adder.outputName(path)))
+	}
+
+	// Cluster: nocopy only works when adding files which are on disk, as
+	// they are.
+	byReference := false
+	if adder.NoCopy {
+		fi, ok := file.(files.FileInfo)
+		if !ok || fi.AbsPath() == "" {
+			return fmt.Errorf("cannot add %s with nocopy: not backed by a file on disk", adder.outputName(path))
+		}
+		if adder.Transform != nil {
+			return fmt.Errorf("cannot add %s with nocopy: its content is transformed", adder.outputName(path))
+		}
+		byReference = true
+	}
+
+	var reader io.Reader = file
+	// Cluster: transform the content.
+	if adder.Transform != nil {
+		var err error
+		reader, err = adder.Transform(adder.outputName(path), reader)
+		if err != nil {
+			return fmt.Errorf("transforming %s: %w", adder.outputName(path), err)
+		}
+	}
+	// Cluster: limit the size of the file.
+	reader, err := adder.limitFileSize(path, file, reader)
+	if err != nil {
+		return err
+	}
+	// Cluster: wrap the reader (i.e. to throttle reading).
+	if adder.WrapReader != nil {
+		reader = adder.WrapReader(reader)
+	}
+	// Cluster: keep the info of files on disk, which nocopy needs, when
+	// the reader is wrapped.
+	if fi, ok := file.(files.FileInfo); ok {
+		if _, ok := reader.(files.FileInfo); !ok {
+			reader = &fileInfoReader{reader, fi}
+		}
+	}
 	// if the progress flag was specified, wrap the file so that we can send
 	// progress updates to the client (over the output channel)
-	var reader io.Reader = file
 	if adder.Progress {
-		rdr := &progressReader{file: reader, path: path, out: adder.Out}
+		rdr := &progressReader{file: reader, path: adder.outputName(path), out: adder.Out, adder: adder}
 		if fi, ok := file.(files.FileInfo); ok {
 			reader = &progressReader2{rdr, fi}
 		} else {
@@ -382,13 +699,62 @@ func (adder *Adder) addFile(path string, file files.File) error {
 		}
 	}
 
-	dagnode, err := adder.add(reader)
+	// Cluster: sniff the content type when needed, and choose raw
+	// leaves from it when asked to.
+	rawLeaves := adder.RawLeaves
+	contentType := ""
+	if adder.RawLeavesAuto || adder.DetectMIME {
+		fi, isFileInfo := reader.(files.FileInfo)
+		reader, contentType, err = sniffContentType(reader)
+		if err != nil {
+			return err
+		}
+		if isFileInfo {
+			reader = &fileInfoReader{reader, fi}
+		}
+		if adder.RawLeavesAuto {
+			rawLeaves = rawLeavesFor(contentType)
+		}
+		if !adder.DetectMIME {
+			contentType = ""
+		}
+	}
+
+	dagnode, err := adder.add(reader, adder.useTrickle(file), rawLeaves)
 	if err != nil {
 		return err
 	}
+	// Cluster: warn about files which changed while reading them, or
+	// fail with StrictSize, unless they are transformed, which may
+	// change their size.
+	if adder.Transform == nil {
+		if err := adder.checkSize(path, file, dagnode); err != nil {
+			return err
+		}
+	}
+	if span.IsRecordingEvents() {
+		size, _ := dagnode.Size()
+		span.AddAttributes(
+			trace.StringAttribute("cid", dagnode.Cid().String()),
+			trace.Int64Attribute("size", int64(size)),
+		)
+	}
 
 	// patch it into the root
-	return adder.addNode(dagnode, path)
+	return adder.addNode(dagnode, path, api.AddedFile, byReference, contentType)
+}
+
+// Cluster: useTrickle returns whether the given file should be added with
+// the trickle layout.
+func (adder *Adder) useTrickle(file files.File) bool {
+	if !adder.AutoLayout {
+		return adder.Trickle
+	}
+	size, err := file.Size()
+	if err != nil || size < 0 {
+		return false
+	}
+	return uint64(size) > adder.TrickleThreshold
 }
 
 func (adder *Adder) addDir(path string, dir files.Directory, toplevel bool) error {
@@ -409,16 +775,59 @@ func (adder *Adder) addDir(path string, dir files.Directory, toplevel bool) erro
 		}
 	}
 
+	// Cluster: normalize entry names when requested, before
+	// sorting by them.
+	if adder.NormalizeNames {
+		dir = normalizedDirectory(dir)
+	}
+
+	// Cluster: add entries sorted by name when requested.
+	if adder.Deterministic {
+		sorted, err := sortedDirectory(dir)
+		if err != nil {
+			return err
+		}
+		dir = sorted
+	}
+
+	// Cluster: add top-level entries in parallel when requested.
+	if toplevel && path == "" && adder.Concurrency > 1 {
+		return adder.addEntriesConcurrently(dir)
+	}
+
+	// Cluster: forget ignore rules read in this directory when done.
+	defer func(n int) {
+		adder.ignoreStack = adder.ignoreStack[:n]
+	}(len(adder.ignoreStack))
+
 	it := dir.Entries()
 	for it.Next() {
 		fpath := gopath.Join(path, it.Name())
-		err := adder.addFileNode(fpath, it.Node(), false)
+		node, err := adder.readIgnoreRules(path, it.Name(), it.Node())
+		if err != nil {
+			return err
+		}
+		err = adder.addFileNode(fpath, node, false)
 		if err != nil {
 			return err
 		}
 	}
+	if it.Err() != nil {
+		return it.Err()
+	}
 
-	return it.Err()
+	// Cluster: the root directory is sharded and output when
+	// finishing.
+	if path == "" {
+		return nil
+	}
+	if adder.ShardingThreshold > 0 {
+		err := adder.shardDir(path)
+		if err != nil {
+			return err
+		}
+	}
+	return adder.outputCompleteDir(path)
 }
 
 // outputDagnode sends dagnode info over the output channel.
@@ -429,32 +838,96 @@ func (adder *Adder) outputDagnode(out chan *api.AddedOutput, name string, dn ipl
 		return nil
 	}
 
-	s, err := dn.Size()
+	ao, err := adder.newAddedOutput(name, dn)
 	if err != nil {
 		return err
 	}
+	ao.Type = api.AddedDirectory
+	out <- ao
+	return nil
+}
 
-	// When adding things in a folder: "OutputPrefix/name"
-	// When adding a single file: "OutputPrefix" (name is unset)
-	// When adding a single thing with no name: ""
-	// Note: ipfs sets the name of files received on stdin to the CID,
-	// but cluster does not support stdin-adding so we do not
-	// account for this here.
-	name = filepath.Join(adder.OutputPrefix, name)
+// outputName returns the name used in output events for the given path.
+//
+// When adding things in a folder: "OutputPrefix/name"
+// When adding a single file: "OutputPrefix" (name is unset)
+//
+// Cluster: names always use forward slashes, regardless of the platform, and
+// every event for a path (progress included) goes through here.
+func (adder *Adder) outputName(name string) string {
+	return gopath.Join(adder.OutputPrefix, filepath.ToSlash(name))
+}
 
-	out <- &api.AddedOutput{
+// Cluster: CIDs may be printed with a different base.
+func (adder *Adder) formatCid(c cid.Cid) string {
+	if adder.FormatCid != nil {
+		return adder.FormatCid(c)
+	}
+	return c.String()
+}
+
+func (adder *Adder) newAddedOutput(name string, dn ipld.Node) (*api.AddedOutput, error) {
+	s, err := dn.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	// When adding a single thing with no name: the CID, as ipfs
+	// does for files received on stdin.
+	name = adder.outputName(name)
+	if name == "" {
+		name = adder.formatCid(dn.Cid())
+	}
+
+	return &api.AddedOutput{
 		Cid:  dn.Cid(),
 		Name: name,
 		Size: s,
+		// Cluster: tell when the data lives in the CID.
+		Inline: dn.Cid().Prefix().MhType == multihash.IDENTITY,
+	}, nil
+}
+
+// addBytesRead adds n to the number of bytes read so far and returns the
+// new total. Entry adders report to their parent.
+func (adder *Adder) addBytesRead(n int64) int64 {
+	if adder.parent != nil {
+		return adder.parent.addBytesRead(n)
 	}
+	return atomic.AddInt64(&adder.bytesRead, n)
+}
 
-	return nil
+// addAddedFile counts an added file. Entry adders report to their parent.
+func (adder *Adder) addAddedFile() {
+	if adder.parent != nil {
+		adder.parent.addAddedFile()
+		return
+	}
+	atomic.AddInt64(&adder.addedFiles, 1)
+}
+
+// AddedFiles returns the number of files added so far.
+func (adder *Adder) AddedFiles() int {
+	return int(atomic.LoadInt64(&adder.addedFiles))
+}
+
+// percent returns the percentage of TotalSize that the given number of read
+// bytes represents or -1 if TotalSize is unknown.
+func (adder *Adder) percent(read int64) float64 {
+	if adder.TotalSize < 0 {
+		return -1
+	}
+	if adder.TotalSize == 0 {
+		return 100
+	}
+	return float64(read) * 100 / float64(adder.TotalSize)
 }
 
 type progressReader struct {
 	file         io.Reader
 	path         string
 	out          chan *api.AddedOutput
+	adder        *Adder
 	bytes        int64
 	lastProgress int64
 }
@@ -463,11 +936,15 @@ func (i *progressReader) Read(p []byte) (int, error) {
 	n, err := i.file.Read(p)
 
 	i.bytes += int64(n)
+	read := i.adder.addBytesRead(int64(n))
 	if i.bytes-i.lastProgress >= progressReaderIncrement || err == io.EOF {
 		i.lastProgress = i.bytes
 		i.out <- &api.AddedOutput{
-			Name:  i.path,
-			Bytes: uint64(i.bytes),
+			Name:       i.path,
+			Bytes:      uint64(i.bytes),
+			AddedBytes: uint64(read),
+			Percent:    i.adder.percent(read),
+			ETA:        i.adder.eta(read),
 		}
 	}
 
@@ -482,3 +959,9 @@ type progressReader2 struct {
 func (i *progressReader2) Read(p []byte) (int, error) {
 	return i.progressReader.Read(p)
 }
+
+// Cluster: fileInfoReader is a wrapped reader of a file on disk.
+type fileInfoReader struct {
+	io.Reader
+	files.FileInfo
+}
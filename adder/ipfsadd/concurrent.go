@@ -0,0 +1,129 @@
+package ipfsadd
+
+import (
+	"context"
+	"sync"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Cluster: go-ipfs adds everything sequentially. When Concurrency is set,
+// the top-level entries of a directory are added in parallel by entry
+// adders which share the mfs root, the DAGService and the output channel
+// with their parent. The resulting DAG is the same as when adding
+// sequentially, but the order of the output events is not.
+
+// newEntryAdder returns an Adder which adds to the same mfs root as this
+// one, using the given context.
+func (adder *Adder) newEntryAdder(ctx context.Context) *Adder {
+	return &Adder{
+		ctx:               ctx,
+		dagService:        adder.dagService,
+		Out:               adder.Out,
+		Progress:          adder.Progress,
+		Trickle:           adder.Trickle,
+		RawLeaves:         adder.RawLeaves,
+		RawLeavesAuto:     adder.RawLeavesAuto,
+		DetectMIME:        adder.DetectMIME,
+		StrictSize:        adder.StrictSize,
+		Silent:            adder.Silent,
+		NoCopy:            adder.NoCopy,
+		Chunker:           adder.Chunker,
+		mroot:             adder.mroot,
+		CidBuilder:        adder.CidBuilder,
+		OutputPrefix:      adder.OutputPrefix,
+		TotalSize:         adder.TotalSize,
+		ShardingThreshold: adder.ShardingThreshold,
+		Symlinks:          adder.Symlinks,
+		DiskRoot:          adder.DiskRoot,
+		Skip:              adder.Skip,
+		SkipHidden:        adder.SkipHidden,
+		Warnings:          adder.Warnings,
+		SkipFailedFiles:   adder.SkipFailedFiles,
+		Deterministic:     adder.Deterministic,
+		FormatCid:         adder.FormatCid,
+		WrapReader:        adder.WrapReader,
+		MaxFileSize:       adder.MaxFileSize,
+		MaxLinks:          adder.MaxLinks,
+		AutoLayout:        adder.AutoLayout,
+		TrickleThreshold:  adder.TrickleThreshold,
+		NormalizeNames:    adder.NormalizeNames,
+		Transform:         adder.Transform,
+		shardedDirs:       make(map[string]ipld.Node),
+		dirsOutput:        make(map[string]struct{}),
+		parent:            adder,
+	}
+}
+
+// addEntriesConcurrently adds the entries of the given top-level directory
+// using up to Concurrency entry adders at the same time. The entries must
+// be readable in any order.
+func (adder *Adder) addEntriesConcurrently(dir files.Directory) error {
+	// make sure the mfs root exists before sharing it.
+	if _, err := adder.mfsRoot(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(adder.ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		sem      = make(chan struct{}, adder.Concurrency)
+		entries  []*Adder
+	)
+
+	setErr := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	it := dir.Entries()
+	for it.Next() {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		entry := adder.newEntryAdder(ctx)
+		entries = append(entries, entry)
+		name, node := it.Name(), it.Node()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := entry.addFileNode(name, node, false); err != nil {
+				setErr(err)
+			}
+		}()
+	}
+	if it.Err() != nil {
+		setErr(it.Err())
+	}
+	wg.Wait()
+
+	// Merged on failure too, for FinishPartial.
+	for _, entry := range entries {
+		for path, nd := range entry.shardedDirs {
+			adder.shardedDirs[path] = nd
+		}
+		for path := range entry.dirsOutput {
+			adder.dirsOutput[path] = struct{}{}
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	// The context may have been cancelled by the caller.
+	return ctx.Err()
+}
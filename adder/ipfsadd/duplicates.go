@@ -0,0 +1,53 @@
+package ipfsadd
+
+import (
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// Cluster: files whose root CID is the same as that of a file added before
+// during the same add are counted as duplicates, for the add result. This
+// is informational only: the blocks are deduplicated anyways.
+
+// fileCids keeps the names of the files added with every root CID.
+type fileCids struct {
+	mu    sync.Mutex
+	names map[cid.Cid][]string
+}
+
+// addFileCid records that the file with the given output name was added
+// with the given root CID. Entry adders report to their parent.
+func (adder *Adder) addFileCid(c cid.Cid, name string) {
+	if adder.parent != nil {
+		adder.parent.addFileCid(c, name)
+		return
+	}
+	adder.files.mu.Lock()
+	defer adder.files.mu.Unlock()
+	if adder.files.names == nil {
+		adder.files.names = make(map[cid.Cid][]string)
+	}
+	adder.files.names[c] = append(adder.files.names[c], name)
+}
+
+// DuplicateFiles returns the number of files added so far which had the same
+// CID as a file added before them, and the names of the files added with
+// each CID that was seen more than once, in the order they were added.
+func (adder *Adder) DuplicateFiles() (int, map[cid.Cid][]string) {
+	adder.files.mu.Lock()
+	defer adder.files.mu.Unlock()
+	count := 0
+	var dups map[cid.Cid][]string
+	for c, names := range adder.files.names {
+		if len(names) < 2 {
+			continue
+		}
+		if dups == nil {
+			dups = make(map[cid.Cid][]string)
+		}
+		count += len(names) - 1
+		dups[c] = append([]string(nil), names...)
+	}
+	return count, dups
+}
@@ -0,0 +1,118 @@
+package ipfsadd
+
+import (
+	"errors"
+	"fmt"
+	gopath "path"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	mfs "github.com/ipfs/go-mfs"
+)
+
+// Cluster: AddEntry and FinishEntries allow adding content which does not
+// come as a files.Directory, like tar archives, one entry at a time. The
+// entries are placed in the mfs root at their paths, in any order.
+
+// AddEntry adds a single file or symlink at the given path, creating the
+// parent directories as needed. When given a directory, it is created empty
+// and its entries are ignored, as they are expected to be added separately.
+func (adder *Adder) AddEntry(path string, node files.Node) error {
+	if path == "" {
+		return errors.New("entries cannot be added at the root")
+	}
+
+	if _, ok := node.(files.Directory); ok {
+		defer node.Close()
+		if adder.skip(path, node) {
+			return nil
+		}
+		mr, err := adder.mfsRoot()
+		if err != nil {
+			return err
+		}
+		return mfs.Mkdir(mr, path, mfs.MkdirOpts{
+			Mkparents:  true,
+			Flush:      false,
+			CidBuilder: adder.CidBuilder,
+		})
+	}
+	return adder.addFileNode(path, node, false)
+}
+
+// FinishEntries completes adding the entries added with AddEntry and returns
+// the root node. When unwrap is set and there is a single top-level entry,
+// it becomes the root. Otherwise the root is the directory containing all
+// top-level entries.
+func (adder *Adder) FinishEntries(unwrap bool) (ipld.Node, error) {
+	mr, err := adder.mfsRoot()
+	if err != nil {
+		return nil, err
+	}
+	rootdir := mr.GetDirectory()
+
+	names, err := rootdir.ListNames(adder.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no entries were added")
+	}
+	swap := unwrap && len(names) == 1
+
+	// Directories are only complete now, so they are sharded now,
+	// deepest first. The root is sharded when finishing.
+	if adder.ShardingThreshold > 0 {
+		if swap {
+			err = adder.shardSubdirs(names[0])
+		} else {
+			err = adder.shardSubdirs("")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return adder.finish(swap, "")
+}
+
+// shardSubdirs shards the directories below the given path when needed.
+func (adder *Adder) shardSubdirs(path string) error {
+	mr, err := adder.mfsRoot()
+	if err != nil {
+		return err
+	}
+	fsn, err := mfs.Lookup(mr, path)
+	if err != nil {
+		return err
+	}
+	dir, ok := fsn.(*mfs.Directory)
+	if !ok {
+		return nil
+	}
+
+	names, err := dir.ListNames(adder.ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		childpath := gopath.Join(path, name)
+		child, err := dir.Child(name)
+		if err != nil {
+			// files cannot be loaded back, see outputDirChildren.
+			continue
+		}
+		if _, ok := child.(*mfs.Directory); !ok {
+			continue
+		}
+		err = adder.shardSubdirs(childpath)
+		if err != nil {
+			return err
+		}
+		err = adder.shardDir(childpath)
+		if err != nil {
+			return fmt.Errorf("sharding %s: %s", childpath, err)
+		}
+	}
+	return nil
+}
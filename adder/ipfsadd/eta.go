@@ -0,0 +1,62 @@
+package ipfsadd
+
+import (
+	"sync"
+	"time"
+)
+
+// etaSmoothing is the weight of the latest throughput sample in the moving
+// average used to estimate the time left.
+const etaSmoothing = 0.3
+
+// Cluster: throughput keeps an exponential moving average of the bytes read
+// per second, sampled on every progress update, to estimate how long the rest
+// of the add takes.
+type throughput struct {
+	mu       sync.Mutex
+	last     time.Time
+	lastRead int64
+	rate     float64 // bytes per second
+}
+
+func newThroughput(now time.Time) *throughput {
+	return &throughput{last: now}
+}
+
+// eta takes a sample with the total bytes read so far and returns the
+// estimated time to read the rest of the total, or -1 when it cannot be
+// estimated.
+func (t *throughput) eta(read, total int64, now time.Time) time.Duration {
+	if total < 0 {
+		return -1
+	}
+	if read >= total {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elapsed := now.Sub(t.last).Seconds(); elapsed > 0 && read > t.lastRead {
+		sample := float64(read-t.lastRead) / elapsed
+		if t.rate == 0 {
+			t.rate = sample
+		} else {
+			t.rate = etaSmoothing*sample + (1-etaSmoothing)*t.rate
+		}
+		t.last = now
+		t.lastRead = read
+	}
+	if t.rate == 0 {
+		return -1
+	}
+	return time.Duration(float64(total-read) / t.rate * float64(time.Second))
+}
+
+// eta returns the estimated time left to read TotalSize bytes when read
+// have been read so far. Entry adders report to their parent.
+func (adder *Adder) eta(read int64) time.Duration {
+	if adder.parent != nil {
+		return adder.parent.eta(read)
+	}
+	return adder.throughput.eta(read, adder.TotalSize, time.Now())
+}
@@ -0,0 +1,47 @@
+package ipfsadd
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/ipfs/ipfs-cluster/api"
+)
+
+// Cluster: when SkipFailedFiles is set, files which cannot be added are
+// reported and left out instead of aborting the whole add.
+
+// skipFailed returns nil instead of the given error when adding the file at
+// path failed and failed files are skipped, reporting the failure on the
+// output channel. Cancellations, interruptions and failures of top-level
+// files, which leave nothing to add, are returned as they are.
+func (adder *Adder) skipFailed(path string, err error, toplevel bool) error {
+	if err == nil || !adder.SkipFailedFiles || toplevel || adder.ctx.Err() != nil || errors.Is(err, ErrInterrupted) {
+		return err
+	}
+
+	name := adder.outputName(path)
+	log.Errorf("skipping %s: %s", name, err)
+	adder.addFailedFile()
+	if adder.Out != nil {
+		adder.Out <- &api.AddedOutput{
+			Name:  name,
+			Error: err.Error(),
+		}
+	}
+	return nil
+}
+
+// addFailedFile counts a skipped file. Entry adders report to their parent.
+func (adder *Adder) addFailedFile() {
+	if adder.parent != nil {
+		adder.parent.addFailedFile()
+		return
+	}
+	atomic.AddInt64(&adder.failedFiles, 1)
+}
+
+// FailedFiles returns the number of files skipped because they could not be
+// added.
+func (adder *Adder) FailedFiles() int {
+	return int(atomic.LoadInt64(&adder.failedFiles))
+}
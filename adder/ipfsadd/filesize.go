@@ -0,0 +1,49 @@
+package ipfsadd
+
+import (
+	"fmt"
+	"io"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// Cluster: when MaxFileSize is set, files larger than it fail to be added.
+// They are skipped like any other failed file when SkipFailedFiles is set.
+
+// limitFileSize returns a reader for the given file which fails once more
+// than MaxFileSize bytes are read from it. Files whose size is known fail
+// right away.
+func (adder *Adder) limitFileSize(path string, file files.File, reader io.Reader) (io.Reader, error) {
+	if adder.MaxFileSize == 0 {
+		return reader, nil
+	}
+
+	name := adder.outputName(path)
+	if size, err := file.Size(); err == nil && size >= 0 && uint64(size) > adder.MaxFileSize {
+		return nil, fileTooLargeError(name, adder.MaxFileSize)
+	}
+	return &fileSizeReader{r: reader, name: name, max: adder.MaxFileSize}, nil
+}
+
+func fileTooLargeError(name string, max uint64) error {
+	return fmt.Errorf("file %q exceeds the maximum file size of %d bytes", name, max)
+}
+
+// fileSizeReader fails, without returning any bytes, once more than max
+// bytes have been read, so that the block which would exceed the limit is
+// never stored.
+type fileSizeReader struct {
+	r    io.Reader
+	name string
+	max  uint64
+	read uint64
+}
+
+func (fr *fileSizeReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	fr.read += uint64(n)
+	if fr.read > fr.max {
+		return 0, fileTooLargeError(fr.name, fr.max)
+	}
+	return n, err
+}
@@ -0,0 +1,122 @@
+package ipfsadd
+
+import (
+	"context"
+	"fmt"
+	gopath "path"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mfs "github.com/ipfs/go-mfs"
+	hamt "github.com/ipfs/go-unixfs/hamt"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// Cluster: go-ipfs only supports HAMT-sharding directories via a global
+// switch (uio.UseHAMTSharding) which applies to all directories. Instead,
+// we convert directories to HAMT shards once they are complete and have
+// more entries than ShardingThreshold. The DAGServices used by Cluster
+// cannot be read from, so shards are built from the directory links alone.
+
+// linkNode is a stand-in for the node behind a directory link. hamt.Shard
+// only needs the Cid and the Size of the nodes it links to.
+type linkNode struct {
+	ipld.Node
+	lnk *ipld.Link
+}
+
+func (n *linkNode) Cid() cid.Cid {
+	return n.lnk.Cid
+}
+
+func (n *linkNode) Size() (uint64, error) {
+	return n.lnk.Size, nil
+}
+
+// shardDAGService does not add linkNodes, which are already stored, but
+// lets the shard nodes through.
+type shardDAGService struct {
+	ipld.DAGService
+}
+
+func (sds shardDAGService) Add(ctx context.Context, nd ipld.Node) error {
+	if _, ok := nd.(*linkNode); ok {
+		return nil
+	}
+	return sds.DAGService.Add(ctx, nd)
+}
+
+// shardNode returns a HAMT-sharded version of the given directory node
+// when it has more links than ShardingThreshold. Otherwise it returns nil.
+func (adder *Adder) shardNode(nd ipld.Node) (ipld.Node, error) {
+	if adder.ShardingThreshold <= 0 || len(nd.Links()) <= adder.ShardingThreshold {
+		return nil, nil
+	}
+
+	shard, err := hamt.NewShard(shardDAGService{adder.dagService}, uio.DefaultShardWidth)
+	if err != nil {
+		return nil, err
+	}
+	shard.SetCidBuilder(adder.CidBuilder)
+
+	for _, lnk := range nd.Links() {
+		err := shard.Set(adder.ctx, lnk.Name, &linkNode{lnk: lnk})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return shard.Node()
+}
+
+// shardDir replaces the directory at the given path in the mfs tree with
+// its HAMT-sharded version when needed.
+func (adder *Adder) shardDir(path string) error {
+	mr, err := adder.mfsRoot()
+	if err != nil {
+		return err
+	}
+
+	fsn, err := mfs.Lookup(mr, path)
+	if err != nil {
+		return err
+	}
+	dir, ok := fsn.(*mfs.Directory)
+	if !ok {
+		return nil
+	}
+
+	nd, err := dir.GetNode()
+	if err != nil {
+		return err
+	}
+
+	shardNd, err := adder.shardNode(nd)
+	if err != nil || shardNd == nil {
+		return err
+	}
+
+	// The shard cannot be read back from the DAGService, so the
+	// directory events for the subtree are sent now.
+	err = adder.outputDirChildren(path, dir)
+	if err != nil {
+		return err
+	}
+	adder.shardedDirs[path] = shardNd
+
+	parentPath, name := gopath.Split(path)
+	pfsn, err := mfs.Lookup(mr, parentPath)
+	if err != nil {
+		return err
+	}
+	parent, ok := pfsn.(*mfs.Directory)
+	if !ok {
+		return fmt.Errorf("%s is not a directory", parentPath)
+	}
+
+	err = parent.Unlink(name)
+	if err != nil {
+		return err
+	}
+	return parent.AddChild(name, shardNd)
+}
@@ -0,0 +1,123 @@
+package ipfsadd
+
+import (
+	"fmt"
+	"io/ioutil"
+	gopath "path"
+	"strings"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	ignore "github.com/crackcomm/go-gitignore"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// Cluster: the ignore files named in IgnoreRulesFiles are read as they are
+// found while walking directories. Their rules apply to the entries that
+// follow them in the same directory (listings are usually sorted, so they
+// come first) and to all the entries in subdirectories, like in git: rules
+// read later take precedence, so nested files can negate the rules of
+// their parents.
+
+// ignoreLevel holds the rules of an ignore file found in dir.
+type ignoreLevel struct {
+	dir   string
+	rules *ignore.GitIgnore
+	// the same rules, preceded by one matching everything. Used when
+	// a path was ignored by a previous level, so that negations in
+	// this level can include it again.
+	rulesIgnored *ignore.GitIgnore
+}
+
+// readIgnoreRules reads the rules from the given directory entry if it is
+// one of the IgnoreRulesFiles. As the file is consumed, a new file with the
+// same contents is returned to be added in its place.
+func (adder *Adder) readIgnoreRules(dir, name string, node files.Node) (files.Node, error) {
+	if !adder.isIgnoreRulesFile(name) {
+		return node, nil
+	}
+	f, ok := node.(files.File)
+	if !ok {
+		return node, nil
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading ignore rules from %s: %s", adder.outputName(dir), err)
+	}
+	lines := strings.Split(string(data), "\n")
+
+	rules, err := ignore.CompileIgnoreLines(lines...)
+	if err != nil {
+		return nil, err
+	}
+	rulesIgnored, err := ignore.CompileIgnoreLines(append([]string{"*"}, lines...)...)
+	if err != nil {
+		return nil, err
+	}
+	adder.ignoreStack = append(adder.ignoreStack, ignoreLevel{
+		dir:          dir,
+		rules:        rules,
+		rulesIgnored: rulesIgnored,
+	})
+	return files.NewBytesFile(data), nil
+}
+
+func (adder *Adder) isIgnoreRulesFile(name string) bool {
+	for _, n := range adder.IgnoreRulesFiles {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored returns true when the rules read so far ignore the given path.
+func (adder *Adder) ignored(path string, dir bool) bool {
+	ignored := false
+	for _, lvl := range adder.ignoreStack {
+		rel := path
+		if lvl.dir != "" {
+			rel = strings.TrimPrefix(path, lvl.dir+"/")
+		}
+		if dir {
+			rel += "/"
+		}
+
+		if ignored {
+			ignored = lvl.rulesIgnored.MatchesPath(rel)
+		} else {
+			ignored = lvl.rules.MatchesPath(rel)
+		}
+	}
+	return ignored
+}
+
+// skip returns true when the entry at path is hidden or left out by the Skip
+// function or the ignore rules, and reports it in the output on progress.
+func (adder *Adder) skip(path string, node files.Node) bool {
+	_, dir := node.(files.Directory)
+	name := adder.outputName(path)
+	var reason string
+	switch {
+	case adder.SkipHidden && strings.HasPrefix(gopath.Base(path), "."):
+		reason = api.SkipHidden
+	case adder.Skip != nil && adder.Skip(name, dir):
+		reason = api.SkipFiltered
+	case adder.ignored(path, dir):
+		reason = api.SkipIgnored
+	default:
+		return false
+	}
+
+	log.Debugf("skipping %s: %s", name, reason)
+	if adder.Progress && adder.Out != nil {
+		adder.Out <- &api.AddedOutput{
+			Name:       name,
+			Skipped:    true,
+			SkipReason: reason,
+		}
+	}
+	return true
+}
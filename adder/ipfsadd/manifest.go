@@ -0,0 +1,51 @@
+package ipfsadd
+
+import (
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// Cluster: the CIDs of the directories and symlinks added are kept by output
+// name, which along with the file CIDs make the manifest of the add.
+
+// entryCids keeps the CID of every directory and symlink added.
+type entryCids struct {
+	mu   sync.Mutex
+	cids map[string]cid.Cid
+}
+
+// addEntryCid records the CID of the directory or symlink with the given
+// output name. Entry adders report to their parent.
+func (adder *Adder) addEntryCid(name string, c cid.Cid) {
+	if adder.parent != nil {
+		adder.parent.addEntryCid(name, c)
+		return
+	}
+	adder.entries.mu.Lock()
+	defer adder.entries.mu.Unlock()
+	if adder.entries.cids == nil {
+		adder.entries.cids = make(map[string]cid.Cid)
+	}
+	adder.entries.cids[name] = c
+}
+
+// Manifest returns the output names of the files, directories and symlinks
+// added so far, with their CIDs. The names of directories end with a slash.
+// The root is left out when it has no name.
+func (adder *Adder) Manifest() map[string]cid.Cid {
+	adder.files.mu.Lock()
+	defer adder.files.mu.Unlock()
+	adder.entries.mu.Lock()
+	defer adder.entries.mu.Unlock()
+	manifest := make(map[string]cid.Cid, len(adder.files.names)+len(adder.entries.cids))
+	for c, names := range adder.files.names {
+		for _, name := range names {
+			manifest[name] = c
+		}
+	}
+	for name, c := range adder.entries.cids {
+		manifest[name] = c
+	}
+	return manifest
+}
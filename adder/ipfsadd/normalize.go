@@ -0,0 +1,77 @@
+package ipfsadd
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	files "github.com/ipfs/go-ipfs-files"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Cluster: when NormalizeNames is set, the names of directory entries have
+// their trailing whitespace removed and are converted to the Unicode NFC
+// form before being linked, so that the same tree gets the same CID on all
+// systems.
+
+// normalizeName returns the normalized form of an entry name.
+func normalizeName(name string) string {
+	return norm.NFC.String(strings.TrimRightFunc(name, unicode.IsSpace))
+}
+
+// normalizedDirectory returns a directory with the entries of the given one
+// under their normalized names. Listing them fails when a name is empty once
+// normalized, or when two entries have the same normalized name.
+func normalizedDirectory(dir files.Directory) files.Directory {
+	return &normalizedDir{Directory: dir}
+}
+
+type normalizedDir struct {
+	files.Directory
+}
+
+func (d *normalizedDir) Entries() files.DirIterator {
+	return &normalizedIterator{
+		DirIterator: d.Directory.Entries(),
+		seen:        make(map[string]string),
+	}
+}
+
+type normalizedIterator struct {
+	files.DirIterator
+	// normalized names to the names they come from.
+	seen map[string]string
+	name string
+	err  error
+}
+
+func (it *normalizedIterator) Name() string {
+	return it.name
+}
+
+func (it *normalizedIterator) Next() bool {
+	if it.err != nil || !it.DirIterator.Next() {
+		return false
+	}
+
+	orig := it.DirIterator.Name()
+	name := normalizeName(orig)
+	if name == "" {
+		it.err = fmt.Errorf("entry name %q is empty once normalized", orig)
+		return false
+	}
+	if other, ok := it.seen[name]; ok {
+		it.err = fmt.Errorf("entry names %q and %q are the same once normalized", other, orig)
+		return false
+	}
+	it.seen[name] = orig
+	it.name = name
+	return true
+}
+
+func (it *normalizedIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.DirIterator.Err()
+}
@@ -0,0 +1,23 @@
+package ipfsadd
+
+import (
+	"errors"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Cluster: adds can be interrupted so that what was added until then is
+// kept. Reading the files fails with ErrInterrupted, which is never skipped,
+// and the directory being added is finished with FinishPartial.
+
+// ErrInterrupted is returned by the readers of the files of interrupted adds.
+var ErrInterrupted = errors.New("adding interrupted")
+
+// FinishPartial finishes adding a directory whose adding failed with
+// ErrInterrupted, with the entries added until then, and returns its root.
+// The files being added when it was interrupted were never put in the mfs
+// root, so they are left out, while the directories being added only have
+// the entries which were added completely.
+func (adder *Adder) FinishPartial() (ipld.Node, error) {
+	return adder.finish(false, "")
+}
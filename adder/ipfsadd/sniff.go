@@ -0,0 +1,30 @@
+package ipfsadd
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of bytes used by http.DetectContentType.
+const sniffLen = 512
+
+// Cluster: sniffContentType peeks at the first bytes of a file and returns
+// its content type, along with a reader which still returns those bytes.
+func sniffContentType(r io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, "", err
+	}
+	contentType := http.DetectContentType(head)
+	log.Debugf("sniffed content type: %s", contentType)
+	return br, contentType, nil
+}
+
+// Cluster: rawLeavesFor returns whether a file with the given content type
+// should be added with raw leaves (when it is not text).
+func rawLeavesFor(contentType string) bool {
+	return !strings.HasPrefix(contentType, "text/")
+}
@@ -0,0 +1,32 @@
+package ipfsadd
+
+import (
+	"sort"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// Cluster: when Deterministic is set, the entries of every directory are
+// added sorted by name, regardless of the order in which they are listed.
+
+// sortedDirectory lists all the entries of the given directory and returns
+// a directory with the same entries sorted by name. Entries with the same
+// name keep their order.
+func sortedDirectory(dir files.Directory) (files.Directory, error) {
+	var entries []files.DirEntry
+	it := dir.Entries()
+	for it.Next() {
+		entries = append(entries, files.FileEntry(it.Name(), it.Node()))
+	}
+	if err := it.Err(); err != nil {
+		for _, e := range entries {
+			e.Node().Close()
+		}
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return files.NewSliceDirectory(entries), nil
+}
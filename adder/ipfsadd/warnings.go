@@ -0,0 +1,62 @@
+package ipfsadd
+
+import (
+	"fmt"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+)
+
+// Cluster: warnings are sent on a best-effort basis, so that a slow reader
+// never blocks adding. They are dropped when the channel is full.
+func (adder *Adder) warn(path, code, format string, args ...interface{}) {
+	w := &api.AddWarning{
+		Name:    adder.outputName(path),
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+	log.Debugf("%s: %s", w.Name, w.Message)
+	if adder.Warnings == nil {
+		return
+	}
+	select {
+	case adder.Warnings <- w:
+	default:
+		log.Warnf("warnings channel full, dropping warning for %s: %s", w.Name, w.Message)
+	}
+}
+
+// checkSize warns when the size of the added file is not the size that the
+// file had when it was listed. With StrictSize, it returns an error instead.
+func (adder *Adder) checkSize(path string, file files.File, nd ipld.Node) error {
+	expected, err := file.Size()
+	if err != nil || expected < 0 {
+		return nil
+	}
+
+	var size uint64
+	switch n := nd.(type) {
+	case *dag.RawNode:
+		size = uint64(len(n.RawData()))
+	case *dag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(n.Data())
+		if err != nil {
+			return nil
+		}
+		size = fsn.FileSize()
+	default:
+		return nil
+	}
+	if size == uint64(expected) {
+		return nil
+	}
+	if adder.StrictSize {
+		return fmt.Errorf("%s changed size while adding it: expected %d bytes but read %d", adder.outputName(path), expected, size)
+	}
+	adder.warn(path, api.WarnSizeChanged, "expected %d bytes but read %d", expected, size)
+	return nil
+}
@@ -0,0 +1,112 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+	path "github.com/ipfs/go-path"
+	resolver "github.com/ipfs/go-path/resolver"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+// ErrNameResolverUnsupported is returned by FromIPFSPath when given an IPNS
+// path and the ClusterDAGService does not implement NameResolver.
+var ErrNameResolverUnsupported = errors.New("adder: the ClusterDAGService cannot resolve IPNS names")
+
+// NameResolver can optionally be implemented by ClusterDAGServices which can
+// resolve IPNS names, so that IPNS paths can be given to FromIPFSPath.
+// ResolveName resolves an /ipns/ path to the /ipfs/ path it currently points
+// to.
+type NameResolver interface {
+	ResolveName(ctx context.Context, p path.Path) (path.Path, error)
+}
+
+// FromIPFSPath adds the content at the given /ipfs/ or /ipns/ path, which
+// exists in IPFS already, without reading it from the client. The path is
+// resolved to its root CID with the Get method of the ClusterDAGService,
+// which is then used to fetch every block of the DAG below it (the single
+// and sharding ClusterDAGServices get them from the local IPFS daemon). Fetched
+// blocks are added to the ClusterDAGService as they are, so the Chunker,
+// CidVersion and HashFun parameters have no effect, and the DAG is finalized
+// with the resolved root. Adding fails if any of the blocks cannot be
+// fetched. The adder will no longer be usable after calling this method.
+func (a *Adder) FromIPFSPath(ctx context.Context, p path.Path) (cid.Cid, error) {
+	a.log.Debugf("adding from %s", p)
+	return a.run(ctx, func() (cid.Cid, error) {
+		return a.addIPFSPath(p)
+	})
+}
+
+// addIPFSPath copies the DAG at the given path and finalizes its root.
+func (a *Adder) addIPFSPath(p path.Path) (cid.Cid, error) {
+	if err := p.IsValid(); err != nil {
+		return cid.Undef, err
+	}
+	if p.Segments()[0] == "ipns" {
+		nr, ok := a.dgs.(NameResolver)
+		if !ok {
+			return cid.Undef, ErrNameResolverUnsupported
+		}
+		resolved, err := nr.ResolveName(a.ctx, p)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("resolving %s: %s", p, err)
+		}
+		a.log.Debugf("%s resolved to %s", p, resolved)
+		p = resolved
+	}
+
+	nd, err := resolver.NewBasicResolver(a.dgs).ResolvePath(a.ctx, p)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("resolving %s: %s", p, err)
+	}
+	root := nd.Cid()
+
+	// Walk the DAG, adding every block once.
+	seen := cid.NewSet()
+	seen.Add(root)
+	pending := []cid.Cid{root}
+	for len(pending) > 0 {
+		select {
+		case <-a.ctx.Done():
+			return cid.Undef, a.ctx.Err()
+		default:
+		}
+
+		c := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if !c.Equals(root) {
+			nd, err = a.dgs.Get(a.ctx, c)
+			if err != nil {
+				return cid.Undef, fmt.Errorf("block %s of %s cannot be fetched: %s", c, root, err)
+			}
+		}
+
+		err = a.tracker.Add(a.ctx, nd)
+		if err != nil {
+			a.log.Error("error adding to cluster: ", err)
+			return cid.Undef, err
+		}
+
+		a.send(&api.AddedOutput{
+			Cid:  c,
+			Name: a.params.FormatCid(c),
+			Size: uint64(len(nd.RawData())),
+		})
+
+		for _, l := range nd.Links() {
+			// inlined data has no block of its own.
+			if l.Cid.Prefix().MhType == multihash.IDENTITY {
+				continue
+			}
+			if seen.Visit(l.Cid) {
+				pending = append(pending, l.Cid)
+			}
+		}
+	}
+
+	return a.finish(a.ctx, root, nil)
+}
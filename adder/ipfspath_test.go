@@ -0,0 +1,180 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	path "github.com/ipfs/go-path"
+)
+
+// namesDAGServ resolves IPNS names from a map.
+type namesDAGServ struct {
+	*MemoryDAGService
+	names map[string]path.Path
+}
+
+func (dag namesDAGServ) ResolveName(ctx context.Context, p path.Path) (path.Path, error) {
+	resolved, ok := dag.names[p.String()]
+	if !ok {
+		return "", errors.New("name not found")
+	}
+	return resolved, nil
+}
+
+// fetchingDAGServ fetches blocks from another DAGService, as cluster peers
+// fetch them from IPFS, and stores them in its own.
+type fetchingDAGServ struct {
+	*MemoryDAGService
+	src *MemoryDAGService
+}
+
+func (dag fetchingDAGServ) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	return dag.src.Get(ctx, c)
+}
+
+func TestAdder_FromIPFSPath(t *testing.T) {
+	// seed adds a tree and returns its root and the CID of dir/sub.
+	seed := func(dags ClusterDAGService) (cid.Cid, cid.Cid) {
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+				files.FileEntry("sub", files.NewSliceDirectory([]files.DirEntry{
+					files.FileEntry("b", files.NewBytesFile(make([]byte, 1024*1024))),
+				})),
+			})),
+		})
+		out := make(chan *api.AddedOutput, 100)
+		root, err := New(dags, api.DefaultAddParams(), out).FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sub cid.Cid
+		for ao := range out {
+			if ao.Name == "dir/sub" {
+				sub = ao.Cid
+			}
+		}
+		return root, sub
+	}
+
+	t.Run("ipfs", func(t *testing.T) {
+		dags := NewMemoryDAGService()
+		root, sub := seed(dags)
+
+		// nothing is missing: all the blocks are fetched and added
+		// again as duplicates.
+		adder := New(dags, api.DefaultAddParams(), nil)
+		c, err := adder.FromIPFSPath(context.Background(), path.FromCid(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Equals(root) {
+			t.Error("expected the root of the DAG")
+		}
+		if res := adder.Result(); res.Blocks == 0 || res.DedupedBlocks != res.Blocks {
+			t.Errorf("expected only deduplicated blocks: %+v", res)
+		}
+
+		c, err = New(dags, api.DefaultAddParams(), nil).FromIPFSPath(context.Background(), path.FromString("/ipfs/"+root.String()+"/sub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Equals(sub) {
+			t.Errorf("expected %s, got %s", sub, c)
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		src := NewMemoryDAGService()
+		root, _ := seed(src)
+
+		dags := fetchingDAGServ{NewMemoryDAGService(), src}
+		adder := New(dags, api.DefaultAddParams(), nil)
+		_, err := adder.FromIPFSPath(context.Background(), path.FromCid(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dags.Len() == 0 || dags.Len() != adder.Result().Blocks {
+			t.Errorf("expected all the blocks to be stored, got %d", dags.Len())
+		}
+		for _, c := range adder.Result().Cids {
+			if ok, _ := dags.Has(context.Background(), c); !ok {
+				t.Error("missing block", c)
+			}
+		}
+	})
+
+	t.Run("only hash", func(t *testing.T) {
+		src := NewMemoryDAGService()
+		root, _ := seed(src)
+
+		dags := fetchingDAGServ{NewMemoryDAGService(), src}
+		p := api.DefaultAddParams()
+		p.OnlyHash = true
+		adder := New(dags, p, nil)
+		c, err := adder.FromIPFSPath(context.Background(), path.FromCid(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Equals(root) {
+			t.Error("expected the root of the DAG")
+		}
+		if dags.Len() != 0 {
+			t.Errorf("nothing should be stored with only-hash, got %d blocks", dags.Len())
+		}
+		copied := fetchingDAGServ{NewMemoryDAGService(), src}
+		if _, err := New(copied, api.DefaultAddParams(), nil).FromIPFSPath(context.Background(), path.FromCid(root)); err != nil {
+			t.Fatal(err)
+		}
+		if adder.Result().Blocks != copied.Len() {
+			t.Error("expected all the blocks to be counted")
+		}
+	})
+
+	t.Run("ipns", func(t *testing.T) {
+		dags := namesDAGServ{NewMemoryDAGService(), make(map[string]path.Path)}
+		root, sub := seed(dags)
+		dags.names["/ipns/example.com"] = path.FromString("/ipfs/" + root.String() + "/sub")
+
+		c, err := New(dags, api.DefaultAddParams(), nil).FromIPFSPath(context.Background(), path.FromString("/ipns/example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Equals(sub) {
+			t.Errorf("expected %s, got %s", sub, c)
+		}
+
+		_, err = New(dags.MemoryDAGService, api.DefaultAddParams(), nil).FromIPFSPath(context.Background(), path.FromString("/ipns/example.com"))
+		if err != ErrNameResolverUnsupported {
+			t.Error("expected ErrNameResolverUnsupported, got", err)
+		}
+	})
+
+	t.Run("missing blocks", func(t *testing.T) {
+		dags := NewMemoryDAGService()
+		root, sub := seed(dags)
+		subNode, err := dags.Get(context.Background(), sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		missing := subNode.Links()[0].Cid
+		dags.Remove(context.Background(), missing)
+
+		_, err = New(dags, api.DefaultAddParams(), nil).FromIPFSPath(context.Background(), path.FromCid(root))
+		if err == nil || !strings.Contains(err.Error(), missing.String()) {
+			t.Error("expected an error naming the missing block, got", err)
+		}
+
+		_, err = New(dags, api.DefaultAddParams(), nil).FromIPFSPath(context.Background(), path.FromString("/ipfs/"+root.String()+"/nope"))
+		if err == nil {
+			t.Error("expected an error for a path which does not exist")
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package adder
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// ErrAddTooLarge is returned when the content being added is larger than
+// the MaxTotalSize parameter allows.
+var ErrAddTooLarge = errors.New("adder: content exceeds the maximum total size")
+
+// sizeLimit counts the bytes read from the content being added. It is
+// shared by all the files in an add, and aborts the add once more than max
+// bytes have been read.
+type sizeLimit struct {
+	max   uint64
+	read  uint64 // accessed atomically
+	abort func(error)
+}
+
+func newSizeLimit(max uint64, abort func(error)) *sizeLimit {
+	return &sizeLimit{
+		max:   max,
+		abort: abort,
+	}
+}
+
+// reader wraps r so that reads fail with ErrAddTooLarge once the limit is
+// exceeded.
+func (sl *sizeLimit) reader(r io.Reader) io.Reader {
+	return &limitedReader{r: r, sl: sl}
+}
+
+type limitedReader struct {
+	r  io.Reader
+	sl *sizeLimit
+}
+
+// Read fails with ErrAddTooLarge, without returning any bytes, when the
+// bytes read are over the limit, so that the block which would overflow it
+// is never stored. The add is aborted too, so that the failure aborts it
+// even when failed files are skipped.
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if atomic.AddUint64(&lr.sl.read, uint64(n)) > lr.sl.max {
+		lr.sl.abort(ErrAddTooLarge)
+		return 0, ErrAddTooLarge
+	}
+	return n, err
+}
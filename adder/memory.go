@@ -0,0 +1,118 @@
+package adder
+
+import (
+	"context"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// MemoryDAGService is a ClusterDAGService which keeps all blocks in memory.
+// Finalize returns the given root as is. It is meant for tests, as the stored
+// DAGs can be fully traversed after adding.
+type MemoryDAGService struct {
+	mu     sync.RWMutex
+	blocks map[cid.Cid]ipld.Node
+}
+
+// NewMemoryDAGService returns an empty MemoryDAGService.
+func NewMemoryDAGService() *MemoryDAGService {
+	return &MemoryDAGService{
+		blocks: make(map[cid.Cid]ipld.Node),
+	}
+}
+
+// Get returns the node with the given CID or ErrDAGNotFound.
+func (mdgs *MemoryDAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	mdgs.mu.RLock()
+	defer mdgs.mu.RUnlock()
+	nd, ok := mdgs.blocks[c]
+	if !ok {
+		return nil, ErrDAGNotFound
+	}
+	return nd, nil
+}
+
+// GetMany returns a channel with the nodes with the given CIDs.
+func (mdgs *MemoryDAGService) GetMany(ctx context.Context, keys []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(keys))
+	for _, c := range keys {
+		nd, err := mdgs.Get(ctx, c)
+		out <- &ipld.NodeOption{Node: nd, Err: err}
+	}
+	close(out)
+	return out
+}
+
+// Has returns whether the node with the given CID is stored.
+func (mdgs *MemoryDAGService) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	mdgs.mu.RLock()
+	defer mdgs.mu.RUnlock()
+	_, ok := mdgs.blocks[c]
+	return ok, nil
+}
+
+// Add stores the given node.
+func (mdgs *MemoryDAGService) Add(ctx context.Context, node ipld.Node) error {
+	mdgs.mu.Lock()
+	defer mdgs.mu.Unlock()
+	mdgs.blocks[node.Cid()] = node
+	return nil
+}
+
+// AddMany stores the given nodes.
+func (mdgs *MemoryDAGService) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	for _, node := range nodes {
+		if err := mdgs.Add(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes the node with the given CID.
+func (mdgs *MemoryDAGService) Remove(ctx context.Context, c cid.Cid) error {
+	mdgs.mu.Lock()
+	defer mdgs.mu.Unlock()
+	delete(mdgs.blocks, c)
+	return nil
+}
+
+// RemoveMany removes the nodes with the given CIDs.
+func (mdgs *MemoryDAGService) RemoveMany(ctx context.Context, keys []cid.Cid) error {
+	for _, c := range keys {
+		if err := mdgs.Remove(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finalize returns the given root.
+func (mdgs *MemoryDAGService) Finalize(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	return root, nil
+}
+
+// Cleanup removes the given nodes.
+func (mdgs *MemoryDAGService) Cleanup(ctx context.Context, cids []cid.Cid) error {
+	return mdgs.RemoveMany(ctx, cids)
+}
+
+// Len returns the number of stored blocks.
+func (mdgs *MemoryDAGService) Len() int {
+	mdgs.mu.RLock()
+	defer mdgs.mu.RUnlock()
+	return len(mdgs.blocks)
+}
+
+// Size returns the total size of the stored blocks.
+func (mdgs *MemoryDAGService) Size() uint64 {
+	mdgs.mu.RLock()
+	defer mdgs.mu.RUnlock()
+	var size uint64
+	for _, nd := range mdgs.blocks {
+		size += uint64(len(nd.RawData()))
+	}
+	return size
+}
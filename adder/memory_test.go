@@ -0,0 +1,70 @@
+package adder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+	"github.com/ipfs/ipfs-cluster/test"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func TestMemoryDAGService(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	dags := NewMemoryDAGService()
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+	})
+	adder := New(dags, api.DefaultAddParams(), nil)
+	root, err := adder.FromFiles(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.String() != test.ShardingDirBalancedRootCID {
+		t.Error("expected the right content root")
+	}
+
+	if dags.Len() != len(test.ShardingDirCids) {
+		t.Errorf("expected %d blocks, got %d", len(test.ShardingDirCids), dags.Len())
+	}
+	if dags.Size() != adder.Result().Bytes-adder.Result().DedupedBytes {
+		t.Error("unexpected size of the stored blocks")
+	}
+
+	// the whole DAG can be traversed.
+	seen := cid.NewSet()
+	var walk func(c cid.Cid)
+	walk = func(c cid.Cid) {
+		if !seen.Visit(c) {
+			return
+		}
+		nd, err := dags.Get(context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range nd.Links() {
+			walk(l.Cid)
+		}
+	}
+	walk(root)
+	if seen.Len() != dags.Len() {
+		t.Errorf("expected to reach %d blocks, reached %d", dags.Len(), seen.Len())
+	}
+
+	for opt := range dags.GetMany(context.Background(), []cid.Cid{root, test.Cid1}) {
+		if opt.Node == nil && opt.Err != ErrDAGNotFound {
+			t.Error("unexpected GetMany result", opt.Err)
+		}
+	}
+
+	if err := dags.Remove(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dags.Get(context.Background(), root); err != ErrDAGNotFound {
+		t.Error("the root should have been removed")
+	}
+}
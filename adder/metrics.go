@@ -0,0 +1,45 @@
+package adder
+
+import (
+	"context"
+
+	"github.com/ipfs/ipfs-cluster/observations"
+
+	"go.opencensus.io/stats"
+)
+
+// AddMetrics is notified when adds start and finish, so that aggregate
+// metrics can be kept across adds. Implementations must be safe for
+// concurrent use. Totals are only reported once per add, so that measuring
+// does not slow adding down.
+type AddMetrics interface {
+	// AddStarted is called when an add starts.
+	AddStarted(ctx context.Context)
+	// AddFinished is called when an add finishes, with the number of
+	// blocks and bytes added, as in AddResult, and the error which made
+	// it fail, if any.
+	AddFinished(ctx context.Context, blocks int, bytes uint64, err error)
+}
+
+// DefaultAddMetrics is the AddMetrics used by Adders unless set otherwise
+// with SetMetrics. It records the adder measures in the observations
+// package.
+var DefaultAddMetrics AddMetrics = observationsMetrics{}
+
+type observationsMetrics struct{}
+
+func (observationsMetrics) AddStarted(ctx context.Context) {
+	stats.Record(ctx, observations.AddsInFlight.M(1))
+}
+
+func (observationsMetrics) AddFinished(ctx context.Context, blocks int, bytes uint64, err error) {
+	ms := []stats.Measurement{
+		observations.AddsInFlight.M(-1),
+		observations.AddedBlocks.M(int64(blocks)),
+		observations.AddedBytes.M(int64(bytes)),
+	}
+	if err != nil {
+		ms = append(ms, observations.AddFailures.M(1))
+	}
+	stats.Record(ctx, ms...)
+}
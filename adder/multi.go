@@ -0,0 +1,208 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrNoDAGServices is returned by MultiDAGService when no ClusterDAGService is
+// left to add to.
+var ErrNoDAGServices = errors.New("multidagservice: no DAGServices left")
+
+// MultiDAGService is a ClusterDAGService which mirrors every block to several
+// ClusterDAGServices and finalizes the content on all of them. Calls are
+// made to all of them in parallel. It is a Cleaner, a BlockChecker, a
+// Preparer and a ShardConfigurer, forwarding those calls to the
+// ClusterDAGServices which implement them (see each method). Get and
+// ResolveName are not forwarded, so it cannot add from IPFS paths.
+type MultiDAGService struct {
+	BaseDAGService
+
+	dropFailed bool
+
+	mu   sync.Mutex
+	dgss []ClusterDAGService
+}
+
+// NewMultiDAGService returns a MultiDAGService which adds to the given
+// ClusterDAGServices. When dropFailed is set, those which fail are dropped
+// and the rest are used for the remainder of the add, which only fails when
+// all of them have failed. Otherwise, any failure fails the add.
+func NewMultiDAGService(dropFailed bool, dgss ...ClusterDAGService) *MultiDAGService {
+	return &MultiDAGService{
+		dropFailed: dropFailed,
+		dgss:       dgss,
+	}
+}
+
+// each calls f on every ClusterDAGService in parallel and handles failures.
+func (mdgs *MultiDAGService) each(f func(dgs ClusterDAGService) error) error {
+	mdgs.mu.Lock()
+	defer mdgs.mu.Unlock()
+
+	if len(mdgs.dgss) == 0 {
+		return ErrNoDAGServices
+	}
+
+	errs := make([]error, len(mdgs.dgss))
+	var wg sync.WaitGroup
+	for i, dgs := range mdgs.dgss {
+		wg.Add(1)
+		go func(i int, dgs ClusterDAGService) {
+			defer wg.Done()
+			errs[i] = f(dgs)
+		}(i, dgs)
+	}
+	wg.Wait()
+
+	var left []ClusterDAGService
+	var lastErr error
+	for i, err := range errs {
+		if err == nil {
+			left = append(left, mdgs.dgss[i])
+			continue
+		}
+		lastErr = err
+		if !mdgs.dropFailed {
+			return fmt.Errorf("multidagservice: DAGService %d: %s", i, err)
+		}
+		logger.Warnf("multidagservice: dropping failed DAGService: %s", err)
+	}
+	mdgs.dgss = left
+	if len(left) == 0 {
+		return fmt.Errorf("multidagservice: all DAGServices failed: %s", lastErr)
+	}
+	return nil
+}
+
+// Add adds the node to all the ClusterDAGServices.
+func (mdgs *MultiDAGService) Add(ctx context.Context, node ipld.Node) error {
+	return mdgs.each(func(dgs ClusterDAGService) error {
+		return dgs.Add(ctx, node)
+	})
+}
+
+// AddMany adds the nodes to all the ClusterDAGServices.
+func (mdgs *MultiDAGService) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	return mdgs.each(func(dgs ClusterDAGService) error {
+		return dgs.AddMany(ctx, nodes)
+	})
+}
+
+// Finalize finalizes the content in all the ClusterDAGServices. It fails if
+// they do not return the same root.
+func (mdgs *MultiDAGService) Finalize(ctx context.Context, ipfsRoot cid.Cid) (cid.Cid, error) {
+	return mdgs.eachRoot(func(dgs ClusterDAGService) (cid.Cid, error) {
+		return dgs.Finalize(ctx, ipfsRoot)
+	})
+}
+
+// eachRoot calls f on every ClusterDAGService with each and checks that they
+// all return the same root.
+func (mdgs *MultiDAGService) eachRoot(f func(dgs ClusterDAGService) (cid.Cid, error)) (cid.Cid, error) {
+	var rootsMu sync.Mutex
+	var roots []cid.Cid
+	err := mdgs.each(func(dgs ClusterDAGService) error {
+		root, err := f(dgs)
+		if err != nil {
+			return err
+		}
+		rootsMu.Lock()
+		roots = append(roots, root)
+		rootsMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	for _, root := range roots[1:] {
+		if !root.Equals(roots[0]) {
+			return cid.Undef, fmt.Errorf("multidagservice: DAGServices returned different roots: %s and %s", roots[0], root)
+		}
+	}
+	return roots[0], nil
+}
+
+// Has returns true when all the ClusterDAGServices left have the block, so
+// that it can be left out of the add. It returns false when any of them is
+// not a BlockChecker.
+func (mdgs *MultiDAGService) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	mdgs.mu.Lock()
+	dgss := mdgs.dgss
+	mdgs.mu.Unlock()
+
+	for _, dgs := range dgss {
+		checker, ok := dgs.(BlockChecker)
+		if !ok {
+			return false, nil
+		}
+		has, err := checker.Has(ctx, c)
+		if err != nil || !has {
+			return false, err
+		}
+	}
+	return len(dgss) > 0, nil
+}
+
+// Prepare prepares the content in all the ClusterDAGServices. It returns
+// ErrPrepareUnsupported when any of them is not a Preparer, and fails if
+// they do not return the same root.
+func (mdgs *MultiDAGService) Prepare(ctx context.Context, ipfsRoot cid.Cid) (cid.Cid, error) {
+	mdgs.mu.Lock()
+	for _, dgs := range mdgs.dgss {
+		if _, ok := dgs.(Preparer); !ok {
+			mdgs.mu.Unlock()
+			return cid.Undef, ErrPrepareUnsupported
+		}
+	}
+	mdgs.mu.Unlock()
+
+	return mdgs.eachRoot(func(dgs ClusterDAGService) (cid.Cid, error) {
+		return dgs.(Preparer).Prepare(ctx, ipfsRoot)
+	})
+}
+
+// Commit commits the prepared content in all the ClusterDAGServices left.
+func (mdgs *MultiDAGService) Commit(ctx context.Context, clusterRoot cid.Cid) error {
+	return mdgs.each(func(dgs ClusterDAGService) error {
+		p, ok := dgs.(Preparer)
+		if !ok {
+			return ErrPrepareUnsupported
+		}
+		return p.Commit(ctx, clusterRoot)
+	})
+}
+
+// ConfigureShards configures the shards of the ClusterDAGServices which are
+// ShardConfigurers.
+func (mdgs *MultiDAGService) ConfigureShards(size uint64, allocation string) {
+	mdgs.mu.Lock()
+	defer mdgs.mu.Unlock()
+	for _, dgs := range mdgs.dgss {
+		if sc, ok := dgs.(ShardConfigurer); ok {
+			sc.ConfigureShards(size, allocation)
+		}
+	}
+}
+
+// Cleanup calls Cleanup on all the ClusterDAGServices left which are
+// Cleaners.
+func (mdgs *MultiDAGService) Cleanup(ctx context.Context, cids []cid.Cid) error {
+	mdgs.mu.Lock()
+	dgss := mdgs.dgss
+	mdgs.mu.Unlock()
+
+	var lastErr error
+	for _, dgs := range dgss {
+		if err := cleanupDAGService(ctx, dgs, cids); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
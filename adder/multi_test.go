@@ -0,0 +1,174 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+	"github.com/ipfs/ipfs-cluster/test"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// brokenCDAGServ fails to add anything.
+type brokenCDAGServ struct {
+	*mockCDAGServ
+}
+
+func (dag brokenCDAGServ) Add(ctx context.Context, node ipld.Node) error {
+	return errors.New("broken")
+}
+
+// otherRootCDAGServ returns a different root on Finalize.
+type otherRootCDAGServ struct {
+	*mockCDAGServ
+}
+
+func (dag otherRootCDAGServ) Finalize(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	return test.Cid1, nil
+}
+
+// shardConfigCDAGServ records the shard configuration.
+type shardConfigCDAGServ struct {
+	*mockCDAGServ
+	size       uint64
+	allocation string
+}
+
+func (dag *shardConfigCDAGServ) ConfigureShards(size uint64, allocation string) {
+	dag.size = size
+	dag.allocation = allocation
+}
+
+func TestMultiDAGService(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	add := func(dgs ClusterDAGService) (cid.Cid, error) {
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+		})
+		return New(dgs, api.DefaultAddParams(), nil).FromFiles(context.Background(), f)
+	}
+	newMock := func() *mockCDAGServ {
+		return &mockCDAGServ{resultCids: make(map[string]struct{})}
+	}
+
+	t.Run("mirror", func(t *testing.T) {
+		dags1, dags2 := newMock(), newMock()
+		root, err := add(NewMultiDAGService(false, dags1, dags2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.String() != test.ShardingDirBalancedRootCID {
+			t.Error("expected the right content root")
+		}
+		for _, dags := range []*mockCDAGServ{dags1, dags2} {
+			if len(dags.resultCids) != len(test.ShardingDirCids) {
+				t.Error("all blocks should be added to all DAGServices")
+			}
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		_, err := add(NewMultiDAGService(false, newMock(), brokenCDAGServ{newMock()}))
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("drop failed", func(t *testing.T) {
+		dags := newMock()
+		root, err := add(NewMultiDAGService(true, brokenCDAGServ{newMock()}, dags))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.String() != test.ShardingDirBalancedRootCID {
+			t.Error("expected the right content root")
+		}
+		if len(dags.resultCids) != len(test.ShardingDirCids) {
+			t.Error("all blocks should be added to the healthy DAGService")
+		}
+
+		_, err = add(NewMultiDAGService(true, brokenCDAGServ{newMock()}, brokenCDAGServ{newMock()}))
+		if err == nil {
+			t.Error("expected an error when all DAGServices fail")
+		}
+	})
+
+	t.Run("different roots", func(t *testing.T) {
+		_, err := add(NewMultiDAGService(false, newMock(), otherRootCDAGServ{newMock()}))
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+	t.Run("block checker", func(t *testing.T) {
+		ctx := context.Background()
+		has, err := NewMultiDAGService(false, checkerCDAGServ{newMock()}, checkerCDAGServ{newMock()}).Has(ctx, test.Cid1)
+		if err != nil || !has {
+			t.Error("expected the block when all DAGServices have it")
+		}
+		has, err = NewMultiDAGService(false, checkerCDAGServ{newMock()}, newMock()).Has(ctx, test.Cid1)
+		if err != nil || has {
+			t.Error("the block cannot be known to be everywhere when a DAGService is not a BlockChecker")
+		}
+	})
+
+	t.Run("prepare", func(t *testing.T) {
+		ctx := context.Background()
+		f := func() files.Directory {
+			return files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+			})
+		}
+		dags1 := &preparerCDAGServ{mockCDAGServ: newMock()}
+		dags2 := &preparerCDAGServ{mockCDAGServ: newMock()}
+		adder := New(NewMultiDAGService(false, dags1, dags2), api.DefaultAddParams(), nil)
+		root, err := adder.Build(ctx, f())
+		if err != nil {
+			t.Fatal(err)
+		}
+		staged, err := adder.Prepare(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := adder.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, dags := range []*preparerCDAGServ{dags1, dags2} {
+			if !dags.prepared.Equals(root) || !dags.committed.Equals(staged) {
+				t.Error("all DAGServices should prepare and commit the content")
+			}
+		}
+
+		adder = New(NewMultiDAGService(false, &preparerCDAGServ{mockCDAGServ: newMock()}, newMock()), api.DefaultAddParams(), nil)
+		if _, err := adder.Build(ctx, f()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := adder.Prepare(ctx); err != ErrPrepareUnsupported {
+			t.Error("expected ErrPrepareUnsupported, got", err)
+		}
+		if _, err := adder.Commit(ctx); err != nil {
+			t.Error("the content should still be committed:", err)
+		}
+	})
+
+	t.Run("shard configurer", func(t *testing.T) {
+		dags := &shardConfigCDAGServ{mockCDAGServ: newMock()}
+		p := api.DefaultAddParams()
+		p.ShardSize = 1024 * 1024
+		p.ShardAllocation = "same"
+		_, err := New(NewMultiDAGService(false, dags, newMock()), p, nil).FromFiles(context.Background(), files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dags.size != p.ShardSize || dags.allocation != "same" {
+			t.Error("the shards should be configured")
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package adder
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/ipfs/ipfs-cluster/adder/ipfsadd"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrNoPartialRoot is returned when an add interrupted with CancelWithCommit
+// has nothing to commit, as only directories can be committed partially.
+var ErrNoPartialRoot = errors.New("adder: interrupted with nothing to commit: only directories can be partially added")
+
+// CancelWithCommit interrupts adding files, keeping what was added so far
+// rather than cleaning it up: the directory being added is finished with the
+// entries added until then, and its root is finalized and returned by the
+// adding method as usual, with Result().Partial set. The partial root omits
+// the files being added when interrupted, as well as the entries which
+// were not reached, and its directories only have the entries which were
+// added completely. When adding a single file, the add fails with
+// ErrNoPartialRoot instead.
+//
+// Files stop being read the next time they would be, so a read which blocks
+// delays the interruption. It has no effect once the files have been added,
+// nor when adding from CAR, IPFS paths or tar archives.
+func (a *Adder) CancelWithCommit() {
+	atomic.StoreInt32(&a.interrupted, 1)
+}
+
+func (a *Adder) isInterrupted() bool {
+	return atomic.LoadInt32(&a.interrupted) == 1
+}
+
+// partialRoot finishes the top-level entry whose adding was interrupted and
+// returns its root.
+func (a *Adder) partialRoot(ipfsAdder *ipfsadd.Adder, entry files.Node) (ipld.Node, error) {
+	if _, ok := entry.(files.Directory); !ok {
+		return nil, ErrNoPartialRoot
+	}
+	nd, err := ipfsAdder.FinishPartial()
+	if err != nil {
+		return nil, err
+	}
+	a.log.Warnf("adding interrupted: committing %s with the entries added so far", nd.Cid())
+	a.partial = true
+	return nd, nil
+}
+
+// interruptibleReader fails with ipfsadd.ErrInterrupted once the add is
+// interrupted by CancelWithCommit.
+type interruptibleReader struct {
+	r io.Reader
+	a *Adder
+}
+
+func (ir *interruptibleReader) Read(p []byte) (int, error) {
+	if ir.a.isInterrupted() {
+		return 0, ipfsadd.ErrInterrupted
+	}
+	return ir.r.Read(p)
+}
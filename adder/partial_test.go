@@ -0,0 +1,100 @@
+package adder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// interruptingReader interrupts the add with CancelWithCommit once its first
+// bytes have been read.
+type interruptingReader struct {
+	r     io.Reader
+	adder *Adder
+}
+
+func (ir *interruptingReader) Read(p []byte) (int, error) {
+	ir.adder.CancelWithCommit()
+	return ir.r.Read(p)
+}
+
+func TestAdder_CancelWithCommit(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Concurrency = 1
+	p.SkipFailedFiles = true
+	dags := NewMemoryDAGService()
+	adder := New(dags, p, nil)
+
+	interrupting := &interruptingReader{
+		r:     bytes.NewReader(bytes.Repeat([]byte("c"), 1<<20)),
+		adder: adder,
+	}
+	dir := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+			files.FileEntry("b", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("b1", files.NewBytesFile([]byte("b1"))),
+			})),
+			files.FileEntry("c", files.NewReaderFile(interrupting)),
+			files.FileEntry("d", files.NewBytesFile([]byte("d"))),
+		})),
+	})
+
+	root, err := adder.FromFiles(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !adder.Result().Partial || adder.Result().Files != 2 {
+		t.Errorf("expected a partial add of 2 files: %+v", adder.Result())
+	}
+
+	nd, err := dags.Get(context.Background(), root)
+	if err != nil {
+		t.Fatal("the partial root should have been stored:", err)
+	}
+	var names []string
+	for _, l := range nd.Links() {
+		names = append(names, l.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a,b" {
+		t.Error("expected the completed entries only, got", names)
+	}
+
+	// the same directory without c.
+	dir = files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+			files.FileEntry("b", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("b1", files.NewBytesFile([]byte("b1"))),
+			})),
+		})),
+	})
+	expected, err := New(NewMemoryDAGService(), p, nil).FromFiles(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(expected) {
+		t.Errorf("expected the partial root to be %s, got %s", expected, root)
+	}
+}
+
+func TestAdder_CancelWithCommitFile(t *testing.T) {
+	adder := New(NewMemoryDAGService(), api.DefaultAddParams(), nil)
+	r := &interruptingReader{
+		r:     bytes.NewReader(bytes.Repeat([]byte("a"), 1<<20)),
+		adder: adder,
+	}
+	_, err := adder.FromReader(context.Background(), r, "")
+	if !errors.Is(err, ErrNoPartialRoot) {
+		t.Error("expected ErrNoPartialRoot, got", err)
+	}
+}
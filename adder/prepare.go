@@ -0,0 +1,135 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrPrepareUnsupported is returned by Prepare when the ClusterDAGService is
+// not a Preparer. The content can still be committed with Commit.
+var ErrPrepareUnsupported = errors.New("adder: the DAGService cannot prepare content without committing it")
+
+// ErrPrepareExpired is returned by Commit when the prepared content was not
+// committed within the PrepareTimeout and was cleaned up.
+var ErrPrepareExpired = errors.New("adder: prepared content was not committed in time")
+
+// The lifecycle of an add is:
+//
+//   - Build adds the content to the ClusterDAGService (i.e. puts the
+//     blocks) and returns the IPFS root.
+//   - Prepare, optionally, stages the content in the ClusterDAGService
+//     (i.e. allocates and pins the shards) and returns the cluster root
+//     without committing it.
+//   - Commit commits the content (i.e. pins the root) and ends the add.
+//
+// FromFiles and the rest of the From* methods do all of them at once.
+// Content which is built or prepared but fails to be committed is cleaned
+// up.
+
+// Prepare stages the content added with Build in the ClusterDAGService
+// without committing it and returns the cluster root, so that the content
+// can be checked before calling Commit, which must be called to end the
+// adding process. When the PrepareTimeout parameter is set and Commit is
+// not called in time, the adding process ends and the prepared content is
+// cleaned up. It returns ErrNotBuilt unless Build was successful, and
+// ErrPrepareUnsupported when the ClusterDAGService is not a Preparer.
+// Otherwise, on error, the adding process ends as with Commit.
+func (a *Adder) Prepare(ctx context.Context) (root cid.Cid, err error) {
+	if !a.built.Defined() {
+		return cid.Undef, ErrNotBuilt
+	}
+	a.commitMu.Lock()
+	defer a.commitMu.Unlock()
+	if a.committed || a.prepared.Defined() {
+		return cid.Undef, ErrAdderConsumed
+	}
+
+	root, err = a.tracker.Prepare(ctx, a.built)
+	if err == ErrPrepareUnsupported {
+		return cid.Undef, err
+	}
+	if err != nil {
+		a.log.Error("error preparing adder:", err)
+		a.committed = true
+		a.end(err)
+		return cid.Undef, err
+	}
+	a.prepared = root
+
+	if timeout := a.params.PrepareTimeout; timeout > 0 {
+		a.prepareTimer = time.AfterFunc(timeout, a.expire)
+	}
+	return root, nil
+}
+
+// expire ends the add when the prepared content was not committed in time.
+func (a *Adder) expire() {
+	a.commitMu.Lock()
+	if a.committed {
+		a.commitMu.Unlock()
+		return
+	}
+	a.committed = true
+	a.expired = true
+	a.commitMu.Unlock()
+
+	a.log.Warnf("%s was prepared but not committed in %s", a.prepared, a.params.PrepareTimeout)
+	a.end(ErrPrepareExpired)
+}
+
+// Prepare stages any buffered nodes and prepares the content in the wrapped
+// DAGService, if it is a Preparer.
+func (dt *dagTracker) Prepare(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	p, ok := dt.ClusterDAGService.(Preparer)
+	if !ok {
+		return cid.Undef, ErrPrepareUnsupported
+	}
+	dt.mu.Lock()
+	err := dt.flush(ctx)
+	dt.mu.Unlock()
+	if err != nil {
+		return cid.Undef, err
+	}
+	return p.Prepare(ctx, root)
+}
+
+// Commit commits the content prepared in the wrapped DAGService.
+func (dt *dagTracker) Commit(ctx context.Context, root cid.Cid) error {
+	p, ok := dt.ClusterDAGService.(Preparer)
+	if !ok {
+		return ErrPrepareUnsupported
+	}
+	return p.Commit(ctx, root)
+}
+
+// Prepare prepares the content in the wrapped DAGService, if it is a
+// Preparer.
+func (cp *checkpoint) Prepare(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	p, ok := cp.ClusterDAGService.(Preparer)
+	if !ok {
+		return cid.Undef, ErrPrepareUnsupported
+	}
+	return p.Prepare(ctx, root)
+}
+
+// Commit commits the content prepared in the wrapped DAGService.
+func (cp *checkpoint) Commit(ctx context.Context, root cid.Cid) error {
+	p, ok := cp.ClusterDAGService.(Preparer)
+	if !ok {
+		return ErrPrepareUnsupported
+	}
+	return p.Commit(ctx, root)
+}
+
+// Prepare returns the given root.
+func (dag discardDAGService) Prepare(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	return root, nil
+}
+
+// Commit is a nop.
+func (dag discardDAGService) Commit(ctx context.Context, root cid.Cid) error {
+	return nil
+}
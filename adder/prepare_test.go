@@ -0,0 +1,153 @@
+package adder
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/ipfs-cluster/api"
+	"github.com/ipfs/ipfs-cluster/test"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// preparerCDAGServ records the calls to prepare, commit and clean up. The
+// prepared root is test.Cid1.
+type preparerCDAGServ struct {
+	*mockCDAGServ
+
+	mu        sync.Mutex
+	prepared  cid.Cid
+	committed cid.Cid
+	cleanedUp bool
+}
+
+func (dag *preparerCDAGServ) Prepare(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	dag.mu.Lock()
+	defer dag.mu.Unlock()
+	dag.prepared = root
+	return test.Cid1, nil
+}
+
+func (dag *preparerCDAGServ) Commit(ctx context.Context, root cid.Cid) error {
+	dag.mu.Lock()
+	defer dag.mu.Unlock()
+	dag.committed = root
+	return nil
+}
+
+func (dag *preparerCDAGServ) Cleanup(ctx context.Context, cids []cid.Cid) error {
+	dag.mu.Lock()
+	defer dag.mu.Unlock()
+	dag.cleanedUp = true
+	return nil
+}
+
+func TestAdder_PrepareCommit(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+	tree := func() files.Directory {
+		return files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("testTree", sth.GetTreeSerialFile(t)),
+		})
+	}
+	newDAGs := func() *preparerCDAGServ {
+		return &preparerCDAGServ{mockCDAGServ: &mockCDAGServ{resultCids: make(map[string]struct{})}}
+	}
+	ctx := context.Background()
+
+	t.Run("commit", func(t *testing.T) {
+		dags := newDAGs()
+		out := make(chan *api.AddedOutput, 100)
+		adder := New(dags, api.DefaultAddParams(), out)
+		if _, err := adder.Prepare(ctx); err != ErrNotBuilt {
+			t.Fatal("expected ErrNotBuilt, got", err)
+		}
+		root, err := adder.Build(ctx, tree())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		staged, err := adder.Prepare(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dags.prepared.Equals(root) || !staged.Equals(test.Cid1) {
+			t.Error("Prepare should stage the built root")
+		}
+		if dags.committed.Defined() {
+			t.Error("Prepare should not commit")
+		}
+		if _, err := adder.Prepare(ctx); err != ErrAdderConsumed {
+			t.Error("expected ErrAdderConsumed, got", err)
+		}
+
+		clusterRoot, err := adder.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !clusterRoot.Equals(staged) || !dags.committed.Equals(staged) {
+			t.Error("Commit should commit the prepared root")
+		}
+		if adder.Result() == nil || dags.cleanedUp {
+			t.Error("expected a result and no cleanup")
+		}
+		for range out { // closed by Commit
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		dags := newDAGs()
+		p := api.DefaultAddParams()
+		p.PrepareTimeout = 50 * time.Millisecond
+		out := make(chan *api.AddedOutput, 100)
+		adder := New(dags, p, out)
+		if _, err := adder.Build(ctx, tree()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := adder.Prepare(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		for range out { // closed when the prepared content expires
+		}
+		dags.mu.Lock()
+		if !dags.cleanedUp || dags.committed.Defined() {
+			t.Error("expired content should be cleaned up and not committed")
+		}
+		dags.mu.Unlock()
+		if _, err := adder.Commit(ctx); err != ErrPrepareExpired {
+			t.Error("expected ErrPrepareExpired, got", err)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		dags := &finalizeCDAGServ{
+			mockCDAGServ: &mockCDAGServ{resultCids: make(map[string]struct{})},
+		}
+		adder := New(dags, api.DefaultAddParams(), nil)
+		if _, err := adder.Build(ctx, tree()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := adder.Prepare(ctx); err != ErrPrepareUnsupported {
+			t.Fatal("expected ErrPrepareUnsupported, got", err)
+		}
+		if _, err := adder.Commit(ctx); err != nil || !dags.finalized {
+			t.Error("the content should still be committed:", err)
+		}
+	})
+
+	t.Run("from files", func(t *testing.T) {
+		dags := newDAGs()
+		root, err := New(dags, api.DefaultAddParams(), nil).FromFiles(ctx, tree())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Finalize is used when adding in one go.
+		if dags.prepared.Defined() || root.String() != test.ShardingDirBalancedRootCID {
+			t.Error("FromFiles should finalize")
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package adder
+
+import (
+	"time"
+
+	"github.com/ipfs/ipfs-cluster/adder/ipfsadd"
+	"github.com/ipfs/ipfs-cluster/api"
+)
+
+// isProgressUpdate tells whether the given output is a progress update,
+// rather than an event for an added, skipped or failed entry.
+func isProgressUpdate(ao *api.AddedOutput) bool {
+	return !ao.Cid.Defined() && ao.Type == "" && !ao.Skipped && ao.Error == ""
+}
+
+// coalesceProgress makes the given ipfs adder send its output through a
+// goroutine which forwards progress updates to the output at most once per
+// ProgressInterval, and the rest as they come. It returns a function to call
+// once the ipfs adder is done, which waits until everything has been
+// forwarded. It does nothing when no ProgressInterval is set or there is no
+// output.
+//
+// The latest update is held until it can be sent. It is dropped when an event
+// for the same entry comes first, so that no update follows the event for its
+// entry, and when adding ends, so that none follows the root.
+func (a *Adder) coalesceProgress(ipfsAdder *ipfsadd.Adder) func() {
+	interval := a.params.ProgressInterval
+	if interval <= 0 || ipfsAdder.Out == nil {
+		return func() {}
+	}
+
+	in := make(chan *api.AddedOutput)
+	done := make(chan struct{})
+	out := ipfsAdder.Out
+	ipfsAdder.Out = in
+
+	go func() {
+		defer close(done)
+		var pending *api.AddedOutput
+		var wait <-chan time.Time
+		var last time.Time
+		for {
+			select {
+			case ao, ok := <-in:
+				if !ok {
+					return
+				}
+				if !isProgressUpdate(ao) {
+					if pending != nil && pending.Name == ao.Name {
+						pending, wait = nil, nil
+					}
+					out <- ao
+					continue
+				}
+				if pending == nil {
+					if since := time.Since(last); since < interval {
+						wait = time.After(interval - since)
+					} else {
+						out <- ao
+						last = time.Now()
+						continue
+					}
+				}
+				pending = ao
+			case <-wait:
+				out <- pending
+				last = time.Now()
+				pending, wait = nil, nil
+			}
+		}
+	}()
+
+	return func() {
+		close(in)
+		<-done
+	}
+}
@@ -0,0 +1,47 @@
+package adder
+
+import (
+	"context"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// AddSession adds many independent items with the same ClusterDAGService and
+// parameters. Every call to Add uses a new Adder, with its own context and
+// output, and a copy of the parameters, so adds do not share any state other
+// than the ClusterDAGService. It may be used concurrently when the
+// ClusterDAGService is safe for concurrent use and can finalize several
+// roots, like MemoryDAGService, which is not the case of those which
+// finalize a single add, like the single and sharding ones.
+type AddSession struct {
+	dgs    ClusterDAGService
+	params *api.AddParams
+}
+
+// NewAddSession returns an AddSession adding to the given ClusterDAGService
+// with a copy of the given parameters.
+func NewAddSession(dgs ClusterDAGService, p *api.AddParams) *AddSession {
+	return &AddSession{
+		dgs:    dgs,
+		params: p.Clone(),
+	}
+}
+
+// Params returns a copy of the parameters used by the session.
+func (s *AddSession) Params() *api.AddParams {
+	return s.params.Clone()
+}
+
+// Add adds the given file like Adder.FromReader with no name, and returns
+// the result of the add.
+func (s *AddSession) Add(ctx context.Context, f files.File) (*api.AddResult, error) {
+	adder := NewQuiet(s.dgs, s.params.Clone())
+	dir := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", f)})
+	defer dir.Close()
+	if _, err := adder.FromFiles(ctx, dir); err != nil {
+		return nil, err
+	}
+	return adder.Result(), nil
+}
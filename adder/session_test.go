@@ -0,0 +1,70 @@
+package adder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func TestAddSession(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Chunker = "size-100"
+	dags := NewMemoryDAGService()
+	session := NewAddSession(dags, p)
+	p.Chunker = "size-200"
+
+	content := func(i int) []byte {
+		return []byte(fmt.Sprintf("%d: %0500d", i, i))
+	}
+
+	results := make([]*api.AddResult, 10)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := session.Add(context.Background(), files.NewBytesFile(content(i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = res
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	blocks := 0
+	for i, res := range results {
+		expected := New(NewMemoryDAGService(), session.Params(), nil)
+		root, err := expected.FromReader(context.Background(), bytes.NewReader(content(i)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Root.Equals(root) {
+			t.Errorf("%d: expected root %s, got %s", i, root, res.Root)
+		}
+		if res.Files != 1 || res.Blocks != expected.Result().Blocks {
+			t.Errorf("%d: results should only count their own add: %+v", i, res)
+		}
+		blocks += res.Blocks
+		if _, err := dags.Get(context.Background(), res.Root); err != nil {
+			t.Errorf("%d: the root should be stored in the session's DAGService", i)
+		}
+	}
+	if dags.Len() > blocks {
+		t.Errorf("expected at most %d blocks, got %d", blocks, dags.Len())
+	}
+
+	if session.Params().Chunker != "size-100" {
+		t.Error("the session params should be a copy of the given ones")
+	}
+}
@@ -17,6 +17,7 @@ import (
 	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
+	path "github.com/ipfs/go-path"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	rpc "github.com/libp2p/go-libp2p-gorpc"
 )
@@ -34,6 +35,9 @@ type DAGService struct {
 
 	pinOpts api.PinOptions
 	output  chan<- *api.AddedOutput
+	// "same" when all shards use the allocations of the first one.
+	allocation  string
+	allocations []peer.ID
 
 	addedSet *cid.Set
 
@@ -44,6 +48,8 @@ type DAGService struct {
 
 	// shard tracking
 	shards map[string]cid.Cid
+	// ClusterDAG CID, once pinned
+	clusterDAG cid.Cid
 
 	startTime time.Time
 	totalSize uint64
@@ -51,6 +57,9 @@ type DAGService struct {
 
 // New returns a new ClusterDAGService, which uses the given rpc client to perform
 // Allocate, IPFSBlockPut and Pin requests to other cluster components.
+// Shards are pinned as they are built, so adding without pinning is not
+// supported: Adders reject NoPin together with Shard (api.ErrNoPinShard)
+// before anything is added.
 func New(rpc *rpc.Client, opts api.PinOptions, out chan<- *api.AddedOutput) *DAGService {
 	// use a default value for this regardless of what is provided.
 	opts.Mode = api.PinModeRecursive
@@ -64,6 +73,15 @@ func New(rpc *rpc.Client, opts api.PinOptions, out chan<- *api.AddedOutput) *DAG
 	}
 }
 
+// ConfigureShards sets the size limit of the shards and how they are
+// allocated: "same" puts all of them on the peers allocated to the first
+// one, and anything else allocates every shard on its own. Adders call it
+// before adding.
+func (dgs *DAGService) ConfigureShards(size uint64, allocation string) {
+	dgs.pinOpts.ShardSize = size
+	dgs.allocation = allocation
+}
+
 // Add puts the given node in its corresponding shard and sends it to the
 // destination peers.
 func (dgs *DAGService) Add(ctx context.Context, node ipld.Node) error {
@@ -78,6 +96,16 @@ func (dgs *DAGService) Add(ctx context.Context, node ipld.Node) error {
 // Finalize finishes sharding, creates the cluster DAG and pins it along
 // with the meta pin for the root node of the content.
 func (dgs *DAGService) Finalize(ctx context.Context, dataRoot cid.Cid) (cid.Cid, error) {
+	if _, err := dgs.Prepare(ctx, dataRoot); err != nil {
+		return dataRoot, err
+	}
+	return dataRoot, dgs.Commit(ctx, dataRoot)
+}
+
+// Prepare flushes the last shard and puts and pins the ClusterDAG, which
+// references all the shards, without pinning the IPFS data root itself. It
+// returns the data root.
+func (dgs *DAGService) Prepare(ctx context.Context, dataRoot cid.Cid) (cid.Cid, error) {
 	lastCid, err := dgs.flushCurrentShard(ctx)
 	if err != nil {
 		return lastCid, err
@@ -118,19 +146,30 @@ func (dgs *DAGService) Finalize(ctx context.Context, dataRoot cid.Cid) (cid.Cid,
 	if err != nil {
 		return dataRoot, err
 	}
+	dgs.clusterDAG = clusterDAG
+	return dataRoot, nil
+}
+
+// Commit pins the META pin for the given data root, which references the
+// ClusterDAG pinned by Prepare.
+func (dgs *DAGService) Commit(ctx context.Context, dataRoot cid.Cid) error {
+	if !dgs.clusterDAG.Defined() {
+		return errors.New("sharding: nothing was prepared")
+	}
+	clusterDAG := dgs.clusterDAG
 
 	// Pin the META pin
 	metaPin := api.PinWithOpts(dataRoot, dgs.pinOpts)
 	metaPin.Type = api.MetaType
 	metaPin.Reference = &clusterDAG
 	metaPin.MaxDepth = 0 // irrelevant. Meta-pins are not pinned
-	err = adder.Pin(ctx, dgs.rpcClient, metaPin)
+	err := adder.Pin(ctx, dgs.rpcClient, metaPin)
 	if err != nil {
-		return dataRoot, err
+		return err
 	}
 
 	// Log some stats
-	dgs.logStats(metaPin.Cid, clusterDAGPin.Cid)
+	dgs.logStats(metaPin.Cid, clusterDAG)
 
 	// Consider doing this? Seems like overkill
 	//
@@ -150,7 +189,31 @@ func (dgs *DAGService) Finalize(ctx context.Context, dataRoot cid.Cid) (cid.Cid,
 	// 	}
 	// }
 
-	return dataRoot, nil
+	return nil
+}
+
+// Cleanup unpins the shards and the ClusterDAG pinned so far. It is called
+// when adding fails, so that no partial content stays pinned. The given
+// CIDs are ignored: everything pinned for the add is unpinned, and the
+// blocks themselves are left to the IPFS garbage collector.
+func (dgs *DAGService) Cleanup(ctx context.Context, cids []cid.Cid) error {
+	var pinned []cid.Cid
+	if dgs.clusterDAG.Defined() {
+		pinned = append(pinned, dgs.clusterDAG)
+	}
+	for _, shardCid := range dgs.shards {
+		pinned = append(pinned, shardCid)
+	}
+
+	var lastErr error
+	for _, c := range pinned {
+		logger.Infof("unpinning %s after failed add of '%s'", c, dgs.pinOpts.Name)
+		if err := adder.Unpin(ctx, dgs.rpcClient, c); err != nil {
+			logger.Errorf("error unpinning %s: %s", c, err)
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
 // ingests a block to the current shard. If it get's full, it
@@ -162,10 +225,13 @@ func (dgs *DAGService) ingestBlock(ctx context.Context, n ipld.Node) error {
 	if shard == nil {
 		logger.Infof("new shard for '%s': #%d", dgs.pinOpts.Name, len(dgs.shards))
 		var err error
-		shard, err = newShard(ctx, dgs.rpcClient, dgs.pinOpts)
+		shard, err = newShard(ctx, dgs.rpcClient, dgs.pinOpts, dgs.allocations)
 		if err != nil {
 			return err
 		}
+		if dgs.allocation == "same" {
+			dgs.allocations = shard.Allocations()
+		}
 		dgs.currentShard = shard
 	}
 
@@ -266,6 +332,19 @@ func (dgs *DAGService) flushCurrentShard(ctx context.Context) (cid.Cid, error) {
 	return shard.LastLink(), nil
 }
 
+// Get gets the block with the given CID from the local IPFS daemon, which
+// fetches it from the IPFS network (i.e. from the peers where it was put)
+// when it does not have it. It allows adding from IPFS paths and verifying
+// added content.
+func (dgs *DAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	return adder.BlockGet(ctx, dgs.rpcClient, c)
+}
+
+// ResolveName resolves the given /ipns/ path with the local IPFS daemon.
+func (dgs *DAGService) ResolveName(ctx context.Context, p path.Path) (path.Path, error) {
+	return adder.ResolvePath(ctx, dgs.rpcClient, p)
+}
+
 // AddMany calls Add for every given node.
 func (dgs *DAGService) AddMany(ctx context.Context, nodes []ipld.Node) error {
 	for _, node := range nodes {
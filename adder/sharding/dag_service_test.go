@@ -1,10 +1,17 @@
 package sharding
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"mime/multipart"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	adder "github.com/ipfs/ipfs-cluster/adder"
@@ -12,7 +19,9 @@ import (
 	"github.com/ipfs/ipfs-cluster/test"
 
 	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
 	logging "github.com/ipfs/go-log/v2"
+	path "github.com/ipfs/go-path"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	rpc "github.com/libp2p/go-libp2p-gorpc"
 )
@@ -25,6 +34,8 @@ func init() {
 type testRPC struct {
 	blocks sync.Map
 	pins   sync.Map
+	unpins int32
+	allocs int32
 }
 
 func (rpcs *testRPC) BlockPut(ctx context.Context, in *api.NodeWithMeta, out *struct{}) error {
@@ -38,10 +49,18 @@ func (rpcs *testRPC) Pin(ctx context.Context, in *api.Pin, out *api.Pin) error {
 	return nil
 }
 
+func (rpcs *testRPC) Unpin(ctx context.Context, in *api.Pin, out *api.Pin) error {
+	rpcs.pins.Delete(in.Cid.String())
+	atomic.AddInt32(&rpcs.unpins, 1)
+	*out = *in
+	return nil
+}
+
 func (rpcs *testRPC) BlockAllocate(ctx context.Context, in *api.Pin, out *[]peer.ID) error {
 	if in.ReplicationFactorMin > 1 {
 		return errors.New("we can only replicate to 1 peer")
 	}
+	atomic.AddInt32(&rpcs.allocs, 1)
 	// it does not matter since we use host == nil for RPC, so it uses the
 	// local one in all cases
 	*out = []peer.ID{test.PeerID1}
@@ -64,6 +83,17 @@ func (rpcs *testRPC) BlockGet(ctx context.Context, c cid.Cid) ([]byte, error) {
 	return bI.([]byte), nil
 }
 
+// testIPFSRPC serves the IPFSConnector methods of a testRPC.
+type testIPFSRPC struct {
+	*testRPC
+}
+
+func (rpcs testIPFSRPC) BlockGet(ctx context.Context, in cid.Cid, out *[]byte) error {
+	data, err := rpcs.testRPC.BlockGet(ctx, in)
+	*out = data
+	return err
+}
+
 func makeAdder(t *testing.T, params *api.AddParams) (*adder.Adder, *testRPC) {
 	rpcObj := &testRPC{}
 	server := rpc.NewServer(nil, "mock")
@@ -71,7 +101,7 @@ func makeAdder(t *testing.T, params *api.AddParams) (*adder.Adder, *testRPC) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = server.RegisterName("IPFSConnector", rpcObj)
+	err = server.RegisterName("IPFSConnector", testIPFSRPC{rpcObj})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -82,11 +112,15 @@ func makeAdder(t *testing.T, params *api.AddParams) (*adder.Adder, *testRPC) {
 	dags := New(client, params.PinOptions, out)
 	add := adder.New(dags, params, out)
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for v := range out {
 			t.Logf("Output: Name: %s. Cid: %s. Size: %d", v.Name, v.Cid, v.Size)
 		}
 	}()
+	// do not log after the test has finished.
+	t.Cleanup(func() { <-done })
 
 	return add, rpcObj
 }
@@ -261,3 +295,272 @@ func TestFromMultipart_Errors(t *testing.T) {
 		f.Close()
 	}
 }
+
+func TestFromFiles_NoPin(t *testing.T) {
+	sth := test.NewShardingTestHelper()
+	defer sth.Clean(t)
+
+	params := api.DefaultAddParams()
+	params.Shard = true
+	params.NoPin = true
+	add, rpcObj := makeAdder(t, params)
+
+	f := sth.GetTreeSerialFile(t)
+	defer f.Close()
+	_, err := add.FromFiles(context.Background(), f)
+	if err != api.ErrNoPinShard {
+		t.Fatal("expected no-pin to be rejected when sharding, got:", err)
+	}
+	rpcObj.blocks.Range(func(k, v interface{}) bool {
+		t.Error("no blocks should be put:", k)
+		return false
+	})
+	rpcObj.pins.Range(func(k, v interface{}) bool {
+		t.Error("nothing should be pinned:", k)
+		return false
+	})
+}
+
+func TestFromFiles_ShardSize(t *testing.T) {
+	for _, allocation := range []string{"per-shard", "same"} {
+		t.Run(allocation, func(t *testing.T) {
+			p := api.DefaultAddParams()
+			p.Name = "testingFile"
+			p.Shard = true
+			p.ReplicationFactorMin = 1
+			p.ReplicationFactorMax = 2
+
+			add, rpcObj := makeAdder(t, p)
+			// The Adder passes them to the DAGService.
+			p.ShardSize = 1024 * 1024 // 1MB
+			p.ShardAllocation = allocation
+
+			// 40 leaves of 256KiB, 3 per shard, and the root.
+			f := files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("file", files.NewReaderFile(io.LimitReader(rand.New(rand.NewSource(1)), 10*1024*1024))),
+			})
+			root, err := add.FromFiles(context.Background(), f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := VerifyShards(t, root, rpcObj, rpcObj, 14); err != nil {
+				t.Fatal(err)
+			}
+
+			allocs := atomic.LoadInt32(&rpcObj.allocs)
+			if allocation == "same" && allocs != 1 {
+				t.Errorf("expected a single allocation, got %d", allocs)
+			}
+			if allocation == "per-shard" && allocs != 14 {
+				t.Errorf("expected an allocation per shard, got %d", allocs)
+			}
+		})
+	}
+}
+
+func TestFromFiles_Checkpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharding-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	p := api.DefaultAddParams()
+	p.Name = "testingFile"
+	p.Shard = true
+	p.ShardSize = 1024 * 1024
+	add, rpcObj := makeAdder(t, p)
+	add.SetCheckpoint(path)
+
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("file", files.NewReaderFile(io.LimitReader(rand.New(rand.NewSource(1)), 2*1024*1024))),
+	})
+	_, err = add.FromFiles(context.Background(), f)
+	if err != adder.ErrCheckpointShard {
+		t.Fatal("expected ErrCheckpointShard, got:", err)
+	}
+	rpcObj.blocks.Range(func(k, v interface{}) bool {
+		t.Error("no blocks should be put:", k)
+		return true
+	})
+	rpcObj.pins.Range(func(k, v interface{}) bool {
+		t.Error("no shards should be pinned:", k)
+		return true
+	})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("no checkpoint should be created")
+	}
+}
+
+// cancelReader calls cancel after reading the given number of bytes.
+type cancelReader struct {
+	r      io.Reader
+	after  int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.read += n
+	if cr.read >= cr.after {
+		cr.cancel()
+	}
+	return n, err
+}
+
+func TestFromFiles_CancelCleanup(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.ShardSize = 1024 * 1024 // 1MB
+	p.Name = "testingFile"
+	p.Shard = true
+	p.ReplicationFactorMin = 1
+	p.ReplicationFactorMax = 2
+
+	add, rpcObj := makeAdder(t, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 50MB, cancelled after 5MB so that some shards are pinned.
+	r := &cancelReader{
+		r:      io.LimitReader(rand.New(rand.NewSource(1)), 50*1024*1024),
+		after:  5 * 1024 * 1024,
+		cancel: cancel,
+	}
+	f := files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("file", files.NewReaderFile(r)),
+	})
+
+	_, err := add.FromFiles(ctx, f)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if atomic.LoadInt32(&rpcObj.unpins) == 0 {
+		t.Error("expected shards to be unpinned")
+	}
+	rpcObj.pins.Range(func(k, v interface{}) bool {
+		t.Errorf("%s should have been unpinned", k)
+		return true
+	})
+}
+
+func TestFromCARRoots(t *testing.T) {
+	dags := adder.NewMemoryDAGService()
+	root, err := adder.New(dags, api.DefaultAddParams(), nil).FromReader(
+		context.Background(),
+		io.LimitReader(rand.New(rand.NewSource(1)), 3*1024*1024),
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var car bytes.Buffer
+	if err := adder.ExportCAR(context.Background(), dags, root, &car); err != nil {
+		t.Fatal(err)
+	}
+
+	p := api.DefaultAddParams()
+	p.ShardSize = 1024 * 1024
+	p.Name = "testingCAR"
+	p.Shard = true
+
+	// unreachable blocks cannot be dropped from the shards.
+	add, rpcObj := makeAdder(t, p)
+	_, err = add.FromCARRoots(context.Background(), bytes.NewReader(car.Bytes()), nil, true)
+	if err == nil {
+		t.Error("expected an error when dropping blocks while sharding")
+	}
+	rpcObj.pins.Range(func(k, v interface{}) bool {
+		t.Errorf("%s should not have been pinned", k)
+		return true
+	})
+
+	add, rpcObj = makeAdder(t, p)
+	roots, err := add.FromCARRoots(context.Background(), bytes.NewReader(car.Bytes()), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 {
+		t.Fatalf("expected one root, got %d", len(roots))
+	}
+	if atomic.LoadInt32(&rpcObj.unpins) != 0 {
+		t.Error("nothing should have been unpinned")
+	}
+	pin, err := rpcObj.PinGet(context.Background(), root)
+	if err != nil {
+		t.Fatal("the content root should still be pinned:", err)
+	}
+	if _, err := rpcObj.PinGet(context.Background(), *pin.Reference); err != nil {
+		t.Error("the ClusterDAG should still be pinned:", err)
+	}
+	shards := 0
+	rpcObj.pins.Range(func(k, v interface{}) bool {
+		if v.(*api.Pin).Type == api.ShardType {
+			shards++
+		}
+		return true
+	})
+	if shards < 3 {
+		t.Errorf("expected the shards to still be pinned, %d are", shards)
+	}
+}
+
+func TestFromIPFSPath(t *testing.T) {
+	dags := adder.NewMemoryDAGService()
+	add := adder.New(dags, api.DefaultAddParams(), nil)
+	root, err := add.FromReader(
+		context.Background(),
+		io.LimitReader(rand.New(rand.NewSource(1)), 3*1024*1024),
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := api.DefaultAddParams()
+	p.ShardSize = 1024 * 1024
+	p.Name = "testingPath"
+	p.Shard = true
+	add2, rpcObj := makeAdder(t, p)
+	// the content is in IPFS already.
+	for _, c := range add.Result().Cids {
+		nd, err := dags.Get(context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpcObj.blocks.Store(c.String(), nd.RawData())
+	}
+
+	c, err := add2.FromIPFSPath(context.Background(), path.FromCid(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(root) {
+		t.Errorf("expected %s, got %s", root, c)
+	}
+
+	shards := 0
+	rpcObj.pins.Range(func(k, v interface{}) bool {
+		if v.(*api.Pin).Type == api.ShardType {
+			shards++
+		}
+		return true
+	})
+	blocks, err := VerifyShards(t, root, rpcObj, rpcObj, shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the blocks of the DAG, leaving out the wrapping directory which
+	// is stored when adding from a reader.
+	if res := add2.Result(); res.Blocks != len(blocks) || res.Blocks < len(add.Result().Cids)-1 {
+		t.Errorf("expected all the blocks of the DAG in the shards, got %d", len(blocks))
+	}
+	for _, c := range add2.Result().Cids {
+		if _, ok := blocks[c.String()]; !ok {
+			t.Error("block missing from the shards:", c)
+		}
+	}
+}
@@ -29,10 +29,15 @@ type shard struct {
 	sizeLimit   uint64
 }
 
-func newShard(ctx context.Context, rpc *rpc.Client, opts api.PinOptions) (*shard, error) {
-	allocs, err := adder.BlockAllocate(ctx, rpc, opts)
-	if err != nil {
-		return nil, err
+// newShard returns a shard put on the given allocations, or on new ones
+// when there are none.
+func newShard(ctx context.Context, rpc *rpc.Client, opts api.PinOptions, allocs []peer.ID) (*shard, error) {
+	if len(allocs) == 0 {
+		var err error
+		allocs, err = adder.BlockAllocate(ctx, rpc, opts)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if opts.ReplicationFactorMin > 0 && len(allocs) == 0 {
@@ -11,6 +11,7 @@ import (
 	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
+	path "github.com/ipfs/go-path"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	rpc "github.com/libp2p/go-libp2p-gorpc"
 )
@@ -29,35 +30,47 @@ type DAGService struct {
 	dests   []peer.ID
 	pinOpts api.PinOptions
 	local   bool
+	noPin   bool
 
 	ba *adder.BlockAdder
 }
 
 // New returns a new Adder with the given rpc Client. The client is used
-// to perform calls to IPFS.BlockPut and Pin content on Cluster.
-func New(rpc *rpc.Client, opts api.PinOptions, local bool) *DAGService {
-	// ensure don't Add something and pin it in direct mode.
-	opts.Mode = api.PinModeRecursive
+// to perform calls to IPFS.BlockPut and Pin content on Cluster. When noPin
+// is set, the blocks are put but the content is not pinned.
+//
+// When local is set, no allocation is requested: the blocks are put in the
+// local IPFS daemon only and the content is pinned with this peer as its
+// only allocation and a replication factor of 1. The rest of the cluster
+// tracks the pin, but does not fetch the content until it is repinned with
+// a larger replication factor (or re-allocated because this peer goes
+// down), so the content is only as available as this peer until then.
+func New(rpc *rpc.Client, opts api.PinOptions, local, noPin bool) *DAGService {
 	return &DAGService{
 		rpcClient: rpc,
 		dests:     nil,
 		pinOpts:   opts,
 		local:     local,
+		noPin:     noPin,
 	}
 }
 
 // Add puts the given node in the destination peers.
 func (dgs *DAGService) Add(ctx context.Context, node ipld.Node) error {
 	if dgs.dests == nil {
-		dests, err := adder.BlockAllocate(ctx, dgs.rpcClient, dgs.pinOpts)
-		if err != nil {
-			return err
-		}
-		dgs.dests = dests
-
 		if dgs.local {
+			self, err := localPeer(ctx, dgs.rpcClient)
+			if err != nil {
+				return err
+			}
+			dgs.dests = []peer.ID{self}
 			dgs.ba = adder.NewBlockAdder(dgs.rpcClient, []peer.ID{""})
 		} else {
+			dests, err := adder.BlockAllocate(ctx, dgs.rpcClient, dgs.pinOpts)
+			if err != nil {
+				return err
+			}
+			dgs.dests = dests
 			dgs.ba = adder.NewBlockAdder(dgs.rpcClient, dests)
 		}
 	}
@@ -65,14 +78,55 @@ func (dgs *DAGService) Add(ctx context.Context, node ipld.Node) error {
 	return dgs.ba.Add(ctx, node)
 }
 
-// Finalize pins the last Cid added to this DAGService.
+// Finalize pins the last Cid added to this DAGService, unless the
+// DAGService was created with noPin.
 func (dgs *DAGService) Finalize(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	root, err := dgs.Prepare(ctx, root)
+	if err != nil {
+		return root, err
+	}
+	return root, dgs.Commit(ctx, root)
+}
+
+// Prepare returns the given root, as the blocks are in their destinations
+// already and only pinning is left.
+func (dgs *DAGService) Prepare(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	return root, nil
+}
+
+// Commit pins the given root in the peers where its blocks were put, unless
+// the DAGService was created with noPin. The root is pinned with the mode in
+// the PinOptions: in direct mode, only the root block is protected from
+// garbage collection in IPFS.
+func (dgs *DAGService) Commit(ctx context.Context, root cid.Cid) error {
+	if dgs.noPin {
+		dgs.dests = nil
+		return nil
+	}
+
 	// Cluster pin the result
 	rootPin := api.PinWithOpts(root, dgs.pinOpts)
 	rootPin.Allocations = dgs.dests
+	if dgs.local {
+		rootPin.ReplicationFactorMin = 1
+		rootPin.ReplicationFactorMax = 1
+	}
 	dgs.dests = nil
 
-	return root, adder.Pin(ctx, dgs.rpcClient, rootPin)
+	return adder.Pin(ctx, dgs.rpcClient, rootPin)
+}
+
+// Get gets the block with the given CID from the local IPFS daemon, which
+// fetches it from the IPFS network (i.e. from the peers where it was put)
+// when it does not have it. It allows adding from IPFS paths and verifying
+// added content.
+func (dgs *DAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	return adder.BlockGet(ctx, dgs.rpcClient, c)
+}
+
+// ResolveName resolves the given /ipns/ path with the local IPFS daemon.
+func (dgs *DAGService) ResolveName(ctx context.Context, p path.Path) (path.Path, error) {
+	return adder.ResolvePath(ctx, dgs.rpcClient, p)
 }
 
 // AddMany calls Add for every given node.
@@ -85,3 +139,17 @@ func (dgs *DAGService) AddMany(ctx context.Context, nodes []ipld.Node) error {
 	}
 	return nil
 }
+
+// localPeer returns the ID of the peer handling the add.
+func localPeer(ctx context.Context, rpcClient *rpc.Client) (peer.ID, error) {
+	var id api.ID
+	err := rpcClient.CallContext(
+		ctx,
+		"",
+		"Cluster",
+		"ID",
+		struct{}{},
+		&id,
+	)
+	return id.ID, err
+}
@@ -4,23 +4,34 @@ import (
 	"context"
 	"errors"
 	"mime/multipart"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	adder "github.com/ipfs/ipfs-cluster/adder"
 	"github.com/ipfs/ipfs-cluster/api"
 	"github.com/ipfs/ipfs-cluster/test"
 
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	path "github.com/ipfs/go-path"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	rpc "github.com/libp2p/go-libp2p-gorpc"
 )
 
 type testIPFSRPC struct {
 	blocks sync.Map
+	// names resolved with Resolve.
+	names sync.Map
+	// when set, BlockGet corrupts raw blocks.
+	corrupt bool
 }
 
 type testClusterRPC struct {
-	pins sync.Map
+	pins   sync.Map
+	allocs int32
 }
 
 func (rpcs *testIPFSRPC) BlockPut(ctx context.Context, in *api.NodeWithMeta, out *struct{}) error {
@@ -28,19 +39,51 @@ func (rpcs *testIPFSRPC) BlockPut(ctx context.Context, in *api.NodeWithMeta, out
 	return nil
 }
 
+func (rpcs *testIPFSRPC) BlockGet(ctx context.Context, in cid.Cid, out *[]byte) error {
+	v, ok := rpcs.blocks.Load(in.String())
+	if !ok {
+		return errors.New("not found")
+	}
+	data := v.(*api.NodeWithMeta).Data
+	if rpcs.corrupt && in.Type() == cid.Raw {
+		data = append([]byte("corrupted"), data...)
+	}
+	*out = data
+	return nil
+}
+
+func (rpcs *testIPFSRPC) Resolve(ctx context.Context, in string, out *cid.Cid) error {
+	v, ok := rpcs.names.Load(in)
+	if !ok {
+		return errors.New("not found")
+	}
+	*out = v.(cid.Cid)
+	return nil
+}
+
 func (rpcs *testClusterRPC) Pin(ctx context.Context, in *api.Pin, out *api.Pin) error {
 	rpcs.pins.Store(in.Cid.String(), in)
 	*out = *in
 	return nil
 }
 
+func (rpcs *testClusterRPC) ID(ctx context.Context, in struct{}, out *api.ID) error {
+	*out = api.ID{ID: test.PeerID2}
+	return nil
+}
+
 func (rpcs *testClusterRPC) BlockAllocate(ctx context.Context, in *api.Pin, out *[]peer.ID) error {
+	atomic.AddInt32(&rpcs.allocs, 1)
 	if in.ReplicationFactorMin > 1 {
 		return errors.New("we can only replicate to 1 peer")
 	}
 	// it does not matter since we use host == nil for RPC, so it uses the
 	// local one in all cases.
 	*out = []peer.ID{test.PeerID1}
+	// honor the user allocations as the allocator does.
+	if len(in.UserAllocations) > 0 {
+		*out = in.UserAllocations
+	}
 	return nil
 }
 
@@ -61,7 +104,7 @@ func TestAdd(t *testing.T) {
 		params := api.DefaultAddParams()
 		params.Wrap = true
 
-		dags := New(client, params.PinOptions, false)
+		dags := New(client, params.PinOptions, false, false)
 		add := adder.New(dags, params, nil)
 
 		sth := test.NewShardingTestHelper()
@@ -109,7 +152,7 @@ func TestAdd(t *testing.T) {
 		params := api.DefaultAddParams()
 		params.Layout = "trickle"
 
-		dags := New(client, params.PinOptions, false)
+		dags := New(client, params.PinOptions, false, false)
 		add := adder.New(dags, params, nil)
 
 		sth := test.NewShardingTestHelper()
@@ -132,4 +175,348 @@ func TestAdd(t *testing.T) {
 			t.Error("the tree wasn't pinned")
 		}
 	})
+	t.Run("no pin", func(t *testing.T) {
+		clusterRPC := &testClusterRPC{}
+		ipfsRPC := &testIPFSRPC{}
+		server := rpc.NewServer(nil, "mock")
+		err := server.RegisterName("Cluster", clusterRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.RegisterName("IPFSConnector", ipfsRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClientWithServer(nil, "mock", server)
+		params := api.DefaultAddParams()
+		params.NoPin = true
+
+		dags := New(client, params.PinOptions, false, params.NoPin)
+		add := adder.New(dags, params, nil)
+
+		sth := test.NewShardingTestHelper()
+		defer sth.Clean(t)
+		mr, closer := sth.GetTreeMultiReader(t)
+		defer closer.Close()
+		r := multipart.NewReader(mr, mr.Boundary())
+
+		rootCid, err := add.FromMultipart(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rootCid.String() != test.ShardingDirBalancedRootCID {
+			t.Fatal("bad root cid")
+		}
+
+		_, ok := ipfsRPC.blocks.Load(test.ShardingDirBalancedRootCID)
+		if !ok {
+			t.Error("the blocks should have been put")
+		}
+
+		_, ok = clusterRPC.pins.Load(test.ShardingDirBalancedRootCID)
+		if ok {
+			t.Error("the tree should not have been pinned")
+		}
+	})
+	t.Run("local", func(t *testing.T) {
+		clusterRPC := &testClusterRPC{}
+		ipfsRPC := &testIPFSRPC{}
+		server := rpc.NewServer(nil, "mock")
+		err := server.RegisterName("Cluster", clusterRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.RegisterName("IPFSConnector", ipfsRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClientWithServer(nil, "mock", server)
+		params := api.DefaultAddParams()
+		params.Local = true
+
+		dags := New(client, params.PinOptions, params.Local, false)
+		add := adder.New(dags, params, nil)
+
+		sth := test.NewShardingTestHelper()
+		defer sth.Clean(t)
+		mr, closer := sth.GetTreeMultiReader(t)
+		defer closer.Close()
+		r := multipart.NewReader(mr, mr.Boundary())
+
+		rootCid, err := add.FromMultipart(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if atomic.LoadInt32(&clusterRPC.allocs) != 0 {
+			t.Error("a local add should not request allocations")
+		}
+
+		_, ok := ipfsRPC.blocks.Load(test.ShardingDirBalancedRootCID)
+		if !ok {
+			t.Error("the blocks should have been put")
+		}
+
+		v, ok := clusterRPC.pins.Load(rootCid.String())
+		if !ok {
+			t.Fatal("the tree wasn't pinned")
+		}
+		pin := v.(*api.Pin)
+		if len(pin.Allocations) != 1 || pin.Allocations[0] != test.PeerID2 {
+			t.Error("the pin should be allocated to the local peer only:", pin.Allocations)
+		}
+		if pin.ReplicationFactorMin != 1 || pin.ReplicationFactorMax != 1 {
+			t.Error("a local pin should have a replication factor of 1")
+		}
+		if params.ReplicationFactorMin != 0 || params.ReplicationFactorMax != 0 {
+			t.Error("the params should be left as given")
+		}
+	})
+	t.Run("replication factors", func(t *testing.T) {
+		clusterRPC := &testClusterRPC{}
+		ipfsRPC := &testIPFSRPC{}
+		server := rpc.NewServer(nil, "mock")
+		err := server.RegisterName("Cluster", clusterRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.RegisterName("IPFSConnector", ipfsRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClientWithServer(nil, "mock", server)
+
+		for _, rpl := range [][2]int{{1, 3}, {-1, -1}} {
+			params := api.DefaultAddParams()
+			params.ReplicationFactorMin = rpl[0]
+			params.ReplicationFactorMax = rpl[1]
+
+			dags := New(client, params.PinOptions, false, false)
+			rootCid, err := adder.New(dags, params, nil).FromReader(context.Background(), strings.NewReader("hello"), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v, ok := clusterRPC.pins.Load(rootCid.String())
+			if !ok {
+				t.Fatal("the content wasn't pinned")
+			}
+			pin := v.(*api.Pin)
+			if pin.ReplicationFactorMin != rpl[0] || pin.ReplicationFactorMax != rpl[1] {
+				t.Errorf("expected replication factors %v, got %d and %d", rpl, pin.ReplicationFactorMin, pin.ReplicationFactorMax)
+			}
+		}
+
+		params := api.DefaultAddParams()
+		params.ReplicationFactorMin = 3
+		params.ReplicationFactorMax = 2
+		dags := New(client, params.PinOptions, false, false)
+		_, err = adder.New(dags, params, nil).FromReader(context.Background(), strings.NewReader("hello"), "")
+		if err == nil {
+			t.Error("expected an error for min > max")
+		}
+	})
+	t.Run("pin metadata and expiry", func(t *testing.T) {
+		clusterRPC := &testClusterRPC{}
+		ipfsRPC := &testIPFSRPC{}
+		server := rpc.NewServer(nil, "mock")
+		err := server.RegisterName("Cluster", clusterRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.RegisterName("IPFSConnector", ipfsRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClientWithServer(nil, "mock", server)
+		params := api.DefaultAddParams()
+		params.Name = "my dataset"
+		params.Metadata = map[string]string{"owner": "datasets", "version": "2"}
+		params.ExpireAt = time.Now().Add(time.Hour).Round(time.Second)
+
+		dags := New(client, params.PinOptions, false, false)
+		rootCid, err := adder.New(dags, params, nil).FromReader(context.Background(), strings.NewReader("hello"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, ok := clusterRPC.pins.Load(rootCid.String())
+		if !ok {
+			t.Fatal("the content wasn't pinned")
+		}
+		pin := v.(*api.Pin)
+		if pin.Name != "my dataset" {
+			t.Error("unexpected pin name:", pin.Name)
+		}
+		if len(pin.Metadata) != 2 || pin.Metadata["owner"] != "datasets" || pin.Metadata["version"] != "2" {
+			t.Error("unexpected pin metadata:", pin.Metadata)
+		}
+		if !pin.ExpireAt.Equal(params.ExpireAt) {
+			t.Errorf("expected the pin to expire at %s, got %s", params.ExpireAt, pin.ExpireAt)
+		}
+	})
+	t.Run("direct", func(t *testing.T) {
+		clusterRPC := &testClusterRPC{}
+		ipfsRPC := &testIPFSRPC{}
+		server := rpc.NewServer(nil, "mock")
+		err := server.RegisterName("Cluster", clusterRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.RegisterName("IPFSConnector", ipfsRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClientWithServer(nil, "mock", server)
+		params := api.DefaultAddParams()
+		params.Mode = api.PinModeDirect
+
+		dags := New(client, params.PinOptions, false, false)
+		add := adder.New(dags, params, nil)
+
+		sth := test.NewShardingTestHelper()
+		defer sth.Clean(t)
+		mr, closer := sth.GetTreeMultiReader(t)
+		defer closer.Close()
+		r := multipart.NewReader(mr, mr.Boundary())
+
+		rootCid, err := add.FromMultipart(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range test.ShardingDirCids {
+			if _, ok := ipfsRPC.blocks.Load(c); !ok {
+				t.Error("no IPFS.BlockPut for block", c)
+			}
+		}
+
+		v, ok := clusterRPC.pins.Load(rootCid.String())
+		if !ok {
+			t.Fatal("the tree wasn't pinned")
+		}
+		pin := v.(*api.Pin)
+		if pin.Mode != api.PinModeDirect || pin.MaxDepth != 0 {
+			t.Errorf("expected a direct pin, got mode %s and depth %d", pin.Mode, pin.MaxDepth)
+		}
+	})
+	t.Run("from ipfs path", func(t *testing.T) {
+		clusterRPC := &testClusterRPC{}
+		ipfsRPC := &testIPFSRPC{}
+		server := rpc.NewServer(nil, "mock")
+		err := server.RegisterName("Cluster", clusterRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.RegisterName("IPFSConnector", ipfsRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClientWithServer(nil, "mock", server)
+
+		// the content is in IPFS already, but not pinned.
+		params := api.DefaultAddParams()
+		params.NoPin = true
+		dags := New(client, params.PinOptions, false, params.NoPin)
+		f := files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+				files.FileEntry("a", files.NewBytesFile([]byte("a"))),
+				files.FileEntry("b", files.NewBytesFile(make([]byte, 1024*1024))),
+			})),
+		})
+		root, err := adder.New(dags, params, nil).FromFiles(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipfsRPC.names.Store("/ipns/example.com", root)
+
+		for _, p := range []string{"/ipfs/" + root.String(), "/ipns/example.com"} {
+			params := api.DefaultAddParams()
+			dags := New(client, params.PinOptions, false, false)
+			c, err := adder.New(dags, params, nil).FromIPFSPath(context.Background(), path.FromString(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.Equals(root) {
+				t.Errorf("%s: expected %s, got %s", p, root, c)
+			}
+			if _, ok := clusterRPC.pins.Load(root.String()); !ok {
+				t.Errorf("%s: the content should be pinned", p)
+			}
+			clusterRPC.pins.Delete(root.String())
+		}
+	})
+	t.Run("verify after add", func(t *testing.T) {
+		clusterRPC := &testClusterRPC{}
+		ipfsRPC := &testIPFSRPC{}
+		server := rpc.NewServer(nil, "mock")
+		err := server.RegisterName("Cluster", clusterRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.RegisterName("IPFSConnector", ipfsRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClientWithServer(nil, "mock", server)
+		params := api.DefaultAddParams()
+		params.VerifyAfterAdd = true
+		params.RawLeaves = true
+
+		dags := New(client, params.PinOptions, false, false)
+		rootCid, err := adder.New(dags, params, nil).FromReader(context.Background(), strings.NewReader("hello"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := clusterRPC.pins.Load(rootCid.String()); !ok {
+			t.Error("the content wasn't pinned")
+		}
+		clusterRPC.pins.Delete(rootCid.String())
+
+		ipfsRPC.corrupt = true
+		dags = New(client, params.PinOptions, false, false)
+		_, err = adder.New(dags, params, nil).FromReader(context.Background(), strings.NewReader("hello"), "")
+		if !errors.Is(err, adder.ErrVerifyMismatch) {
+			t.Fatal("expected ErrVerifyMismatch, got", err)
+		}
+		clusterRPC.pins.Range(func(k, v interface{}) bool {
+			t.Error("nothing should be pinned when the verification fails:", k)
+			return true
+		})
+	})
+	t.Run("user allocations", func(t *testing.T) {
+		clusterRPC := &testClusterRPC{}
+		ipfsRPC := &testIPFSRPC{}
+		server := rpc.NewServer(nil, "mock")
+		err := server.RegisterName("Cluster", clusterRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.RegisterName("IPFSConnector", ipfsRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClientWithServer(nil, "mock", server)
+		params := api.DefaultAddParams()
+		params.UserAllocations = []peer.ID{test.PeerID3}
+
+		dags := New(client, params.PinOptions, false, false)
+		rootCid, err := adder.New(dags, params, nil).FromReader(context.Background(), strings.NewReader("hello"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, ok := clusterRPC.pins.Load(rootCid.String())
+		if !ok {
+			t.Fatal("the content wasn't pinned")
+		}
+		pin := v.(*api.Pin)
+		if len(pin.UserAllocations) != 1 || pin.UserAllocations[0] != test.PeerID3 {
+			t.Error("the pin should carry the user allocations:", pin.UserAllocations)
+		}
+		if len(pin.Allocations) != 1 || pin.Allocations[0] != test.PeerID3 {
+			t.Error("the pin should be allocated to the requested peers:", pin.Allocations)
+		}
+	})
 }
@@ -0,0 +1,162 @@
+package adder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// StreamSummary is the last object written by StreamOutput when adding
+// succeeds. It is taken from the AddResult.
+type StreamSummary struct {
+	// Root is the root CID of the added content, as returned by the
+	// ClusterDAGService.
+	Root cid.Cid `json:"root"`
+	// Bytes is the size of all the blocks added.
+	Bytes uint64 `json:"bytes"`
+	// Blocks is the number of distinct blocks added.
+	Blocks int `json:"blocks"`
+}
+
+// StreamError is written by StreamOutput in place of events which cannot
+// be encoded, and as the last object when adding fails.
+type StreamError struct {
+	Error string `json:"error"`
+}
+
+// streamSummary is the StreamSummary as written, with the root printed
+// with the CidBase of the add.
+type streamSummary struct {
+	Root interface{} `json:"root"`
+	StreamSummary
+}
+
+// streamSummaryLine wraps the summary so that it can be told apart from
+// the events.
+type streamSummaryLine struct {
+	Summary streamSummary `json:"summary"`
+}
+
+// StreamOutput calls add, which must add content with the Adder (i.e. with
+// FromMultipart), and writes the output events of the Adder to w as
+// newline-delimited JSON objects while it runs. w is flushed after every
+// line when it supports it, so that clients see progress as it happens.
+// CIDs are printed with the CidBase of the AddParams.
+// Events which cannot be encoded are replaced by a StreamError object. Once
+// add returns, a {"summary": StreamSummary} object is written, or a
+// StreamError with the error of the add when it failed. When the Adder was
+// created without an output channel, one is made for it. Quiet Adders have
+// no output and cannot be streamed.
+//
+// If writing fails, the rest of the events are discarded, so that the
+// adding process is not blocked, and the error is returned once add
+// returns.
+//
+// StreamOutput runs the add rather than only reading an output channel, as
+// the summary comes from the AddResult and the error of the add must be
+// written last, both of which are only known once adding has ended.
+func (a *Adder) StreamOutput(w io.Writer, add func() error) error {
+	if a.quiet {
+		return errors.New("adder: quiet adders have no output to stream")
+	}
+	if a.output == nil {
+		size := a.params.ProgressBuffer
+		if size <= 0 {
+			size = api.DefaultProgressBuffer
+		}
+		a.output = make(chan *api.AddedOutput, size)
+	}
+	out := a.output
+
+	done := make(chan error, 1)
+	go func() {
+		done <- add()
+	}()
+
+	var writeErr error
+	write := func(ao *api.AddedOutput) {
+		if writeErr != nil {
+			return
+		}
+		line, err := json.Marshal(a.params.FormatOutput(ao))
+		if err != nil {
+			line, _ = json.Marshal(StreamError{
+				Error: fmt.Sprintf("encoding output for %s: %s", ao.Name, err),
+			})
+		}
+		writeErr = writeLine(w, line)
+	}
+
+	var addErr error
+loop:
+	for {
+		select {
+		case ao, ok := <-out:
+			if !ok {
+				addErr = <-done
+				break loop
+			}
+			write(ao)
+		case addErr = <-done:
+			// The output is closed once adding ends, but not when
+			// adding could not start: only what is left is read.
+			for {
+				select {
+				case ao, ok := <-out:
+					if !ok {
+						break loop
+					}
+					write(ao)
+				default:
+					break loop
+				}
+			}
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	var line []byte
+	var err error
+	res := a.Result()
+	switch {
+	case addErr != nil:
+		line, err = json.Marshal(StreamError{Error: addErr.Error()})
+	case res == nil:
+		line, err = json.Marshal(StreamError{Error: ErrNotFinished.Error()})
+	default:
+		line, err = json.Marshal(streamSummaryLine{Summary: streamSummary{
+			Root: a.params.FormatCidJSON(res.Root),
+			StreamSummary: StreamSummary{
+				Bytes:  res.Bytes,
+				Blocks: res.Blocks,
+			},
+		}})
+	}
+	if err != nil {
+		return err
+	}
+	return writeLine(w, line)
+}
+
+func writeLine(w io.Writer, line []byte) error {
+	_, err := w.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	switch f := w.(type) {
+	case http.Flusher:
+		f.Flush()
+	case interface{ Flush() error }: // i.e. bufio.Writer
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package adder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func streamTestDir() files.Directory {
+	return files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("dir", files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", files.NewBytesFile([]byte("hello"))),
+			files.FileEntry("b", files.NewBytesFile([]byte(strings.Repeat("b", 1024*1024)))),
+		})),
+	})
+}
+
+func streamLines(t *testing.T, buf *bytes.Buffer) [][]byte {
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) == 0 {
+		t.Fatal("nothing was written")
+	}
+	return lines
+}
+
+func TestAdder_StreamOutput(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Progress = true
+	dags := NewMemoryDAGService()
+	adder := New(dags, p, nil)
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	err := adder.StreamOutput(w, func() error {
+		// cannot be encoded.
+		adder.output <- &api.AddedOutput{Name: "nan", Percent: math.NaN()}
+		_, err := adder.FromFiles(context.Background(), streamTestDir())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := streamLines(t, &buf)
+	var serr StreamError
+	if err := json.Unmarshal(lines[0], &serr); err != nil || serr.Error == "" {
+		t.Error("expected an error object for the event which cannot be encoded")
+	}
+	names := make(map[string]bool)
+	for _, line := range lines[1 : len(lines)-1] {
+		var ao api.AddedOutput
+		if err := json.Unmarshal(line, &ao); err != nil {
+			t.Fatal(err)
+		}
+		names[ao.Name] = true
+	}
+	for _, name := range []string{"dir/a", "dir/b", "dir"} {
+		if !names[name] {
+			t.Errorf("expected an event for %s", name)
+		}
+	}
+
+	var summary struct {
+		Summary StreamSummary `json:"summary"`
+	}
+	if err := json.Unmarshal(lines[len(lines)-1], &summary); err != nil {
+		t.Fatal(err)
+	}
+	res := adder.Result()
+	if !summary.Summary.Root.Equals(res.Root) {
+		t.Error("bad root", summary.Summary.Root)
+	}
+	if summary.Summary.Bytes != res.Bytes || summary.Summary.Blocks != res.Blocks || res.Blocks != dags.Len() {
+		t.Errorf("bad summary: %+v, result: %+v", summary.Summary, res)
+	}
+}
+
+func TestAdder_StreamOutput_CidBase(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.CidVersion = 1
+	p.CidBase = "base58btc"
+	adder := New(NewMemoryDAGService(), p, nil)
+
+	var buf bytes.Buffer
+	var root cid.Cid
+	err := adder.StreamOutput(&buf, func() error {
+		var err error
+		root, err = adder.FromFiles(context.Background(), streamTestDir())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b58 := []byte(`{"/":"` + p.FormatCid(root) + `"}`)
+	lines := streamLines(t, &buf)
+	for _, line := range lines[:len(lines)-1] {
+		var ao api.AddedOutput
+		if err := json.Unmarshal(line, &ao); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(line, []byte(`"cid":{"/":"`+p.FormatCid(ao.Cid)+`"}`)) {
+			t.Errorf("expected the CID printed in base58btc: %s", line)
+		}
+	}
+	if !bytes.Contains(lines[len(lines)-1], append([]byte(`"root":`), b58...)) {
+		t.Errorf("expected the summary root printed in base58btc: %s", lines[len(lines)-1])
+	}
+}
+
+func TestAdder_StreamOutput_AddError(t *testing.T) {
+	adder := New(brokenCDAGServ{&mockCDAGServ{resultCids: make(map[string]struct{})}}, api.DefaultAddParams(), nil)
+	add := func() error {
+		_, err := adder.FromFiles(context.Background(), streamTestDir())
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := adder.StreamOutput(&buf, add); err != nil {
+		t.Fatal(err)
+	}
+	lines := streamLines(t, &buf)
+	var serr StreamError
+	if err := json.Unmarshal(lines[len(lines)-1], &serr); err != nil {
+		t.Fatal(err)
+	}
+	if serr.Error != "broken" {
+		t.Errorf("expected the error of the add, got %q", serr.Error)
+	}
+
+	// adding cannot start, and the output is never closed.
+	buf.Reset()
+	if err := adder.StreamOutput(&buf, add); err != nil {
+		t.Fatal(err)
+	}
+	lines = streamLines(t, &buf)
+	if err := json.Unmarshal(lines[len(lines)-1], &serr); err != nil {
+		t.Fatal(err)
+	}
+	if serr.Error != ErrAdderConsumed.Error() {
+		t.Errorf("expected %q, got %q", ErrAdderConsumed, serr.Error)
+	}
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestAdder_StreamOutput_WriteError(t *testing.T) {
+	p := api.DefaultAddParams()
+	p.Progress = true
+	p.ProgressBuffer = 1
+	adder := New(NewMemoryDAGService(), p, nil)
+	var addErr error
+	err := adder.StreamOutput(failingWriter{}, func() error {
+		_, addErr = adder.FromFiles(context.Background(), streamTestDir())
+		return addErr
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if addErr != nil {
+		t.Error("adding should not be blocked by the failed writes:", addErr)
+	}
+}
+
+func TestAdder_StreamOutput_Quiet(t *testing.T) {
+	adder := NewQuiet(NewMemoryDAGService(), api.DefaultAddParams())
+	called := false
+	err := adder.StreamOutput(failingWriter{}, func() error {
+		called = true
+		return nil
+	})
+	if err == nil || called {
+		t.Error("quiet adders cannot be streamed")
+	}
+}
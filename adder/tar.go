@@ -0,0 +1,129 @@
+package adder
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	gopath "path"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// FromTar adds the contents of a tar archive as a UnixFS directory tree,
+// using the chunking and hashing parameters like the other methods. When the
+// archive has a single top-level entry and Wrap is not set, that entry is
+// the root. Otherwise the root is a directory containing all top-level
+// entries. Hardlinks, special files and entries with absolute paths or
+// paths outside the archive are rejected. Modes and modification times in
+// the headers are not kept, as the UnixFS implementation in use cannot
+// store them. The adder will no longer be usable after calling this method.
+func (a *Adder) FromTar(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	a.log.Debug("adding from tar")
+	return a.run(ctx, func() (cid.Cid, error) {
+		return a.addTar(r)
+	})
+}
+
+// addTar adds the entries of the archive and finalizes the root.
+func (a *Adder) addTar(r io.Reader) (cid.Cid, error) {
+	// Symlink targets would be read from the local disk rather than
+	// from the archive.
+	if a.params.Symlinks == "follow" {
+		return cid.Undef, errors.New("symlinks cannot be followed when adding from tar")
+	}
+
+	ipfsAdder, err := a.newIPFSAdder()
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer a.coalesceProgress(ipfsAdder)()
+
+	if a.params.Wrap {
+		ipfsAdder.OutputPrefix = a.params.WrapName
+	}
+
+	a.cp, err = a.startCheckpoint()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		select {
+		case <-a.ctx.Done():
+			return cid.Undef, a.ctx.Err()
+		default:
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cid.Undef, fmt.Errorf("tar: %s", err)
+		}
+
+		path, err := tarEntryPath(hdr.Name)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if path == "" { // the archive root, i.e. "./"
+			continue
+		}
+
+		var node files.Node
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			node = files.NewSliceDirectory(nil)
+		case tar.TypeReg, tar.TypeRegA:
+			node = files.NewReaderFile(tr)
+		case tar.TypeSymlink:
+			node = files.NewLinkFile(hdr.Linkname, nil)
+		case tar.TypeLink:
+			return cid.Undef, fmt.Errorf("tar: %s: hardlinks are not supported", hdr.Name)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return cid.Undef, fmt.Errorf("tar: %s: unsupported entry type %q", hdr.Name, hdr.Typeflag)
+		}
+
+		a.log.Debugf("ipfsAdder AddEntry(%s)", path)
+		err = ipfsAdder.AddEntry(path, node)
+		if err != nil {
+			a.log.Error("error adding to cluster: ", err)
+			return cid.Undef, err
+		}
+	}
+
+	adderRoot, err := ipfsAdder.FinishEntries(!a.params.Wrap)
+	if err == nil {
+		err = a.tracker.checkInline(adderRoot)
+	}
+	if err != nil {
+		a.log.Error("error adding to cluster: ", err)
+		return cid.Undef, err
+	}
+
+	return a.finish(a.ctx, adderRoot.Cid(), a.cp)
+}
+
+// tarEntryPath returns the cleaned path of a tar entry. Absolute paths and
+// paths pointing outside of the archive are rejected.
+func tarEntryPath(name string) (string, error) {
+	if strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("tar: %s: absolute paths are not allowed", name)
+	}
+
+	p := gopath.Clean(name)
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("tar: %s: paths outside the archive are not allowed", name)
+	}
+	if p == "." {
+		return "", nil
+	}
+	return p, nil
+}
@@ -0,0 +1,122 @@
+package adder
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func makeTestTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var testTarEntries = []tarEntry{
+	{hdr: tar.Header{Name: "d/", Typeflag: tar.TypeDir}},
+	// file listed before its parent directory entry
+	{hdr: tar.Header{Name: "d/sub/b", Typeflag: tar.TypeReg}, data: "file b"},
+	{hdr: tar.Header{Name: "d/sub/", Typeflag: tar.TypeDir}},
+	{hdr: tar.Header{Name: "./d/a", Typeflag: tar.TypeReg}, data: "file a"},
+	{hdr: tar.Header{Name: "d/empty/", Typeflag: tar.TypeDir}},
+}
+
+// testTarDirectory returns the same tree as testTarEntries.
+func testTarDirectory() files.Directory {
+	return files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("d", files.NewMapDirectory(map[string]files.Node{
+			"a": files.NewBytesFile([]byte("file a")),
+			"sub": files.NewMapDirectory(map[string]files.Node{
+				"b": files.NewBytesFile([]byte("file b")),
+			}),
+			"empty": files.NewMapDirectory(nil),
+		})),
+	})
+}
+
+func TestAdder_FromTar(t *testing.T) {
+	archive := makeTestTar(t, testTarEntries)
+
+	for _, params := range []struct {
+		wrap      bool
+		threshold int
+	}{{false, 0}, {true, 0}, {false, 1}} {
+		p := api.DefaultAddParams()
+		p.Wrap = params.wrap
+		p.ShardingThreshold = params.threshold
+
+		adder := New(&mockCDAGServ{resultCids: make(map[string]struct{})}, p, nil)
+		expected, err := adder.FromFiles(context.Background(), testTarDirectory())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dags := &mockCDAGServ{
+			resultCids: make(map[string]struct{}),
+		}
+		adder = New(dags, p, nil)
+		root, err := adder.FromTar(context.Background(), bytes.NewReader(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !root.Equals(expected) {
+			t.Errorf("%+v: expected the same root as adding the files", params)
+		}
+		if _, ok := dags.resultCids[root.String()]; !ok {
+			t.Error("the root should have been added")
+		}
+	}
+}
+
+func TestAdder_FromTar_Rejected(t *testing.T) {
+	testCases := []struct {
+		name  string
+		entry tarEntry
+	}{
+		{"absolute", tarEntry{hdr: tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg}, data: "x"}},
+		{"parent", tarEntry{hdr: tar.Header{Name: "d/../../x", Typeflag: tar.TypeReg}, data: "x"}},
+		{"hardlink", tarEntry{hdr: tar.Header{Name: "d/l", Typeflag: tar.TypeLink, Linkname: "d/a"}}},
+		{"fifo", tarEntry{hdr: tar.Header{Name: "d/f", Typeflag: tar.TypeFifo}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := makeTestTar(t, append(append([]tarEntry{}, testTarEntries...), tc.entry))
+			dags := &mockCDAGServ{
+				resultCids: make(map[string]struct{}),
+			}
+			adder := New(dags, api.DefaultAddParams(), nil)
+			_, err := adder.FromTar(context.Background(), bytes.NewReader(archive))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
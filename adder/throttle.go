@@ -0,0 +1,87 @@
+package adder
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttle is a token bucket limiting the rate at which the content being
+// added is read. It is shared by all the files in an add, so the limit
+// applies to the add as a whole.
+type throttle struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newThrottle returns a throttle allowing rate bytes per second, with bursts
+// of up to a tenth of a second worth of bytes.
+func newThrottle(rate uint64) *throttle {
+	burst := float64(rate) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &throttle{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait takes n bytes from the bucket, blocking until they are available or
+// the context is done. Reads are not split, so n may exceed the burst: the
+// bucket then goes into debt and the wait is longer.
+func (th *throttle) wait(ctx context.Context, n int) error {
+	th.mu.Lock()
+	now := time.Now()
+	th.tokens += now.Sub(th.last).Seconds() * th.rate
+	if th.tokens > th.burst {
+		th.tokens = th.burst
+	}
+	th.last = now
+	th.tokens -= float64(n)
+	tokens := th.tokens
+	th.mu.Unlock()
+
+	if tokens >= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(-tokens / th.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reader wraps r so that reading from it is throttled.
+func (th *throttle) reader(ctx context.Context, r io.Reader) io.Reader {
+	return &throttledReader{ctx: ctx, r: r, th: th}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	th  *throttle
+}
+
+// Read reads from the underlying reader and then waits for the bytes read
+// to be available in the bucket.
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if werr := tr.th.wait(tr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
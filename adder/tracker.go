@@ -0,0 +1,349 @@
+package adder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/ipfs-cluster/api"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+// dagTracker wraps a ClusterDAGService and keeps track of the blocks that
+// have been added through it. Calls to Add and AddMany are serialized, as
+// ClusterDAGServices are not safe for concurrent use. Inlined blocks, whose
+// data is contained in their CID, are not stored nor tracked.
+type dagTracker struct {
+	ClusterDAGService
+	log Logger
+
+	// ctx is checked before adding, as the DAG builders do not pass
+	// down the adding context. When cancelled, adding fails.
+	ctx context.Context
+
+	// checker is set when the original ClusterDAGService is a
+	// BlockChecker. Blocks which it has already are not stored again.
+	checker BlockChecker
+
+	// timeout, when set, limits the time to store each block.
+	timeout time.Duration
+	// failed attempts to store a block are retried up to retries
+	// times, waiting backoff before the first retry and doubling it
+	// every time.
+	retries int
+	backoff time.Duration
+	// onBlock, when set, is called with every block stored. When it
+	// fails, the add is aborted with abort.
+	onBlock func(*api.AddedOutput) error
+	abort   func(error)
+	// blocks are stored in batches of batchSize with AddMany, waiting
+	// no longer than flushInterval, when batchSize is larger than 1.
+	batchSize     int
+	flushInterval time.Duration
+	// buffer, when set, limits the bytes of the blocks being stored,
+	// including those in the batch.
+	buffer *byteSemaphore
+	// identityLimit, when set, is the maximum size of inlined blocks.
+	// Larger leaves fail to be added, so that adding large files fails
+	// early. The rest are checked with the roots that they belong to,
+	// as inlined roots contain their whole DAG, and as the ipfs adder
+	// wraps top-level files in a directory which is not part of it.
+	identityLimit int
+
+	mu   sync.Mutex
+	set  *cid.Set
+	cids []cid.Cid
+	// existing has the blocks which were not stored because the
+	// ClusterDAGService had them already.
+	existing *cid.Set
+	// batch has the nodes waiting to be stored, which are in batched
+	// too, and batchBytes the bytes they hold from the buffer.
+	// flushErr is set when storing them failed.
+	batch      []ipld.Node
+	batched    map[cid.Cid]ipld.Node
+	batchBytes uint64
+	timer      *time.Timer
+	flushErr   error
+	// bytes of all the blocks added, and of those which were added
+	// already or were stored before.
+	bytes        uint64
+	dedupedBytes uint64
+}
+
+func newDAGTracker(dgs ClusterDAGService) *dagTracker {
+	checker, _ := dgs.(BlockChecker)
+	return &dagTracker{
+		ClusterDAGService: dgs,
+		log:               logger,
+		checker:           checker,
+		set:               cid.NewSet(),
+		existing:          cid.NewSet(),
+	}
+}
+
+// had returns true when the DAGService reported having the block before it
+// was added in this session.
+func (dt *dagTracker) had(ctx context.Context, c cid.Cid) bool {
+	if dt.existing.Has(c) {
+		return true
+	}
+	if dt.checker == nil || dt.set.Has(c) {
+		return false
+	}
+	ok, err := dt.checker.Has(ctx, c)
+	if err != nil {
+		dt.log.Debugf("error checking for block %s: %s", c, err)
+		return false
+	}
+	return ok
+}
+
+func (dt *dagTracker) track(node ipld.Node, had bool) error {
+	size := uint64(len(node.RawData()))
+	dt.bytes += size
+	if !dt.set.Visit(node.Cid()) {
+		dt.dedupedBytes += size
+		return nil
+	}
+	dt.cids = append(dt.cids, node.Cid())
+	if had {
+		dt.existing.Add(node.Cid())
+		dt.dedupedBytes += size
+	}
+	return dt.notify(node, size)
+}
+
+// notify calls onBlock with a block newly stored, aborting the add when it
+// fails.
+func (dt *dagTracker) notify(node ipld.Node, size uint64) error {
+	if dt.onBlock == nil {
+		return nil
+	}
+	err := dt.onBlock(&api.AddedOutput{
+		Cid:  node.Cid(),
+		Size: size,
+	})
+	if err != nil {
+		err = fmt.Errorf("block %s: %w", node.Cid(), err)
+		if dt.abort != nil {
+			dt.abort(err)
+		}
+	}
+	return err
+}
+
+func isInline(c cid.Cid) bool {
+	return c.Prefix().MhType == multihash.IDENTITY
+}
+
+// checkInline returns an error for inlined nodes larger than the
+// identityLimit, when set. Only leaves are checked when adding.
+func (dt *dagTracker) checkInline(node ipld.Node) error {
+	if size := len(node.RawData()); dt.identityLimit > 0 && size > dt.identityLimit {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrIdentityTooLarge, size, dt.identityLimit)
+	}
+	return nil
+}
+
+// done returns a channel which is closed when the adding context is done, or
+// nil when there is no context.
+func (dt *dagTracker) done() <-chan struct{} {
+	if dt.ctx == nil {
+		return nil
+	}
+	return dt.ctx.Done()
+}
+
+func (dt *dagTracker) err() error {
+	if dt.ctx == nil {
+		return nil
+	}
+	return dt.ctx.Err()
+}
+
+// withAddContext returns a context which is also cancelled when the add is.
+// Nodes may come with a context other than that of the add (i.e. from the
+// UnixFS importer), and putting them must stop when the add is aborted.
+func (dt *dagTracker) withAddContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if dt.ctx == nil {
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-dt.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Add adds a node to the wrapped DAGService and tracks it.
+func (dt *dagTracker) Add(ctx context.Context, node ipld.Node) error {
+	if err := dt.err(); err != nil {
+		return err
+	}
+	if isInline(node.Cid()) {
+		if len(node.Links()) > 0 {
+			return nil
+		}
+		return dt.checkInline(node)
+	}
+	weight, err := dt.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.batching() {
+		return dt.enqueue(ctx, node, weight)
+	}
+	defer dt.release(weight)
+	return dt.add(ctx, node)
+}
+
+func (dt *dagTracker) add(ctx context.Context, node ipld.Node) error {
+	had := dt.had(ctx, node.Cid())
+	if !had {
+		if err := dt.put(ctx, node); err != nil {
+			return err
+		}
+	}
+	return dt.track(node, had)
+}
+
+// added returns the CIDs of the blocks stored, leaving out those which the
+// ClusterDAGService had already.
+func (dt *dagTracker) added() []cid.Cid {
+	if dt.existing.Len() == 0 {
+		return dt.cids
+	}
+	added := make([]cid.Cid, 0, len(dt.cids)-dt.existing.Len())
+	for _, c := range dt.cids {
+		if !dt.existing.Has(c) {
+			added = append(added, c)
+		}
+	}
+	return added
+}
+
+// put stores a node in the wrapped DAGService, retrying failed attempts as
+// configured.
+func (dt *dagTracker) put(ctx context.Context, node ipld.Node) error {
+	backoff := dt.backoff
+	for attempt := 1; ; attempt++ {
+		err := dt.putOnce(ctx, node)
+		if err == nil || attempt > dt.retries || dt.err() != nil {
+			return err
+		}
+
+		dt.log.Debugf("retrying block %s in %s (%d/%d): %s", node.Cid(), backoff, attempt, dt.retries, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-dt.done():
+			return dt.err()
+		}
+		backoff *= 2
+	}
+}
+
+func (dt *dagTracker) putOnce(ctx context.Context, node ipld.Node) error {
+	ctx, cancel := dt.withAddContext(ctx)
+	defer cancel()
+	if dt.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, dt.timeout)
+		defer cancel()
+	}
+	err := dt.ClusterDAGService.Add(ctx, node)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("adding block %s: timed out after %s", node.Cid(), dt.timeout)
+	}
+	return err
+}
+
+// AddMany adds nodes to the wrapped DAGService and tracks them.
+func (dt *dagTracker) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	if err := dt.err(); err != nil {
+		return err
+	}
+	var stored []ipld.Node
+	for _, node := range nodes {
+		if !isInline(node.Cid()) {
+			stored = append(stored, node)
+		} else if len(node.Links()) == 0 {
+			if err := dt.checkInline(node); err != nil {
+				return err
+			}
+		}
+	}
+	nodes = stored
+	if len(nodes) == 0 {
+		return nil
+	}
+	// Nodes take from the buffer semaphore one by one, as all of them
+	// may not fit at once.
+	if dt.buffer != nil {
+		for _, node := range nodes {
+			if err := dt.Add(ctx, node); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.batching() {
+		for _, node := range nodes {
+			if err := dt.enqueue(ctx, node, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return dt.addMany(ctx, nodes)
+}
+
+// addMany stores and tracks the given nodes. It must be called with the lock
+// held.
+func (dt *dagTracker) addMany(ctx context.Context, nodes []ipld.Node) error {
+	// Blocks are added one by one to know which one timed out and
+	// to retry them separately.
+	if dt.timeout > 0 || dt.retries > 0 {
+		for _, node := range nodes {
+			if err := dt.add(ctx, node); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	had := make([]bool, len(nodes))
+	var missing []ipld.Node
+	for i, node := range nodes {
+		had[i] = dt.had(ctx, node.Cid())
+		if !had[i] {
+			missing = append(missing, node)
+		}
+	}
+	if len(missing) > 0 {
+		ctx, cancel := dt.withAddContext(ctx)
+		defer cancel()
+		err := dt.ClusterDAGService.AddMany(ctx, missing)
+		if err != nil {
+			return err
+		}
+	}
+	for i, node := range nodes {
+		if err := dt.track(node, had[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
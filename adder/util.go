@@ -8,8 +8,10 @@ import (
 	"github.com/ipfs/ipfs-cluster/api"
 	"github.com/ipfs/ipfs-cluster/rpcutil"
 
+	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
+	path "github.com/ipfs/go-path"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	rpc "github.com/libp2p/go-libp2p-gorpc"
 )
@@ -121,6 +123,47 @@ func BlockAllocate(ctx context.Context, rpc *rpc.Client, pinOpts api.PinOptions)
 	return allocsStr, err
 }
 
+// BlockGet helps getting blocks from the local IPFS daemon, which fetches
+// them from the IPFS network when it does not have them. The data is not
+// checked against the CID.
+func BlockGet(ctx context.Context, rpc *rpc.Client, c cid.Cid) (ipld.Node, error) {
+	var data []byte
+	err := rpc.CallContext(
+		ctx,
+		"", // use our IPFS daemon
+		"IPFSConnector",
+		"BlockGet",
+		c,
+		&data,
+	)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(blk)
+}
+
+// ResolvePath helps resolving /ipfs/ and /ipns/ paths to the /ipfs/ path
+// of the CID they point to, using the local IPFS daemon.
+func ResolvePath(ctx context.Context, rpc *rpc.Client, p path.Path) (path.Path, error) {
+	var c cid.Cid
+	err := rpc.CallContext(
+		ctx,
+		"", // use our IPFS daemon
+		"IPFSConnector",
+		"Resolve",
+		p.String(),
+		&c,
+	)
+	if err != nil {
+		return "", err
+	}
+	return path.FromCid(c), nil
+}
+
 // Pin helps sending local RPC pin requests.
 func Pin(ctx context.Context, rpc *rpc.Client, pin *api.Pin) error {
 	if pin.ReplicationFactorMin < 0 {
@@ -138,12 +181,27 @@ func Pin(ctx context.Context, rpc *rpc.Client, pin *api.Pin) error {
 	)
 }
 
+// Unpin helps sending local RPC unpin requests.
+func Unpin(ctx context.Context, rpc *rpc.Client, c cid.Cid) error {
+	logger.Debugf("adder unpinning %s", c)
+	var pinResp api.Pin
+	return rpc.CallContext(
+		ctx,
+		"", // use ourself to unpin
+		"Cluster",
+		"Unpin",
+		api.PinCid(c),
+		&pinResp,
+	)
+}
+
 // ErrDAGNotFound is returned whenever we try to get a block from the DAGService.
 var ErrDAGNotFound = errors.New("dagservice: block not found")
 
 // BaseDAGService partially implements an ipld.DAGService.
 // It provides the methods which are not needed by ClusterDAGServices
-// (Get*, Remove*) so that they can save adding this code.
+// (Get*, Remove*) so that they can save adding this code. Adders need Get
+// to add from IPFS paths and to verify what was added (see BlockGet).
 type BaseDAGService struct {
 }
 
@@ -169,3 +227,34 @@ func (dag BaseDAGService) Remove(ctx context.Context, key cid.Cid) error {
 func (dag BaseDAGService) RemoveMany(ctx context.Context, keys []cid.Cid) error {
 	return nil
 }
+
+// discardDAGService is a ClusterDAGService which discards all blocks and
+// does not pin anything on Finalize. It is used to only calculate CIDs.
+type discardDAGService struct {
+	BaseDAGService
+}
+
+// Add is a nop.
+func (dag discardDAGService) Add(ctx context.Context, node ipld.Node) error {
+	return nil
+}
+
+// AddMany is a nop.
+func (dag discardDAGService) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	return nil
+}
+
+// Finalize returns the given root.
+func (dag discardDAGService) Finalize(ctx context.Context, root cid.Cid) (cid.Cid, error) {
+	return root, nil
+}
+
+// cleanupDAGService calls Cleanup on the given ClusterDAGService if it is a
+// Cleaner.
+func cleanupDAGService(ctx context.Context, dgs ClusterDAGService, cids []cid.Cid) error {
+	c, ok := dgs.(Cleaner)
+	if !ok {
+		return nil
+	}
+	return c.Cleanup(ctx, cids)
+}
@@ -0,0 +1,63 @@
+package adder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrVerifyMismatch is returned when VerifyAfterAdd is set and a block read
+// back from the ClusterDAGService does not match its CID.
+var ErrVerifyMismatch = errors.New("adder: a block read back does not match its CID")
+
+// verifyRoot verifies the DAG with the given root when the VerifyAfterAdd
+// parameter is set, once any batched blocks have been stored.
+func (a *Adder) verifyRoot(ctx context.Context, root cid.Cid) error {
+	if !a.params.VerifyAfterAdd {
+		return nil
+	}
+	err := a.tracker.Flush(ctx)
+	if err == nil {
+		err = a.verify(ctx, root)
+	}
+	if err != nil {
+		a.log.Error("error verifying added content:", err)
+	}
+	return err
+}
+
+// verify reads every block of the DAG with the given root back from the
+// ClusterDAGService, once each, and checks that its data matches its CID.
+// Inlined blocks are not stored and are skipped.
+func (a *Adder) verify(ctx context.Context, root cid.Cid) error {
+	seen := cid.NewSet()
+	pending := []cid.Cid{root}
+	for len(pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if isInline(c) || !seen.Visit(c) {
+			continue
+		}
+
+		nd, err := a.dgs.Get(ctx, c)
+		if err != nil {
+			return fmt.Errorf("verify: block %s cannot be read back: %w", c, err)
+		}
+		sum, err := c.Prefix().Sum(nd.RawData())
+		if err != nil {
+			return fmt.Errorf("verify: block %s: %w", c, err)
+		}
+		if !sum.Equals(c) {
+			return fmt.Errorf("%w: %s", ErrVerifyMismatch, c)
+		}
+		for _, l := range nd.Links() {
+			pending = append(pending, l.Cid)
+		}
+	}
+	return nil
+}
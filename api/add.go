@@ -5,27 +5,222 @@ import (
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	multibase "github.com/multiformats/go-multibase"
+	multihash "github.com/multiformats/go-multihash"
 )
 
 // DefaultShardSize is the shard size for params objects created with DefaultParams().
 var DefaultShardSize = uint64(100 * 1024 * 1024) // 100 MB
 
+// DefaultInlineLimit is the maximum size of inlined blocks for params
+// objects created with DefaultParams().
+var DefaultInlineLimit = 32
+
+// DefaultPutBackoff is the time to wait before retrying to store a block for
+// params objects created with DefaultParams().
+var DefaultPutBackoff = 100 * time.Millisecond
+
+// DefaultTrickleThreshold is the size above which files are added with the
+// trickle layout when using the "auto" layout, for params objects created
+// with DefaultParams().
+var DefaultTrickleThreshold = uint64(16 * 1024 * 1024) // 16 MiB
+
+// MaxLinksLimit is the largest MaxLinks value allowed, which keeps the
+// intermediate nodes of UnixFS DAGs well under the maximum block size.
+var MaxLinksLimit = 8192
+
+// Limits on the name and metadata of the pin created by an add, which end up
+// in the shared state of the cluster.
+var (
+	MaxPinNameLength       = 1024
+	MaxMetadataEntries     = 64
+	MaxMetadataKeyLength   = 256
+	MaxMetadataValueLength = 4096
+)
+
+// DefaultProgressBuffer is the size of the output channel buffer for params
+// objects created with DefaultParams().
+var DefaultProgressBuffer = 100
+
+// ErrNoPinShard is returned when NoPin is used with sharding, as shards are
+// pinned while they are built.
+var ErrNoPinShard = errors.New("no-pin cannot be used when sharding")
+
+// ErrDirectShard is returned when the direct pin mode is used with sharding,
+// as sharded DAGs are only usable when pinned recursively.
+var ErrDirectShard = errors.New("direct pin mode cannot be used when sharding")
+
+// ErrInlineCidV0 is returned when inlining is requested with CIDv0.
+var ErrInlineCidV0 = errors.New("inline requires CIDv1")
+
+// ErrNoAlternateCid is returned by AlternateCid for CIDs which have no
+// equivalent of the other CID version for the same block.
+var ErrNoAlternateCid = errors.New("no CID of the other version for the same block: only sha2-256 dag-pb blocks have both")
+
 // AddedOutput carries information for displaying the standard ipfs output
 // indicating a node of a file has been added.
+//
+// Name is the path of the entry relative to the root of the add, using
+// forward slashes: "dir/sub/file.txt" when adding the "dir" folder. When Wrap
+// is set, the wrapping directory is the anchor and names start with WrapName
+// (or are relative to it when WrapName is empty). A single file is named after
+// itself, and content with no name (i.e. stdin) is named by its CID. Progress
+// updates, skipped and failed entries use the same names as the final event
+// for the entry.
 type AddedOutput struct {
 	Name  string  `json:"name" codec:"n,omitempty"`
 	Cid   cid.Cid `json:"cid" codec:"c"`
 	Bytes uint64  `json:"bytes,omitempty" codec:"b,omitempty"`
 	Size  uint64  `json:"size,omitempty" codec:"s,omitempty"`
+	// Progress updates also carry the bytes processed so far for the
+	// whole add and the percentage of the total size that they
+	// represent (-1 when the total size is not known in advance).
+	AddedBytes uint64  `json:"added_bytes,omitempty" codec:"ab,omitempty"`
+	Percent    float64 `json:"percent,omitempty" codec:"p,omitempty"`
+	// ETA is the estimated time left to read the rest of the content,
+	// from the recent throughput (-1 when it cannot be estimated, as
+	// when the total size is not known or nothing has been read yet).
+	ETA time.Duration `json:"eta,omitempty" codec:"et,omitempty"`
+	// ByReference is set when a file was added with nocopy and its
+	// blocks reference the original file rather than copying it.
+	ByReference bool `json:"by_reference,omitempty" codec:"br,omitempty"`
+	// Type is the type of the added entry: one of AddedFile,
+	// AddedDirectory or AddedSymlink. It is not set for progress
+	// updates. AddedPlan marks the first event sent when Progress is
+	// set and the total size is known, which carries the total size in
+	// Bytes and an estimate of the number of blocks in ExpectedBlocks.
+	Type string `json:"type,omitempty" codec:"t,omitempty"`
+	// ExpectedBlocks estimates the number of leaf blocks for the whole
+	// add (see AddParams.EstimateBlocks).
+	ExpectedBlocks int64 `json:"expected_blocks,omitempty" codec:"eb,omitempty"`
+	// Skipped is set on progress updates for entries left out by the
+	// Include and Exclude filters, by ignore rules or for being
+	// hidden. SkipReason says which one (see the Skip* constants).
+	Skipped    bool   `json:"skipped,omitempty" codec:"sk,omitempty"`
+	SkipReason string `json:"skip_reason,omitempty" codec:"sr,omitempty"`
+	// Error is set for files which failed to be added and were left
+	// out because of SkipFailedFiles.
+	Error string `json:"error,omitempty" codec:"e,omitempty"`
+	// Inline is set when the data is inlined in the CID, using the
+	// identity hash, so no block was stored for it.
+	Inline bool `json:"inline,omitempty" codec:"in,omitempty"`
+	// ContentType is the MIME type detected for files when
+	// AddParams.DetectMIME is set.
+	ContentType string `json:"content_type,omitempty" codec:"ct,omitempty"`
+}
+
+// Types of entries in AddedOutput.
+const (
+	AddedFile      = "file"
+	AddedDirectory = "directory"
+	AddedSymlink   = "symlink"
+	AddedPlan      = "plan"
+)
+
+// Reasons for skipping entries in AddedOutput.
+const (
+	SkipFiltered = "filtered"
+	SkipIgnored  = "ignored"
+	SkipHidden   = "hidden"
+)
+
+// AddWarning describes a non-fatal issue found while adding, so that it can
+// be shown to the user without failing the add.
+type AddWarning struct {
+	// Name of the entry, as in AddedOutput.
+	Name string `json:"name" codec:"n,omitempty"`
+	// Code is the kind of warning: one of the Warn* constants.
+	Code    string `json:"code" codec:"c,omitempty"`
+	Message string `json:"message" codec:"m,omitempty"`
+}
+
+// Kinds of AddWarnings.
+const (
+	// A symlink was left out, as the Symlinks parameter says.
+	WarnSymlinkSkipped = "symlink_skipped"
+	// A file did not have the expected size once read, i.e. because
+	// it was being written while adding it.
+	WarnSizeChanged = "size_changed"
+)
+
+// AddResult summarizes the outcome of an add operation. It is available
+// once the adding process has finished.
+type AddResult struct {
+	// The root CID of the added content as returned by the
+	// ClusterDAGService.
+	Root cid.Cid `json:"root" codec:"r"`
+	// The IPFS roots of the top-level entries added from files, in the
+	// order in which they were added. There are several when adding
+	// several top-level files without Wrap, which are independent from
+	// each other. The last one is the primary root: the only one which
+	// is finalized, resulting in Root. When finalizing several roots
+	// of a CAR archive, these are those roots, all of which are
+	// finalized.
+	Roots []cid.Cid `json:"roots,omitempty" codec:"rs,omitempty"`
+	// Partial is set when the add was interrupted with the Adder's
+	// CancelWithCommit and Root only has the entries added until then.
+	Partial bool `json:"partial,omitempty" codec:"pa,omitempty"`
+	// The root under the other CID version, when AlternateCid is set
+	// and the root has one (see AlternateCid).
+	AlternateRoot cid.Cid `json:"alternate_root,omitempty" codec:"ar,omitempty"`
+	// The CID of the only file in the wrapping directory, when
+	// UnwrapSingle is set and there is a single file.
+	UnwrappedRoot cid.Cid `json:"unwrapped_root,omitempty" codec:"ur,omitempty"`
+	// Every block CID added during the operation, in the order in
+	// which they were added. Includes directory and wrapping nodes.
+	Cids []cid.Cid `json:"cids,omitempty" codec:"c,omitempty"`
+	// The CID of every entry added from files, by its name as in
+	// AddedOutput. The names of directories end with a slash, and the
+	// root is only included when it has a name.
+	Manifest map[string]cid.Cid `json:"manifest,omitempty" codec:"mf,omitempty"`
+	// The number of files which failed to be added and were left out
+	// because of SkipFailedFiles.
+	SkippedFiles int `json:"skipped_files,omitempty" codec:"sf,omitempty"`
+	// The number of files added and the number of distinct blocks.
+	Files  int `json:"files" codec:"f,omitempty"`
+	Blocks int `json:"blocks" codec:"bl,omitempty"`
+	// The number of files which had the same content (the same root
+	// CID) as a file added before, and the names of the files added for
+	// every such CID, printed as in AddedOutput. This is informational: duplicate blocks are not
+	// stored twice, whatever the file they belong to.
+	DuplicateFiles int                 `json:"duplicate_files,omitempty" codec:"df,omitempty"`
+	Duplicates     map[string][]string `json:"duplicates,omitempty" codec:"dup,omitempty"`
+	// The size of all the blocks added, and of those which were
+	// duplicates of blocks added before or which were stored already.
+	// DedupedBytes/Bytes is the deduplication ratio.
+	Bytes        uint64 `json:"bytes" codec:"by,omitempty"`
+	DedupedBytes uint64 `json:"deduped_bytes" codec:"db,omitempty"`
+	// The number of blocks which the ClusterDAGService had already
+	// and which were therefore not stored again.
+	DedupedBlocks int `json:"deduped_blocks,omitempty" codec:"dbl,omitempty"`
+	// How long adding took.
+	Duration time.Duration `json:"duration" codec:"d,omitempty"`
 }
 
 // AddParams contains all of the configurable parameters needed to specify the
 // importing process of a file being added to an ipfs-cluster
 type AddParams struct {
+	// Options for the pin of the added content. Mode sets how the root
+	// is pinned. Recursive pins (the default) keep the whole DAG. Direct
+	// pins only keep the root block: the rest of the blocks are put in
+	// IPFS as usual, but are not protected by the pin and will be
+	// removed by IPFS garbage collection unless something else pins
+	// them. Direct pins cannot be used when sharding. UserAllocations
+	// are the peers which the allocator puts first when allocating the
+	// content.
 	PinOptions
 
+	// Local adds the content to the peer handling the request only:
+	// blocks are put in its IPFS daemon and the content is pinned with
+	// that peer as its only allocation, without asking the cluster for
+	// allocations. Replication to other peers is deferred until the pin
+	// is updated, so the replication factors must be 1 (or left to the
+	// default). It has no effect with Shard.
 	Local          bool
 	Recursive      bool
 	Layout         string
@@ -39,6 +234,207 @@ type AddParams struct {
 	HashFun        string
 	StreamChannels bool
 	NoCopy         bool
+	// How the shards of sharded adds are allocated: "per-shard" (or
+	// empty) allocates every shard on its own, spreading the content
+	// over the cluster, and "same" puts all the shards on the peers
+	// allocated to the first one. When sharding, ShardSize must leave
+	// room for the largest block (see MinShardSize).
+	ShardAllocation string
+	// Directories with more entries than the threshold are built as
+	// HAMT-sharded UnixFS directories. 0 disables HAMT sharding.
+	ShardingThreshold int
+	// Compute the CIDs without storing or pinning anything.
+	OnlyHash bool
+	// Number of top-level entries of a directory which are added in
+	// parallel. 0 or 1 add them sequentially. Has no effect on
+	// multipart adds, whose parts must be read in order.
+	Concurrency int
+	// How symlinks are added: "preserve" (or empty) stores them as
+	// UnixFS symlinks, "follow" adds the files they point to instead
+	// (relative targets are only followed when adding from the local
+	// filesystem) and "skip" leaves them out.
+	Symlinks string
+	// Store the blocks without pinning the content. The blocks are
+	// subject to garbage collection in the IPFS daemons until the
+	// content is pinned. Cannot be used with Shard.
+	NoPin bool
+	// Glob patterns (see path.Match) matched against the entry paths
+	// as shown in the output, i.e. including the name of the added
+	// directory. A "**" segment matches any number of directories.
+	// Entries matching Exclude are left out. When Include is set, only
+	// files matching it are added.
+	Include []string
+	Exclude []string
+	// Names of .gitignore-style files (i.e. ".ipfsignore") whose rules
+	// are applied to the rest of the directory they are found in and
+	// its subdirectories. Directories are then added sequentially.
+	IgnoreRulesFiles []string
+	// Size of the buffer of the output channel created by the adder
+	// when the caller does not provide one. A larger buffer keeps
+	// adding from blocking on slow output consumers. 0 means
+	// DefaultProgressBuffer.
+	ProgressBuffer int
+	// When set, progress updates are coalesced so that at most one is
+	// sent per interval, carrying the latest byte counts. Events for
+	// added, skipped and failed entries are always sent. 0 sends every
+	// update.
+	ProgressInterval time.Duration
+	// Report and leave out files which fail to be added (i.e. when
+	// they cannot be read) instead of aborting. Cancelling still
+	// aborts. Files which cannot be opened while listing a directory
+	// still abort, as the listing cannot continue.
+	SkipFailedFiles bool
+	// Add the entries of every directory sorted by name and one at a
+	// time, so that adding the same tree always produces the same
+	// output events, regardless of the order in which entries are
+	// listed. Root CIDs do not depend on that order anyway, as
+	// directory links are sorted when encoded. Has no effect on
+	// multipart adds, which are added in the order sent.
+	Deterministic bool
+	// Name of the wrapping directory in the output when Wrap is set.
+	// The names of the wrapped entries are prefixed with it too. The
+	// root has no name in the DAG, so this only affects the output.
+	WrapName string
+	// Place the added files in a directory named after the time when
+	// the add started, in RFC3339 format and UTC (i.e.
+	// "2024-01-02T15:04:05Z"), inside a wrapping directory, as with
+	// Wrap. Unlike the WrapName, the name is linked from the root, so
+	// adds made at different times have different roots. It applies
+	// to the same adds as TargetPath, which is then relative to the
+	// timestamped directory. Cannot be used with WrapName.
+	WrapTimestamp bool
+	// Report the CID of the file in AddResult.UnwrappedRoot too when a
+	// wrapped add has a single file in the wrapping directory. Nothing
+	// is reported when it has more entries, or other kinds of entries.
+	UnwrapSingle bool
+	// Slash-separated path under which the added files are placed in a
+	// wrapping directory, i.e. "docs" places "a.txt" at "docs/a.txt".
+	// The intermediate directories are created, so the root is always a
+	// wrapping directory, as with Wrap. Empty and "." components are
+	// ignored and ".." components are not allowed. It applies to files
+	// added from readers, multipart, directories and the filesystem,
+	// not to CAR files, tar archives or blocks.
+	TargetPath string
+	// Inline blocks no larger than InlineLimit bytes in their CIDs,
+	// using the identity hash, rather than storing them. Requires
+	// CidVersion 1. When HashFun is "identity", every block is inlined
+	// and adding fails on blocks larger than InlineLimit, which must
+	// be set.
+	Inline      bool
+	InlineLimit int
+	// Maximum time to store a single block. Adding fails when a block
+	// takes longer, unless the block belongs to a file and
+	// SkipFailedFiles is set. 0 means no timeout.
+	BlockTimeout time.Duration
+	// Number of times to retry storing a block when it fails, waiting
+	// PutBackoff before the first retry and doubling it every time.
+	// 0 means no retries.
+	PutRetries int
+	PutBackoff time.Duration
+	// Multibase (i.e. "base32", "base58btc") used to print CIDv1s in
+	// the output, where CIDs are shown as strings. CIDv0s are always
+	// base58btc. Empty means the default for each CID version.
+	CidBase string
+	// Maximum rate, in bytes per second, at which the content being
+	// added is read, so that adding does not saturate the network
+	// links used to send it. 0 means unlimited.
+	MaxRate uint64
+	// Maximum number of bytes of content which can be read when
+	// adding. Adding fails with an error once more content is read,
+	// before storing the block which would exceed it. 0 means
+	// unlimited.
+	MaxTotalSize uint64
+	// Maximum size of every file added. Adding fails when a file is
+	// larger, unless SkipFailedFiles is set, in which case the file is
+	// left out. 0 means unlimited.
+	MaxFileSize uint64
+	// Maximum time that adding may take, from when it starts until the
+	// content is finalized. Adding is aborted and what was added is
+	// cleaned up once it is exceeded. It applies on top of any
+	// deadline of the context given to the Adder. 0 means no limit.
+	MaxDuration time.Duration
+	// IPLD codec ("raw", "dag-pb" or "dag-cbor") of the blocks added
+	// with Adder.AddBlock without a CID builder, and which the nodes
+	// added with Adder.AddNode must use. Empty means raw blocks and
+	// any codec, respectively. Files are always added as UnixFS
+	// (dag-pb).
+	Codec string
+	// Maximum number of links of the intermediate nodes of the DAG of
+	// every file, between 2 and MaxLinksLimit. Wider DAGs need fewer
+	// nodes to be fetched to read a file sequentially, while narrower
+	// ones make intermediate nodes smaller, which helps reading random
+	// parts of it. The CIDs depend on it. 0 means the default (174).
+	MaxLinks int
+	// With the "auto" layout, files larger than this many bytes use the
+	// trickle layout, which suits content read sequentially (i.e.
+	// media), while the rest use the balanced layout, which suits
+	// random access. Files whose size is not known in advance (i.e.
+	// streamed without a size) use the balanced layout.
+	TrickleThreshold uint64
+	// Store blocks in batches of BatchSize with a single AddMany call,
+	// which saves round-trips when adding many small files. Batches
+	// are stored once full, FlushInterval after their first block was
+	// added, if set, and when finalizing. 0 or 1 disable batching.
+	BatchSize     int
+	FlushInterval time.Duration
+	// Maximum bytes of block data held at once while waiting for the
+	// blocks to be stored, including batched ones. Once reached,
+	// adding waits until the ClusterDAGService has stored enough of
+	// them. Blocks larger than it are stored on their own. 0 means no
+	// limit.
+	MaxBufferBytes uint64
+	// Time after which content prepared with the Adder's Prepare is
+	// cleaned up if it has not been committed. 0 means no timeout.
+	PrepareTimeout time.Duration
+	// Decide whether to use raw leaves for every file by sniffing its
+	// first bytes (as http.DetectContentType does): binary content
+	// uses raw leaves, while text (text/* content types) keeps UnixFS
+	// leaves. RawLeaves is ignored when set. As with RawLeaves, CIDv1
+	// is used, so the CIDs of all files change, not only those of
+	// binary ones. Set with "raw-leaves=auto" in queries. Cannot be
+	// used with NoCopy.
+	RawLeavesAuto bool
+	// Normalize the names of directory entries before linking them:
+	// trailing whitespace is removed and names are converted to the
+	// Unicode NFC form, so that the same tree gets the same CID on
+	// systems which store names differently (i.e. in NFD on macOS).
+	// It changes the CIDs of directories with such names. Adding fails
+	// when two entries of a directory have the same normalized name.
+	NormalizeNames bool
+	// Report the root under the other CID version in
+	// AddResult.AlternateRoot too (see AlternateCid). Requires sha2-256.
+	AlternateCid bool
+	// Length in bytes of the digests of the multihashes, to truncate
+	// them, between 1 and the default length of HashFun, when the hash
+	// function supports it. 0 or -1 mean the default length. This
+	// changes the CIDs, and CIDv1 is used as CIDv0 requires full
+	// sha2-256 digests.
+	HashLength int
+	// Decompress the files before adding them: "gzip" or "none" (or
+	// empty). The decompressed bytes are stored, so the CIDs are those
+	// of the original files, and MaxTotalSize and MaxFileSize apply to
+	// them, which guards against decompression bombs. Adding files
+	// which are not compressed fails. It applies to files added from
+	// readers, multipart, directories and the filesystem, not to CAR
+	// files, tar archives or blocks. Cannot be used with NoCopy.
+	Decompress string
+	// Detect the MIME type of every file from its first 512 bytes
+	// (see http.DetectContentType) and set it in the ContentType of
+	// its AddedOutput. It does not change the DAG.
+	DetectMIME bool
+	// Fail adding a file when the number of bytes read from it is not
+	// the size it reported (i.e. because it was being written while
+	// adding it), instead of adding what was read and sending a
+	// WarnSizeChanged warning. Files with an unknown size, and files
+	// which are transformed, are not checked.
+	StrictSize bool
+	// Before the content is finalized (i.e. pinned), read every block
+	// of the DAG back from the ClusterDAGService and check that it
+	// matches its CID, failing otherwise. It is expensive, and requires
+	// a ClusterDAGService which can return the blocks it stored (the
+	// cluster ones read them from the local IPFS daemon). Cannot be
+	// used with OnlyHash.
+	VerifyAfterAdd bool
 }
 
 // DefaultAddParams returns a AddParams object with standard defaults
@@ -57,6 +453,47 @@ func DefaultAddParams() *AddParams {
 		HashFun:        "sha2-256",
 		StreamChannels: true,
 		NoCopy:         false,
+		// Each shard is allocated on its own by default.
+		ShardAllocation: "",
+		// Not sharding directories by default.
+		ShardingThreshold: 0,
+		OnlyHash:          false,
+		Concurrency:       0,
+		Symlinks:          "", // corresponds to preserve
+		NoPin:             false,
+		ProgressBuffer:    DefaultProgressBuffer,
+		ProgressInterval:  0,
+		SkipFailedFiles:   false,
+		Deterministic:     false,
+		WrapName:          "",
+		WrapTimestamp:     false,
+		UnwrapSingle:      false,
+		TargetPath:        "",
+		Inline:            false,
+		InlineLimit:       DefaultInlineLimit,
+		BlockTimeout:      0,
+		PutRetries:        0,
+		PutBackoff:        DefaultPutBackoff,
+		CidBase:           "",
+		MaxRate:           0,
+		MaxTotalSize:      0,
+		MaxFileSize:       0,
+		MaxDuration:       0,
+		Codec:             "",
+		MaxLinks:          0,
+		TrickleThreshold:  DefaultTrickleThreshold,
+		BatchSize:         0,
+		FlushInterval:     0,
+		MaxBufferBytes:    0,
+		PrepareTimeout:    0,
+		RawLeavesAuto:     false,
+		NormalizeNames:    false,
+		VerifyAfterAdd:    false,
+		AlternateCid:      false,
+		HashLength:        0,
+		Decompress:        "",
+		DetectMIME:        false,
+		StrictSize:        false,
 		PinOptions: PinOptions{
 			ReplicationFactorMin: 0,
 			ReplicationFactorMax: 0,
@@ -79,6 +516,17 @@ func parseBoolParam(q url.Values, name string, dest *bool) error {
 	return nil
 }
 
+func parseDurationParam(q url.Values, name string, dest *time.Duration) error {
+	if v := q.Get(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("parameter %s invalid", name)
+		}
+		*dest = d
+	}
+	return nil
+}
+
 func parseIntParam(q url.Values, name string, dest *int) error {
 	if v := q.Get(name); v != "" {
 		i, err := strconv.Atoi(v)
@@ -103,15 +551,50 @@ func AddParamsFromQuery(query url.Values) (*AddParams, error) {
 	params.PinOptions = *opts
 	params.PinUpdate = cid.Undef // hardcode as does not make sense for adding
 
+	// PinOptions default to recursive on unknown modes, but adding with
+	// the wrong mode is not something to recover from.
+	switch mode := query.Get("mode"); mode {
+	case "recursive", "direct", "":
+	default:
+		return nil, fmt.Errorf("bad pin mode: %s", mode)
+	}
+
+	// PinOptions skip the user allocations which cannot be parsed, which
+	// would place the content somewhere else than requested.
+	params.UserAllocations = nil
+	if allocs := query.Get("user-allocations"); allocs != "" {
+		seen := make(map[peer.ID]struct{})
+		for _, a := range strings.Split(allocs, ",") {
+			pid, err := peer.Decode(a)
+			if err != nil {
+				return nil, fmt.Errorf("bad user allocation %q: %s", a, err)
+			}
+			if _, ok := seen[pid]; ok {
+				continue
+			}
+			seen[pid] = struct{}{}
+			params.UserAllocations = append(params.UserAllocations, pid)
+		}
+	}
+
 	layout := query.Get("layout")
 	switch layout {
-	case "trickle", "balanced", "":
+	case "trickle", "balanced", "auto", "":
 		// nothing
 	default:
 		return nil, errors.New("layout parameter invalid")
 	}
 	params.Layout = layout
 
+	symlinks := query.Get("symlinks")
+	switch symlinks {
+	case "follow", "preserve", "skip", "":
+		// nothing
+	default:
+		return nil, errors.New("symlinks parameter invalid")
+	}
+	params.Symlinks = symlinks
+
 	chunker := query.Get("chunker")
 	if chunker != "" {
 		params.Chunker = chunker
@@ -132,9 +615,13 @@ func AddParamsFromQuery(query url.Values) (*AddParams, error) {
 		return nil, err
 	}
 
-	err = parseBoolParam(query, "raw-leaves", &params.RawLeaves)
-	if err != nil {
-		return nil, err
+	if query.Get("raw-leaves") == "auto" {
+		params.RawLeavesAuto = true
+	} else {
+		err = parseBoolParam(query, "raw-leaves", &params.RawLeaves)
+		if err != nil {
+			return nil, err
+		}
 	}
 	err = parseBoolParam(query, "hidden", &params.Hidden)
 	if err != nil {
@@ -148,6 +635,7 @@ func AddParamsFromQuery(query url.Values) (*AddParams, error) {
 	if err != nil {
 		return nil, err
 	}
+	params.ShardAllocation = query.Get("shard-allocation")
 
 	err = parseBoolParam(query, "progress", &params.Progress)
 	if err != nil {
@@ -169,10 +657,549 @@ func AddParamsFromQuery(query url.Values) (*AddParams, error) {
 		return nil, err
 	}
 
+	err = parseIntParam(query, "sharding-threshold", &params.ShardingThreshold)
+	if err != nil {
+		return nil, err
+	}
+	if params.ShardingThreshold < 0 {
+		return nil, errors.New("sharding-threshold parameter invalid")
+	}
+
+	err = parseBoolParam(query, "only-hash", &params.OnlyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseBoolParam(query, "no-pin", &params.NoPin)
+	if err != nil {
+		return nil, err
+	}
+
+	if include := query.Get("include"); include != "" {
+		params.Include = strings.Split(include, ",")
+	}
+
+	if exclude := query.Get("exclude"); exclude != "" {
+		params.Exclude = strings.Split(exclude, ",")
+	}
+
+	if ignoreFiles := query.Get("ignore-rules-files"); ignoreFiles != "" {
+		params.IgnoreRulesFiles = strings.Split(ignoreFiles, ",")
+	}
+
+	err = parseIntParam(query, "concurrency", &params.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+	if params.Concurrency < 0 {
+		return nil, errors.New("concurrency parameter invalid")
+	}
+
+	err = parseBoolParam(query, "skip-failed-files", &params.SkipFailedFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseBoolParam(query, "deterministic", &params.Deterministic)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseBoolParam(query, "normalize-names", &params.NormalizeNames)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseBoolParam(query, "verify-after-add", &params.VerifyAfterAdd)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseBoolParam(query, "alternate-cid", &params.AlternateCid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseIntParam(query, "hash-length", &params.HashLength)
+	if err != nil {
+		return nil, err
+	}
+
+	params.WrapName = query.Get("wrap-name")
+
+	err = parseBoolParam(query, "wrap-timestamp", &params.WrapTimestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseBoolParam(query, "unwrap-single", &params.UnwrapSingle)
+	if err != nil {
+		return nil, err
+	}
+
+	params.TargetPath = query.Get("target-path")
+
+	err = parseBoolParam(query, "inline", &params.Inline)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseIntParam(query, "inline-limit", &params.InlineLimit)
+	if err != nil {
+		return nil, err
+	}
+	if params.InlineLimit < 0 {
+		return nil, errors.New("inline-limit parameter invalid")
+	}
+
+	err = parseDurationParam(query, "block-timeout", &params.BlockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if params.BlockTimeout < 0 {
+		return nil, errors.New("block-timeout parameter invalid")
+	}
+
+	err = parseIntParam(query, "put-retries", &params.PutRetries)
+	if err != nil {
+		return nil, err
+	}
+	if params.PutRetries < 0 {
+		return nil, errors.New("put-retries parameter invalid")
+	}
+
+	err = parseDurationParam(query, "put-backoff", &params.PutBackoff)
+	if err != nil {
+		return nil, err
+	}
+	if params.PutBackoff < 0 {
+		return nil, errors.New("put-backoff parameter invalid")
+	}
+
+	params.CidBase = query.Get("cid-base")
+	if params.CidBase != "" {
+		if _, err := multibase.EncoderByName(params.CidBase); err != nil {
+			return nil, errors.New("cid-base parameter invalid")
+		}
+	}
+
+	if v := query.Get("max-rate"); v != "" {
+		maxRate, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("max-rate parameter invalid")
+		}
+		params.MaxRate = maxRate
+	}
+
+	if v := query.Get("max-total-size"); v != "" {
+		maxTotalSize, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("max-total-size parameter invalid")
+		}
+		params.MaxTotalSize = maxTotalSize
+	}
+
+	if v := query.Get("max-file-size"); v != "" {
+		maxFileSize, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("max-file-size parameter invalid")
+		}
+		params.MaxFileSize = maxFileSize
+	}
+
+	err = parseDurationParam(query, "max-duration", &params.MaxDuration)
+	if err != nil {
+		return nil, err
+	}
+	if params.MaxDuration < 0 {
+		return nil, errors.New("max-duration parameter invalid")
+	}
+
+	params.Codec = query.Get("codec")
+
+	params.Decompress = query.Get("decompress")
+
+	err = parseBoolParam(query, "detect-mime", &params.DetectMIME)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseBoolParam(query, "strict-size", &params.StrictSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseIntParam(query, "max-links", &params.MaxLinks)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := query.Get("trickle-threshold"); v != "" {
+		trickleThreshold, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("trickle-threshold parameter invalid")
+		}
+		params.TrickleThreshold = trickleThreshold
+	}
+
+	err = parseIntParam(query, "batch-size", &params.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseDurationParam(query, "flush-interval", &params.FlushInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := query.Get("max-buffer-bytes"); v != "" {
+		maxBufferBytes, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("max-buffer-bytes parameter invalid")
+		}
+		params.MaxBufferBytes = maxBufferBytes
+	}
+
+	err = parseDurationParam(query, "prepare-timeout", &params.PrepareTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseIntParam(query, "progress-buffer", &params.ProgressBuffer)
+	if err != nil {
+		return nil, err
+	}
+	if params.ProgressBuffer < 0 {
+		return nil, errors.New("progress-buffer parameter invalid")
+	}
+
+	err = parseDurationParam(query, "progress-interval", &params.ProgressInterval)
+	if err != nil {
+		return nil, err
+	}
+	if params.ProgressInterval < 0 {
+		return nil, errors.New("progress-interval parameter invalid")
+	}
+
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
 	return params, nil
 }
 
+// Validate checks that the parameters are valid and can be used together,
+// so that bad parameters are caught before any content is read.
+func (p *AddParams) Validate() error {
+	switch p.Layout {
+	case "trickle", "balanced", "auto", "":
+	default:
+		return fmt.Errorf("bad layout: %s", p.Layout)
+	}
+
+	switch p.Symlinks {
+	case "follow", "preserve", "skip", "":
+	default:
+		return fmt.Errorf("bad symlinks mode: %s", p.Symlinks)
+	}
+
+	if err := validateChunker(p.Chunker); err != nil {
+		return err
+	}
+
+	if p.CidVersion < 0 || p.CidVersion > 1 {
+		return fmt.Errorf("bad CID version: %d", p.CidVersion)
+	}
+
+	if p.HashLength < -1 {
+		return fmt.Errorf("bad hash length: %d", p.HashLength)
+	}
+
+	cidVersion, err := p.EffectiveCidVersion()
+	if err != nil {
+		return err
+	}
+
+	// Inlining only fails when CIDv0 would actually be used.
+	if p.Inline && cidVersion == 0 {
+		return ErrInlineCidV0
+	}
+
+	if p.NoPin && p.Shard {
+		return ErrNoPinShard
+	}
+
+	switch p.ShardAllocation {
+	case "", "per-shard", "same":
+	default:
+		return fmt.Errorf("bad shard allocation: %s", p.ShardAllocation)
+	}
+
+	if min := p.MinShardSize(); p.Shard && p.ShardSize < min {
+		return fmt.Errorf("shard size %d too small: it must be at least %d bytes to fit the largest block", p.ShardSize, min)
+	}
+
+	if p.RawLeavesAuto && p.NoCopy {
+		return errors.New("raw-leaves=auto cannot be used with nocopy")
+	}
+
+	switch p.Decompress {
+	case "gzip":
+		if p.NoCopy {
+			return errors.New("decompress cannot be used with nocopy: the files on disk are compressed")
+		}
+	case "none", "":
+	default:
+		return fmt.Errorf("bad decompress option: %s", p.Decompress)
+	}
+
+	if p.VerifyAfterAdd && p.OnlyHash {
+		return errors.New("verify-after-add cannot be used with only-hash: nothing is stored")
+	}
+
+	if p.InlineLimit == 0 && strings.EqualFold(p.HashFun, "identity") {
+		return errors.New("the identity hash function requires an inline limit")
+	}
+
+	// Other hash functions give other DAGs, which would need to be
+	// chunked and hashed again.
+	if p.AlternateCid {
+		if hashFun, _ := p.EffectiveHashFunction(); hashFun.Code != multihash.SHA2_256 || hashFun.Length != 32 {
+			return errors.New("alternate-cid requires untruncated sha2-256")
+		}
+	}
+
+	switch p.Mode {
+	case PinModeRecursive:
+	case PinModeDirect:
+		if p.Shard {
+			return ErrDirectShard
+		}
+	default:
+		return fmt.Errorf("bad pin mode: %d", p.Mode)
+	}
+
+	if p.CidBase != "" {
+		if _, err := multibase.EncoderByName(p.CidBase); err != nil {
+			return fmt.Errorf("bad CID base: %s", err)
+		}
+	}
+
+	if strings.Contains(p.WrapName, "/") {
+		return fmt.Errorf("bad wrap name %q: cannot contain '/'", p.WrapName)
+	}
+
+	if p.WrapTimestamp && p.WrapName != "" {
+		return errors.New("wrap-timestamp cannot be used with wrap-name")
+	}
+
+	if _, err := p.TargetPathComponents(); err != nil {
+		return err
+	}
+
+	if p.Codec != "" {
+		if _, err := ResolveCodec(p.Codec); err != nil {
+			return err
+		}
+	}
+
+	if err := p.validateReplicationFactors(); err != nil {
+		return err
+	}
+
+	// Local pins are always pinned with a replication factor of 1.
+	if p.Local && !p.Shard && (p.ReplicationFactorMin > 1 || p.ReplicationFactorMin < 0 || p.ReplicationFactorMax > 1 || p.ReplicationFactorMax < 0) {
+		return fmt.Errorf("local adds are pinned with a replication factor of 1, not min %d and max %d", p.ReplicationFactorMin, p.ReplicationFactorMax)
+	}
+
+	if err := p.validatePinMetadata(); err != nil {
+		return err
+	}
+
+	seen := make(map[peer.ID]struct{}, len(p.UserAllocations))
+	for _, pid := range p.UserAllocations {
+		if err := pid.Validate(); err != nil {
+			return fmt.Errorf("bad user allocation: %s", err)
+		}
+		if _, ok := seen[pid]; ok {
+			return fmt.Errorf("duplicate user allocation: %s", pid)
+		}
+		seen[pid] = struct{}{}
+	}
+
+	// An expiry in the past would fail pinning after adding everything.
+	if !p.ExpireAt.IsZero() && !p.ExpireAt.After(time.Now()) {
+		return fmt.Errorf("bad expire-at: %s is not in the future", p.ExpireAt.Format(time.RFC3339))
+	}
+
+	if p.MaxLinks != 0 && (p.MaxLinks < 2 || p.MaxLinks > MaxLinksLimit) {
+		return fmt.Errorf("bad max links: %d: must be between 2 and %d", p.MaxLinks, MaxLinksLimit)
+	}
+
+	switch {
+	case p.ShardingThreshold < 0:
+		return errors.New("sharding threshold cannot be negative")
+	case p.Concurrency < 0:
+		return errors.New("concurrency cannot be negative")
+	case p.InlineLimit < 0:
+		return errors.New("inline limit cannot be negative")
+	case p.BlockTimeout < 0:
+		return errors.New("block timeout cannot be negative")
+	case p.MaxDuration < 0:
+		return errors.New("max duration cannot be negative")
+	case p.PutRetries < 0:
+		return errors.New("put retries cannot be negative")
+	case p.PutBackoff < 0:
+		return errors.New("put backoff cannot be negative")
+	case p.ProgressBuffer < 0:
+		return errors.New("progress buffer cannot be negative")
+	case p.ProgressInterval < 0:
+		return errors.New("progress interval cannot be negative")
+	case p.BatchSize < 0:
+		return errors.New("batch size cannot be negative")
+	case p.FlushInterval < 0:
+		return errors.New("flush interval cannot be negative")
+	case p.PrepareTimeout < 0:
+		return errors.New("prepare timeout cannot be negative")
+	}
+	return nil
+}
+
+// validateReplicationFactors checks the replication factors for the pin
+// created by the add. 0 leaves a factor to the cluster default and -1 means
+// pinning everywhere, in which case both factors must be -1 (or one of them
+// left to the default).
+func (p *AddParams) validateReplicationFactors() error {
+	rplMin, rplMax := p.ReplicationFactorMin, p.ReplicationFactorMax
+	switch {
+	case rplMin < -1:
+		return fmt.Errorf("bad replication factor min: %d", rplMin)
+	case rplMax < -1:
+		return fmt.Errorf("bad replication factor max: %d", rplMax)
+	case rplMin == 0 || rplMax == 0:
+		return nil
+	case (rplMin == -1) != (rplMax == -1):
+		return errors.New("replication factor min and max must be -1 when one of them is")
+	case rplMin > rplMax:
+		return fmt.Errorf("replication factor min (%d) is larger than max (%d)", rplMin, rplMax)
+	}
+	return nil
+}
+
+// validatePinMetadata checks that the name and metadata of the pin created
+// by the add are within limits. They are stored as they are on the resulting
+// pin.
+func (p *AddParams) validatePinMetadata() error {
+	if len(p.Name) > MaxPinNameLength {
+		return fmt.Errorf("pin name is too long: %d bytes (max %d)", len(p.Name), MaxPinNameLength)
+	}
+	if len(p.Metadata) > MaxMetadataEntries {
+		return fmt.Errorf("too many metadata entries: %d (max %d)", len(p.Metadata), MaxMetadataEntries)
+	}
+	for k, v := range p.Metadata {
+		if k == "" {
+			return errors.New("metadata keys cannot be empty")
+		}
+		if len(k) > MaxMetadataKeyLength {
+			return fmt.Errorf("metadata key is too long: %d bytes (max %d)", len(k), MaxMetadataKeyLength)
+		}
+		if len(v) > MaxMetadataValueLength {
+			return fmt.Errorf("metadata value for %q is too long: %d bytes (max %d)", k, len(v), MaxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// EstimateBlocks estimates the number of blocks that adding the given number
+// of bytes produces with these parameters: the size divided by the average
+// chunk size of the chunker, rounded up. It is exact for a single file and a
+// size-based chunker, but does not count the intermediate nodes of the DAG,
+// directories or the extra chunks for files which do not fill their last
+// one. It returns -1 when the size is not known (negative).
+func (p *AddParams) EstimateBlocks(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	chunkSize := averageChunkSize(p.Chunker)
+	return (size + chunkSize - 1) / chunkSize
+}
+
+// EffectiveChunker returns the chunker spec passed to the IPFS chunkers when
+// adding with these parameters, with any sizes given with units converted
+// to byte counts. Invalid specs are returned as they are.
+func (p *AddParams) EffectiveChunker() string {
+	spec, err := normalizeChunker(p.Chunker)
+	if err != nil {
+		return p.Chunker
+	}
+	return spec
+}
+
+// MinShardSize returns the smallest ShardSize which fits the largest leaf
+// block made by the chunker, with the UnixFS wrapping, when sharding.
+func (p *AddParams) MinShardSize() uint64 {
+	return uint64(maxChunkSize(p.Chunker)) + shardBlockOverhead
+}
+
+// TargetPathComponents returns the directory names in TargetPath, in order,
+// without empty or "." components. It fails when a component is "..", as
+// it would escape the root.
+func (p *AddParams) TargetPathComponents() ([]string, error) {
+	var components []string
+	for _, c := range strings.Split(p.TargetPath, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			return nil, fmt.Errorf("bad target path %q: cannot contain '..'", p.TargetPath)
+		default:
+			components = append(components, c)
+		}
+	}
+	return components, nil
+}
+
+// EffectiveHashFunction returns the hash function used when adding with
+// these parameters, with the length set by HashLength, if any. It fails
+// when the hash function does not support that length.
+func (p *AddParams) EffectiveHashFunction() (HashFunction, error) {
+	hashFun, err := ResolveHashFunction(p.HashFun)
+	if err != nil {
+		return HashFunction{}, err
+	}
+	if p.HashLength <= 0 || p.HashLength == hashFun.Length {
+		return hashFun, nil
+	}
+	if hashFun.Code == multihash.IDENTITY || p.HashLength > hashFun.Length {
+		return HashFunction{}, fmt.Errorf("bad hash length for %s: %d", p.HashFun, p.HashLength)
+	}
+	if _, err := multihash.Sum(nil, hashFun.Code, p.HashLength); err != nil {
+		return HashFunction{}, fmt.Errorf("bad hash length for %s: %d: %s", p.HashFun, p.HashLength, err)
+	}
+	hashFun.Length = p.HashLength
+	return hashFun, nil
+}
+
+// EffectiveCidVersion returns the CID version used when adding with these
+// parameters. CIDv0 can only represent sha2-256 dag-pb blocks, so CIDv1 is
+// used instead of CIDv0 with other hash functions (as ipfs does), with
+// truncated hashes and with raw leaves, which would otherwise mix CIDv1
+// leaves into a CIDv0 DAG.
+func (p *AddParams) EffectiveCidVersion() (int, error) {
+	hashFun, err := p.EffectiveHashFunction()
+	if err != nil {
+		return 0, err
+	}
+	if p.CidVersion == 0 && (hashFun.Code != multihash.SHA2_256 || hashFun.Length != 32 || p.RawLeaves || p.RawLeavesAuto) {
+		return 1, nil
+	}
+	return p.CidVersion, nil
+}
+
 // ToQueryString returns a url query string (key=value&key2=value2&...)
+// with all the parameters. Keys are sorted, so the result is stable, and
+// values use the formats accepted by AddParamsFromQuery, which parses valid
+// params back into equal ones. PinUpdate is not included, and Include,
+// Exclude and IgnoreRulesFiles are comma-separated, so their entries cannot
+// contain commas.
 func (p *AddParams) ToQueryString() (string, error) {
 	pinOptsQuery, err := p.PinOptions.ToQuery()
 	if err != nil {
@@ -183,11 +1210,16 @@ func (p *AddParams) ToQueryString() (string, error) {
 		return "", err
 	}
 	query.Set("shard", fmt.Sprintf("%t", p.Shard))
+	query.Set("shard-allocation", p.ShardAllocation)
 	query.Set("local", fmt.Sprintf("%t", p.Local))
 	query.Set("recursive", fmt.Sprintf("%t", p.Recursive))
 	query.Set("layout", p.Layout)
+	query.Set("symlinks", p.Symlinks)
 	query.Set("chunker", p.Chunker)
 	query.Set("raw-leaves", fmt.Sprintf("%t", p.RawLeaves))
+	if p.RawLeavesAuto {
+		query.Set("raw-leaves", "auto")
+	}
 	query.Set("hidden", fmt.Sprintf("%t", p.Hidden))
 	query.Set("wrap-with-directory", fmt.Sprintf("%t", p.Wrap))
 	query.Set("progress", fmt.Sprintf("%t", p.Progress))
@@ -195,16 +1227,61 @@ func (p *AddParams) ToQueryString() (string, error) {
 	query.Set("hash", p.HashFun)
 	query.Set("stream-channels", fmt.Sprintf("%t", p.StreamChannels))
 	query.Set("nocopy", fmt.Sprintf("%t", p.NoCopy))
+	query.Set("sharding-threshold", fmt.Sprintf("%d", p.ShardingThreshold))
+	query.Set("only-hash", fmt.Sprintf("%t", p.OnlyHash))
+	query.Set("concurrency", fmt.Sprintf("%d", p.Concurrency))
+	query.Set("no-pin", fmt.Sprintf("%t", p.NoPin))
+	query.Set("include", strings.Join(p.Include, ","))
+	query.Set("exclude", strings.Join(p.Exclude, ","))
+	query.Set("ignore-rules-files", strings.Join(p.IgnoreRulesFiles, ","))
+	query.Set("progress-buffer", fmt.Sprintf("%d", p.ProgressBuffer))
+	query.Set("skip-failed-files", fmt.Sprintf("%t", p.SkipFailedFiles))
+	query.Set("deterministic", fmt.Sprintf("%t", p.Deterministic))
+	query.Set("normalize-names", fmt.Sprintf("%t", p.NormalizeNames))
+	query.Set("verify-after-add", fmt.Sprintf("%t", p.VerifyAfterAdd))
+	query.Set("alternate-cid", fmt.Sprintf("%t", p.AlternateCid))
+	query.Set("hash-length", fmt.Sprintf("%d", p.HashLength))
+	query.Set("decompress", p.Decompress)
+	query.Set("detect-mime", fmt.Sprintf("%t", p.DetectMIME))
+	query.Set("strict-size", fmt.Sprintf("%t", p.StrictSize))
+	query.Set("wrap-name", p.WrapName)
+	query.Set("wrap-timestamp", fmt.Sprintf("%t", p.WrapTimestamp))
+	query.Set("unwrap-single", fmt.Sprintf("%t", p.UnwrapSingle))
+	query.Set("target-path", p.TargetPath)
+	query.Set("inline", fmt.Sprintf("%t", p.Inline))
+	query.Set("inline-limit", fmt.Sprintf("%d", p.InlineLimit))
+	query.Set("block-timeout", p.BlockTimeout.String())
+	query.Set("put-retries", fmt.Sprintf("%d", p.PutRetries))
+	query.Set("put-backoff", p.PutBackoff.String())
+	query.Set("cid-base", p.CidBase)
+	query.Set("max-rate", fmt.Sprintf("%d", p.MaxRate))
+	query.Set("max-total-size", fmt.Sprintf("%d", p.MaxTotalSize))
+	query.Set("max-file-size", fmt.Sprintf("%d", p.MaxFileSize))
+	query.Set("max-duration", p.MaxDuration.String())
+	query.Set("codec", p.Codec)
+	query.Set("max-links", fmt.Sprintf("%d", p.MaxLinks))
+	query.Set("trickle-threshold", fmt.Sprintf("%d", p.TrickleThreshold))
+	query.Set("batch-size", fmt.Sprintf("%d", p.BatchSize))
+	query.Set("flush-interval", p.FlushInterval.String())
+	query.Set("max-buffer-bytes", fmt.Sprintf("%d", p.MaxBufferBytes))
+	query.Set("prepare-timeout", p.PrepareTimeout.String())
+	query.Set("progress-interval", p.ProgressInterval.String())
 	return query.Encode(), nil
 }
 
 // Equals checks if p equals p2.
 func (p *AddParams) Equals(p2 *AddParams) bool {
+	if p == nil || p2 == nil {
+		return p == p2
+	}
+
 	return p.PinOptions.Equals(&p2.PinOptions) &&
 		p.Local == p2.Local &&
 		p.Recursive == p2.Recursive &&
 		p.Shard == p2.Shard &&
+		p.ShardAllocation == p2.ShardAllocation &&
 		p.Layout == p2.Layout &&
+		p.Symlinks == p2.Symlinks &&
 		p.Chunker == p2.Chunker &&
 		p.RawLeaves == p2.RawLeaves &&
 		p.Hidden == p2.Hidden &&
@@ -212,5 +1289,144 @@ func (p *AddParams) Equals(p2 *AddParams) bool {
 		p.CidVersion == p2.CidVersion &&
 		p.HashFun == p2.HashFun &&
 		p.StreamChannels == p2.StreamChannels &&
-		p.NoCopy == p2.NoCopy
+		p.NoCopy == p2.NoCopy &&
+		p.ShardingThreshold == p2.ShardingThreshold &&
+		p.OnlyHash == p2.OnlyHash &&
+		p.Concurrency == p2.Concurrency &&
+		p.NoPin == p2.NoPin &&
+		equalStrings(p.Include, p2.Include) &&
+		equalStrings(p.Exclude, p2.Exclude) &&
+		equalStrings(p.IgnoreRulesFiles, p2.IgnoreRulesFiles) &&
+		p.ProgressBuffer == p2.ProgressBuffer &&
+		p.SkipFailedFiles == p2.SkipFailedFiles &&
+		p.Deterministic == p2.Deterministic &&
+		p.WrapName == p2.WrapName &&
+		p.WrapTimestamp == p2.WrapTimestamp &&
+		p.UnwrapSingle == p2.UnwrapSingle &&
+		p.TargetPath == p2.TargetPath &&
+		p.Inline == p2.Inline &&
+		p.InlineLimit == p2.InlineLimit &&
+		p.BlockTimeout == p2.BlockTimeout &&
+		p.PutRetries == p2.PutRetries &&
+		p.PutBackoff == p2.PutBackoff &&
+		p.CidBase == p2.CidBase &&
+		p.MaxRate == p2.MaxRate &&
+		p.MaxTotalSize == p2.MaxTotalSize &&
+		p.MaxFileSize == p2.MaxFileSize &&
+		p.MaxDuration == p2.MaxDuration &&
+		p.Codec == p2.Codec &&
+		p.MaxLinks == p2.MaxLinks &&
+		p.TrickleThreshold == p2.TrickleThreshold &&
+		p.BatchSize == p2.BatchSize &&
+		p.FlushInterval == p2.FlushInterval &&
+		p.MaxBufferBytes == p2.MaxBufferBytes &&
+		p.PrepareTimeout == p2.PrepareTimeout &&
+		p.RawLeavesAuto == p2.RawLeavesAuto &&
+		p.NormalizeNames == p2.NormalizeNames &&
+		p.VerifyAfterAdd == p2.VerifyAfterAdd &&
+		p.ProgressInterval == p2.ProgressInterval &&
+		p.AlternateCid == p2.AlternateCid &&
+		p.HashLength == p2.HashLength &&
+		p.Decompress == p2.Decompress &&
+		p.DetectMIME == p2.DetectMIME &&
+		p.StrictSize == p2.StrictSize
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a deep copy of the AddParams, which can be modified without
+// affecting the original, i.e. when using the params as a template.
+func (p *AddParams) Clone() *AddParams {
+	if p == nil {
+		return nil
+	}
+
+	p2 := *p
+	p2.UserAllocations = append([]peer.ID(nil), p.UserAllocations...)
+	if p.Metadata != nil {
+		p2.Metadata = make(map[string]string, len(p.Metadata))
+		for k, v := range p.Metadata {
+			p2.Metadata[k] = v
+		}
+	}
+	p2.Include = append([]string(nil), p.Include...)
+	p2.Exclude = append([]string(nil), p.Exclude...)
+	p2.IgnoreRulesFiles = append([]string(nil), p.IgnoreRulesFiles...)
+	return &p2
+}
+
+// AlternateCid returns the CID of the same block under the other CID
+// version: the CIDv1 of a CIDv0 and the CIDv0 of a dag-pb CIDv1. As both wrap
+// the same multihash, converting is free, but only sha2-256 dag-pb blocks
+// have both, so any other CID results in ErrNoAlternateCid.
+//
+// Converting a root does not convert the rest of its DAG, whose blocks link
+// to each other with the version they were added with. Adding the same
+// content with the other CID version gives the converted root only for
+// single-block DAGs: otherwise the links, and so the root, differ, as they do
+// with raw leaves, which CIDv1 adds use by default, or with another hash
+// function. Getting that root needs a second chunking and hashing pass over
+// the content, which is as expensive as adding it again with OnlyHash.
+func AlternateCid(c cid.Cid) (cid.Cid, error) {
+	prefix := c.Prefix()
+	if prefix.Codec != cid.DagProtobuf || prefix.MhType != multihash.SHA2_256 || prefix.MhLength != 32 {
+		return cid.Undef, ErrNoAlternateCid
+	}
+	if c.Version() == 0 {
+		return cid.NewCidV1(cid.DagProtobuf, c.Hash()), nil
+	}
+	return cid.NewCidV0(c.Hash()), nil
+}
+
+// FormatCid returns the string representation of the given CID using
+// CidBase for CIDv1s.
+func (p *AddParams) FormatCid(c cid.Cid) string {
+	if p.CidBase == "" || c.Version() == 0 {
+		return c.String()
+	}
+	enc, err := multibase.EncoderByName(p.CidBase)
+	if err != nil {
+		return c.String()
+	}
+	return c.Encode(enc)
+}
+
+// cidLink is the JSON form of a CID ({"/": "<cid>"}), with the CID
+// already printed in the chosen base.
+type cidLink struct {
+	Cid string `json:"/"`
+}
+
+// FormatCidJSON returns a value which encodes to JSON like the given CID
+// does, but printed with CidBase (see FormatCid).
+func (p *AddParams) FormatCidJSON(c cid.Cid) interface{} {
+	if p.CidBase == "" || !c.Defined() || c.Version() == 0 {
+		return c
+	}
+	return cidLink{Cid: p.FormatCid(c)}
+}
+
+// FormatOutput returns a value which encodes to JSON like the given
+// AddedOutput does, but with its CID printed with CidBase (see FormatCid).
+func (p *AddParams) FormatOutput(ao *AddedOutput) interface{} {
+	if ao == nil || p.CidBase == "" || !ao.Cid.Defined() || ao.Cid.Version() == 0 {
+		return ao
+	}
+	return struct {
+		*AddedOutput
+		Cid cidLink `json:"cid"`
+	}{
+		AddedOutput: ao,
+		Cid:         cidLink{Cid: p.FormatCid(ao.Cid)},
+	}
 }
@@ -1,12 +1,20 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 )
 
 func TestAddParams_FromQuery(t *testing.T) {
-	qStr := "layout=balanced&chunker=size-262144&name=test&raw-leaves=true&hidden=true&shard=true&replication-min=2&replication-max=4&shard-size=1"
+	qStr := "layout=balanced&chunker=size-262144&name=test&raw-leaves=true&hidden=true&shard=true&replication-min=2&replication-max=4&shard-size=1048576"
 
 	q, err := url.ParseQuery(qStr)
 	if err != nil {
@@ -23,7 +31,7 @@ func TestAddParams_FromQuery(t *testing.T) {
 		!p.RawLeaves || !p.Hidden || !p.Shard ||
 		p.ReplicationFactorMin != 2 ||
 		p.ReplicationFactorMax != 4 ||
-		p.ShardSize != 1 {
+		p.ShardSize != 1048576 {
 		t.Fatal("did not parse the query correctly")
 	}
 }
@@ -35,6 +43,7 @@ func TestAddParams_ToQueryString(t *testing.T) {
 	p.Name = "something"
 	p.RawLeaves = true
 	p.ShardSize = 1020
+	p.ProgressBuffer = 500
 	qstr, err := p.ToQueryString()
 	if err != nil {
 		t.Fatal(err)
@@ -53,3 +62,458 @@ func TestAddParams_ToQueryString(t *testing.T) {
 		t.Error("generated and parsed params should be equal")
 	}
 }
+
+func TestAddParams_CidBase(t *testing.T) {
+	q, _ := url.ParseQuery("cid-base=nope")
+	if _, err := AddParamsFromQuery(q); err == nil {
+		t.Error("expected an error for an unknown base")
+	}
+
+	q, _ = url.ParseQuery("cid-base=base58btc")
+	p, err := AddParamsFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v0, _ := cid.Decode("QmXZrtE5jQwXNqCJMfHUTQkvhQ4ZAnqMnmzFMJfLewuabc")
+	v1 := cid.NewCidV1(cid.DagProtobuf, v0.Hash())
+	if s := p.FormatCid(v1); s[0] != 'z' {
+		t.Error("expected a base58btc CID, got", s)
+	}
+	if s := p.FormatCid(v0); s != v0.String() {
+		t.Error("CIDv0 should not change, got", s)
+	}
+	if s := DefaultAddParams().FormatCid(v1); s != v1.String() {
+		t.Error("expected the default base, got", s)
+	}
+
+	ao := &AddedOutput{Name: "a", Cid: v1}
+	js, err := json.Marshal(p.FormatOutput(ao))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back AddedOutput
+	if err := json.Unmarshal(js, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(js), p.FormatCid(v1)) || !back.Cid.Equals(v1) || back.Name != "a" {
+		t.Error("expected the output CID printed in base58btc, got", string(js))
+	}
+	if p.FormatOutput(&AddedOutput{Cid: v0}) == nil || DefaultAddParams().FormatOutput(ao) != ao {
+		t.Error("outputs should be left as they are when the base does not apply")
+	}
+}
+
+func TestAlternateCid(t *testing.T) {
+	v0, _ := cid.Decode("QmXZrtE5jQwXNqCJMfHUTQkvhQ4ZAnqMnmzFMJfLewuabc")
+	v1, err := AlternateCid(v0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.Version() != 1 || v1.Type() != cid.DagProtobuf || string(v1.Hash()) != string(v0.Hash()) {
+		t.Error("expected the dag-pb CIDv1 with the same multihash, got", v1)
+	}
+	back, err := AlternateCid(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !back.Equals(v0) {
+		t.Error("expected to get the CIDv0 back, got", back)
+	}
+
+	raw := cid.NewCidV1(cid.Raw, v0.Hash())
+	if _, err := AlternateCid(raw); err != ErrNoAlternateCid {
+		t.Error("raw blocks have no CIDv0, got", err)
+	}
+}
+
+func TestAddParams_RawLeavesAuto(t *testing.T) {
+	q, _ := url.ParseQuery("raw-leaves=auto")
+	p, err := AddParamsFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.RawLeavesAuto || p.RawLeaves {
+		t.Error("expected automatic raw leaves")
+	}
+
+	q, _ = url.ParseQuery("raw-leaves=sometimes")
+	if _, err := AddParamsFromQuery(q); err == nil {
+		t.Error("expected an error for a bad raw-leaves value")
+	}
+}
+
+func TestAddParams_PinMode(t *testing.T) {
+	q, _ := url.ParseQuery("mode=direct")
+	p, err := AddParamsFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != PinModeDirect {
+		t.Error("expected direct mode")
+	}
+
+	if DefaultAddParams().Mode != PinModeRecursive {
+		t.Error("adding should default to recursive pins")
+	}
+
+	q, _ = url.ParseQuery("mode=indirect")
+	if _, err := AddParamsFromQuery(q); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestAddParams_UserAllocations(t *testing.T) {
+	pid1, _ := peer.Decode("QmXZrtE5jQwXNqCJMfHUTQkvhQ4ZAnqMnmzFMJfLewuabc")
+	pid2, _ := peer.Decode("QmUZ13osndQ5uL4tPWHXe3iBgBgq9gfewcBMSCAuMBsDJ6")
+
+	q, _ := url.ParseQuery("user-allocations=" + pid1.String() + "," + pid2.String() + "," + pid1.String())
+	p, err := AddParamsFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.UserAllocations) != 2 || p.UserAllocations[0] != pid1 || p.UserAllocations[1] != pid2 {
+		t.Error("expected deduplicated allocations in order:", p.UserAllocations)
+	}
+
+	q, _ = url.ParseQuery("user-allocations=" + pid1.String() + ",notapeer")
+	if _, err := AddParamsFromQuery(q); err == nil {
+		t.Error("expected an error for a bad peer ID")
+	}
+}
+
+func TestAddParams_Validate(t *testing.T) {
+	pid1, _ := peer.Decode("QmXZrtE5jQwXNqCJMfHUTQkvhQ4ZAnqMnmzFMJfLewuabc")
+	pid2, _ := peer.Decode("QmUZ13osndQ5uL4tPWHXe3iBgBgq9gfewcBMSCAuMBsDJ6")
+
+	tcs := []struct {
+		name  string
+		set   func(p *AddParams)
+		valid bool
+	}{
+		{"defaults", func(p *AddParams) {}, true},
+		{"trickle", func(p *AddParams) { p.Layout = "trickle" }, true},
+		{"bad layout", func(p *AddParams) { p.Layout = "flat" }, false},
+		{"bad symlinks", func(p *AddParams) { p.Symlinks = "copy" }, false},
+		{"chunker", func(p *AddParams) { p.Chunker = "rabin-16-262144-524288" }, true},
+		{"bad chunker", func(p *AddParams) { p.Chunker = "size-0" }, false},
+		{"hash", func(p *AddParams) { p.HashFun = "blake2b-256" }, true},
+		{"bad hash", func(p *AddParams) { p.HashFun = "sha4-256" }, false},
+		{"blake3 hash", func(p *AddParams) { p.HashFun = "blake3" }, true},
+		{"uncomputable hash", func(p *AddParams) { p.HashFun = "blake2s-128" }, false},
+		{"uncomputable keccak", func(p *AddParams) { p.HashFun = "keccak-224" }, false},
+		{"identity hash", func(p *AddParams) { p.HashFun = "identity" }, true},
+		{"hash length", func(p *AddParams) { p.HashFun = "blake2b-256"; p.HashLength = 20 }, true},
+		{"default hash length", func(p *AddParams) { p.HashLength = -1 }, true},
+		{"hash length too long", func(p *AddParams) { p.HashLength = 33 }, false},
+		{"bad hash length", func(p *AddParams) { p.HashLength = -2 }, false},
+		{"gzip", func(p *AddParams) { p.Decompress = "gzip" }, true},
+		{"gzip nocopy", func(p *AddParams) { p.Decompress = "gzip"; p.NoCopy = true }, false},
+		{"bad decompress", func(p *AddParams) { p.Decompress = "zip" }, false},
+		{"identity hash length", func(p *AddParams) { p.HashFun = "identity"; p.HashLength = 8 }, false},
+		{"unsupported hash length", func(p *AddParams) { p.HashFun = "blake2s-128"; p.HashLength = 8 }, false},
+		{"alternate cid truncated", func(p *AddParams) { p.AlternateCid = true; p.HashLength = 20 }, false},
+		{"identity hash without limit", func(p *AddParams) { p.HashFun = "identity"; p.InlineLimit = 0 }, false},
+		{"cidv1", func(p *AddParams) { p.CidVersion = 1 }, true},
+		{"bad cid version", func(p *AddParams) { p.CidVersion = 2 }, false},
+		{"negative cid version", func(p *AddParams) { p.CidVersion = -1 }, false},
+		{"cidv0 raw leaves", func(p *AddParams) { p.RawLeaves = true }, true},
+		{"inline raw leaves", func(p *AddParams) { p.Inline = true; p.RawLeaves = true }, true},
+		{"inline cidv1", func(p *AddParams) { p.Inline = true; p.CidVersion = 1 }, true},
+		{"inline cidv0", func(p *AddParams) { p.Inline = true }, false},
+		{"inline upgraded cidv0", func(p *AddParams) { p.Inline = true; p.HashFun = "sha3-256" }, true},
+		{"no-pin", func(p *AddParams) { p.NoPin = true }, true},
+		{"no-pin shard", func(p *AddParams) { p.NoPin = true; p.Shard = true }, false},
+		{"cid base", func(p *AddParams) { p.CidBase = "base32" }, true},
+		{"bad cid base", func(p *AddParams) { p.CidBase = "base1000" }, false},
+		{"wrap name", func(p *AddParams) { p.WrapName = "dir" }, true},
+		{"bad wrap name", func(p *AddParams) { p.WrapName = "a/b" }, false},
+		{"wrap timestamp", func(p *AddParams) { p.WrapTimestamp = true }, true},
+		{"wrap timestamp and name", func(p *AddParams) { p.WrapTimestamp = true; p.WrapName = "dir" }, false},
+		{"target path", func(p *AddParams) { p.TargetPath = "/a/./b/" }, true},
+		{"escaping target path", func(p *AddParams) { p.TargetPath = "a/../../b" }, false},
+		{"codec", func(p *AddParams) { p.Codec = "dag-cbor" }, true},
+		{"dag-json codec", func(p *AddParams) { p.Codec = "dag-json" }, false},
+		{"bad codec", func(p *AddParams) { p.Codec = "json" }, false},
+		{"replication factors", func(p *AddParams) { p.ReplicationFactorMin = 2; p.ReplicationFactorMax = 3 }, true},
+		{"replication everywhere", func(p *AddParams) { p.ReplicationFactorMin = -1; p.ReplicationFactorMax = -1 }, true},
+		{"replication min only", func(p *AddParams) { p.ReplicationFactorMin = 5 }, true},
+		{"replication min over max", func(p *AddParams) { p.ReplicationFactorMin = 3; p.ReplicationFactorMax = 2 }, false},
+		{"replication mixed everywhere", func(p *AddParams) { p.ReplicationFactorMin = 2; p.ReplicationFactorMax = -1 }, false},
+		{"bad replication min", func(p *AddParams) { p.ReplicationFactorMin = -2 }, false},
+		{"bad replication max", func(p *AddParams) { p.ReplicationFactorMax = -2 }, false},
+		{"local", func(p *AddParams) { p.Local = true; p.ReplicationFactorMin = 1; p.ReplicationFactorMax = 1 }, true},
+		{"local replication", func(p *AddParams) { p.Local = true; p.ReplicationFactorMin = 1; p.ReplicationFactorMax = 3 }, false},
+		{"local everywhere", func(p *AddParams) { p.Local = true; p.ReplicationFactorMin = -1; p.ReplicationFactorMax = -1 }, false},
+		{"local sharded replication", func(p *AddParams) { p.Local = true; p.Shard = true; p.ReplicationFactorMin = 2; p.ReplicationFactorMax = 3 }, true},
+		{"pin metadata", func(p *AddParams) { p.Name = "dataset"; p.Metadata = map[string]string{"owner": "me"} }, true},
+		{"long pin name", func(p *AddParams) { p.Name = strings.Repeat("a", MaxPinNameLength+1) }, false},
+		{"empty metadata key", func(p *AddParams) { p.Metadata = map[string]string{"": "v"} }, false},
+		{"long metadata key", func(p *AddParams) { p.Metadata = map[string]string{strings.Repeat("k", MaxMetadataKeyLength+1): "v"} }, false},
+		{"long metadata value", func(p *AddParams) { p.Metadata = map[string]string{"k": strings.Repeat("v", MaxMetadataValueLength+1)} }, false},
+		{"too many metadata entries", func(p *AddParams) {
+			p.Metadata = make(map[string]string)
+			for i := 0; i <= MaxMetadataEntries; i++ {
+				p.Metadata[fmt.Sprint(i)] = "v"
+			}
+		}, false},
+		{"expire at", func(p *AddParams) { p.ExpireAt = time.Now().Add(time.Hour) }, true},
+		{"expired", func(p *AddParams) { p.ExpireAt = time.Now().Add(-time.Hour) }, false},
+		{"direct", func(p *AddParams) { p.Mode = PinModeDirect }, true},
+		{"direct shard", func(p *AddParams) { p.Mode = PinModeDirect; p.Shard = true }, false},
+		{"shard allocation", func(p *AddParams) { p.Shard = true; p.ShardAllocation = "same" }, true},
+		{"bad shard allocation", func(p *AddParams) { p.ShardAllocation = "random" }, false},
+		{"shard size too small", func(p *AddParams) { p.Shard = true; p.ShardSize = 200 * 1024 }, false},
+		{"small shard size", func(p *AddParams) { p.Shard = true; p.Chunker = "size-1024"; p.ShardSize = 200 * 1024 }, true},
+		{"small shard size without sharding", func(p *AddParams) { p.ShardSize = 200 }, true},
+		{"bad pin mode", func(p *AddParams) { p.Mode = 5 }, false},
+		{"user allocations", func(p *AddParams) { p.UserAllocations = []peer.ID{pid1, pid2} }, true},
+		{"duplicate user allocations", func(p *AddParams) { p.UserAllocations = []peer.ID{pid1, pid1} }, false},
+		{"empty user allocation", func(p *AddParams) { p.UserAllocations = []peer.ID{""} }, false},
+		{"max links", func(p *AddParams) { p.MaxLinks = 1024 }, true},
+		{"too few max links", func(p *AddParams) { p.MaxLinks = 1 }, false},
+		{"too many max links", func(p *AddParams) { p.MaxLinks = MaxLinksLimit + 1 }, false},
+		{"negative concurrency", func(p *AddParams) { p.Concurrency = -1 }, false},
+		{"negative retries", func(p *AddParams) { p.PutRetries = -1 }, false},
+		{"negative timeout", func(p *AddParams) { p.BlockTimeout = -1 }, false},
+		{"max duration", func(p *AddParams) { p.MaxDuration = time.Minute }, true},
+		{"negative max duration", func(p *AddParams) { p.MaxDuration = -1 }, false},
+		{"batching", func(p *AddParams) { p.BatchSize = 100; p.FlushInterval = time.Second }, true},
+		{"negative batch size", func(p *AddParams) { p.BatchSize = -1 }, false},
+		{"negative flush interval", func(p *AddParams) { p.FlushInterval = -1 }, false},
+		{"progress interval", func(p *AddParams) { p.ProgressInterval = time.Second }, true},
+		{"negative progress interval", func(p *AddParams) { p.ProgressInterval = -1 }, false},
+		{"negative prepare timeout", func(p *AddParams) { p.PrepareTimeout = -1 }, false},
+		{"auto raw leaves", func(p *AddParams) { p.RawLeavesAuto = true }, true},
+		{"auto raw leaves nocopy", func(p *AddParams) { p.RawLeavesAuto = true; p.NoCopy = true }, false},
+		{"verify", func(p *AddParams) { p.VerifyAfterAdd = true }, true},
+		{"verify only hash", func(p *AddParams) { p.VerifyAfterAdd = true; p.OnlyHash = true }, false},
+		{"alternate cid", func(p *AddParams) { p.AlternateCid = true; p.CidVersion = 1 }, true},
+		{"alternate cid other hash", func(p *AddParams) { p.AlternateCid = true; p.HashFun = "sha3-256" }, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			p := DefaultAddParams()
+			tc.set(p)
+			err := p.Validate()
+			if tc.valid && err != nil {
+				t.Error("expected valid params:", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("expected invalid params")
+			}
+		})
+	}
+
+	q, _ := url.ParseQuery("inline=true&cid-version=0")
+	if _, err := AddParamsFromQuery(q); err != ErrInlineCidV0 {
+		t.Error("expected query params to be validated, got:", err)
+	}
+}
+
+func TestAddParams_EffectiveCidVersion(t *testing.T) {
+	tcs := []struct {
+		name    string
+		set     func(p *AddParams)
+		version int
+	}{
+		{"defaults", func(p *AddParams) {}, 0},
+		{"cidv1", func(p *AddParams) { p.CidVersion = 1 }, 1},
+		{"raw leaves", func(p *AddParams) { p.RawLeaves = true }, 1},
+		{"auto raw leaves", func(p *AddParams) { p.RawLeavesAuto = true }, 1},
+		{"other hash", func(p *AddParams) { p.HashFun = "sha2-512" }, 1},
+		{"truncated hash", func(p *AddParams) { p.HashLength = 20 }, 1},
+		{"full hash length", func(p *AddParams) { p.HashLength = 32 }, 0},
+	}
+
+	for _, tc := range tcs {
+		p := DefaultAddParams()
+		tc.set(p)
+		v, err := p.EffectiveCidVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != tc.version {
+			t.Errorf("%s: expected CIDv%d, got CIDv%d", tc.name, tc.version, v)
+		}
+	}
+}
+
+func TestAddParams_Clone(t *testing.T) {
+	pid, _ := peer.Decode("QmXZrtE5jQwXNqCJMfHUTQkvhQ4ZAnqMnmzFMJfLewuabc")
+	p := DefaultAddParams()
+	p.Name = "template"
+	p.UserAllocations = []peer.ID{pid}
+	p.Metadata = map[string]string{"a": "b"}
+	p.Include = []string{"*.txt"}
+	p.Exclude = []string{"tmp"}
+	p.IgnoreRulesFiles = []string{".ipfsignore"}
+
+	p2 := p.Clone()
+	if !p.Equals(p2) {
+		t.Fatal("clone should equal the original")
+	}
+
+	p2.Name = "other"
+	p2.UserAllocations[0] = ""
+	p2.Metadata["a"] = "c"
+	p2.Include[0] = "*.md"
+	p2.Exclude = append(p2.Exclude, "more")
+	p2.IgnoreRulesFiles[0] = ".gitignore"
+
+	if p.Name != "template" ||
+		p.UserAllocations[0] != pid ||
+		p.Metadata["a"] != "b" ||
+		p.Include[0] != "*.txt" ||
+		len(p.Exclude) != 1 ||
+		p.IgnoreRulesFiles[0] != ".ipfsignore" {
+		t.Error("modifying the clone should not modify the original")
+	}
+	if p.Equals(p2) {
+		t.Error("modified clone should not equal the original")
+	}
+
+	var nilParams *AddParams
+	if nilParams.Clone() != nil || !nilParams.Equals(nil) || p.Equals(nil) {
+		t.Error("bad nil handling")
+	}
+}
+
+func TestAddParams_EqualsSlices(t *testing.T) {
+	p := DefaultAddParams()
+	p.Include = []string{"a,b"}
+	p2 := DefaultAddParams()
+	p2.Include = []string{"a", "b"}
+	if p.Equals(p2) {
+		t.Error("params with different patterns should not be equal")
+	}
+}
+
+// randomAddParams returns valid AddParams with random values.
+func randomAddParams(r *rand.Rand) *AddParams {
+	pick := func(opts ...string) string { return opts[r.Intn(len(opts))] }
+	flag := func() bool { return r.Intn(2) == 0 }
+	patterns := func() []string {
+		var pts []string
+		for i := r.Intn(3); i > 0; i-- {
+			pts = append(pts, pick("*.txt", "a/**/b", "tmp", "a b"))
+		}
+		return pts
+	}
+
+	p := DefaultAddParams()
+	p.ReplicationFactorMin = r.Intn(5)
+	p.ReplicationFactorMax = p.ReplicationFactorMin + r.Intn(5)
+	p.Name = pick("", "name", "with spaces&symbols=?")
+	p.Mode = PinModeFromString(pick("recursive", "direct"))
+	p.ShardSize = 1<<20 + uint64(r.Int63n(1<<30))
+	if flag() {
+		p.ExpireAt = time.Unix(time.Now().Unix()+3600+r.Int63n(1<<30), 0).UTC()
+	}
+	if flag() {
+		p.Metadata = map[string]string{"key": pick("a", "b c")}
+	}
+	if flag() {
+		pid, _ := peer.Decode(pick(
+			"QmXZrtE5jQwXNqCJMfHUTQkvhQ4ZAnqMnmzFMJfLewuabc",
+			"QmUZ13osndQ5uL4tPWHXe3iBgBgq9gfewcBMSCAuMBsDJ6",
+		))
+		p.UserAllocations = []peer.ID{pid}
+	}
+	p.Local = p.ReplicationFactorMax <= 1 && flag()
+	p.Recursive = flag()
+	p.Layout = pick("", "balanced", "trickle", "auto")
+	p.Chunker = pick("size-262144", "size-1024", "rabin", "rabin-16-262144-524288", "buzhash")
+	p.RawLeaves = flag()
+	p.Hidden = flag()
+	p.Wrap = flag()
+	p.Shard = flag()
+	p.ShardAllocation = pick("", "per-shard", "same")
+	p.Progress = flag()
+	p.CidVersion = r.Intn(2)
+	p.HashFun = pick("sha2-256", "sha3-512", "blake2b-256")
+	p.StreamChannels = flag()
+	p.NoCopy = flag()
+	p.ShardingThreshold = r.Intn(2000)
+	p.OnlyHash = flag()
+	p.Concurrency = r.Intn(10)
+	p.Symlinks = pick("", "preserve", "follow", "skip")
+	p.NoPin = !p.Shard && flag()
+	if p.Shard {
+		p.Mode = PinModeRecursive
+	}
+	p.Include = patterns()
+	p.Exclude = patterns()
+	p.IgnoreRulesFiles = patterns()
+	p.ProgressBuffer = r.Intn(1000)
+	p.SkipFailedFiles = flag()
+	p.Deterministic = flag()
+	p.NormalizeNames = flag()
+	p.VerifyAfterAdd = !p.OnlyHash && flag()
+	p.HashLength = []int{-1, 0, 20, 32}[r.Intn(4)]
+	p.Decompress = pick("", "none")
+	p.DetectMIME = flag()
+	p.StrictSize = flag()
+	if !p.NoCopy && flag() {
+		p.Decompress = "gzip"
+	}
+	p.AlternateCid = p.HashFun == "sha2-256" && p.HashLength != 20 && flag()
+	p.WrapName = pick("", "dir", "a name")
+	p.WrapTimestamp = p.WrapName == "" && flag()
+	p.UnwrapSingle = flag()
+	p.TargetPath = pick("", "docs", "a/b")
+	p.Inline = p.CidVersion == 1 && flag()
+	p.InlineLimit = r.Intn(100)
+	p.BlockTimeout = time.Duration(r.Int63n(int64(time.Hour)))
+	p.PutRetries = r.Intn(5)
+	p.PutBackoff = time.Duration(r.Int63n(int64(time.Minute)))
+	p.CidBase = pick("", "base32", "base58btc", "base64url")
+	p.MaxRate = uint64(r.Int63n(1 << 40))
+	p.MaxTotalSize = uint64(r.Int63n(1 << 40))
+	p.MaxFileSize = uint64(r.Int63n(1 << 40))
+	p.MaxDuration = time.Duration(r.Int63n(int64(24 * time.Hour)))
+	p.Codec = pick("", "raw", "dag-pb", "dag-cbor")
+	p.MaxLinks = []int{0, 2, 174, 1024}[r.Intn(4)]
+	p.TrickleThreshold = uint64(r.Int63n(1 << 40))
+	p.BatchSize = r.Intn(1000)
+	p.FlushInterval = time.Duration(r.Int63n(int64(time.Second)))
+	p.MaxBufferBytes = uint64(r.Int63n(1 << 30))
+	p.PrepareTimeout = time.Duration(r.Int63n(int64(time.Hour)))
+	p.ProgressInterval = time.Duration(r.Int63n(int64(time.Second)))
+	if !p.NoCopy && flag() {
+		p.RawLeaves = false
+		p.RawLeavesAuto = true
+	}
+	return p
+}
+
+func TestAddParams_QueryRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		p := randomAddParams(r)
+		qstr, err := p.ToQueryString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := url.ParseQuery(qstr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p2, err := AddParamsFromQuery(q)
+		if err != nil {
+			t.Fatalf("%s: %s", qstr, err)
+		}
+		if !p.Equals(p2) {
+			t.Fatalf("params do not round-trip:\n%+v\n%+v", p, p2)
+		}
+
+		qstr2, err := p2.ToQueryString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if qstr != qstr2 {
+			t.Fatalf("query strings should be stable:\n%s\n%s", qstr, qstr2)
+		}
+	}
+}
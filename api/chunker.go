@@ -0,0 +1,227 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+)
+
+// chunkerUnits are the unit suffixes accepted in chunker size parameters.
+var chunkerUnits = []struct {
+	suffix string
+	bytes  int
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+}
+
+// Bounds of the number of bits of the mask of "buzhash-<bits>" chunkers.
+// Their chunks are between 2^bits and 4*2^bits bytes long, which must not
+// exceed the maximum chunk size.
+const (
+	minBuzhashBits = 10
+	maxBuzhashBits = 18
+)
+
+// validateChunker checks that a chunker spec is one of "size-<n>",
+// "rabin", "rabin-<avg>", "rabin-<min>-<avg>-<max>", "buzhash" or
+// "buzhash-<bits>" (or empty or "default", for the default chunker), with
+// sane values, so that bad specs are caught before any content is read.
+//
+// Fixed-size chunks are the cheapest to make, but an insertion or a
+// deletion shifts every chunk after it, so edited files share few blocks
+// with their previous versions. Rabin and buzhash are content-defined:
+// chunk boundaries follow the content, so edits only change the chunks
+// around them and most blocks are deduplicated. Buzhash is much faster
+// than rabin. "buzhash" looks for boundaries with a 17-bit mask, making
+// chunks of 128KiB to 512KiB, 256KiB on average; "buzhash-<bits>" uses a
+// mask of 10 to 18 bits, making chunks of 2^bits to 4*2^bits bytes, twice
+// 2^bits on average. Smaller chunks deduplicate better, at the cost of
+// more blocks to store and provide.
+func validateChunker(spec string) error {
+	_, err := normalizeChunker(spec)
+	return err
+}
+
+// normalizeChunker validates a chunker spec as validateChunker and returns
+// it with sizes given with units (i.e. "size-256KiB") as byte counts, which
+// is what the IPFS chunkers understand.
+func normalizeChunker(spec string) (string, error) {
+	parts := strings.Split(spec, "-")
+	switch parts[0] {
+	case "buzhash":
+		return normalizeBuzhash(spec, parts[1:])
+	case "", "default":
+		if len(parts) != 1 {
+			return "", fmt.Errorf("chunker %q: unexpected parameters: %s", spec, strings.Join(parts[1:], "-"))
+		}
+		return spec, nil
+	case "size":
+		if len(parts) != 2 {
+			return "", fmt.Errorf("chunker %q: expected size-<bytes>", spec)
+		}
+		n, err := parseChunkerValue(spec, parts[1], "")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("size-%d", n), nil
+	case "rabin":
+		return normalizeRabin(spec, parts[1:])
+	default:
+		return "", fmt.Errorf("chunker %q: unknown chunker %q", spec, parts[0])
+	}
+}
+
+func normalizeBuzhash(spec string, params []string) (string, error) {
+	switch len(params) {
+	case 0:
+		return spec, nil
+	case 1:
+		bits, err := strconv.Atoi(params[0])
+		if err != nil {
+			return "", fmt.Errorf("chunker %q: invalid value %q", spec, params[0])
+		}
+		if bits < minBuzhashBits || bits > maxBuzhashBits {
+			return "", fmt.Errorf("chunker %q: buzhash bits must be between %d and %d", spec, minBuzhashBits, maxBuzhashBits)
+		}
+		return fmt.Sprintf("buzhash-%d", bits), nil
+	default:
+		return "", fmt.Errorf("chunker %q: expected buzhash or buzhash-<bits>", spec)
+	}
+}
+
+func normalizeRabin(spec string, params []string) (string, error) {
+	switch len(params) {
+	case 0:
+		return spec, nil
+	case 1:
+		avg, err := parseChunkerValue(spec, params[0], "")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("rabin-%d", avg), nil
+	case 3:
+		min, err := parseChunkerValue(spec, params[0], "min")
+		if err != nil {
+			return "", err
+		}
+		avg, err := parseChunkerValue(spec, params[1], "avg")
+		if err != nil {
+			return "", err
+		}
+		max, err := parseChunkerValue(spec, params[2], "max")
+		if err != nil {
+			return "", err
+		}
+		if min < 16 {
+			return "", fmt.Errorf("chunker %q: rabin min must be at least 16", spec)
+		}
+		if min >= avg || avg >= max {
+			return "", fmt.Errorf("chunker %q: rabin values must satisfy min < avg < max", spec)
+		}
+		return fmt.Sprintf("rabin-%d-%d-%d", min, avg, max), nil
+	default:
+		return "", fmt.Errorf("chunker %q: expected rabin, rabin-<avg> or rabin-<min>-<avg>-<max>", spec)
+	}
+}
+
+// parseChunkerValue parses a chunker size parameter, optionally prefixed by
+// "<label>:" and suffixed by one of the chunkerUnits, and checks it is
+// within the allowed chunk sizes.
+func parseChunkerValue(spec, token, label string) (int, error) {
+	v := token
+	if label != "" {
+		v = strings.TrimPrefix(token, label+":")
+	}
+
+	unit := 1
+	if i := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' }); i > 0 {
+		suffix := v[i:]
+		unit = 0
+		for _, u := range chunkerUnits {
+			if suffix == u.suffix {
+				unit = u.bytes
+			}
+		}
+		if unit == 0 {
+			return 0, fmt.Errorf("chunker %q: unknown unit %q in %q (use KiB, MiB, GiB, KB, MB or GB)", spec, suffix, token)
+		}
+		v = v[:i]
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("chunker %q: invalid value %q", spec, token)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("chunker %q: value %q must be positive", spec, token)
+	}
+	if n > chunker.ChunkSizeLimit/unit {
+		return 0, fmt.Errorf("chunker %q: value %q exceeds the maximum chunk size of %d", spec, token, chunker.ChunkSizeLimit)
+	}
+	return n * unit, nil
+}
+
+// averageChunkSize returns the size of the chunks produced by the given
+// chunker spec, on average for content-defined chunkers. Bad specs return
+// the default block size.
+func averageChunkSize(spec string) int64 {
+	parts := strings.Split(spec, "-")
+	switch {
+	case parts[0] == "size" && len(parts) == 2:
+		if n, err := parseChunkerValue(spec, parts[1], ""); err == nil {
+			return int64(n)
+		}
+	case parts[0] == "rabin" && len(parts) == 2:
+		if n, err := parseChunkerValue(spec, parts[1], ""); err == nil {
+			return int64(n)
+		}
+	case parts[0] == "rabin" && len(parts) == 4:
+		if n, err := parseChunkerValue(spec, parts[2], "avg"); err == nil {
+			return int64(n)
+		}
+	case parts[0] == "buzhash" && len(parts) == 2:
+		if _, err := normalizeBuzhash(spec, parts[1:]); err == nil {
+			bits, _ := strconv.Atoi(parts[1])
+			return 2 << bits
+		}
+	}
+	// The default chunker, buzhash and rabin without parameters all
+	// average the default block size.
+	return chunker.DefaultBlockSize
+}
+
+// shardBlockOverhead is the room left in shards for the UnixFS wrapping of
+// the chunks in leaf blocks.
+const shardBlockOverhead = 1 << 10
+
+// maxChunkSize returns the size of the largest chunks produced by the given
+// chunker spec. Bad specs return the default block size.
+func maxChunkSize(spec string) int64 {
+	spec, err := normalizeChunker(spec)
+	if err != nil {
+		return chunker.DefaultBlockSize
+	}
+	parts := strings.Split(spec, "-")
+	last, _ := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	switch {
+	case parts[0] == "size" || (parts[0] == "rabin" && len(parts) == 4):
+		return last
+	case parts[0] == "rabin" && len(parts) == 2:
+		// as chunker.NewRabin.
+		return last + last/2
+	case parts[0] == "rabin":
+		return chunker.DefaultBlockSize + chunker.DefaultBlockSize/2
+	case parts[0] == "buzhash" && len(parts) == 2:
+		return 4 << last
+	case parts[0] == "buzhash":
+		return 512 << 10
+	}
+	return chunker.DefaultBlockSize
+}
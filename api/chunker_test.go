@@ -0,0 +1,149 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateChunker(t *testing.T) {
+	valid := []string{
+		"",
+		"default",
+		"size-262144",
+		"size-1",
+		"rabin",
+		"rabin-262144",
+		"rabin-16-262144-524288",
+		"rabin-min:16-avg:262144-max:524288",
+		"buzhash",
+		"buzhash-10",
+		"buzhash-17",
+		"buzhash-18",
+		"size-256KiB",
+		"size-1MiB",
+		"size-500KB",
+		"rabin-16-256KiB-512KiB",
+	}
+
+	invalid := []string{
+		"size-abc",
+		"size-",
+		"size-0",
+		"size--5",
+		"size-100000000",
+		"size-10-20",
+		"rabin-",
+		"rabin-1-2",
+		"rabin-8-262144-524288",
+		"rabin-300-200-400",
+		"rabin-16-262144-100000000",
+		"buzhash-9",
+		"buzhash-19",
+		"buzhash-abc",
+		"buzhash-12-1",
+		"buzhash-",
+		"fixed-1000",
+		"size-256XB",
+		"size-256kib",
+		"size-KiB",
+		"size-2MiB",
+		"size-1GiB",
+	}
+
+	for _, spec := range valid {
+		if err := validateChunker(spec); err != nil {
+			t.Errorf("%q should be valid: %s", spec, err)
+		}
+	}
+
+	for _, spec := range invalid {
+		if err := validateChunker(spec); err == nil {
+			t.Errorf("%q should be invalid", spec)
+		}
+	}
+}
+
+func TestNormalizeChunker(t *testing.T) {
+	tcs := []struct {
+		spec     string
+		expected string
+	}{
+		{"", ""},
+		{"buzhash", "buzhash"},
+		{"buzhash-012", "buzhash-12"},
+		{"size-262144", "size-262144"},
+		{"size-256KiB", "size-262144"},
+		{"size-1MiB", "size-1048576"},
+		{"size-100KB", "size-100000"},
+		{"rabin-256KiB", "rabin-262144"},
+		{"rabin-min:16-avg:256KiB-max:1MB", "rabin-16-262144-1000000"},
+	}
+	for _, tc := range tcs {
+		spec, err := normalizeChunker(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %s", tc.spec, err)
+			continue
+		}
+		if spec != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.spec, tc.expected, spec)
+		}
+		p := DefaultAddParams()
+		p.Chunker = tc.spec
+		if p.EffectiveChunker() != tc.expected {
+			t.Errorf("%q: unexpected effective chunker %q", tc.spec, p.EffectiveChunker())
+		}
+	}
+
+	_, err := normalizeChunker("size-256XB")
+	if err == nil || !strings.Contains(err.Error(), "unknown unit") {
+		t.Error("expected an unknown unit error, got", err)
+	}
+}
+
+func TestAddParams_EstimateBlocks(t *testing.T) {
+	tcs := []struct {
+		chunker  string
+		size     int64
+		expected int64
+	}{
+		{"", 0, 0},
+		{"", 1, 1},
+		{"", 262144, 1},
+		{"", 262145, 2},
+		{"size-1024", 10 * 1024, 10},
+		{"rabin-1024", 10*1024 + 1, 11},
+		{"rabin-min:16-avg:1024-max:4096", 2048, 2},
+		{"buzhash", 1024 * 1024, 4},
+		{"buzhash-12", 1024 * 1024, 128},
+		{"size-1024", -1, -1},
+	}
+	for _, tc := range tcs {
+		p := DefaultAddParams()
+		p.Chunker = tc.chunker
+		if n := p.EstimateBlocks(tc.size); n != tc.expected {
+			t.Errorf("%q, %d bytes: expected %d blocks, got %d", tc.chunker, tc.size, tc.expected, n)
+		}
+	}
+}
+
+func TestAddParams_MinShardSize(t *testing.T) {
+	tcs := []struct {
+		chunker  string
+		expected uint64
+	}{
+		{"", 262144 + shardBlockOverhead},
+		{"size-1KiB", 1024 + shardBlockOverhead},
+		{"rabin-1024", 1536 + shardBlockOverhead},
+		{"rabin-min:16-avg:1024-max:4096", 4096 + shardBlockOverhead},
+		{"rabin", 393216 + shardBlockOverhead},
+		{"buzhash", 524288 + shardBlockOverhead},
+		{"buzhash-12", 16384 + shardBlockOverhead},
+	}
+	for _, tc := range tcs {
+		p := DefaultAddParams()
+		p.Chunker = tc.chunker
+		if min := p.MinShardSize(); min != tc.expected {
+			t.Errorf("%q: expected %d, got %d", tc.chunker, tc.expected, min)
+		}
+	}
+}
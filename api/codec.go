@@ -0,0 +1,25 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// codecs maps the names accepted in AddParams.Codec to their multicodec
+// codes.
+var codecs = map[string]uint64{
+	"raw":      cid.Raw,
+	"dag-pb":   cid.DagProtobuf,
+	"dag-cbor": cid.DagCBOR,
+}
+
+// ResolveCodec returns the multicodec code for the given IPLD codec name.
+func ResolveCodec(name string) (uint64, error) {
+	name = strings.ToLower(name)
+	if c, ok := codecs[name]; ok {
+		return c, nil
+	}
+	return 0, fmt.Errorf("unrecognized codec: %s", name)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	multihash "github.com/multiformats/go-multihash"
+)
+
+// HashFunction describes a hash function that can be used to add content.
+type HashFunction struct {
+	Code uint64
+	// default digest length in bytes
+	Length int
+}
+
+// hashFunctions maps the names accepted in AddParams.HashFun to their
+// multihash codes and default lengths.
+var hashFunctions = map[string]HashFunction{
+	// identity puts the data in the CID, up to AddParams.InlineLimit.
+	"identity":     {multihash.IDENTITY, -1},
+	"sha1":         {multihash.SHA1, 20},
+	"md5":          {multihash.MD5, 16},
+	"sha2-256":     {multihash.SHA2_256, 32},
+	"sha2-512":     {multihash.SHA2_512, 64},
+	"dbl-sha2-256": {multihash.DBL_SHA2_256, 32},
+	"sha3":         {multihash.SHA3_512, 64},
+	"sha3-224":     {multihash.SHA3_224, 28},
+	"sha3-256":     {multihash.SHA3_256, 32},
+	"sha3-384":     {multihash.SHA3_384, 48},
+	"sha3-512":     {multihash.SHA3_512, 64},
+	"keccak-256":   {multihash.KECCAK_256, 32},
+	"keccak-512":   {multihash.KECCAK_512, 64},
+	"shake-128":    {multihash.SHAKE_128, 32},
+	"shake-256":    {multihash.SHAKE_256, 64},
+	"blake2s-256":  {multihash.BLAKE2S_MAX, 32},
+	"blake3":       {multihash.BLAKE3, 32},
+}
+
+func init() {
+	// blake2b-8 to blake2b-512, whose codes go up with the digest length
+	// by 8 bits. go-multihash only computes blake2s-256.
+	for c := uint64(multihash.BLAKE2B_MIN); c <= multihash.BLAKE2B_MAX; c++ {
+		hashFunctions[multihash.Codes[c]] = HashFunction{c, int(c-multihash.BLAKE2B_MIN) + 1}
+	}
+}
+
+// ResolveHashFunction returns the HashFunction for the given name, as used
+// in AddParams.HashFun. It fails for hash functions which go-multihash
+// cannot compute, so that adding never fails while hashing.
+func ResolveHashFunction(name string) (HashFunction, error) {
+	name = strings.ToLower(name)
+	hf, ok := hashFunctions[name]
+	if !ok {
+		return HashFunction{}, fmt.Errorf("unrecognized hash function: %s", name)
+	}
+	if _, err := multihash.Sum([]byte{}, hf.Code, hf.Length); err != nil {
+		return HashFunction{}, fmt.Errorf("hash function %s is not supported: %s", name, err)
+	}
+	return hf, nil
+}
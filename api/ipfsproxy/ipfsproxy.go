@@ -542,10 +542,6 @@ func (proxy *Server) addHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	q := r.URL.Query()
-	if q.Get("only-hash") == "true" {
-		ipfsErrorResponder(w, "only-hash is not supported when adding to cluster", -1)
-	}
-
 	unpin := q.Get("pin") == "false"
 
 	// Luckily, most IPFS add query params are compatible with cluster's
@@ -555,6 +551,12 @@ func (proxy *Server) addHandler(w http.ResponseWriter, r *http.Request) {
 		ipfsErrorResponder(w, "error parsing options:"+err.Error(), -1)
 		return
 	}
+	// Avoid pinning rather than unpinning afterwards when possible.
+	if unpin && !params.Shard {
+		params.NoPin = true
+		unpin = false
+	}
+
 	trickle := q.Get("trickle")
 	if trickle == "true" {
 		params.Layout = "trickle"
@@ -565,7 +567,7 @@ func (proxy *Server) addHandler(w http.ResponseWriter, r *http.Request) {
 	outputTransform := func(in *api.AddedOutput) interface{} {
 		r := &ipfsAddResp{
 			Name:  in.Name,
-			Hash:  in.Cid.String(),
+			Hash:  params.FormatCid(in.Cid),
 			Bytes: int64(in.Bytes),
 		}
 		if in.Size != 0 {
@@ -588,7 +590,7 @@ func (proxy *Server) addHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !unpin {
+	if !unpin || params.OnlyHash {
 		return
 	}
 
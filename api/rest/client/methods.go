@@ -574,17 +574,28 @@ func (c *defaultClient) AddMultiFile(
 	}
 
 	// our handler decodes an AddedOutput and puts it
-	// in the out channel.
+	// in the out channel. The summary written at the end of the stream
+	// and the error objects are not AddedOutputs: errors of the add
+	// come in the trailer as well.
 	handler := func(dec *json.Decoder) error {
-		if out == nil {
-			return nil
+		var obj struct {
+			api.AddedOutput
+			Summary *json.RawMessage `json:"summary"`
 		}
-		var obj api.AddedOutput
 		err := dec.Decode(&obj)
 		if err != nil {
 			return err
 		}
-		out <- &obj
+		switch {
+		case obj.Summary != nil:
+			return nil
+		case obj.Name == "" && !obj.Cid.Defined() && obj.Error != "":
+			logger.Error(obj.Error)
+			return nil
+		}
+		if out != nil {
+			out <- &obj.AddedOutput
+		}
 		return nil
 	}
 
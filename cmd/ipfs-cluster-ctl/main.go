@@ -307,7 +307,7 @@ content.
 				cli.StringFlag{
 					Name:  "layout",
 					Value: defaultAddParams.Layout,
-					Usage: "Dag layout to use for dag generation: balanced or trickle",
+					Usage: "Dag layout to use for dag generation: balanced, trickle or auto (trickle for large files)",
 				},
 				cli.BoolFlag{
 					Name:  "wrap-with-directory, w",
@@ -324,7 +324,7 @@ content.
 				},
 				cli.BoolFlag{
 					Name:  "raw-leaves",
-					Usage: "Use raw blocks for leaves (experimental)",
+					Usage: "Use raw blocks for leaves (experimental). Implies cid-version 1",
 				},
 				cli.IntFlag{
 					Name:  "cid-version",
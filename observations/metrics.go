@@ -38,6 +38,14 @@ var (
 	Peers = stats.Int64("cluster/peers", "Number of cluster peers", stats.UnitDimensionless)
 	// Alerts is the number of alerts that have been sent due to peers not sending "ping" heartbeats in time.
 	Alerts = stats.Int64("cluster/alerts", "Number of alerts triggered", stats.UnitDimensionless)
+	// AddedBytes is the number of bytes of the blocks added by the adder.
+	AddedBytes = stats.Int64("adder/bytes", "Bytes added", stats.UnitBytes)
+	// AddedBlocks is the number of blocks added by the adder.
+	AddedBlocks = stats.Int64("adder/blocks", "Number of blocks added", stats.UnitDimensionless)
+	// AddsInFlight is the number of adds in progress.
+	AddsInFlight = stats.Int64("adder/adds_in_flight", "Number of adds in progress", stats.UnitDimensionless)
+	// AddFailures is the number of adds which failed.
+	AddFailures = stats.Int64("adder/failures", "Number of failed adds", stats.UnitDimensionless)
 )
 
 // views, which is just the aggregation of the metrics
@@ -66,11 +74,39 @@ var (
 		Aggregation: messageCountDistribution,
 	}
 
+	AddedBytesView = &view.View{
+		Measure:     AddedBytes,
+		TagKeys:     []tag.Key{HostKey},
+		Aggregation: view.Sum(),
+	}
+
+	AddedBlocksView = &view.View{
+		Measure:     AddedBlocks,
+		TagKeys:     []tag.Key{HostKey},
+		Aggregation: view.Sum(),
+	}
+
+	AddsInFlightView = &view.View{
+		Measure:     AddsInFlight,
+		TagKeys:     []tag.Key{HostKey},
+		Aggregation: view.Sum(),
+	}
+
+	AddFailuresView = &view.View{
+		Measure:     AddFailures,
+		TagKeys:     []tag.Key{HostKey},
+		Aggregation: view.Count(),
+	}
+
 	DefaultViews = []*view.View{
 		PinsView,
 		TrackerPinsView,
 		PeersView,
 		AlertsView,
+		AddedBytesView,
+		AddedBlocksView,
+		AddsInFlightView,
+		AddFailuresView,
 	}
 )
 